@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Scopes granted to credentials. Admin implies every other scope.
+const (
+	ScopeLinksCreate = "links:create"
+	ScopeLinksRead   = "links:read"
+	ScopeLinksDelete = "links:delete"
+	ScopeAdmin       = "admin"
+)
+
+// Scopes lists the known scopes.
+var Scopes = []string{ScopeLinksCreate, ScopeLinksRead, ScopeLinksDelete, ScopeAdmin}
+
+var (
+	ErrInvalidCredentials = errors.New("invalid or expired credentials")
+	ErrInvalidScope       = errors.New("invalid scope")
+	ErrInvalidAccount     = errors.New("invalid account")
+)
+
+// Kinds of principals.
+const (
+	KindKey  = "key"
+	KindUser = "user"
+)
+
+// Roles of user accounts.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// roleScopes lists the scopes granted to each role.
+var roleScopes = map[string][]string{
+	RoleUser:  {ScopeLinksCreate, ScopeLinksRead, ScopeLinksDelete},
+	RoleAdmin: {ScopeAdmin},
+}
+
+// Principal is the authenticated caller of a request. SetupRequired marks
+// users who have to enrol a second factor before they are granted scopes.
+type Principal struct {
+	Kind          string
+	ID            string
+	Name          string
+	Scopes        []string
+	SetupRequired bool
+}
+
+// Identity names the principal for rate limits and logs, e.g. "key:abc".
+func (p Principal) Identity() string {
+	return p.Kind + ":" + p.ID
+}
+
+// Has reports whether the principal was granted scope.
+func (p Principal) Has(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateScopes checks that scopes is not empty and holds known scopes
+// only.
+func ValidateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("%w: at least one scope is required", ErrInvalidScope)
+	}
+	for _, scope := range scopes {
+		known := false
+		for _, s := range Scopes {
+			known = known || s == scope
+		}
+		if !known {
+			return fmt.Errorf("%w: unknown scope %q", ErrInvalidScope, scope)
+		}
+	}
+	return nil
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal stored by WithPrincipal.
+func FromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Signature algorithms accepted for JWTs. Symmetric algorithms and "none"
+// are refused, so a public key can never be used as an HMAC secret.
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+)
+
+// minRSABits is the smallest RSA modulus accepted from a key set.
+const minRSABits = 2048
+
+// maxJWKSSize limits the size of a fetched key set.
+const maxJWKSSize = 1 << 20
+
+// JWKSSource reads a JSON Web Key Set (RFC 7517).
+type JWKSSource func() ([]byte, error)
+
+// JWKSFile reads the key set from the file at path on every refresh, so
+// rotated keys are picked up without a restart.
+func JWKSFile(path string) JWKSSource {
+	return func() ([]byte, error) {
+		return os.ReadFile(path)
+	}
+}
+
+// JWKSURL fetches the key set from url, usually the jwks_uri of the
+// identity provider.
+func JWKSURL(url string, client *http.Client) JWKSSource {
+	return func() ([]byte, error) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+	}
+}
+
+// JWKSLocation is JWKSURL for http and https locations and JWKSFile for
+// everything else.
+func JWKSLocation(location string) JWKSSource {
+	if strings.HasPrefix(location, "https://") || strings.HasPrefix(location, "http://") {
+		return JWKSURL(location, &http.Client{Timeout: 10 * time.Second})
+	}
+	return JWKSFile(location)
+}
+
+// jwtKey is a verification key of the key set.
+type jwtKey struct {
+	id  string
+	alg string
+	key crypto.PublicKey
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS returns the RSA and P-256 signing keys of the key set. Keys
+// of other types or uses are skipped, so providers may publish them.
+func parseJWKS(data []byte) ([]jwtKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid key set: %w", err)
+	}
+
+	var keys []jwtKey
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		var key jwtKey
+		var err error
+		switch {
+		case jwk.Kty == "RSA" && (jwk.Alg == "" || jwk.Alg == AlgRS256):
+			key, err = parseRSAKey(jwk)
+		case jwk.Kty == "EC" && jwk.Crv == "P-256" && (jwk.Alg == "" || jwk.Alg == AlgES256):
+			key, err = parseECKey(jwk)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", jwk.Kid, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("invalid key set: no RS256 or ES256 signing keys")
+	}
+	return keys, nil
+}
+
+func parseRSAKey(jwk jsonWebKey) (jwtKey, error) {
+	n, err := decodeBigInt(jwk.N)
+	if err != nil {
+		return jwtKey{}, fmt.Errorf("modulus: %w", err)
+	}
+	e, err := decodeBigInt(jwk.E)
+	if err != nil {
+		return jwtKey{}, fmt.Errorf("exponent: %w", err)
+	}
+	if n.BitLen() < minRSABits {
+		return jwtKey{}, fmt.Errorf("modulus must have at least %d bits", minRSABits)
+	}
+	if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 || e.Bit(0) == 0 {
+		return jwtKey{}, fmt.Errorf("invalid exponent")
+	}
+	return jwtKey{id: jwk.Kid, alg: AlgRS256, key: &rsa.PublicKey{N: n, E: int(e.Int64())}}, nil
+}
+
+func parseECKey(jwk jsonWebKey) (jwtKey, error) {
+	x, err := decodeCoordinate(jwk.X)
+	if err != nil {
+		return jwtKey{}, fmt.Errorf("x: %w", err)
+	}
+	y, err := decodeCoordinate(jwk.Y)
+	if err != nil {
+		return jwtKey{}, fmt.Errorf("y: %w", err)
+	}
+	// ecdh checks that the point is on the curve.
+	if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+		return jwtKey{}, err
+	}
+	key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	return jwtKey{id: jwk.Kid, alg: AlgES256, key: key}, nil
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("missing value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func decodeCoordinate(value string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 32 {
+		return nil, fmt.Errorf("expected 32 bytes, got %d", len(b))
+	}
+	return b, nil
+}
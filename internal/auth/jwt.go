@@ -0,0 +1,364 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KindToken is the kind of principals authenticated by a JWT. Their
+// identity is "jwt:<sub>", so the links they create are owned by the
+// subject of the identity provider.
+const KindToken = "jwt"
+
+// maxJWTSize limits the size of accepted tokens.
+const maxJWTSize = 16 << 10
+
+// JWTConfig controls JWT bearer authentication. Tokens must be issued by
+// Issuer for Audience, when set; Validate requires both for production use.
+// The GroupsClaim lists the groups of the subject: members of AdminGroups
+// get the admin role, members of UserGroups the user role, and subjects in
+// neither get no scopes. Leeway tolerates clock differences with the
+// identity provider.
+//
+// The key set is refreshed every RefreshInterval and, at most once per
+// MinRefreshInterval, when a token is signed with an unknown key, so keys
+// rotated by the provider are picked up right away.
+type JWTConfig struct {
+	Issuer             string
+	Audience           string
+	GroupsClaim        string
+	AdminGroups        []string
+	UserGroups         []string
+	Leeway             time.Duration
+	RefreshInterval    time.Duration
+	MinRefreshInterval time.Duration
+}
+
+// Validate checks that tokens are bound to this service. Without an issuer
+// and an audience, any token of the provider's key set would be accepted,
+// including tokens issued to other applications.
+func (c JWTConfig) Validate() error {
+	if c.Issuer == "" {
+		return errors.New("the issuer is required")
+	}
+	if c.Audience == "" {
+		return errors.New("the audience is required")
+	}
+	return nil
+}
+
+// GrantsScopes reports whether any group is mapped to a role. Without
+// groups, tokens authenticate but are allowed nothing.
+func (c JWTConfig) GrantsScopes() bool {
+	return len(c.AdminGroups) > 0 || len(c.UserGroups) > 0
+}
+
+func DefaultJWTConfig() JWTConfig {
+	return JWTConfig{
+		GroupsClaim:        "groups",
+		Leeway:             time.Minute,
+		RefreshInterval:    15 * time.Minute,
+		MinRefreshInterval: time.Minute,
+	}
+}
+
+// JWT checks bearer tokens signed by an identity provider against its
+// cached JSON Web Key Set.
+type JWT struct {
+	source  JWKSSource
+	cfg     JWTConfig
+	now     func() time.Time
+	mu      sync.Mutex
+	keys    []jwtKey
+	fetched time.Time
+	done    chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+func NewJWT(source JWKSSource, cfg JWTConfig) *JWT {
+	return NewJWTWithClock(source, cfg, time.Now)
+}
+
+// NewJWTWithClock is NewJWT with a custom time source for tests.
+func NewJWTWithClock(source JWKSSource, cfg JWTConfig, now func() time.Time) *JWT {
+	defaults := DefaultJWTConfig()
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = defaults.GroupsClaim
+	}
+	if cfg.Leeway <= 0 {
+		cfg.Leeway = defaults.Leeway
+	}
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = defaults.RefreshInterval
+	}
+	if cfg.MinRefreshInterval <= 0 {
+		cfg.MinRefreshInterval = defaults.MinRefreshInterval
+	}
+	return &JWT{source: source, cfg: cfg, now: now, done: make(chan struct{})}
+}
+
+// Refresh reloads the key set. On failure the cached keys stay in use.
+func (j *JWT) Refresh() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.refreshLocked()
+}
+
+func (j *JWT) refreshLocked() error {
+	j.fetched = j.now()
+	data, err := j.source()
+	if err != nil {
+		return fmt.Errorf("failed to load key set: %w", err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	j.keys = keys
+	return nil
+}
+
+// lookup returns the keys that may have signed a token with kid and alg.
+// Unknown key IDs refresh the key set unless it was loaded recently.
+func (j *JWT) lookup(kid string, alg string) ([]jwtKey, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	keys := matchingKeys(j.keys, kid, alg)
+	if len(keys) > 0 {
+		return keys, nil
+	}
+	if len(j.keys) > 0 && j.now().Sub(j.fetched) < j.cfg.MinRefreshInterval {
+		return nil, nil
+	}
+	if err := j.refreshLocked(); err != nil {
+		if len(j.keys) == 0 {
+			return nil, err
+		}
+		log.Printf("failed to refresh key set: %v", err)
+		return nil, nil
+	}
+	return matchingKeys(j.keys, kid, alg), nil
+}
+
+func matchingKeys(keys []jwtKey, kid string, alg string) []jwtKey {
+	var matching []jwtKey
+	for _, key := range keys {
+		if key.alg == alg && (kid == "" || key.id == kid) {
+			matching = append(matching, key)
+		}
+	}
+	return matching
+}
+
+// Authenticate verifies the signature and claims of token. Invalid,
+// expired and foreign tokens fail with ErrInvalidCredentials.
+func (j *JWT) Authenticate(token string) (Principal, error) {
+	if len(token) > maxJWTSize {
+		return Principal{}, fmt.Errorf("%w: token is too large", ErrInvalidCredentials)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Principal{}, fmt.Errorf("%w: malformed token", ErrInvalidCredentials)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Principal{}, fmt.Errorf("%w: malformed header", ErrInvalidCredentials)
+	}
+	if header.Alg != AlgRS256 && header.Alg != AlgES256 {
+		return Principal{}, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidCredentials, header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: malformed signature", ErrInvalidCredentials)
+	}
+
+	keys, err := j.lookup(header.Kid, header.Alg)
+	if err != nil {
+		return Principal{}, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	verified := false
+	for _, key := range keys {
+		if verifySignature(key, digest[:], signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return Principal{}, fmt.Errorf("%w: invalid signature or unknown key", ErrInvalidCredentials)
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Principal{}, fmt.Errorf("%w: malformed claims", ErrInvalidCredentials)
+	}
+	if err := j.validateClaims(claims); err != nil {
+		return Principal{}, err
+	}
+	return j.principal(claims), nil
+}
+
+func verifySignature(key jwtKey, digest []byte, signature []byte) bool {
+	switch pub := key.key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		// JWS encodes ES256 signatures as r and s of 32 bytes each.
+		if len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
+
+func (j *JWT) validateClaims(claims map[string]any) error {
+	now := j.now()
+	exp, ok := numericDate(claims["exp"])
+	if !ok {
+		return fmt.Errorf("%w: missing exp claim", ErrInvalidCredentials)
+	}
+	if !now.Before(exp.Add(j.cfg.Leeway)) {
+		return fmt.Errorf("%w: token expired", ErrInvalidCredentials)
+	}
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Add(j.cfg.Leeway).Before(nbf) {
+		return fmt.Errorf("%w: token not valid yet", ErrInvalidCredentials)
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return fmt.Errorf("%w: missing sub claim", ErrInvalidCredentials)
+	}
+	if j.cfg.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != j.cfg.Issuer {
+			return fmt.Errorf("%w: unexpected issuer", ErrInvalidCredentials)
+		}
+	}
+	if j.cfg.Audience != "" && !contains(stringList(claims["aud"]), j.cfg.Audience) {
+		return fmt.Errorf("%w: unexpected audience", ErrInvalidCredentials)
+	}
+	return nil
+}
+
+// principal maps the subject to the owner of links and its groups to a
+// role.
+func (j *JWT) principal(claims map[string]any) Principal {
+	sub := claims["sub"].(string)
+	principal := Principal{Kind: KindToken, ID: sub, Name: sub}
+	for _, claim := range []string{"preferred_username", "name"} {
+		if name, ok := claims[claim].(string); ok && name != "" {
+			principal.Name = name
+			break
+		}
+	}
+
+	groups := stringList(claims[j.cfg.GroupsClaim])
+	switch {
+	case intersects(groups, j.cfg.AdminGroups):
+		principal.Scopes = roleScopes[RoleAdmin]
+	case intersects(groups, j.cfg.UserGroups):
+		principal.Scopes = roleScopes[RoleUser]
+	}
+	return principal
+}
+
+// Start refreshes the key set in the background until Close.
+func (j *JWT) Start() {
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		ticker := time.NewTicker(j.cfg.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-j.done:
+				return
+			case <-ticker.C:
+				if err := j.Refresh(); err != nil {
+					log.Printf("failed to refresh key set: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func (j *JWT) Close() {
+	j.once.Do(func() {
+		close(j.done)
+	})
+	j.wg.Wait()
+}
+
+// LooksLikeJWT tells JWTs apart from API keys and other opaque tokens.
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2 && !strings.HasPrefix(token, tokenPrefix)
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func numericDate(value any) (time.Time, bool) {
+	seconds, ok := value.(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// stringList reads a claim that is either a string or a list of strings,
+// like aud.
+func stringList(value any) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func intersects(a []string, b []string) bool {
+	for _, item := range a {
+		if contains(b, item) {
+			return true
+		}
+	}
+	return false
+}
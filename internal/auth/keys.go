@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"OZON_test/internal/storage"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Tokens look like "sk_<id>_<secret>". The id locates the stored key, the
+// whole token is compared by its SHA-256 hash. Secrets are random, so a
+// fast hash is enough and no salt is needed.
+const tokenPrefix = "sk_"
+
+// BootstrapID is the ID of the key configured with SetBootstrap.
+const BootstrapID = "bootstrap"
+
+// Keys issues and checks API keys.
+type Keys struct {
+	storage   storage.APIKeyStorage
+	now       func() time.Time
+	bootstrap string
+}
+
+func NewKeys(st storage.APIKeyStorage) *Keys {
+	return NewKeysWithClock(st, time.Now)
+}
+
+// NewKeysWithClock is NewKeys with a custom time source for tests.
+func NewKeysWithClock(st storage.APIKeyStorage, now func() time.Time) *Keys {
+	return &Keys{storage: st, now: now}
+}
+
+// SetBootstrap accepts token as an admin key that is not kept in the
+// storage. It is meant for creating the first keys of a new deployment.
+func (k *Keys) SetBootstrap(token string) {
+	k.bootstrap = ""
+	if token != "" {
+		k.bootstrap = hashToken(token)
+	}
+}
+
+// Create issues a key with scopes. A positive ttl limits its lifetime. The
+// returned token is the only copy of the secret.
+func (k *Keys) Create(name string, scopes []string, ttl time.Duration) (storage.APIKey, string, error) {
+	if err := ValidateScopes(scopes); err != nil {
+		return storage.APIKey{}, "", err
+	}
+
+	id, err := randomString(8, hex.EncodeToString)
+	if err != nil {
+		return storage.APIKey{}, "", err
+	}
+	secret, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return storage.APIKey{}, "", err
+	}
+	token := tokenPrefix + id + "_" + secret
+
+	key := storage.APIKey{
+		ID:        id,
+		Name:      name,
+		Hash:      hashToken(token),
+		Scopes:    append([]string(nil), scopes...),
+		CreatedAt: k.now().UTC(),
+	}
+	if ttl > 0 {
+		key.ExpiresAt = key.CreatedAt.Add(ttl)
+	}
+	if err := k.storage.CreateAPIKey(key); err != nil {
+		return storage.APIKey{}, "", err
+	}
+	return key, token, nil
+}
+
+// Authenticate finds the key of token. Unknown, revoked and expired keys
+// fail with ErrInvalidCredentials.
+func (k *Keys) Authenticate(token string) (Principal, error) {
+	hash := hashToken(token)
+	if k.bootstrap != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(k.bootstrap)) == 1 {
+		return Principal{Kind: KindKey, ID: BootstrapID, Name: BootstrapID, Scopes: []string{ScopeAdmin}}, nil
+	}
+
+	rest, ok := strings.CutPrefix(token, tokenPrefix)
+	if !ok {
+		return Principal{}, ErrInvalidCredentials
+	}
+	id, _, ok := strings.Cut(rest, "_")
+	if !ok || id == "" {
+		return Principal{}, ErrInvalidCredentials
+	}
+	key, err := k.storage.LoadAPIKey(id)
+	if errors.Is(err, storage.ErrNotFound) {
+		return Principal{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return Principal{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(key.Hash)) != 1 {
+		return Principal{}, ErrInvalidCredentials
+	}
+	if !key.ExpiresAt.IsZero() && !k.now().Before(key.ExpiresAt) {
+		return Principal{}, ErrInvalidCredentials
+	}
+	return Principal{Kind: KindKey, ID: key.ID, Name: key.Name, Scopes: key.Scopes}, nil
+}
+
+func (k *Keys) List() ([]storage.APIKey, error) {
+	return k.storage.ListAPIKeys()
+}
+
+func (k *Keys) Revoke(id string) error {
+	return k.storage.DeleteAPIKey(id)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(size int, encode func([]byte) string) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encode(b), nil
+}
@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"OZON_test/internal/storage"
+	"encoding/base64"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// SessionConfig controls browser sessions. Sessions expire TTL after
+// sign-in regardless of activity; expired ones are removed every
+// PruneInterval.
+type SessionConfig struct {
+	TTL           time.Duration
+	PruneInterval time.Duration
+}
+
+func DefaultSessionConfig() SessionConfig {
+	return SessionConfig{TTL: 24 * time.Hour, PruneInterval: 10 * time.Minute}
+}
+
+// Sessions signs users in for the browser. The session token is kept in a
+// cookie and only its hash is stored, like API keys.
+type Sessions struct {
+	storage storage.SessionStorage
+	users   storage.UserStorage
+	totp    *TOTP
+	cfg     SessionConfig
+	now     func() time.Time
+	done    chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+func NewSessions(st storage.SessionStorage, users storage.UserStorage, cfg SessionConfig) *Sessions {
+	return NewSessionsWithClock(st, users, cfg, time.Now)
+}
+
+// NewSessionsWithClock is NewSessions with a custom time source for tests.
+func NewSessionsWithClock(st storage.SessionStorage, users storage.UserStorage, cfg SessionConfig, now func() time.Time) *Sessions {
+	if cfg.TTL <= 0 {
+		cfg.TTL = DefaultSessionConfig().TTL
+	}
+	if cfg.PruneInterval <= 0 {
+		cfg.PruneInterval = DefaultSessionConfig().PruneInterval
+	}
+	return &Sessions{storage: st, users: users, cfg: cfg, now: now, done: make(chan struct{})}
+}
+
+// SetTOTP makes sessions of users who still have to enrol a second
+// factor as restricted as their login, see TOTP.Principal.
+func (s *Sessions) SetTOTP(totp *TOTP) {
+	s.totp = totp
+}
+
+// Create signs in the user with userID and returns the session token for
+// the cookie. The token is not stored anywhere else.
+func (s *Sessions) Create(userID string) (string, storage.Session, error) {
+	token, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return "", storage.Session{}, err
+	}
+	csrf, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return "", storage.Session{}, err
+	}
+	now := s.now().UTC()
+	session := storage.Session{
+		ID:        hashToken(token),
+		UserID:    userID,
+		CSRF:      csrf,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.cfg.TTL),
+	}
+	if err := s.storage.CreateSession(session); err != nil {
+		return "", storage.Session{}, err
+	}
+	return token, session, nil
+}
+
+// Resolve returns the user signed in with token and the session. Unknown
+// and expired sessions, as well as sessions of removed users, fail with
+// ErrInvalidCredentials.
+func (s *Sessions) Resolve(token string) (Principal, storage.Session, error) {
+	session, err := s.storage.LoadSession(hashToken(token))
+	if errors.Is(err, storage.ErrNotFound) {
+		return Principal{}, storage.Session{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return Principal{}, storage.Session{}, err
+	}
+	if !s.now().Before(session.ExpiresAt) {
+		_ = s.storage.DeleteSession(session.ID)
+		return Principal{}, storage.Session{}, ErrInvalidCredentials
+	}
+	user, err := s.users.LoadUser(session.UserID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return Principal{}, storage.Session{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return Principal{}, storage.Session{}, err
+	}
+	if s.totp != nil {
+		principal, err := s.totp.Principal(user)
+		return principal, session, err
+	}
+	return UserPrincipal(user), session, nil
+}
+
+// End signs out the session of token. Unknown sessions are ignored.
+func (s *Sessions) End(token string) error {
+	err := s.storage.DeleteSession(hashToken(token))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// TTL is the lifetime of new sessions.
+func (s *Sessions) TTL() time.Duration {
+	return s.cfg.TTL
+}
+
+// Start removes expired sessions in the background until Close.
+func (s *Sessions) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.cfg.PruneInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				if _, err := s.storage.DeleteExpiredSessions(s.now()); err != nil {
+					log.Printf("failed to prune sessions: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func (s *Sessions) Close() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	s.wg.Wait()
+}
@@ -0,0 +1,228 @@
+package tests
+
+import (
+	"OZON_test/internal/auth"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// signingKey is a key of a fake identity provider.
+type signingKey struct {
+	id  string
+	key crypto.Signer
+}
+
+func newRSAKey(t *testing.T, id string) signingKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	return signingKey{id: id, key: key}
+}
+
+func newECKey(t *testing.T, id string) signingKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	return signingKey{id: id, key: key}
+}
+
+func (k signingKey) jwk() map[string]string {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch pub := k.key.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": k.id, "use": "sig", "n": encode(pub.N.Bytes()), "e": encode(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": k.id, "crv": "P-256", "x": encode(pub.X.FillBytes(make([]byte, 32))), "y": encode(pub.Y.FillBytes(make([]byte, 32)))}
+	}
+	return nil
+}
+
+func jwks(t *testing.T, keys ...signingKey) []byte {
+	set := struct {
+		Keys []map[string]string `json:"keys"`
+	}{Keys: []map[string]string{}}
+	for _, key := range keys {
+		set.Keys = append(set.Keys, key.jwk())
+	}
+	data, err := json.Marshal(set)
+	assert.NoError(t, err)
+	return data
+}
+
+func (k signingKey) sign(t *testing.T, claims map[string]any) string {
+	alg := auth.AlgRS256
+	if _, ok := k.key.(*ecdsa.PrivateKey); ok {
+		alg = auth.AlgES256
+	}
+	return k.signWith(t, map[string]any{"alg": alg, "kid": k.id, "typ": "JWT"}, claims)
+}
+
+func (k signingKey) signWith(t *testing.T, header map[string]any, claims map[string]any) string {
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		assert.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	input := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(input))
+
+	var signature []byte
+	switch key := k.key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		assert.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		assert.NoError(t, err)
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTConfig_Validate(t *testing.T) {
+	assert.NoError(t, auth.JWTConfig{Issuer: "https://idp.example", Audience: "shortener"}.Validate())
+	assert.Error(t, auth.JWTConfig{Audience: "shortener"}.Validate())
+	assert.Error(t, auth.JWTConfig{Issuer: "https://idp.example"}.Validate())
+	assert.False(t, auth.JWTConfig{}.GrantsScopes())
+	assert.True(t, auth.JWTConfig{UserGroups: []string{"staff"}}.GrantsScopes())
+}
+
+func TestJWT_Authenticate(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rsaKey, ecKey := newRSAKey(t, "rsa"), newECKey(t, "ec")
+	data := jwks(t, rsaKey, ecKey)
+	cfg := auth.JWTConfig{Issuer: "https://idp.example", Audience: "shortener", AdminGroups: []string{"link-admins"}, UserGroups: []string{"staff"}}
+	tokens := auth.NewJWTWithClock(func() ([]byte, error) { return data, nil }, cfg, func() time.Time { return now })
+
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{
+			"iss":                "https://idp.example",
+			"aud":                []string{"other", "shortener"},
+			"sub":                "248289761001",
+			"preferred_username": "alice",
+			"groups":             []string{"staff"},
+			"exp":                now.Add(time.Hour).Unix(),
+			"iat":                now.Unix(),
+		}
+		for name, value := range changes {
+			if value == nil {
+				delete(c, name)
+			} else {
+				c[name] = value
+			}
+		}
+		return c
+	}
+
+	for _, key := range []signingKey{rsaKey, ecKey} {
+		principal, err := tokens.Authenticate(key.sign(t, claims(nil)))
+		assert.NoError(t, err, key.id)
+		assert.Equal(t, "jwt:248289761001", principal.Identity(), "the subject owns the links")
+		assert.Equal(t, "alice", principal.Name)
+		assert.True(t, principal.Has(auth.ScopeLinksCreate))
+		assert.False(t, principal.Has(auth.ScopeAdmin))
+	}
+
+	principal, err := tokens.Authenticate(ecKey.sign(t, claims(map[string]any{"groups": []string{"staff", "link-admins"}})))
+	assert.NoError(t, err)
+	assert.True(t, principal.Has(auth.ScopeAdmin))
+	principal, err = tokens.Authenticate(ecKey.sign(t, claims(map[string]any{"groups": nil, "aud": "shortener"})))
+	assert.NoError(t, err)
+	assert.Empty(t, principal.Scopes, "subjects outside the configured groups get no scopes")
+
+	ungrouped := auth.NewJWTWithClock(func() ([]byte, error) { return data, nil }, auth.JWTConfig{}, func() time.Time { return now })
+	principal, err = ungrouped.Authenticate(ecKey.sign(t, claims(nil)))
+	assert.NoError(t, err)
+	assert.Empty(t, principal.Scopes, "without configured groups no subject gets scopes")
+
+	invalid := map[string]string{
+		"expired":         rsaKey.sign(t, claims(map[string]any{"exp": now.Add(-2 * time.Minute).Unix()})),
+		"no exp":          rsaKey.sign(t, claims(map[string]any{"exp": nil})),
+		"not yet valid":   rsaKey.sign(t, claims(map[string]any{"nbf": now.Add(2 * time.Minute).Unix()})),
+		"no sub":          rsaKey.sign(t, claims(map[string]any{"sub": nil})),
+		"wrong issuer":    rsaKey.sign(t, claims(map[string]any{"iss": "https://evil.example"})),
+		"wrong audience":  rsaKey.sign(t, claims(map[string]any{"aud": "other"})),
+		"unknown key":     newRSAKey(t, "rsa").sign(t, claims(nil)),
+		"alg none":        rsaKey.signWith(t, map[string]any{"alg": "none", "kid": "rsa"}, claims(nil)),
+		"alg HS256":       rsaKey.signWith(t, map[string]any{"alg": "HS256", "kid": "rsa"}, claims(nil)),
+		"alg of EC key":   rsaKey.signWith(t, map[string]any{"alg": auth.AlgES256, "kid": "ec"}, claims(nil)),
+		"malformed":       "not.a.token",
+		"tampered claims": strings.Replace(rsaKey.sign(t, claims(nil)), ".", ".e30", 1),
+	}
+	for name, token := range invalid {
+		_, err := tokens.Authenticate(token)
+		assert.ErrorIs(t, err, auth.ErrInvalidCredentials, name)
+	}
+
+	principal, err = tokens.Authenticate(rsaKey.sign(t, claims(map[string]any{"exp": now.Add(-30 * time.Second).Unix()})))
+	assert.NoError(t, err, "expiry is checked with leeway")
+	assert.Equal(t, "alice", principal.Name)
+}
+
+func TestJWT_Rotation(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	old, rotated := newRSAKey(t, "2024-01"), newECKey(t, "2024-02")
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(path, jwks(t, old), 0o600))
+	tokens := auth.NewJWTWithClock(auth.JWKSFile(path), auth.JWTConfig{MinRefreshInterval: time.Minute}, func() time.Time { return now })
+	claims := map[string]any{"sub": "alice", "exp": now.Add(24 * time.Hour).Unix()}
+
+	_, err := tokens.Authenticate(old.sign(t, claims))
+	assert.NoError(t, err, "the key set is loaded on first use")
+
+	assert.NoError(t, os.WriteFile(path, jwks(t, old, rotated), 0o600))
+	_, err = tokens.Authenticate(rotated.sign(t, claims))
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials, "unknown keys refresh at most once per MinRefreshInterval")
+	now = now.Add(time.Minute)
+	_, err = tokens.Authenticate(rotated.sign(t, claims))
+	assert.NoError(t, err, "unknown keys refresh the key set")
+
+	assert.NoError(t, os.WriteFile(path, jwks(t, rotated), 0o600))
+	assert.NoError(t, tokens.Refresh())
+	_, err = tokens.Authenticate(old.sign(t, claims))
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials, "retired keys are dropped")
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{"keys": []}`), 0o600))
+	assert.Error(t, tokens.Refresh())
+	_, err = tokens.Authenticate(rotated.sign(t, claims))
+	assert.NoError(t, err, "a broken key set keeps the cached keys")
+}
+
+func TestJWT_URL(t *testing.T) {
+	key := newECKey(t, "ec")
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(jwks(t, key))
+	}))
+	t.Cleanup(server.Close)
+
+	tokens := auth.NewJWT(auth.JWKSLocation(server.URL), auth.JWTConfig{})
+	for range 3 {
+		_, err := tokens.Authenticate(key.sign(t, map[string]any{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int32(1), fetches.Load(), "the key set is cached")
+
+	broken := auth.NewJWT(auth.JWKSURL(server.URL+"/missing", http.DefaultClient), auth.JWTConfig{})
+	server.Config.Handler = http.NotFoundHandler()
+	assert.Error(t, broken.Refresh())
+	assert.True(t, auth.LooksLikeJWT(key.sign(t, map[string]any{"sub": "alice"})))
+	assert.False(t, auth.LooksLikeJWT("sk_abc_def"))
+}
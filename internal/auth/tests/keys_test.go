@@ -0,0 +1,89 @@
+package tests
+
+import (
+	"OZON_test/internal/auth"
+	"OZON_test/internal/storage"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeys_Authenticate(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	st := storage.NewSafeMap()
+	keys := auth.NewKeysWithClock(st, func() time.Time { return now })
+
+	key, token, err := keys.Create("ci", []string{auth.ScopeLinksCreate}, time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(token, "sk_"+key.ID+"_"))
+	assert.Equal(t, now.Add(time.Hour), key.ExpiresAt)
+
+	stored, err := st.LoadAPIKey(key.ID)
+	assert.NoError(t, err)
+	assert.NotContains(t, stored.Hash, token[len("sk_"+key.ID+"_"):], "the secret must not be stored")
+
+	principal, err := keys.Authenticate(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "key:"+key.ID, principal.Identity())
+	assert.Equal(t, "ci", principal.Name)
+	assert.True(t, principal.Has(auth.ScopeLinksCreate))
+	assert.False(t, principal.Has(auth.ScopeLinksDelete))
+
+	for _, bad := range []string{"", "sk_", token + "x", "sk_" + key.ID, "sk_missing_secret", strings.TrimPrefix(token, "sk_")} {
+		_, err = keys.Authenticate(bad)
+		assert.ErrorIs(t, err, auth.ErrInvalidCredentials, bad)
+	}
+
+	now = now.Add(time.Hour)
+	_, err = keys.Authenticate(token)
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials, "expired keys must be rejected")
+}
+
+func TestKeys_Revoke(t *testing.T) {
+	keys := auth.NewKeys(storage.NewSafeMap())
+	key, token, err := keys.Create("ci", []string{auth.ScopeLinksRead}, 0)
+	assert.NoError(t, err)
+	assert.True(t, key.ExpiresAt.IsZero())
+
+	list, err := keys.List()
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	assert.NoError(t, keys.Revoke(key.ID))
+	_, err = keys.Authenticate(token)
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+	assert.ErrorIs(t, keys.Revoke(key.ID), storage.ErrNotFound)
+}
+
+func TestKeys_Bootstrap(t *testing.T) {
+	keys := auth.NewKeys(storage.NewSafeMap())
+	_, err := keys.Authenticate("initial-admin-secret")
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+
+	keys.SetBootstrap("initial-admin-secret")
+	principal, err := keys.Authenticate("initial-admin-secret")
+	assert.NoError(t, err)
+	assert.Equal(t, auth.BootstrapID, principal.ID)
+	assert.True(t, principal.Has(auth.ScopeLinksDelete), "admin implies every scope")
+}
+
+func TestValidateScopes(t *testing.T) {
+	assert.NoError(t, auth.ValidateScopes([]string{auth.ScopeLinksCreate, auth.ScopeAdmin}))
+	assert.ErrorIs(t, auth.ValidateScopes(nil), auth.ErrInvalidScope)
+	assert.ErrorIs(t, auth.ValidateScopes([]string{"links:write"}), auth.ErrInvalidScope)
+
+	_, _, err := auth.NewKeys(storage.NewSafeMap()).Create("ci", []string{"everything"}, 0)
+	assert.ErrorIs(t, err, auth.ErrInvalidScope)
+}
+
+func TestPrincipalContext(t *testing.T) {
+	_, ok := auth.FromContext(context.Background())
+	assert.False(t, ok)
+
+	ctx := auth.WithPrincipal(context.Background(), auth.Principal{Kind: auth.KindKey, ID: "abc"})
+	principal, ok := auth.FromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "abc", principal.ID)
+}
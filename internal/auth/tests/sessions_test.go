@@ -0,0 +1,60 @@
+package tests
+
+import (
+	"OZON_test/internal/auth"
+	"OZON_test/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSessions_Resolve(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	st := storage.NewSafeMap()
+	user, err := auth.NewUsers(st).Create("alice", "correct horse", auth.RoleUser)
+	assert.NoError(t, err)
+	sessions := auth.NewSessionsWithClock(st, st, auth.SessionConfig{TTL: time.Hour}, func() time.Time { return now })
+
+	token, session, err := sessions.Create(user.ID)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, session.CSRF)
+	assert.Equal(t, now.Add(time.Hour), session.ExpiresAt)
+	_, err = st.LoadSession(token)
+	assert.ErrorIs(t, err, storage.ErrNotFound, "the token must not be stored")
+
+	principal, resolved, err := sessions.Resolve(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "user:"+user.ID, principal.Identity())
+	assert.Equal(t, session, resolved)
+	_, _, err = sessions.Resolve(token + "x")
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+
+	other, _, err := sessions.Create(user.ID)
+	assert.NoError(t, err)
+	assert.NoError(t, sessions.End(other))
+	_, _, err = sessions.Resolve(other)
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials, "ended sessions must be rejected")
+	assert.NoError(t, sessions.End(other), "ending twice is not an error")
+
+	now = now.Add(time.Hour)
+	_, _, err = sessions.Resolve(token)
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials, "expired sessions must be rejected")
+	_, err = st.LoadSession(session.ID)
+	assert.ErrorIs(t, err, storage.ErrNotFound, "expired sessions are removed")
+}
+
+func TestSessions_Prune(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	st := storage.NewSafeMap()
+	sessions := auth.NewSessionsWithClock(st, st, auth.SessionConfig{TTL: time.Hour, PruneInterval: time.Millisecond}, func() time.Time { return now })
+	_, session, err := sessions.Create("1")
+	assert.NoError(t, err)
+
+	now = now.Add(2 * time.Hour)
+	sessions.Start()
+	assert.Eventually(t, func() bool {
+		_, err := st.LoadSession(session.ID)
+		return err != nil
+	}, time.Second, time.Millisecond)
+	sessions.Close()
+}
@@ -0,0 +1,146 @@
+package tests
+
+import (
+	"OZON_test/internal/auth"
+	"OZON_test/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// The SHA1 test vectors of RFC 6238, appendix B, cut to six digits.
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, want := range vectors {
+		code, err := auth.TOTPCode(secret, time.Unix(unix, 0))
+		assert.NoError(t, err)
+		assert.Equal(t, want, code, "time %d", unix)
+	}
+	_, err := auth.TOTPCode("not base32!", time.Unix(59, 0))
+	assert.Error(t, err)
+}
+
+func TestTOTP_Enroll(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	st := storage.NewSafeMap()
+	totp := auth.NewTOTPWithClock(st, auth.TOTPConfig{Issuer: "Short Links"}, func() time.Time { return now })
+
+	enrollment, err := totp.Enroll("u1", "alice")
+	assert.NoError(t, err)
+	assert.Len(t, enrollment.RecoveryCodes, auth.RecoveryCodeCount)
+	uri, err := url.Parse(enrollment.URI)
+	assert.NoError(t, err)
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/Short Links:alice", uri.Path)
+	assert.Equal(t, enrollment.Secret, uri.Query().Get("secret"))
+	assert.Equal(t, "Short Links", uri.Query().Get("issuer"))
+
+	stored, err := st.LoadSecondFactor("u1")
+	assert.NoError(t, err)
+	assert.False(t, stored.Confirmed)
+	assert.NotContains(t, stored.RecoveryCodes, enrollment.RecoveryCodes[0], "recovery codes must be stored hashed")
+
+	code, err := auth.TOTPCode(enrollment.Secret, now)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, totp.Verify("u1", code), auth.ErrInvalidCode, "pending enrolments do not count")
+	assert.ErrorIs(t, totp.Confirm("u1", "000000"), auth.ErrInvalidCode)
+	assert.ErrorIs(t, totp.Confirm("u2", code), auth.ErrInvalidCode)
+	assert.NoError(t, totp.Confirm("u1", code))
+	assert.ErrorIs(t, totp.Confirm("u1", code), auth.ErrAlreadyEnrolled)
+	_, err = totp.Enroll("u1", "alice")
+	assert.ErrorIs(t, err, auth.ErrAlreadyEnrolled)
+
+	status, err := totp.Status(storage.User{ID: "u1", Role: auth.RoleUser})
+	assert.NoError(t, err)
+	assert.Equal(t, auth.SecondFactorStatus{Enabled: true, RecoveryCodes: auth.RecoveryCodeCount}, status)
+}
+
+func TestTOTP_Verify(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	st := storage.NewSafeMap()
+	totp := auth.NewTOTPWithClock(st, auth.DefaultTOTPConfig(), func() time.Time { return now })
+	enrollment, err := totp.Enroll("u1", "alice")
+	assert.NoError(t, err)
+	code, _ := auth.TOTPCode(enrollment.Secret, now)
+	assert.NoError(t, totp.Confirm("u1", code))
+
+	assert.ErrorIs(t, totp.Verify("u1", code), auth.ErrInvalidCode, "the confirmation code must not be replayed")
+
+	now = now.Add(auth.TOTPPeriod)
+	late, _ := auth.TOTPCode(enrollment.Secret, now.Add(-auth.TOTPPeriod))
+	assert.ErrorIs(t, totp.Verify("u1", late), auth.ErrInvalidCode, "codes of used steps are refused")
+	early, _ := auth.TOTPCode(enrollment.Secret, now.Add(auth.TOTPPeriod))
+	assert.NoError(t, totp.Verify("u1", early), "codes one step ahead are accepted")
+	current, _ := auth.TOTPCode(enrollment.Secret, now)
+	assert.ErrorIs(t, totp.Verify("u1", current), auth.ErrInvalidCode, "steps before the last used one are refused")
+
+	now = now.Add(10 * auth.TOTPPeriod)
+	stale, _ := auth.TOTPCode(enrollment.Secret, now.Add(-2*auth.TOTPPeriod))
+	assert.ErrorIs(t, totp.Verify("u1", stale), auth.ErrInvalidCode, "codes outside the skew are refused")
+
+	recovery := enrollment.RecoveryCodes[3]
+	assert.NoError(t, totp.Verify("u1", " "+recovery+" "))
+	assert.ErrorIs(t, totp.Verify("u1", recovery), auth.ErrInvalidCode, "recovery codes work once")
+	status, err := totp.Status(storage.User{ID: "u1"})
+	assert.NoError(t, err)
+	assert.Equal(t, auth.RecoveryCodeCount-1, status.RecoveryCodes)
+
+	assert.ErrorIs(t, totp.Disable("u1", "nonsense"), auth.ErrInvalidCode)
+	assert.NoError(t, totp.Disable("u1", enrollment.RecoveryCodes[0]))
+	_, err = st.LoadSecondFactor("u1")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	assert.NoError(t, totp.Reset("u1"), "resetting without an enrolment is not an error")
+}
+
+func TestTOTP_Login(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	st := storage.NewSafeMap()
+	users := auth.NewUsers(st)
+	totp := auth.NewTOTPWithClock(st, auth.TOTPConfig{RequiredRoles: []string{auth.RoleAdmin}}, func() time.Time { return now })
+	users.SetTOTP(totp)
+	alice, err := users.Create("alice", "alice password", auth.RoleUser)
+	assert.NoError(t, err)
+	root, err := users.Create("root", "root password", auth.RoleAdmin)
+	assert.NoError(t, err)
+
+	principal, err := users.Login("alice", "alice password")
+	assert.NoError(t, err, "users without a second factor log in with their password")
+	assert.True(t, principal.Has(auth.ScopeLinksCreate))
+
+	principal, err = users.Login("root", "root password")
+	assert.NoError(t, err)
+	assert.True(t, principal.SetupRequired, "enforced roles must enrol first")
+	assert.False(t, principal.Has(auth.ScopeAdmin))
+
+	for _, user := range []storage.User{alice, root} {
+		enrollment, err := totp.Enroll(user.ID, user.Username)
+		assert.NoError(t, err)
+		code, _ := auth.TOTPCode(enrollment.Secret, now)
+		assert.NoError(t, totp.Confirm(user.ID, code))
+	}
+	now = now.Add(auth.TOTPPeriod)
+
+	_, err = users.Login("alice", "alice password")
+	assert.ErrorIs(t, err, auth.ErrSecondFactorRequired)
+	_, err = users.LoginWithCode("alice", "wrong password", "000000")
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials, "the password is checked first")
+	_, err = users.LoginWithCode("alice", "alice password", "000000")
+	assert.ErrorIs(t, err, auth.ErrInvalidCode)
+
+	factor, _ := st.LoadSecondFactor(root.ID)
+	code, _ := auth.TOTPCode(factor.Secret, now)
+	principal, err = users.LoginWithCode("root", "root password", code)
+	assert.NoError(t, err)
+	assert.False(t, principal.SetupRequired)
+	assert.True(t, principal.Has(auth.ScopeAdmin))
+}
@@ -0,0 +1,60 @@
+package tests
+
+import (
+	"OZON_test/internal/auth"
+	"OZON_test/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestUsers_Login(t *testing.T) {
+	st := storage.NewSafeMap()
+	users := auth.NewUsers(st)
+
+	user, err := users.Create("alice", "correct horse", auth.RoleUser)
+	assert.NoError(t, err)
+	stored, err := st.LoadUser(user.ID)
+	assert.NoError(t, err)
+	assert.NotContains(t, stored.PasswordHash, "correct horse", "the password must not be stored")
+
+	principal, err := users.Login("alice", "correct horse")
+	assert.NoError(t, err)
+	assert.Equal(t, "user:"+user.ID, principal.Identity())
+	assert.Equal(t, "alice", principal.Name)
+	assert.True(t, principal.Has(auth.ScopeLinksCreate))
+	assert.True(t, principal.Has(auth.ScopeLinksDelete))
+	assert.False(t, principal.Has(auth.ScopeAdmin))
+
+	_, err = users.Login("alice", "wrong horse")
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+	_, err = users.Login("bob", "correct horse")
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+
+	admin, err := users.Create("root", "admin password", auth.RoleAdmin)
+	assert.NoError(t, err)
+	principal, err = users.Login("root", "admin password")
+	assert.NoError(t, err)
+	assert.Equal(t, "user:"+admin.ID, principal.Identity())
+	assert.True(t, principal.Has(auth.ScopeAdmin))
+}
+
+func TestUsers_Create(t *testing.T) {
+	users := auth.NewUsers(storage.NewSafeMap())
+
+	_, err := users.Create("alice", "correct horse", auth.RoleUser)
+	assert.NoError(t, err)
+	_, err = users.Create("alice", "another password", auth.RoleUser)
+	assert.ErrorIs(t, err, storage.ErrAlreadyExists)
+
+	for _, tc := range []struct{ username, password, role string }{
+		{"al", "correct horse", auth.RoleUser},
+		{"alice smith", "correct horse", auth.RoleUser},
+		{"bob", "short", auth.RoleUser},
+		{"bob", strings.Repeat("x", auth.MaxPasswordLen+1), auth.RoleUser},
+		{"bob", "correct horse", "root"},
+	} {
+		_, err = users.Create(tc.username, tc.password, tc.role)
+		assert.ErrorIs(t, err, auth.ErrInvalidAccount, tc)
+	}
+}
@@ -0,0 +1,329 @@
+package auth
+
+import (
+	"OZON_test/internal/storage"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters of RFC 6238. They are the defaults of authenticator
+// apps, so the provisioning URI only states them for completeness.
+const (
+	TOTPDigits = 6
+	TOTPPeriod = 30 * time.Second
+)
+
+// RecoveryCodeCount is the number of recovery codes issued on enrolment.
+const RecoveryCodeCount = 10
+
+var (
+	ErrSecondFactorRequired = errors.New("second factor required")
+	ErrInvalidCode          = errors.New("invalid or used code")
+	ErrAlreadyEnrolled      = errors.New("second factor already enrolled")
+)
+
+var secretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPConfig controls two-factor authentication. Issuer names the service
+// in authenticator apps. Accounts with one of RequiredRoles must enrol
+// before they are granted any scope. Skew is the number of time steps a
+// code may be early or late.
+type TOTPConfig struct {
+	Issuer        string
+	RequiredRoles []string
+	Skew          int
+}
+
+func DefaultTOTPConfig() TOTPConfig {
+	return TOTPConfig{Issuer: "OZON_test", Skew: 1}
+}
+
+// Enrollment is what a user needs to set up an authenticator app. The
+// recovery codes are only shown once, like API keys.
+type Enrollment struct {
+	Secret        string
+	URI           string
+	RecoveryCodes []string
+}
+
+// SecondFactorStatus describes the enrolment of an account.
+type SecondFactorStatus struct {
+	Enabled       bool
+	Required      bool
+	RecoveryCodes int
+}
+
+// TOTP manages time-based one-time passwords as a second factor.
+type TOTP struct {
+	storage storage.SecondFactorStorage
+	cfg     TOTPConfig
+	now     func() time.Time
+}
+
+func NewTOTP(st storage.SecondFactorStorage, cfg TOTPConfig) *TOTP {
+	return NewTOTPWithClock(st, cfg, time.Now)
+}
+
+// NewTOTPWithClock is NewTOTP with a custom time source for tests.
+func NewTOTPWithClock(st storage.SecondFactorStorage, cfg TOTPConfig, now func() time.Time) *TOTP {
+	if cfg.Issuer == "" {
+		cfg.Issuer = DefaultTOTPConfig().Issuer
+	}
+	if cfg.Skew < 0 {
+		cfg.Skew = 0
+	}
+	return &TOTP{storage: st, cfg: cfg, now: now}
+}
+
+// ValidateRoles checks that roles holds known roles only.
+func ValidateRoles(roles []string) error {
+	for _, role := range roles {
+		if _, ok := roleScopes[role]; !ok {
+			return fmt.Errorf("%w: unknown role %q", ErrInvalidAccount, role)
+		}
+	}
+	return nil
+}
+
+// Enroll creates a new secret and recovery codes for the user with userID.
+// The enrolment takes effect after Confirm; until then Enroll may be
+// called again, e.g. when the QR code was lost. Confirmed enrolments fail
+// with ErrAlreadyEnrolled.
+func (t *TOTP) Enroll(userID string, account string) (Enrollment, error) {
+	factor, err := t.storage.LoadSecondFactor(userID)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return Enrollment{}, err
+	}
+	if err == nil && factor.Confirmed {
+		return Enrollment{}, ErrAlreadyEnrolled
+	}
+
+	secret, err := randomString(20, secretEncoding.EncodeToString)
+	if err != nil {
+		return Enrollment{}, err
+	}
+	enrollment := Enrollment{Secret: secret, URI: t.provisioningURI(secret, account)}
+	hashes := make([]string, 0, RecoveryCodeCount)
+	for range RecoveryCodeCount {
+		code, err := randomString(5, hex.EncodeToString)
+		if err != nil {
+			return Enrollment{}, err
+		}
+		code = code[:5] + "-" + code[5:]
+		enrollment.RecoveryCodes = append(enrollment.RecoveryCodes, code)
+		hashes = append(hashes, hashToken(code))
+	}
+
+	err = t.storage.StoreSecondFactor(storage.SecondFactor{
+		UserID:        userID,
+		Secret:        secret,
+		RecoveryCodes: hashes,
+		CreatedAt:     t.now().UTC(),
+	})
+	if err != nil {
+		return Enrollment{}, err
+	}
+	return enrollment, nil
+}
+
+// provisioningURI is the otpauth URI authenticator apps read from the QR
+// code, see https://github.com/google/google-authenticator/wiki/Key-Uri-Format.
+func (t *TOTP) provisioningURI(secret string, account string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", t.cfg.Issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(TOTPDigits))
+	query.Set("period", fmt.Sprint(int(TOTPPeriod.Seconds())))
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + t.cfg.Issuer + ":" + account,
+		RawQuery: query.Encode(),
+	}
+	return uri.String()
+}
+
+// Confirm enables the pending enrolment of userID once the app shows a
+// matching code.
+func (t *TOTP) Confirm(userID string, code string) error {
+	factor, err := t.storage.LoadSecondFactor(userID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("%w: enrol first", ErrInvalidCode)
+	}
+	if err != nil {
+		return err
+	}
+	if factor.Confirmed {
+		return ErrAlreadyEnrolled
+	}
+	step, ok := t.match(factor.Secret, code)
+	if !ok {
+		return ErrInvalidCode
+	}
+	factor.Confirmed = true
+	factor.LastStep = step
+	return t.storage.StoreSecondFactor(factor)
+}
+
+// Verify checks a code of the app or an unused recovery code of the
+// enrolled user with userID. Each code is accepted only once.
+func (t *TOTP) Verify(userID string, code string) error {
+	factor, err := t.storage.LoadSecondFactor(userID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return ErrInvalidCode
+	}
+	if err != nil {
+		return err
+	}
+	if !factor.Confirmed {
+		return ErrInvalidCode
+	}
+
+	code = strings.TrimSpace(code)
+	if step, ok := t.match(factor.Secret, code); ok {
+		used, err := t.storage.UseTOTPStep(userID, step)
+		if err != nil {
+			return err
+		}
+		if !used {
+			return ErrInvalidCode
+		}
+		return nil
+	}
+	used, err := t.storage.UseRecoveryCode(userID, hashToken(strings.ToLower(code)))
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// Disable removes the enrolment of userID after checking code.
+func (t *TOTP) Disable(userID string, code string) error {
+	if err := t.Verify(userID, code); err != nil {
+		return err
+	}
+	return t.Reset(userID)
+}
+
+// Reset removes the enrolment of userID without a code, for admins helping
+// users who lost their device. Unknown enrolments are ignored.
+func (t *TOTP) Reset(userID string) error {
+	err := t.storage.DeleteSecondFactor(userID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// Status reports whether user has enrolled and must use a second factor.
+func (t *TOTP) Status(user storage.User) (SecondFactorStatus, error) {
+	status := SecondFactorStatus{Required: t.required(user.Role)}
+	factor, err := t.storage.LoadSecondFactor(user.ID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return status, nil
+	}
+	if err != nil {
+		return SecondFactorStatus{}, err
+	}
+	if factor.Confirmed {
+		status.Enabled = true
+		status.RecoveryCodes = len(factor.RecoveryCodes)
+	}
+	return status, nil
+}
+
+// Principal returns the principal of a user who passed every factor.
+// Users whose role requires a second factor but who have not enrolled yet
+// get a principal without scopes that may only enrol.
+func (t *TOTP) Principal(user storage.User) (Principal, error) {
+	principal := UserPrincipal(user)
+	if !t.required(user.Role) {
+		return principal, nil
+	}
+	status, err := t.Status(user)
+	if err != nil {
+		return Principal{}, err
+	}
+	if !status.Enabled {
+		principal.Scopes = nil
+		principal.SetupRequired = true
+	}
+	return principal, nil
+}
+
+// Check completes the login of user, who already passed the password.
+// Enrolled users have to present a code, otherwise it is ignored.
+func (t *TOTP) Check(user storage.User, code string) (Principal, error) {
+	status, err := t.Status(user)
+	if err != nil {
+		return Principal{}, err
+	}
+	if !status.Enabled {
+		return t.Principal(user)
+	}
+	if strings.TrimSpace(code) == "" {
+		return Principal{}, ErrSecondFactorRequired
+	}
+	if err := t.Verify(user.ID, code); err != nil {
+		return Principal{}, err
+	}
+	return UserPrincipal(user), nil
+}
+
+func (t *TOTP) required(role string) bool {
+	return contains(t.cfg.RequiredRoles, role)
+}
+
+// match looks for code within the allowed skew around now and returns its
+// time step.
+func (t *TOTP) match(secret string, code string) (int64, bool) {
+	if len(code) != TOTPDigits {
+		return 0, false
+	}
+	key, err := secretEncoding.DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+	now := t.now().Unix() / int64(TOTPPeriod.Seconds())
+	for step := now - int64(t.cfg.Skew); step <= now+int64(t.cfg.Skew); step++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// TOTPCode returns the code of the base32 secret at time at, as shown by
+// authenticator apps.
+func TOTPCode(secret string, at time.Time) (string, error) {
+	key, err := secretEncoding.DecodeString(strings.TrimRight(strings.ToUpper(secret), "="))
+	if err != nil {
+		return "", fmt.Errorf("invalid secret: %w", err)
+	}
+	return hotp(key, at.Unix()/int64(TOTPPeriod.Seconds())), nil
+}
+
+// hotp is the HMAC-SHA1 one-time password of RFC 4226 for counter.
+func hotp(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TOTPDigits, value%1000000)
+}
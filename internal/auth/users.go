@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"OZON_test/internal/storage"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password limits. bcrypt ignores everything past 72 bytes, so longer
+// passwords are rejected instead of being silently truncated.
+const (
+	MinPasswordLen = 8
+	MaxPasswordLen = 72
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{2,63}$`)
+
+// dummyHash is compared against when the user does not exist, so a login
+// takes as long for unknown usernames as for wrong passwords.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// Users manages accounts with bcrypt hashed passwords.
+type Users struct {
+	storage storage.UserStorage
+	totp    *TOTP
+	now     func() time.Time
+}
+
+func NewUsers(st storage.UserStorage) *Users {
+	return NewUsersWithClock(st, time.Now)
+}
+
+// NewUsersWithClock is NewUsers with a custom time source for tests.
+func NewUsersWithClock(st storage.UserStorage, now func() time.Time) *Users {
+	return &Users{storage: st, now: now}
+}
+
+// Create registers an account. Taken usernames fail with
+// storage.ErrAlreadyExists.
+func (u *Users) Create(username, password, role string) (storage.User, error) {
+	if !usernamePattern.MatchString(username) {
+		return storage.User{}, fmt.Errorf("%w: username must be 3-64 letters, digits, dots, dashes or underscores", ErrInvalidAccount)
+	}
+	if len(password) < MinPasswordLen || len(password) > MaxPasswordLen {
+		return storage.User{}, fmt.Errorf("%w: password must be %d-%d bytes long", ErrInvalidAccount, MinPasswordLen, MaxPasswordLen)
+	}
+	if _, ok := roleScopes[role]; !ok {
+		return storage.User{}, fmt.Errorf("%w: unknown role %q", ErrInvalidAccount, role)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return storage.User{}, err
+	}
+	id, err := randomString(8, hex.EncodeToString)
+	if err != nil {
+		return storage.User{}, err
+	}
+	user := storage.User{
+		ID:           id,
+		Username:     username,
+		PasswordHash: string(hash),
+		Role:         role,
+		CreatedAt:    u.now().UTC(),
+	}
+	if err := u.storage.CreateUser(user); err != nil {
+		return storage.User{}, err
+	}
+	return user, nil
+}
+
+// SetTOTP enables two-factor authentication, see LoginWithCode.
+func (u *Users) SetTOTP(totp *TOTP) {
+	u.totp = totp
+}
+
+// Login checks the password of username. Unknown users and wrong passwords
+// both fail with ErrInvalidCredentials. Users with a second factor cannot
+// log in with a password alone and fail with ErrSecondFactorRequired.
+func (u *Users) Login(username, password string) (Principal, error) {
+	return u.LoginWithCode(username, password, "")
+}
+
+// LoginWithCode is Login for users who may have enrolled a second factor:
+// their code is checked after the password, see TOTP.Check.
+func (u *Users) LoginWithCode(username, password, code string) (Principal, error) {
+	user, err := u.storage.LoadUserByName(username)
+	if errors.Is(err, storage.ErrNotFound) {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return Principal{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return Principal{}, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return Principal{}, ErrInvalidCredentials
+	}
+	if u.totp != nil {
+		return u.totp.Check(user, code)
+	}
+	return UserPrincipal(user), nil
+}
+
+// Lookup returns the account with id.
+func (u *Users) Lookup(id string) (storage.User, error) {
+	return u.storage.LoadUser(id)
+}
+
+// UserPrincipal is the principal of an account, scoped by its role.
+func UserPrincipal(user storage.User) Principal {
+	return Principal{Kind: KindUser, ID: user.ID, Name: user.Username, Scopes: roleScopes[user.Role]}
+}
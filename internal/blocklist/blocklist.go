@@ -0,0 +1,219 @@
+package blocklist
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/net/idna"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const regexPrefix = "re:"
+
+// NoHostRule is reported for URLs without a host to check against the
+// rules. They are blocked, so a blocked host cannot slip through in a form
+// the host rules do not understand.
+const NoHostRule = "<no host>"
+
+// Blocklist matches URLs against rules loaded from local files. Each line of
+// a file holds one rule:
+//
+//	evil.com                 the host itself
+//	*.evil.com               any subdomain of evil.com
+//	re:^https?://[^/]*phish  a regular expression matched against the whole URL
+//
+// Empty lines and lines starting with # are ignored.
+type Blocklist struct {
+	files []string
+	rules atomic.Pointer[ruleSet]
+
+	mu     sync.Mutex
+	stamps map[string]fileStamp
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+type ruleSet struct {
+	hosts    map[string]string
+	suffixes map[string]string
+	patterns []*regexp.Regexp
+}
+
+func Load(files ...string) (*Blocklist, error) {
+	b := &Blocklist{files: files, stamps: make(map[string]fileStamp), done: make(chan struct{})}
+	if _, err := b.Reload(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reload re-reads the rule files if any of them changed since the last load.
+// On error the previously loaded rules stay active.
+func (b *Blocklist) Reload() (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stamps := make(map[string]fileStamp, len(b.files))
+	changed := b.rules.Load() == nil
+	for _, file := range b.files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, fmt.Errorf("failed to stat blocklist %s: %w", file, err)
+		}
+		stamps[file] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		if stamps[file] != b.stamps[file] {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	rules := &ruleSet{hosts: make(map[string]string), suffixes: make(map[string]string)}
+	for _, file := range b.files {
+		if err := rules.readFile(file); err != nil {
+			return false, err
+		}
+	}
+
+	b.rules.Store(rules)
+	b.stamps = stamps
+	return true, nil
+}
+
+// Watch polls the rule files every interval until Close is called.
+func (b *Blocklist) Watch(interval time.Duration) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-b.done:
+				return
+			case <-ticker.C:
+				reloaded, err := b.Reload()
+				if err != nil {
+					log.Printf("failed to reload blocklist: %v", err)
+				} else if reloaded {
+					log.Println("blocklist reloaded")
+				}
+			}
+		}
+	}()
+}
+
+func (b *Blocklist) Close() {
+	close(b.done)
+	b.wg.Wait()
+}
+
+// Blocked reports whether rawUrl matches a rule and returns that rule.
+// URLs without a host are blocked with NoHostRule.
+func (b *Blocklist) Blocked(rawUrl string) (string, bool) {
+	rules := b.rules.Load()
+	if rules == nil {
+		return "", false
+	}
+
+	for _, pattern := range rules.patterns {
+		if pattern.MatchString(rawUrl) {
+			return regexPrefix + pattern.String(), true
+		}
+	}
+
+	host := hostOf(rawUrl)
+	if host == "" {
+		return NoHostRule, true
+	}
+
+	if rule, ok := rules.hosts[host]; ok {
+		return rule, true
+	}
+	for suffix := host; ; {
+		_, parent, found := strings.Cut(suffix, ".")
+		if !found {
+			return "", false
+		}
+		if rule, ok := rules.suffixes[parent]; ok {
+			return rule, true
+		}
+		suffix = parent
+	}
+}
+
+func (rs *ruleSet) readFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("failed to open blocklist %s: %w", file, err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Printf("failed to close blocklist %s: %v", file, err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		rule := strings.TrimSpace(scanner.Text())
+		if rule == "" || strings.HasPrefix(rule, "#") {
+			continue
+		}
+		if err := rs.add(rule); err != nil {
+			return fmt.Errorf("%s:%d: %w", file, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (rs *ruleSet) add(rule string) error {
+	switch {
+	case strings.HasPrefix(rule, regexPrefix):
+		pattern, err := regexp.Compile(strings.TrimPrefix(rule, regexPrefix))
+		if err != nil {
+			return fmt.Errorf("invalid regex rule: %w", err)
+		}
+		rs.patterns = append(rs.patterns, pattern)
+	case strings.HasPrefix(rule, "*."):
+		rs.suffixes[normalizeHost(strings.TrimPrefix(rule, "*."))] = rule
+	default:
+		rs.hosts[normalizeHost(rule)] = rule
+	}
+	return nil
+}
+
+// hostOf returns the host of rawUrl as the validator parses it. Input
+// without a scheme, like "evil.com/path", is read as a host and a path.
+// Opaque URLs like "https:evil.com" have no host.
+func hostOf(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err == nil && u.Scheme == "" && u.Host == "" && !strings.HasPrefix(rawUrl, "/") {
+		u, err = url.Parse("//" + rawUrl)
+	}
+	if err != nil || u.Opaque != "" {
+		return ""
+	}
+	return normalizeHost(u.Hostname())
+}
+
+func normalizeHost(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ascii, err := idna.Punycode.ToASCII(host); err == nil {
+		host = ascii
+	}
+	return host
+}
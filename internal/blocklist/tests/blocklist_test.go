@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"OZON_test/internal/blocklist"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeRules(t *testing.T, path string, rules string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatalf("failed to write rules: %v", err)
+	}
+}
+
+func TestBlocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	writeRules(t, path, `
+# фишинговые домены
+evil.com
+*.phish.net
+re:^https?://[^/]*\.example\.org/login
+пример.рф
+`)
+
+	bl, err := blocklist.Load(path)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		url         string
+		wantBlocked bool
+	}{
+		{name: "ExactHost", url: "http://evil.com/path", wantBlocked: true},
+		{name: "ExactHostCase", url: "https://EVIL.com./", wantBlocked: true},
+		{name: "ExactHostSubdomain", url: "http://www.evil.com", wantBlocked: false},
+		{name: "Wildcard", url: "http://login.phish.net", wantBlocked: true},
+		{name: "WildcardDeep", url: "http://a.b.phish.net/x", wantBlocked: true},
+		{name: "WildcardApex", url: "http://phish.net", wantBlocked: false},
+		{name: "Regex", url: "https://secure.example.org/login?next=/", wantBlocked: true},
+		{name: "RegexNoMatch", url: "https://secure.example.org/about", wantBlocked: false},
+		{name: "Idn", url: "http://xn--e1afmkfd.xn--p1ai/", wantBlocked: true},
+		{name: "NoScheme", url: "evil.com/path", wantBlocked: true},
+		{name: "Opaque", url: "https:evil.com", wantBlocked: true},
+		{name: "OpaqueClean", url: "https:example.com", wantBlocked: true},
+		{name: "NoHost", url: "http:///evil.com", wantBlocked: true},
+		{name: "Clean", url: "https://example.com", wantBlocked: false},
+	}
+
+	for _, tt := range tests {
+		tt := tt // захват переменной
+		t.Run(tt.name, func(t *testing.T) {
+			_, blocked := bl.Blocked(tt.url)
+			assert.Equal(t, tt.wantBlocked, blocked)
+		})
+	}
+}
+
+func TestBlocked_NoHost(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	writeRules(t, path, "evil.com\n")
+
+	bl, err := blocklist.Load(path)
+	assert.NoError(t, err)
+
+	rule, blocked := bl.Blocked("https:evil.com")
+	assert.True(t, blocked, "dropping the slashes must not bypass host rules")
+	assert.Equal(t, blocklist.NoHostRule, rule)
+}
+
+func TestLoad_Errors(t *testing.T) {
+	_, err := blocklist.Load(filepath.Join(t.TempDir(), "missing.txt"))
+	assert.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	writeRules(t, path, "re:([")
+	_, err = blocklist.Load(path)
+	assert.Error(t, err)
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	writeRules(t, path, "evil.com\n")
+
+	bl, err := blocklist.Load(path)
+	assert.NoError(t, err)
+
+	reloaded, err := bl.Reload()
+	assert.NoError(t, err)
+	assert.False(t, reloaded, "unchanged files must not be reloaded")
+
+	writeRules(t, path, "evil.com\nworse.com\n")
+	reloaded, err = bl.Reload()
+	assert.NoError(t, err)
+	assert.True(t, reloaded)
+	_, blocked := bl.Blocked("http://worse.com")
+	assert.True(t, blocked)
+
+	// Ошибка в новом файле не должна сбрасывать уже загруженные правила.
+	writeRules(t, path, "re:([\n")
+	_, err = bl.Reload()
+	assert.Error(t, err)
+	_, blocked = bl.Blocked("http://worse.com")
+	assert.True(t, blocked)
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	writeRules(t, path, "evil.com\n")
+
+	bl, err := blocklist.Load(path)
+	assert.NoError(t, err)
+	bl.Watch(10 * time.Millisecond)
+	t.Cleanup(bl.Close)
+
+	writeRules(t, path, "evil.com\nnew-threat.com\n")
+	assert.Eventually(t, func() bool {
+		_, blocked := bl.Blocked("http://new-threat.com")
+		return blocked
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,21 @@
+package encoder
+
+import (
+	"crypto/rand"
+	"golang.org/x/crypto/openpgp/errors"
+)
+
+func GenerateRandomShortId(keyLen int) (string, error) {
+	if keyLen > 32 {
+		return "", errors.InvalidArgumentError("keyLen > 32")
+	}
+	buf := make([]byte, keyLen)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	b := make([]byte, keyLen)
+	for i := range b {
+		b[i] = base63Chars[buf[i]%byte(len(base63Chars))]
+	}
+	return string(b), nil
+}
@@ -0,0 +1,64 @@
+package encoder
+
+import (
+	"golang.org/x/crypto/openpgp/errors"
+	"sync"
+)
+
+// RangeLeaser hands out non-overlapping ranges [start, start+size) of ids.
+type RangeLeaser interface {
+	LeaseRange(size uint64) (uint64, error)
+}
+
+func EncodeSequentialId(id uint64, keyLen int) (string, error) {
+	if keyLen > 32 {
+		return "", errors.InvalidArgumentError("keyLen > 32")
+	}
+	b := make([]byte, keyLen)
+	for i := keyLen - 1; i >= 0; i-- {
+		b[i] = base63Chars[id%uint64(len(base63Chars))]
+		id /= uint64(len(base63Chars))
+	}
+	if id != 0 {
+		return "", errors.InvalidArgumentError("id does not fit into keyLen")
+	}
+	return string(b), nil
+}
+
+// SequentialGenerator issues keys from ranges leased by a RangeLeaser, so
+// every key it returns is unique across all replicas sharing the leaser.
+type SequentialGenerator struct {
+	mu        sync.Mutex
+	leaser    RangeLeaser
+	leaseSize uint64
+	keyLen    int
+	next      uint64
+	end       uint64
+}
+
+func NewSequentialGenerator(leaser RangeLeaser, leaseSize uint64, keyLen int) *SequentialGenerator {
+	if leaseSize == 0 {
+		leaseSize = 1
+	}
+	return &SequentialGenerator{leaser: leaser, leaseSize: leaseSize, keyLen: keyLen}
+}
+
+// Generate matches the generator signature used by the handlers. The url and
+// seed are ignored: keys never collide, so the first candidate is always free.
+// Repeated urls are deduplicated by the handlers, which look up existing
+// links by url before generating a key.
+func (g *SequentialGenerator) Generate(_ string, _ int) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.next == g.end {
+		start, err := g.leaser.LeaseRange(g.leaseSize)
+		if err != nil {
+			return "", err
+		}
+		g.next, g.end = start, start+g.leaseSize
+	}
+	id := g.next
+	g.next++
+	return EncodeSequentialId(id, g.keyLen)
+}
@@ -6,11 +6,12 @@ import (
 	"strconv"
 )
 
+const base63Chars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ_"
+
 func GenerateSecureShortId(url string, seed int, keyLen int) (string, error) {
 	if keyLen > 32 {
 		return "", errors.InvalidArgumentError("keyLen > 32")
 	}
-	const base63Chars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ_"
 	sha := sha256.Sum256([]byte(url + strconv.Itoa(seed)))
 	b := make([]byte, keyLen)
 	for i := range b {
@@ -0,0 +1,104 @@
+package tests
+
+import (
+	"OZON_test/internal/encoder"
+	"OZON_test/internal/storage"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestEncodeSequentialId(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      uint64
+		keyLen  int
+		want    string
+		wantErr bool
+	}{
+		{name: "Zero", id: 0, keyLen: 4, want: "0000"},
+		{name: "SingleDigit", id: 62, keyLen: 4, want: "000_"},
+		{name: "Carry", id: 63, keyLen: 4, want: "0010"},
+		{name: "Overflow", id: 63 * 63, keyLen: 2, wantErr: true},
+		{name: "TooLong", id: 1, keyLen: 33, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt // захват переменной
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encoder.EncodeSequentialId(tt.id, tt.keyLen)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+type countingLeaser struct {
+	leaser storage.SafeCounter
+	leases int
+}
+
+func (l *countingLeaser) LeaseRange(size uint64) (uint64, error) {
+	l.leases++
+	return l.leaser.LeaseRange(size)
+}
+
+func TestSequentialGenerator(t *testing.T) {
+	leaser := &countingLeaser{}
+	gen := encoder.NewSequentialGenerator(leaser, 10, 6)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 25; i++ {
+		key, err := gen.Generate("http://example.com", 0)
+		assert.NoError(t, err)
+		assert.Len(t, key, 6)
+		assert.False(t, seen[key], "key %q issued twice", key)
+		seen[key] = true
+	}
+	assert.Equal(t, 3, leaser.leases)
+}
+
+func TestSequentialGenerator_Replicas(t *testing.T) {
+	shared := storage.NewSafeCounter()
+	first := encoder.NewSequentialGenerator(shared, 5, 6)
+	second := encoder.NewSequentialGenerator(shared, 5, 6)
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		seen = make(map[string]bool)
+	)
+	for _, gen := range []*encoder.SequentialGenerator{first, second} {
+		wg.Add(1)
+		go func(gen *encoder.SequentialGenerator) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				key, err := gen.Generate("", 0)
+				assert.NoError(t, err)
+				mu.Lock()
+				assert.False(t, seen[key], "key %q issued twice", key)
+				seen[key] = true
+				mu.Unlock()
+			}
+		}(gen)
+	}
+	wg.Wait()
+	assert.Len(t, seen, 100)
+}
+
+func TestSequentialGenerator_LeaseError(t *testing.T) {
+	gen := encoder.NewSequentialGenerator(failingLeaser{}, 10, 6)
+	_, err := gen.Generate("", 0)
+	assert.Error(t, err)
+}
+
+type failingLeaser struct{}
+
+func (failingLeaser) LeaseRange(uint64) (uint64, error) {
+	return 0, errors.New("lease failed")
+}
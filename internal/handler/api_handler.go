@@ -0,0 +1,267 @@
+package handler
+
+import (
+	"OZON_test/internal/storage"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultLinksPageSize = 100
+	maxLinksPageSize     = 1000
+	maxRequestBodySize   = 1 << 20
+)
+
+type linkRequest struct {
+	Url         string               `json:"url"`
+	Passthrough *storage.Passthrough `json:"passthrough,omitempty"`
+	Redirect    *string              `json:"redirect,omitempty"`
+	Preview     *bool                `json:"preview,omitempty"`
+	Qr          bool                 `json:"qr,omitempty"`
+}
+
+type linkResponse struct {
+	Key         string              `json:"key"`
+	Url         string              `json:"url"`
+	ShortUrl    string              `json:"short_url"`
+	Passthrough storage.Passthrough `json:"passthrough"`
+	Redirect    string              `json:"redirect,omitempty"`
+	Preview     bool                `json:"preview,omitempty"`
+	Qr          string              `json:"qr,omitempty"`
+	Owner       string              `json:"owner,omitempty"`
+}
+
+type linkListResponse struct {
+	Links []linkResponse `json:"links"`
+	Next  string         `json:"next,omitempty"`
+}
+
+type errorResponse struct {
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+}
+
+// options applies the option fields present in the request to base.
+func (req linkRequest) options(base storage.LinkOptions) storage.LinkOptions {
+	if req.Passthrough != nil {
+		base.Passthrough = *req.Passthrough
+	}
+	if req.Redirect != nil {
+		base.Redirect = *req.Redirect
+	}
+	if req.Preview != nil {
+		base.Preview = *req.Preview
+	}
+	return base
+}
+
+func newLinkResponse(base string, link storage.Link) linkResponse {
+	return linkResponse{
+		Key:         link.Key,
+		Url:         link.Url,
+		ShortUrl:    shortUrl(base, link.Key),
+		Passthrough: link.Options.Passthrough,
+		Redirect:    link.Options.Redirect,
+		Preview:     link.Options.Preview,
+		Owner:       link.Owner,
+	}
+}
+
+func (h *Handlers) createLinkHandler(w http.ResponseWriter, r *http.Request) {
+	var req linkRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if req.Url == "" {
+		writeError(w, r, reasonInvalidRequest, "missing url")
+		return
+	}
+
+	link, existed, err := h.shorten(h.storage, req.Url, req.options(storage.LinkOptions{}), ownerOf(r.Context(), h.storage))
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+
+	status := http.StatusCreated
+	if existed {
+		status = http.StatusOK
+	}
+	base := h.baseUrl(r)
+	response := newLinkResponse(base, link)
+	if req.Qr {
+		if response.Qr, err = qrDataUri(base, link.Key); err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+	}
+	w.Header().Set("Location", h.path("/api/v1/links/"+link.Key))
+	writeJSON(w, status, response)
+}
+
+func (h *Handlers) linkHandler(w http.ResponseWriter, r *http.Request) {
+	link, err := h.loadLink(mux.Vars(r)["key"])
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newLinkResponse(h.baseUrl(r), link))
+}
+
+func (h *Handlers) listLinksHandler(w http.ResponseWriter, r *http.Request) {
+	lister, ok := h.storage.(storage.Lister)
+	if !ok {
+		writeError(w, r, reasonNotSupported, "listing is not supported by the storage")
+		return
+	}
+	h.writeLinks(w, r, lister.List)
+}
+
+// writeLinks answers with the page of links list returns for the after and
+// limit query parameters.
+func (h *Handlers) writeLinks(w http.ResponseWriter, r *http.Request, list func(after string, limit int) ([]storage.Link, error)) {
+	limit, ok := parseLimit(r, defaultLinksPageSize)
+	if !ok {
+		writeError(w, r, reasonInvalidRequest, "invalid limit parameter")
+		return
+	}
+	limit = min(limit, maxLinksPageSize)
+
+	links, err := list(r.URL.Query().Get("after"), limit)
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+
+	base := h.baseUrl(r)
+	response := linkListResponse{Links: make([]linkResponse, 0, len(links))}
+	for _, link := range links {
+		response.Links = append(response.Links, newLinkResponse(base, link))
+	}
+	if len(links) == limit {
+		response.Next = links[len(links)-1].Key
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// updateLinkHandler changes the destination and/or the options of an
+// existing link. Omitted fields are left as they are.
+func (h *Handlers) updateLinkHandler(w http.ResponseWriter, r *http.Request) {
+	manager, ok := h.storage.(storage.Manager)
+	if !ok {
+		writeError(w, r, reasonNotSupported, "updates are not supported by the storage")
+		return
+	}
+
+	var req linkRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if req.Url == "" && req.Passthrough == nil && req.Redirect == nil && req.Preview == nil {
+		writeError(w, r, reasonInvalidRequest, "nothing to update")
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	link, err := h.loadLink(key)
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	if err := h.authorizeOwner(r.Context(), key); err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+
+	var (
+		optionsStorage storage.OptionsStorage
+		options        = req.options(link.Options)
+	)
+	if options != link.Options {
+		if err := validateOptions(options); err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+		if optionsStorage, ok = h.storage.(storage.OptionsStorage); !ok {
+			writeError(w, r, reasonNotSupported, "link options are not supported by the storage")
+			return
+		}
+	}
+
+	if req.Url != "" {
+		url, err := h.prepare(req.Url)
+		if err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+		if err := manager.Update(key, url); err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+	}
+	if optionsStorage != nil {
+		if err := optionsStorage.StoreOptions(key, options); err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+	}
+
+	link, err = h.loadLink(key)
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newLinkResponse(h.baseUrl(r), link))
+}
+
+func (h *Handlers) deleteLinkHandler(w http.ResponseWriter, r *http.Request) {
+	manager, ok := h.storage.(storage.Manager)
+	if !ok {
+		writeError(w, r, reasonNotSupported, "deletion is not supported by the storage")
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	if err := h.authorizeOwner(r.Context(), key); err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	if err := manager.Delete(key); err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handlers) loadLink(key string) (storage.Link, error) {
+	url, err := h.storage.Load(key)
+	if err != nil {
+		return storage.Link{}, storage.ErrNotFound
+	}
+	return storage.Link{Key: key, Url: url, Options: loadOptions(h.storage, key), Owner: loadOwner(h.storage, key)}, nil
+}
+
+// decodeRequest reads a JSON body into v, answering with 400 on failure.
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeError(w, r, reasonInvalidRequest, "invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func parseLimit(r *http.Request, defaultLimit int) (int, bool) {
+	raw := r.URL.Query().Get("limit")
+	if raw == "" {
+		return defaultLimit, true
+	}
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit <= 0 {
+		return 0, false
+	}
+	return limit, true
+}
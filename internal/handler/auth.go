@@ -0,0 +1,268 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+
+	"OZON_test/internal/auth"
+	pb "OZON_test/internal/handler/proto"
+	"OZON_test/internal/ratelimit"
+	"OZON_test/internal/storage"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Authenticator checks bearer tokens.
+type Authenticator interface {
+	Authenticate(token string) (auth.Principal, error)
+}
+
+// PasswordAuthenticator checks the username and password of an account.
+type PasswordAuthenticator interface {
+	Login(username, password string) (auth.Principal, error)
+}
+
+// Authenticators resolve the credentials of the Authorization header:
+// Bearer tokens are checked by Keys, or by Tokens when they are JWTs, and
+// Basic credentials by Users. Any may be nil to refuse those credentials.
+// Failed authentications count against the login policy of Limiter, which
+// may be nil too.
+type Authenticators struct {
+	Keys    Authenticator
+	Tokens  Authenticator
+	Users   PasswordAuthenticator
+	Limiter RateLimiter
+}
+
+func (a Authenticators) authenticate(header string) (auth.Principal, error) {
+	if token, ok := bearerToken(header); ok {
+		if a.Tokens != nil && auth.LooksLikeJWT(token) {
+			return a.Tokens.Authenticate(token)
+		}
+		if a.Keys != nil {
+			return a.Keys.Authenticate(token)
+		}
+	}
+	if username, password, ok := basicCredentials(header); ok && a.Users != nil {
+		return a.Users.Login(username, password)
+	}
+	return auth.Principal{}, newError(reasonUnauthenticated, a.expected())
+}
+
+// limitFailure counts a failed authentication with header from address.
+// Only rejected credentials count, not missing ones or storage failures.
+func (a Authenticators) limitFailure(err error, header string, address string) ratelimit.Decision {
+	if !errors.Is(err, auth.ErrInvalidCredentials) {
+		return ratelimit.Decision{Allowed: true}
+	}
+	username, _, _ := basicCredentials(header)
+	return allowLogin(a.Limiter, address, username)
+}
+
+func (a Authenticators) expected() string {
+	bearer := a.Keys != nil || a.Tokens != nil
+	switch {
+	case bearer && a.Users != nil:
+		return "expected a bearer token or basic credentials"
+	case a.Users != nil:
+		return "expected basic credentials"
+	default:
+		return "expected a bearer token"
+	}
+}
+
+// grpcScopes lists the scope each gRPC method requires. Methods missing
+// from it, like the health service, are open.
+var grpcScopes = map[string]string{
+	pb.UrlService_GenerateKey_FullMethodName: auth.ScopeLinksCreate,
+	pb.UrlService_Redirect_FullMethodName:    auth.ScopeLinksRead,
+	pb.UrlService_GenerateQr_FullMethodName:  auth.ScopeLinksRead,
+}
+
+// authenticated reports whether requests must carry credentials.
+func (h *Handlers) authenticated() bool {
+	return h.keys != nil || h.tokens != nil || h.users != nil
+}
+
+func (h *Handlers) authenticators() Authenticators {
+	var authenticators Authenticators
+	if h.keys != nil {
+		authenticators.Keys = h.keys
+	}
+	if h.tokens != nil {
+		authenticators.Tokens = h.tokens
+	}
+	if h.users != nil {
+		authenticators.Users = h.users
+	}
+	authenticators.Limiter = h.limiter
+	return authenticators
+}
+
+// authenticate resolves the credentials of the request, if any, to a
+// principal. Without an Authorization header the session cookie is used.
+// Requests without credentials continue anonymously and are rejected later
+// by the routes that require a scope. Clients failing too often are
+// answered with 429 instead.
+func (h *Handlers) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if !h.authenticated() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if header == "" {
+			next.ServeHTTP(w, h.withSession(r))
+			return
+		}
+		authenticators := h.authenticators()
+		principal, err := authenticators.authenticate(header)
+		if err != nil {
+			if decision := authenticators.limitFailure(err, header, "ip:"+h.publicUrl.ClientIP(r)); !decision.Allowed {
+				writeRateLimited(w, r, decision)
+				return
+			}
+			writeProblem(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), principal)))
+	})
+}
+
+// require lets through requests whose principal has scope. Without
+// authentication every request is let through.
+func (h *Handlers) require(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.authenticated() {
+			if err := authorize(r.Context(), scope); err != nil {
+				writeProblem(w, r, err)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// authorizeOwner lets admins and the owner of the link with key through.
+// Links without an owner may only be changed by admins. Without
+// authentication every request is let through.
+func (h *Handlers) authorizeOwner(ctx context.Context, key string) error {
+	if !h.authenticated() {
+		return nil
+	}
+	principal, ok := auth.FromContext(ctx)
+	if !ok {
+		return newError(reasonUnauthenticated, "authentication required")
+	}
+	if principal.Has(auth.ScopeAdmin) {
+		return nil
+	}
+	ownerStorage, ok := h.storage.(storage.OwnerStorage)
+	if !ok {
+		return newError(reasonForbidden, "only admins may change links")
+	}
+	owner, err := ownerStorage.LoadOwner(key)
+	if err != nil {
+		return err
+	}
+	if owner == "" || owner != principal.Identity() {
+		return newError(reasonForbidden, "only the owner of the link or an admin may change it")
+	}
+	return nil
+}
+
+// authorizeJob lets the owner of job and admins access it when
+// authentication is enabled. Jobs without an owner are left to admins.
+func (h *Handlers) authorizeJob(ctx context.Context, job storage.Job) error {
+	if !h.authenticated() {
+		return nil
+	}
+	principal, ok := auth.FromContext(ctx)
+	if !ok {
+		return newError(reasonUnauthenticated, "authentication required")
+	}
+	if principal.Has(auth.ScopeAdmin) {
+		return nil
+	}
+	if job.Owner == "" || job.Owner != principal.Identity() {
+		return newError(reasonForbidden, "only the owner of the job or an admin may access it")
+	}
+	return nil
+}
+
+func authorize(ctx context.Context, scope string) error {
+	principal, ok := auth.FromContext(ctx)
+	if !ok {
+		return newError(reasonUnauthenticated, "authentication required")
+	}
+	if principal.SetupRequired {
+		return newError(reasonForbidden, "two-factor authentication must be set up first")
+	}
+	if !principal.Has(scope) {
+		return newError(reasonForbidden, "missing scope "+scope)
+	}
+	return nil
+}
+
+// withPrincipal stores the principal and makes rate limits count its
+// requests instead of those of its address.
+func withPrincipal(ctx context.Context, principal auth.Principal) context.Context {
+	ctx = auth.WithPrincipal(ctx, principal)
+	return ratelimit.WithIdentity(ctx, principal.Identity())
+}
+
+func bearerToken(header string) (string, bool) {
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+func basicCredentials(header string) (string, string, bool) {
+	scheme, encoded, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// UnaryAuth reads a bearer token or basic credentials from the
+// authorization metadata and checks the scope of the called method. It has
+// to run before UnaryRateLimit, so limits are counted per principal.
+// Clients failing too often get ResourceExhausted instead of
+// Unauthenticated.
+func UnaryAuth(authenticators Authenticators) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		scope, ok := grpcScopes[info.FullMethod]
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get("authorization"); len(values) > 0 {
+				principal, err := authenticators.authenticate(values[0])
+				if err != nil {
+					if decision := authenticators.limitFailure(err, values[0], grpcIdentity(ctx)); !decision.Allowed {
+						return nil, grpcRateLimited(ctx, decision)
+					}
+					return nil, grpcError(ctx, err)
+				}
+				ctx = withPrincipal(ctx, principal)
+			}
+		}
+		if err := authorize(ctx, scope); err != nil {
+			return nil, grpcError(ctx, err)
+		}
+		return handler(ctx, req)
+	}
+}
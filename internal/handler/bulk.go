@@ -0,0 +1,476 @@
+package handler
+
+import (
+	"OZON_test/internal/storage"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const maxBulkBodySize = 32 << 20
+
+// maxBatchAttempts bounds how often a bulk request is deduplicated again
+// when concurrent requests keep taking its keys.
+const maxBatchAttempts = 3
+
+var (
+	errTooManyItems         = errors.New("too many items")
+	errUnsupportedMediaType = errors.New("unsupported media type")
+)
+
+// BulkConfig limits bulk shortening. MaxItems caps the number of URLs in a
+// single request and Concurrency the number of URLs validated at once.
+type BulkConfig struct {
+	MaxItems    int
+	Concurrency int
+}
+
+func DefaultBulkConfig() BulkConfig {
+	return BulkConfig{MaxItems: 1000, Concurrency: 8}
+}
+
+func (h *Handlers) SetBulkConfig(cfg BulkConfig) {
+	h.bulk = cfg
+}
+
+type bulkResult struct {
+	Index    int            `json:"index"`
+	Url      string         `json:"url"`
+	Key      string         `json:"key,omitempty"`
+	ShortUrl string         `json:"short_url,omitempty"`
+	Existed  bool           `json:"existed,omitempty"`
+	Error    *errorResponse `json:"error,omitempty"`
+}
+
+type bulkResponse struct {
+	Results []bulkResult `json:"results"`
+	Created int          `json:"created"`
+	Existed int          `json:"existed"`
+	Failed  int          `json:"failed"`
+}
+
+func (h *Handlers) bulkHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBulkBodySize)
+	items, err := readBulkItems(r, h.bulk.MaxItems)
+	if !writeBulkInputError(w, r, err, h.bulk.MaxItems) {
+		return
+	}
+	if len(items) == 0 {
+		writeError(w, r, reasonInvalidRequest, "no urls to shorten")
+		return
+	}
+
+	response := bulkResponse{Results: h.shortenBulk(h.baseUrl(r), items, ownerOf(r.Context(), h.storage))}
+	for _, result := range response.Results {
+		switch {
+		case result.Error != nil:
+			response.Failed++
+		case result.Existed:
+			response.Existed++
+		default:
+			response.Created++
+		}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// shortenBulk shortens items with the same semantics as single requests.
+// Validation and canonicalization run concurrently; the links are then
+// deduplicated in order and new ones are written in one batch. Short URLs
+// are built on base and the new links belong to owner.
+//
+// With a key pool the batch does not cover new links: the pool commits each
+// pooled key on its own, so they are written one by one, are not retried
+// and stay stored when other items fail.
+func (h *Handlers) shortenBulk(base string, items []linkRequest, owner string) []bulkResult {
+	results := make([]bulkResult, len(items))
+	prepared := make([]string, len(items))
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < max(min(h.bulk.Concurrency, len(items)), 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = bulkResult{Index: i, Url: items[i].Url}
+				url, err := h.prepareItem(items[i])
+				if err != nil {
+					results[i].Error = itemError(err)
+					continue
+				}
+				prepared[i] = url
+			}
+		}()
+	}
+	for i := range items {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	for attempt := 1; ; attempt++ {
+		stored := slices.Clone(results)
+		pending := newBatch(h.storage)
+		for i, item := range items {
+			if stored[i].Error != nil {
+				continue
+			}
+			link, existed, err := h.store(pending, prepared[i], item.options(storage.LinkOptions{}), owner)
+			if err != nil {
+				stored[i].Error = itemError(err)
+				continue
+			}
+			stored[i].Key = link.Key
+			stored[i].ShortUrl = shortUrl(base, link.Key)
+			stored[i].Existed = existed
+		}
+
+		err := pending.flush()
+		if errors.Is(err, storage.ErrAlreadyExists) && attempt < maxBatchAttempts {
+			// A concurrent request took one of the keys and the batch was
+			// rolled back; deduplicate again against the stored links.
+			continue
+		}
+		if err != nil {
+			for i := range stored {
+				if stored[i].Error == nil && !stored[i].Existed && pending.has(stored[i].Key) {
+					stored[i] = bulkResult{Index: i, Url: items[i].Url, Error: itemError(err)}
+				}
+			}
+		}
+		return stored
+	}
+}
+
+func readBulkItems(r *http.Request, maxItems int) ([]linkRequest, error) {
+	format, input, err := readBulkInput(r)
+	if err != nil {
+		return nil, err
+	}
+	return parseBulkInput(format, input, maxItems)
+}
+
+// writeBulkInputError answers with the error of reading bulk input, if
+// any, and reports whether the request may proceed.
+func writeBulkInputError(w http.ResponseWriter, r *http.Request, err error, maxItems int) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errTooManyItems):
+		writeError(w, r, reasonTooManyItems, fmt.Sprintf("at most %d urls are allowed per request", maxItems))
+	case errors.Is(err, errUnsupportedMediaType):
+		writeError(w, r, reasonUnsupportedMediaType, "expected application/json, text/csv or multipart/form-data")
+	default:
+		writeError(w, r, reasonInvalidRequest, err.Error())
+	}
+	return false
+}
+
+func (h *Handlers) prepareItem(item linkRequest) (string, error) {
+	if item.Url == "" {
+		return "", newError(reasonInvalidRequest, "missing url")
+	}
+	options := item.options(storage.LinkOptions{})
+	if err := validateOptions(options); err != nil {
+		return "", err
+	}
+	if err := checkOptionsSupport(h.storage, options); err != nil {
+		return "", err
+	}
+	return h.prepare(item.Url)
+}
+
+const (
+	bulkFormatJSON = "json"
+	bulkFormatCSV  = "csv"
+)
+
+// readBulkInput reads a JSON array, a CSV body or a CSV or JSON file
+// uploaded as the "file" form field, returning its format and contents.
+func readBulkInput(r *http.Request) (string, []byte, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "application/json"
+	}
+
+	var (
+		format string
+		body   io.Reader
+	)
+	switch mediaType {
+	case "application/json":
+		format, body = bulkFormatJSON, r.Body
+	case "text/csv":
+		format, body = bulkFormatCSV, r.Body
+	case "multipart/form-data":
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			return "", nil, fmt.Errorf("missing file: %v", err)
+		}
+		defer file.Close()
+
+		format, body = bulkFormatCSV, file
+		fileType, _, _ := mime.ParseMediaType(header.Header.Get("Content-Type"))
+		if fileType == "application/json" || strings.EqualFold(filepath.Ext(header.Filename), ".json") {
+			format = bulkFormatJSON
+		}
+	default:
+		return "", nil, errUnsupportedMediaType
+	}
+
+	input, err := io.ReadAll(body)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read input: %v", err)
+	}
+	return format, input, nil
+}
+
+func parseBulkInput(format string, input []byte, maxItems int) ([]linkRequest, error) {
+	if format == bulkFormatJSON {
+		return parseJSONItems(bytes.NewReader(input), maxItems)
+	}
+	return parseCSVItems(bytes.NewReader(input), maxItems)
+}
+
+func parseJSONItems(r io.Reader, maxItems int) ([]linkRequest, error) {
+	var items []linkRequest
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&items); err != nil {
+		return nil, fmt.Errorf("invalid JSON body: %v", err)
+	}
+	if len(items) > maxItems {
+		return nil, errTooManyItems
+	}
+	return items, nil
+}
+
+// parseCSVItems reads one url per line. The first line is treated as a
+// header if one of its cells is "url"; the header may also name the
+// redirect, preview, query and path columns.
+func parseCSVItems(r io.Reader, maxItems int) ([]linkRequest, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	columns := map[string]int{"url": 0}
+	var items []linkRequest
+	for first := true; ; first = false {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return items, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %v", err)
+		}
+		if first {
+			if header, ok := parseCSVHeader(record); ok {
+				columns = header
+				continue
+			}
+		}
+		if len(items) == maxItems {
+			return nil, errTooManyItems
+		}
+
+		item, err := csvItem(record, columns)
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("invalid CSV on line %d: %v", line, err)
+		}
+		items = append(items, item)
+	}
+}
+
+func parseCSVHeader(record []string) (map[string]int, bool) {
+	columns := make(map[string]int, len(record))
+	for i, name := range record {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	_, ok := columns["url"]
+	return columns, ok
+}
+
+func csvItem(record []string, columns map[string]int) (linkRequest, error) {
+	get := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	parseBool := func(name string) (bool, error) {
+		if raw := get(name); raw != "" {
+			value, err := strconv.ParseBool(raw)
+			if err != nil {
+				return false, fmt.Errorf("invalid %s value %q", name, raw)
+			}
+			return value, nil
+		}
+		return false, nil
+	}
+
+	item := linkRequest{Url: get("url")}
+	if redirect := get("redirect"); redirect != "" {
+		item.Redirect = &redirect
+	}
+	preview, err := parseBool("preview")
+	if err != nil {
+		return linkRequest{}, err
+	}
+	if preview {
+		item.Preview = &preview
+	}
+	path, err := parseBool("path")
+	if err != nil {
+		return linkRequest{}, err
+	}
+	if query := get("query"); query != "" || path {
+		item.Passthrough = &storage.Passthrough{Query: query, Path: path}
+	}
+	return item, nil
+}
+
+// batch buffers links created during a bulk request on top of a storage,
+// so that deduplication sees them before they are written in one go.
+type batch struct {
+	storage.Storage
+	links map[string]storage.Link
+	order []string
+}
+
+func newBatch(st storage.Storage) *batch {
+	return &batch{Storage: st, links: make(map[string]storage.Link)}
+}
+
+func (b *batch) Load(key string) (string, error) {
+	if link, ok := b.links[key]; ok {
+		return link.Url, nil
+	}
+	return b.Storage.Load(key)
+}
+
+func (b *batch) Store(key string, value string) error {
+	if _, ok := b.links[key]; !ok {
+		b.order = append(b.order, key)
+	}
+	b.links[key] = storage.Link{Key: key, Url: value}
+	return nil
+}
+
+func (b *batch) LoadOptions(key string) (storage.LinkOptions, error) {
+	if link, ok := b.links[key]; ok {
+		return link.Options, nil
+	}
+	if optionsStorage, ok := b.Storage.(storage.OptionsStorage); ok {
+		return optionsStorage.LoadOptions(key)
+	}
+	return storage.LinkOptions{}, nil
+}
+
+func (b *batch) StoreOptions(key string, options storage.LinkOptions) error {
+	if link, ok := b.links[key]; ok {
+		link.Options = options
+		b.links[key] = link
+		return nil
+	}
+	optionsStorage, ok := b.Storage.(storage.OptionsStorage)
+	if !ok {
+		return errOptionsNotSupported
+	}
+	return optionsStorage.StoreOptions(key, options)
+}
+
+func (b *batch) LoadOwner(key string) (string, error) {
+	if link, ok := b.links[key]; ok {
+		return link.Owner, nil
+	}
+	if ownerStorage, ok := b.Storage.(storage.OwnerStorage); ok {
+		return ownerStorage.LoadOwner(key)
+	}
+	return "", nil
+}
+
+func (b *batch) StoreOwner(key string, owner string) error {
+	if link, ok := b.links[key]; ok {
+		link.Owner = owner
+		b.links[key] = link
+		return nil
+	}
+	if ownerStorage, ok := b.Storage.(storage.OwnerStorage); ok {
+		return ownerStorage.StoreOwner(key, owner)
+	}
+	return nil
+}
+
+func (b *batch) ListOwned(owner string, after string, limit int) ([]storage.Link, error) {
+	if ownerStorage, ok := b.Storage.(storage.OwnerStorage); ok {
+		return ownerStorage.ListOwned(owner, after, limit)
+	}
+	return nil, nil
+}
+
+func (b *batch) RecentOwned(owner string, limit int) ([]storage.Link, error) {
+	if ownerStorage, ok := b.Storage.(storage.OwnerStorage); ok {
+		return ownerStorage.RecentOwned(owner, limit)
+	}
+	return nil, nil
+}
+
+func (b *batch) FindByUrl(url string) ([]storage.Link, error) {
+	var links []storage.Link
+	if finder, ok := b.Storage.(storage.UrlFinder); ok {
+		stored, err := finder.FindByUrl(url)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, stored...)
+	}
+	for _, key := range b.order {
+		if link := b.links[key]; link.Url == url {
+			links = append(links, link)
+		}
+	}
+	return links, nil
+}
+
+func (b *batch) has(key string) bool {
+	_, ok := b.links[key]
+	return ok
+}
+
+func (b *batch) flush() error {
+	if len(b.order) == 0 {
+		return nil
+	}
+	links := make([]storage.Link, 0, len(b.order))
+	for _, key := range b.order {
+		links = append(links, b.links[key])
+	}
+	if batcher, ok := b.Storage.(storage.Batcher); ok {
+		return batcher.StoreBatch(links)
+	}
+	optionsStorage, _ := b.Storage.(storage.OptionsStorage)
+	for _, link := range links {
+		if err := b.Storage.Store(link.Key, link.Url); err != nil {
+			return err
+		}
+		if err := storeOptions(optionsStorage, link.Key, link.Options); err != nil {
+			return err
+		}
+		if err := storeOwner(b.Storage, link.Key, link.Owner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
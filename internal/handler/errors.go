@@ -0,0 +1,289 @@
+package handler
+
+import (
+	"OZON_test/internal/auth"
+	"OZON_test/internal/jobs"
+	"OZON_test/internal/qr"
+	"OZON_test/internal/storage"
+	"OZON_test/internal/validator"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+)
+
+// Stable error codes. They are returned as "reason" in HTTP problem
+// details and as ErrorInfo.Reason over gRPC, next to the validator reasons.
+const (
+	reasonInvalidRequest       = "INVALID_REQUEST"
+	reasonNotFound             = "NOT_FOUND"
+	reasonUnauthenticated      = "UNAUTHENTICATED"
+	reasonForbidden            = "FORBIDDEN"
+	reasonAlreadyExists        = "ALREADY_EXISTS"
+	reasonMethodNotAllowed     = "METHOD_NOT_ALLOWED"
+	reasonNotSupported         = "NOT_SUPPORTED"
+	reasonDestinationBlocked   = "DESTINATION_BLOCKED"
+	reasonTooManyItems         = "TOO_MANY_ITEMS"
+	reasonUnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE"
+	reasonQueueFull            = "QUEUE_FULL"
+	reasonJobNotActive         = "JOB_NOT_ACTIVE"
+	reasonJobNotFinished       = "JOB_NOT_FINISHED"
+	reasonKeyGeneration        = "KEY_GENERATION_FAILED"
+	reasonNotReady             = "NOT_READY"
+	reasonRateLimited          = "RATE_LIMITED"
+	reasonInternal             = "INTERNAL"
+)
+
+const (
+	problemContentType = "application/problem+json"
+	problemTypePrefix  = "urn:shortener:error:"
+	errorDomain        = "shortener"
+	requestIDHeader    = "X-Request-ID"
+)
+
+var (
+	errOptionsNotSupported = errors.New("link options are not supported by the storage")
+	errDestinationBlocked  = errors.New("destination is blocked")
+)
+
+// apiError is a failure with a stable code and a message that is safe to
+// show to clients.
+type apiError struct {
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func newError(code string, message string) error {
+	return &apiError{code: code, message: message}
+}
+
+// errorMapping ties a stable code to its HTTP and gRPC statuses and to the
+// domain errors reported with it. message replaces the text of the domain
+// errors when it is not meant for clients.
+type errorMapping struct {
+	code    string
+	title   string
+	status  int
+	grpc    codes.Code
+	errs    []error
+	message string
+}
+
+// errorTable is the single mapping between domain and transport errors.
+// Validator reasons missing from it are reported as invalid requests.
+var errorTable = []errorMapping{
+	{code: reasonInvalidRequest, title: "Invalid request", status: http.StatusBadRequest, grpc: codes.InvalidArgument, errs: []error{qr.ErrInvalidOptions, auth.ErrInvalidScope, auth.ErrInvalidAccount, auth.ErrInvalidCode}},
+	{code: validator.ReasonInvalidUrl, title: "Invalid URL", status: http.StatusBadRequest, grpc: codes.InvalidArgument, errs: []error{errInvalidUrl}},
+	{code: validator.ReasonUrlTooLong, title: "URL is too long", status: http.StatusBadRequest, grpc: codes.InvalidArgument},
+	{code: validator.ReasonSchemeNotAllowed, title: "Scheme is not allowed", status: http.StatusBadRequest, grpc: codes.InvalidArgument},
+	{code: validator.ReasonMissingHost, title: "URL has no host", status: http.StatusBadRequest, grpc: codes.InvalidArgument},
+	{code: validator.ReasonSelfReference, title: "URL points to this service", status: http.StatusBadRequest, grpc: codes.InvalidArgument},
+	{code: validator.ReasonBlocked, title: "URL is blocked", status: http.StatusBadRequest, grpc: codes.InvalidArgument},
+	{code: validator.ReasonInvalidOptions, title: "Invalid link options", status: http.StatusBadRequest, grpc: codes.InvalidArgument},
+	{code: reasonUnauthenticated, title: "Unauthenticated", status: http.StatusUnauthorized, grpc: codes.Unauthenticated, errs: []error{auth.ErrInvalidCredentials, auth.ErrSecondFactorRequired}},
+	{code: reasonForbidden, title: "Forbidden", status: http.StatusForbidden, grpc: codes.PermissionDenied},
+	{code: reasonDestinationBlocked, title: "Destination is blocked", status: http.StatusForbidden, grpc: codes.PermissionDenied, errs: []error{errDestinationBlocked}},
+	{code: reasonNotFound, title: "Not found", status: http.StatusNotFound, grpc: codes.NotFound, errs: []error{storage.ErrNotFound}, message: "link not found"},
+	{code: reasonAlreadyExists, title: "Already exists", status: http.StatusConflict, grpc: codes.AlreadyExists, errs: []error{storage.ErrAlreadyExists, auth.ErrAlreadyEnrolled}},
+	{code: reasonMethodNotAllowed, title: "Method not allowed", status: http.StatusMethodNotAllowed, grpc: codes.Unimplemented},
+	{code: reasonNotSupported, title: "Not supported", status: http.StatusNotImplemented, grpc: codes.Unimplemented, errs: []error{errOptionsNotSupported}},
+	{code: reasonTooManyItems, title: "Too many items", status: http.StatusRequestEntityTooLarge, grpc: codes.InvalidArgument, errs: []error{errTooManyItems}},
+	{code: reasonUnsupportedMediaType, title: "Unsupported media type", status: http.StatusUnsupportedMediaType, grpc: codes.InvalidArgument, errs: []error{errUnsupportedMediaType}},
+	{code: reasonQueueFull, title: "Queue is full", status: http.StatusServiceUnavailable, grpc: codes.Unavailable, errs: []error{jobs.ErrQueueFull, jobs.ErrClosed}},
+	{code: reasonJobNotActive, title: "Job is not active", status: http.StatusConflict, grpc: codes.FailedPrecondition, errs: []error{jobs.ErrNotActive}},
+	{code: reasonJobNotFinished, title: "Job is not finished", status: http.StatusConflict, grpc: codes.FailedPrecondition, errs: []error{jobs.ErrNotFinished}},
+	{code: reasonKeyGeneration, title: "Key generation failed", status: http.StatusInternalServerError, grpc: codes.Internal, errs: []error{errKeyGeneration}, message: "failed to generate key"},
+	{code: reasonRateLimited, title: "Too many requests", status: http.StatusTooManyRequests, grpc: codes.ResourceExhausted},
+	{code: reasonNotReady, title: "Service is not ready", status: http.StatusServiceUnavailable, grpc: codes.Unavailable},
+	{code: reasonInternal, title: "Internal error", status: http.StatusInternalServerError, grpc: codes.Internal, message: "internal error"},
+}
+
+func errorMappingByCode(code string) (errorMapping, bool) {
+	for _, m := range errorTable {
+		if m.code == code {
+			return m, true
+		}
+	}
+	return errorMapping{}, false
+}
+
+// classifyError finds the mapping of err and the message to report. Errors
+// unknown to the table are internal and their text is not exposed.
+func classifyError(err error) (errorMapping, string, string) {
+	var (
+		apiErr        *apiError
+		validationErr *validator.Error
+	)
+	switch {
+	case errors.As(err, &apiErr):
+		if m, ok := errorMappingByCode(apiErr.code); ok {
+			return m, apiErr.code, apiErr.message
+		}
+	case errors.As(err, &validationErr):
+		m, ok := errorMappingByCode(validationErr.Reason)
+		if !ok {
+			m, _ = errorMappingByCode(reasonInvalidRequest)
+		}
+		return m, validationErr.Reason, validationErr.Message
+	}
+
+	for _, m := range errorTable {
+		for _, target := range m.errs {
+			if errors.Is(err, target) {
+				message := m.message
+				if message == "" {
+					message = err.Error()
+				}
+				return m, m.code, message
+			}
+		}
+	}
+	m, _ := errorMappingByCode(reasonInternal)
+	return m, m.code, m.message
+}
+
+// problem is an RFC 7807 problem details object.
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail"`
+	Instance  string `json:"instance,omitempty"`
+	Reason    string `json:"reason"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func newProblem(r *http.Request, err error) problem {
+	m, code, message := classifyError(err)
+	id := requestID(r.Context())
+	if m.grpc == codes.Internal {
+		log.Printf("request %s: %s %s: %v", id, r.Method, r.URL.Path, err)
+	}
+	return problem{
+		Type:      problemTypePrefix + code,
+		Title:     m.title,
+		Status:    m.status,
+		Detail:    message,
+		Instance:  r.URL.Path,
+		Reason:    code,
+		RequestID: id,
+	}
+}
+
+// writeProblem answers with the problem details of err.
+func writeProblem(w http.ResponseWriter, r *http.Request, err error) {
+	p := newProblem(r, err)
+	switch p.Reason {
+	case reasonQueueFull:
+		w.Header().Set("Retry-After", "60")
+	case reasonUnauthenticated:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		log.Println("encode error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, code string, message string) {
+	writeProblem(w, r, newError(code, message))
+}
+
+// itemError describes the failure of a single item of a bulk request.
+func itemError(err error) *errorResponse {
+	m, code, message := classifyError(err)
+	if m.grpc == codes.Internal {
+		log.Println("bulk item error", err)
+	}
+	return &errorResponse{Message: message, Reason: code}
+}
+
+// grpcError converts err to a gRPC status carrying its code in ErrorInfo
+// and the request ID in RequestInfo.
+func grpcError(ctx context.Context, err error) error {
+	m, code, message := classifyError(err)
+	id := requestID(ctx)
+	if m.grpc == codes.Internal {
+		log.Printf("request %s: %v", id, err)
+	}
+
+	details := []protoadapt.MessageV1{&errdetails.ErrorInfo{Reason: code, Domain: errorDomain}}
+	if id != "" {
+		details = append(details, &errdetails.RequestInfo{RequestId: id})
+	}
+	st, detailsErr := status.New(m.grpc, message).WithDetails(details...)
+	if detailsErr != nil {
+		return status.Error(m.grpc, message)
+	}
+	return st.Err()
+}
+
+type requestIDKey struct{}
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID stores the client supplied request ID in ctx, or a new one
+// if it is missing or malformed.
+func withRequestID(ctx context.Context, id string) (context.Context, string) {
+	if !validRequestID.MatchString(id) {
+		b := make([]byte, 16)
+		_, _ = rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	return context.WithValue(ctx, requestIDKey{}, id), id
+}
+
+// requestIDMiddleware tags every request with an ID, echoed in the
+// X-Request-ID response header and in problem details.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, id := withRequestID(r.Context(), r.Header.Get(requestIDHeader))
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// UnaryRequestID is the gRPC counterpart of the HTTP request ID handling:
+// it reads x-request-id from the incoming metadata and sends it back in
+// the response header.
+func UnaryRequestID(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	var incoming string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(strings.ToLower(requestIDHeader)); len(values) > 0 {
+			incoming = values[0]
+		}
+	}
+	ctx, id := withRequestID(ctx, incoming)
+	_ = grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(requestIDHeader), id))
+	return handler(ctx, req)
+}
+
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, reasonNotFound, "no such route")
+}
+
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, reasonMethodNotAllowed, r.Method+" is not allowed here")
+}
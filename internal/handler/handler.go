@@ -1,84 +1,286 @@
 package handler
 
 import (
+	"OZON_test/internal/auth"
+	"OZON_test/internal/publicurl"
+	"OZON_test/internal/ratelimit"
 	"OZON_test/internal/storage"
+	"bytes"
 	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"html/template"
 	"io"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
 
-//go:embed page.html
+//go:embed page.html blocked.html redirect.html preview.html docs.html login.html
 var f embed.FS
 
 const PathToHtml = "page.html"
+const PathToBlockedHtml = "blocked.html"
 
-var ip string
-var port string
+// Options configure the HTTP layer. Generator and Storage are required.
+type Options struct {
+	Generator func(url string, seed int) (string, error)
+	Storage   storage.Storage
+	// Addr is the address Run listens on, ":8080" if empty.
+	Addr string
+	// PathPrefix is the sub-path the handlers are mounted under, e.g. "/s".
+	// It is stripped from incoming requests and prepended to the paths the
+	// handlers generate.
+	PathPrefix string
+	// PublicUrl resolves the base of short links. By default links are
+	// built on http://<Addr><PathPrefix>, with localhost for an empty host.
+	PublicUrl *publicurl.Resolver
+	// Bulk limits bulk requests, DefaultBulkConfig if zero.
+	Bulk BulkConfig
+}
 
-func CreateHandlers(generator func(url string, seed int) (string, error), storage storage.Storage, nip string, nport string) *Handlers {
-	ip = nip
-	port = nport
+// NewHandlers builds the HTTP layer. The returned Handlers is an
+// http.Handler and can be mounted into another router or wrapped with
+// middleware instead of being started with Run.
+func NewHandlers(opts Options) *Handlers {
+	if opts.Addr == "" {
+		opts.Addr = ":8080"
+	}
+	prefix := strings.TrimSuffix(opts.PathPrefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	if opts.PublicUrl == nil {
+		host, port, err := net.SplitHostPort(opts.Addr)
+		if err != nil {
+			host, port = opts.Addr, "80"
+		}
+		if host == "" {
+			host = "localhost"
+		}
+		opts.PublicUrl = publicurl.Static("http://" + net.JoinHostPort(host, port) + prefix)
+	}
+	if opts.Bulk == (BulkConfig{}) {
+		opts.Bulk = DefaultBulkConfig()
+	}
 
 	var r = mux.NewRouter()
 
-	server := &http.Server{
-		Addr:    fmt.Sprintf(":%s", port),
-		Handler: r,
+	h := &Handlers{
+		shortener: shortener{generator: opts.Generator},
+		storage:   opts.Storage,
+		router:    r,
+		prefix:    prefix,
+		publicUrl: opts.PublicUrl,
+		bulk:      opts.Bulk,
+	}
+	h.server = &http.Server{
+		Addr:    opts.Addr,
+		Handler: h,
 	}
 
-	h := &Handlers{generator, storage, server}
-
+	r.Use(requestIDMiddleware, h.authenticate)
+	r.NotFoundHandler = requestIDMiddleware(http.HandlerFunc(notFoundHandler))
+	r.MethodNotAllowedHandler = requestIDMiddleware(http.HandlerFunc(methodNotAllowedHandler))
 	r.HandleFunc("/page", h.pageHandler).Methods(http.MethodGet)
-	r.HandleFunc("/{key}", h.getHandler).Methods(http.MethodGet)
-	r.HandleFunc("/", h.getHandler).Methods(http.MethodGet)
-	r.HandleFunc("/", h.postHandler).Methods(http.MethodPost)
+	r.HandleFunc("/login", h.loginPageHandler).Methods(http.MethodGet)
+	r.HandleFunc("/login", h.loginHandler).Methods(http.MethodPost)
+	r.HandleFunc("/logout", h.logoutHandler).Methods(http.MethodPost)
+	r.HandleFunc("/docs", h.docsHandler).Methods(http.MethodGet)
+	r.HandleFunc("/openapi.json", h.openAPIHandler).Methods(http.MethodGet)
+	r.HandleFunc("/readyz", h.readyHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/health", h.require(auth.ScopeLinksRead, h.unhealthyHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/links", h.limited(ratelimit.ClassCreate, h.require(auth.ScopeLinksCreate, h.createLinkHandler))).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/links", h.require(auth.ScopeLinksRead, h.listLinksHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/links/bulk", h.limited(ratelimit.ClassCreate, h.require(auth.ScopeLinksCreate, h.bulkHandler))).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/links/{key}", h.require(auth.ScopeLinksRead, h.linkHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/links/{key}", h.require(auth.ScopeLinksCreate, h.updateLinkHandler)).Methods(http.MethodPatch)
+	r.HandleFunc("/api/v1/links/{key}", h.require(auth.ScopeLinksDelete, h.deleteLinkHandler)).Methods(http.MethodDelete)
+	r.HandleFunc("/api/v1/links/{key}/health", h.require(auth.ScopeLinksRead, h.linkHealthHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/links/{key}/qr", h.require(auth.ScopeLinksRead, h.qrHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/jobs", h.limited(ratelimit.ClassCreate, h.require(auth.ScopeLinksCreate, h.createJobHandler))).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/jobs/{id}", h.require(auth.ScopeLinksRead, h.jobHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/jobs/{id}", h.require(auth.ScopeLinksCreate, h.cancelJobHandler)).Methods(http.MethodDelete)
+	r.HandleFunc("/api/v1/jobs/{id}/result", h.require(auth.ScopeLinksRead, h.jobResultHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/me/links", h.require(auth.ScopeLinksRead, h.myLinksHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/me/totp", h.totpStatusHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/me/totp", h.enrollTOTPHandler).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/me/totp/confirm", h.confirmTOTPHandler).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/me/totp/disable", h.disableTOTPHandler).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/admin/keys", h.require(auth.ScopeAdmin, h.listKeysHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/admin/keys", h.require(auth.ScopeAdmin, h.createKeyHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/admin/keys/{id}", h.require(auth.ScopeAdmin, h.revokeKeyHandler)).Methods(http.MethodDelete)
+	r.HandleFunc("/api/v1/admin/users", h.require(auth.ScopeAdmin, h.createUserHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/admin/users/{id}/totp", h.require(auth.ScopeAdmin, h.resetTOTPHandler)).Methods(http.MethodDelete)
+	r.HandleFunc("/preview/{key}", h.limited(ratelimit.ClassRedirect, h.previewHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/preview/{key}", h.previewSettingsHandler).Methods(http.MethodPost)
+	r.HandleFunc("/preview/{key}/continue", h.limited(ratelimit.ClassRedirect, h.continueHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/preview/{key}/continue/{suffix:.*}", h.limited(ratelimit.ClassRedirect, h.continueHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/{key:[^/]+}+", h.limited(ratelimit.ClassRedirect, h.previewHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/{key}", h.limited(ratelimit.ClassRedirect, h.getHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/{key}/{suffix:.*}", h.limited(ratelimit.ClassRedirect, h.getHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/", h.limited(ratelimit.ClassRedirect, h.getHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/", h.limited(ratelimit.ClassCreate, h.require(auth.ScopeLinksCreate, h.postHandler))).Methods(http.MethodPost)
+
+	return h
+}
 
-	return &Handlers{generator, storage, server}
+// CreateHandlers is a shorthand for NewHandlers listening on port and
+// building links on http://ip:port.
+func CreateHandlers(generator func(url string, seed int) (string, error), storage storage.Storage, ip string, port string) *Handlers {
+	return NewHandlers(Options{
+		Generator: generator,
+		Storage:   storage,
+		Addr:      ":" + port,
+		PublicUrl: publicurl.Static(fmt.Sprintf("http://%s:%s", ip, port)),
+	})
 }
 
 type Handlers struct {
-	generator func(url string, seed int) (string, error)
-	storage   storage.Storage
-	server    *http.Server
+	shortener
+	storage       storage.Storage
+	server        *http.Server
+	router        *mux.Router
+	prefix        string
+	publicUrl     *publicurl.Resolver
+	health        HealthReporter
+	fallbackUrl   string
+	ready         func() bool
+	limiter       RateLimiter
+	keys          KeyManager
+	tokens        Authenticator
+	users         UserManager
+	sessions      SessionManager
+	totp          SecondFactorManager
+	secureCookies bool
+	bulk          BulkConfig
+	jobs          JobQueue
+	maxJobItems   int
 }
 
-func (h *Handlers) Run() {
-	log.Printf("Starting listening on http://%s:%s\n", ip, port)
-	if err := h.server.ListenAndServe(); err != nil {
-		fmt.Println(err)
+// ServeHTTP strips the path prefix and dispatches the request to the
+// router.
+func (h *Handlers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.prefix != "" {
+		rest, ok := strings.CutPrefix(r.URL.Path, h.prefix)
+		if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+			requestIDMiddleware(http.HandlerFunc(notFoundHandler)).ServeHTTP(w, r)
+			return
+		}
+		if rest == "" {
+			rest = "/"
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = rest
+		r2.URL.RawPath = ""
+		r = r2
 	}
+	h.router.ServeHTTP(w, r)
+}
+
+// path turns a route path into the path clients should request.
+func (h *Handlers) path(route string) string {
+	return h.prefix + route
+}
+
+// Run listens on Options.Addr until Close is called.
+func (h *Handlers) Run() error {
+	log.Printf("Starting listening on %s, short links at %s\n", h.server.Addr, h.baseUrl(nil))
+	if err := h.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests
+// until ctx is done.
+func (h *Handlers) Shutdown(ctx context.Context) error {
+	return h.server.Shutdown(ctx)
 }
 
 func (h *Handlers) Close() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if err := h.server.Shutdown(ctx); err != nil {
+	if err := h.Shutdown(ctx); err != nil {
 		fmt.Println("Server shutdown error:", err)
 	} else {
 		fmt.Println("Server gracefully stopped")
 	}
 }
 
-func (h *Handlers) pageHandler(w http.ResponseWriter, _ *http.Request) {
+// SetPublicUrl sets the resolver of the address short links are served
+// from. It is used for every short URL the handlers return.
+func (h *Handlers) SetPublicUrl(resolver *publicurl.Resolver) {
+	h.publicUrl = resolver
+}
+
+func (h *Handlers) baseUrl(r *http.Request) string {
+	return h.publicUrl.Base(r)
+}
+
+func shortUrl(base string, key string) string {
+	return base + "/" + key
+}
+
+func (h *Handlers) pageHandler(w http.ResponseWriter, r *http.Request) {
 	htmlPage, _ := fs.ReadFile(f, PathToHtml)
 
 	data := struct {
-		IP   string
-		PORT string
-	}{IP: ip, PORT: port}
-	err := template.Must(template.New("page").Parse(string(htmlPage))).Execute(w, data)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("execution error %s", err), http.StatusInternalServerError)
+		BaseURL    string
+		User       string
+		CSRF       string
+		LoginPath  string
+		LogoutPath string
+		Links      []linkResponse
+	}{BaseURL: h.baseUrl(r)}
+	if h.sessions != nil {
+		data.LoginPath, data.LogoutPath = h.path("/login"), h.path("/logout")
+		if session, ok := sessionFromContext(r.Context()); ok {
+			principal, _ := auth.FromContext(r.Context())
+			data.User, data.CSRF = principal.Name, session.CSRF
+			data.Links = h.recentLinksOf(principal, data.BaseURL)
+		}
+	}
+	var page bytes.Buffer
+	if err := template.Must(template.New("page").Parse(string(htmlPage))).Execute(&page, data); err != nil {
+		writeProblem(w, r, fmt.Errorf("execution error: %w", err))
+		return
+	}
+	if _, err := page.WriteTo(w); err != nil {
+		log.Println("write error", err)
+	}
+}
+
+func (h *Handlers) blockedHandler(w http.ResponseWriter, r *http.Request, key string, url string) {
+	htmlPage, _ := fs.ReadFile(f, PathToBlockedHtml)
+
+	data := struct {
+		Key string
+		URL string
+	}{Key: key, URL: url}
+
+	var page bytes.Buffer
+	if err := template.Must(template.New("blocked").Parse(string(htmlPage))).Execute(&page, data); err != nil {
+		writeProblem(w, r, fmt.Errorf("execution error: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	if _, err := page.WriteTo(w); err != nil {
+		log.Println("write error", err)
 	}
 }
 
@@ -87,31 +289,126 @@ func (h *Handlers) getHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["key"]
 	if key == "" {
-		http.Error(w, "Missing key parameter", http.StatusBadRequest)
+		writeError(w, r, reasonInvalidRequest, "missing key")
 		return
 	}
 
+	redirectURL, options, ok := h.resolve(w, r, key, vars["suffix"])
+	if !ok {
+		return
+	}
+
+	if options.Preview || alwaysPreview(r) {
+		h.previewPage(w, r, key, redirectURL, h.path(continuePath(key, vars["suffix"], r.URL.RawQuery)))
+		return
+	}
+
+	h.follow(w, r, key, redirectURL, options)
+}
+
+// resolve builds the final destination of a request to key. When there is
+// none it writes the error, warning or fallback response itself and
+// returns false.
+func (h *Handlers) resolve(w http.ResponseWriter, r *http.Request, key string, suffix string) (string, storage.LinkOptions, bool) {
 	redirectURL, err := h.storage.Load(key)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Cannot found key %v", err), http.StatusNotFound)
-		return
+		writeError(w, r, reasonNotFound, "link not found")
+		return "", storage.LinkOptions{}, false
+	}
+
+	if rule, ok := h.blocked(redirectURL); ok {
+		log.Printf("blocked redirect %s -> %s by rule %q", key, redirectURL, rule)
+		h.blockedHandler(w, r, key, redirectURL)
+		return "", storage.LinkOptions{}, false
+	}
+
+	if h.fallbackUrl != "" && h.health != nil && h.health.Dead(key) {
+		log.Printf("dead link %s -> %s, redirecting to fallback", key, redirectURL)
+		h.redirect(w, r, h.fallbackUrl, storage.RedirectFound)
+		return "", storage.LinkOptions{}, false
 	}
 
 	if !strings.Contains(redirectURL, "://") {
 		redirectURL = "//" + redirectURL
 	}
+
+	options := loadOptions(h.storage, key)
+	if suffix != "" && !options.Passthrough.Path {
+		writeError(w, r, reasonNotFound, "link not found")
+		return "", storage.LinkOptions{}, false
+	}
+
+	redirectURL, err = applyPassthrough(redirectURL, r.URL.Query(), suffix, options.Passthrough)
+	if err != nil {
+		writeProblem(w, r, fmt.Errorf("invalid destination: %w", err))
+		return "", storage.LinkOptions{}, false
+	}
+	if rule, ok := h.blocked(redirectURL); ok {
+		log.Printf("blocked redirect %s -> %s by rule %q", key, redirectURL, rule)
+		h.blockedHandler(w, r, key, redirectURL)
+		return "", storage.LinkOptions{}, false
+	}
+	return redirectURL, options, true
+}
+
+// follow counts a click on key and redirects to its destination.
+func (h *Handlers) follow(w http.ResponseWriter, r *http.Request, key string, redirectURL string, options storage.LinkOptions) {
+	if stats, ok := h.storage.(storage.StatsStorage); ok {
+		if err := stats.RecordClick(key); err != nil {
+			log.Printf("failed to record click on %s: %v", key, err)
+		}
+	}
+
 	log.Println(redirectURL)
-	http.Redirect(w, r, redirectURL, http.StatusFound)
+	h.redirect(w, r, redirectURL, options.Redirect)
 }
 
-func (h *Handlers) postHandler(w http.ResponseWriter, r *http.Request) {
-	type RequestData struct {
-		Url string `json:"url"`
+func loadOptions(st storage.Storage, key string) storage.LinkOptions {
+	optionsStorage, ok := st.(storage.OptionsStorage)
+	if !ok {
+		return storage.LinkOptions{}
+	}
+	options, err := optionsStorage.LoadOptions(key)
+	if err != nil {
+		log.Printf("failed to load options of %s: %v", key, err)
+		return storage.LinkOptions{}
 	}
+	return options
+}
+
+func loadOwner(st storage.Storage, key string) string {
+	ownerStorage, ok := st.(storage.OwnerStorage)
+	if !ok {
+		return ""
+	}
+	owner, err := ownerStorage.LoadOwner(key)
+	if err != nil {
+		log.Printf("failed to load owner of %s: %v", key, err)
+		return ""
+	}
+	return owner
+}
 
+// shortenRequest and shortenResponse are the bodies of the original
+// POST / endpoint, kept as is for existing clients.
+type shortenRequest struct {
+	Url         string              `json:"url"`
+	Passthrough storage.Passthrough `json:"passthrough,omitempty"`
+	Redirect    string              `json:"redirect,omitempty"`
+	Preview     bool                `json:"preview,omitempty"`
+	Qr          bool                `json:"qr,omitempty"`
+}
+
+type shortenResponse struct {
+	Message string `json:"message"`
+	URL     string `json:"URL"`
+	Qr      string `json:"qr,omitempty"`
+}
+
+func (h *Handlers) postHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		writeError(w, r, reasonInvalidRequest, "failed to read request body")
 		return
 	}
 
@@ -122,59 +419,43 @@ func (h *Handlers) postHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}(r.Body)
 
-	data := RequestData{}
+	data := shortenRequest{}
 
 	if err := json.Unmarshal(body, &data); err != nil {
-		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		writeError(w, r, reasonInvalidRequest, "invalid JSON body: "+err.Error())
 		return
 	}
 	if data.Url == "" {
-		http.Error(w, "Missing url parameter", http.StatusBadRequest)
+		writeError(w, r, reasonInvalidRequest, "missing url")
+		return
+	}
+	link, existed, err := h.shorten(h.storage, data.Url, storage.LinkOptions{
+		Passthrough: data.Passthrough,
+		Redirect:    data.Redirect,
+		Preview:     data.Preview,
+	}, ownerOf(r.Context(), h.storage))
+	if err != nil {
+		writeProblem(w, r, err)
 		return
 	}
-	res := ""
-	for i := 0; ; i++ {
-		key, err := h.generator(data.Url, i)
-		if err != nil {
-			http.Error(w, "Failed to generate key", http.StatusInternalServerError)
-			return
-		}
 
-		v, err := h.storage.Load(key)
-		if err != nil {
-			res = key
-			err = h.storage.Store(key, data.Url)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Failed to store key %v", err), http.StatusInternalServerError)
-			}
-			break
-		}
+	message := "Data received successfully"
+	if existed {
+		message = "Data already received"
+	}
 
-		if v == data.Url {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			response := map[string]interface{}{
-				"message": "Data already received",
-				"URL":     fmt.Sprintf(`http://%s:%s/%s`, ip, port, key),
-			}
-
-			err := json.NewEncoder(w).Encode(response)
-			if err != nil {
-				http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
-				return
-			}
+	base := h.baseUrl(r)
+	response := shortenResponse{Message: message, URL: shortUrl(base, link.Key)}
+	if data.Qr {
+		if response.Qr, err = qrDataUri(base, link.Key); err != nil {
+			writeProblem(w, r, err)
 			return
 		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	response := map[string]interface{}{
-		"message": "Data received successfully",
-		"URL":     fmt.Sprintf(`http://%s:%s/%s`, ip, port, res),
-	}
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
-		return
+		log.Println("encode error", err)
 	}
 }
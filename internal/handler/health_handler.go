@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"OZON_test/internal/storage"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"time"
+)
+
+const defaultHealthPageSize = 100
+
+// HealthReporter exposes the results of destination health checks.
+type HealthReporter interface {
+	Health(key string) (storage.LinkHealth, error)
+	Unhealthy(after string, limit int) ([]storage.LinkHealth, error)
+	Dead(key string) bool
+}
+
+type healthResponse struct {
+	Key                 string    `json:"key"`
+	Status              int       `json:"status"`
+	Error               string    `json:"error,omitempty"`
+	CheckedAt           time.Time `json:"checked_at"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Dead                bool      `json:"dead"`
+}
+
+type healthListResponse struct {
+	Links []healthResponse `json:"links"`
+	Next  string           `json:"next,omitempty"`
+}
+
+type readinessResponse struct {
+	Status string `json:"status"`
+}
+
+// SetReadiness makes /readyz answer 503 while ready returns false, e.g.
+// during shutdown. Without it the handlers are always ready.
+func (h *Handlers) SetReadiness(ready func() bool) {
+	h.ready = ready
+}
+
+func (h *Handlers) readyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if h.ready != nil && !h.ready() {
+		writeError(w, r, reasonNotReady, "service is not ready")
+		return
+	}
+	writeJSON(w, http.StatusOK, readinessResponse{Status: "ready"})
+}
+
+// SetHealth enables the health API. When fallbackUrl is not empty, redirects
+// of dead links go to fallbackUrl instead of the stored destination.
+func (h *Handlers) SetHealth(health HealthReporter, fallbackUrl string) {
+	h.health = health
+	h.fallbackUrl = fallbackUrl
+}
+
+func (h *Handlers) newHealthResponse(health storage.LinkHealth) healthResponse {
+	return healthResponse{
+		Key:                 health.Key,
+		Status:              health.Status,
+		Error:               health.Error,
+		CheckedAt:           health.CheckedAt,
+		ConsecutiveFailures: health.ConsecutiveFailures,
+		Dead:                h.health.Dead(health.Key),
+	}
+}
+
+func (h *Handlers) linkHealthHandler(w http.ResponseWriter, r *http.Request) {
+	if h.health == nil {
+		writeError(w, r, reasonNotSupported, "health checks are disabled")
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	if _, err := h.storage.Load(key); err != nil {
+		writeError(w, r, reasonNotFound, "link not found")
+		return
+	}
+
+	health, err := h.health.Health(key)
+	if errors.Is(err, storage.ErrNotFound) {
+		writeError(w, r, reasonNotFound, "link has not been checked yet")
+		return
+	}
+	if err != nil {
+		writeProblem(w, r, fmt.Errorf("failed to load health: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.newHealthResponse(health))
+}
+
+func (h *Handlers) unhealthyHandler(w http.ResponseWriter, r *http.Request) {
+	if h.health == nil {
+		writeError(w, r, reasonNotSupported, "health checks are disabled")
+		return
+	}
+
+	limit, ok := parseLimit(r, defaultHealthPageSize)
+	if !ok {
+		writeError(w, r, reasonInvalidRequest, "invalid limit parameter")
+		return
+	}
+
+	unhealthy, err := h.health.Unhealthy(r.URL.Query().Get("after"), limit)
+	if err != nil {
+		writeProblem(w, r, fmt.Errorf("failed to list health: %w", err))
+		return
+	}
+
+	response := healthListResponse{Links: make([]healthResponse, 0, len(unhealthy))}
+	for _, health := range unhealthy {
+		response.Links = append(response.Links, h.newHealthResponse(health))
+	}
+	if len(unhealthy) == limit {
+		response.Next = unhealthy[len(unhealthy)-1].Key
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func writeJSON(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Println("encode error", err)
+	}
+}
@@ -0,0 +1,241 @@
+package handler
+
+import (
+	"OZON_test/internal/jobs"
+	"OZON_test/internal/storage"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"github.com/gorilla/mux"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	maxJobBodySize = 256 << 20
+	jobChunkSize   = 500
+	maxJobErrors   = 20
+)
+
+const jobResultHeader = "index,url,key,short_url,existed,error_reason,error_message\n"
+
+// JobQueue runs bulk shortening in the background.
+type JobQueue interface {
+	Submit(format string, total int, input []byte, owner string) (storage.Job, error)
+	Job(id string) (storage.Job, error)
+	Result(id string) ([]byte, error)
+	Cancel(id string) (storage.Job, error)
+}
+
+type jobResponse struct {
+	ID        string             `json:"id"`
+	Status    string             `json:"status"`
+	Total     int                `json:"total"`
+	Processed int                `json:"processed"`
+	Created   int                `json:"created"`
+	Existed   int                `json:"existed"`
+	Failed    int                `json:"failed"`
+	Errors    []storage.JobError `json:"errors"`
+	Error     string             `json:"error,omitempty"`
+	CreatedAt time.Time          `json:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at"`
+	ResultUrl string             `json:"result_url"`
+}
+
+// SetJobs enables the jobs API. maxItems caps the number of URLs in a job.
+func (h *Handlers) SetJobs(queue JobQueue, maxItems int) {
+	h.jobs = queue
+	h.maxJobItems = maxItems
+}
+
+func (h *Handlers) newJobResponse(job storage.Job) jobResponse {
+	errs := job.Errors
+	if errs == nil {
+		errs = []storage.JobError{}
+	}
+	return jobResponse{
+		ID:        job.ID,
+		Status:    job.Status,
+		Total:     job.Total,
+		Processed: job.Processed,
+		Created:   job.Created,
+		Existed:   job.Existed,
+		Failed:    job.Failed,
+		Errors:    errs,
+		Error:     job.Error,
+		CreatedAt: job.CreatedAt,
+		UpdatedAt: job.UpdatedAt,
+		ResultUrl: h.path("/api/v1/jobs/" + job.ID + "/result"),
+	}
+}
+
+func (h *Handlers) createJobHandler(w http.ResponseWriter, r *http.Request) {
+	if h.jobs == nil {
+		writeError(w, r, reasonNotSupported, "jobs are disabled")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxJobBodySize)
+	format, input, err := readBulkInput(r)
+	if !writeBulkInputError(w, r, err, h.maxJobItems) {
+		return
+	}
+	items, err := parseBulkInput(format, input, h.maxJobItems)
+	if !writeBulkInputError(w, r, err, h.maxJobItems) {
+		return
+	}
+	if len(items) == 0 {
+		writeError(w, r, reasonInvalidRequest, "no urls to shorten")
+		return
+	}
+
+	job, err := h.jobs.Submit(format, len(items), input, ownerOf(r.Context(), h.storage))
+	if err != nil {
+		writeJobError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", h.path("/api/v1/jobs/"+job.ID))
+	writeJSON(w, http.StatusAccepted, h.newJobResponse(job))
+}
+
+func (h *Handlers) jobHandler(w http.ResponseWriter, r *http.Request) {
+	if h.jobs == nil {
+		writeError(w, r, reasonNotSupported, "jobs are disabled")
+		return
+	}
+
+	job, err := h.job(r)
+	if err != nil {
+		writeJobError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.newJobResponse(job))
+}
+
+func (h *Handlers) jobResultHandler(w http.ResponseWriter, r *http.Request) {
+	if h.jobs == nil {
+		writeError(w, r, reasonNotSupported, "jobs are disabled")
+		return
+	}
+
+	job, err := h.job(r)
+	if err != nil {
+		writeJobError(w, r, err)
+		return
+	}
+	result, err := h.jobs.Result(job.ID)
+	if err != nil {
+		writeJobError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="job-`+job.ID+`.csv"`)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(jobResultHeader))
+	_, _ = w.Write(result)
+}
+
+func (h *Handlers) cancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	if h.jobs == nil {
+		writeError(w, r, reasonNotSupported, "jobs are disabled")
+		return
+	}
+
+	job, err := h.job(r)
+	if err != nil {
+		writeJobError(w, r, err)
+		return
+	}
+	job, err = h.jobs.Cancel(job.ID)
+	if err != nil {
+		writeJobError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.newJobResponse(job))
+}
+
+// job loads the job of the request, which only its owner and admins may
+// access.
+func (h *Handlers) job(r *http.Request) (storage.Job, error) {
+	job, err := h.jobs.Job(mux.Vars(r)["id"])
+	if err != nil {
+		return storage.Job{}, err
+	}
+	if err := h.authorizeJob(r.Context(), job); err != nil {
+		return storage.Job{}, err
+	}
+	return job, nil
+}
+
+// writeJobError answers with the problem details of a failed job
+// operation.
+func writeJobError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, storage.ErrNotFound) {
+		err = newError(reasonNotFound, "job not found")
+	}
+	writeProblem(w, r, err)
+}
+
+// ProcessJob shortens the items of a job in chunks, resuming after the
+// items it has already processed. It is meant to be run by jobs.Manager.
+// Jobs run outside of requests, so short URLs use the configured base URL.
+func (h *Handlers) ProcessJob(ctx context.Context, job storage.Job, input []byte, report func(jobs.Progress) error) error {
+	items, err := parseBulkInput(job.Format, input, math.MaxInt)
+	if err != nil {
+		return err
+	}
+
+	base := h.baseUrl(nil)
+	progress := jobs.Progress{
+		Processed: job.Processed,
+		Created:   job.Created,
+		Existed:   job.Existed,
+		Failed:    job.Failed,
+		Errors:    job.Errors,
+	}
+	for start := job.Processed; start < len(items); start += jobChunkSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		end := min(start+jobChunkSize, len(items))
+		var rows bytes.Buffer
+		writer := csv.NewWriter(&rows)
+		for _, result := range h.shortenBulk(base, items[start:end], job.Owner) {
+			index := start + result.Index
+			reason, message := "", ""
+			switch {
+			case result.Error != nil:
+				progress.Failed++
+				reason, message = result.Error.Reason, result.Error.Message
+				if len(progress.Errors) < maxJobErrors {
+					progress.Errors = append(progress.Errors, storage.JobError{
+						Index: index, Url: result.Url, Reason: reason, Message: message,
+					})
+				}
+			case result.Existed:
+				progress.Existed++
+			default:
+				progress.Created++
+			}
+			_ = writer.Write([]string{
+				strconv.Itoa(index), result.Url, result.Key, result.ShortUrl,
+				strconv.FormatBool(result.Existed), reason, message,
+			})
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return err
+		}
+
+		progress.Processed = end
+		progress.Result = rows.Bytes()
+		if err := report(progress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"OZON_test/internal/auth"
+	"OZON_test/internal/storage"
+	"errors"
+	"github.com/gorilla/mux"
+	"net/http"
+	"time"
+)
+
+// KeyManager authenticates API keys and manages them for admins.
+type KeyManager interface {
+	Authenticator
+	Create(name string, scopes []string, ttl time.Duration) (storage.APIKey, string, error)
+	List() ([]storage.APIKey, error)
+	Revoke(id string) error
+}
+
+type apiKeyRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn string   `json:"expires_in,omitempty"`
+}
+
+type apiKeyResponse struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Token     string     `json:"token,omitempty"`
+}
+
+type apiKeyListResponse struct {
+	Keys []apiKeyResponse `json:"keys"`
+}
+
+// SetKeys enables API key authentication. Link management and creation
+// then require a key with the matching scope, while redirects stay open.
+func (h *Handlers) SetKeys(keys KeyManager) {
+	h.keys = keys
+}
+
+// SetTokens enables JWT bearer authentication next to API keys. Subjects
+// own the links they create like user accounts.
+func (h *Handlers) SetTokens(tokens Authenticator) {
+	h.tokens = tokens
+}
+
+func newAPIKeyResponse(key storage.APIKey) apiKeyResponse {
+	response := apiKeyResponse{ID: key.ID, Name: key.Name, Scopes: key.Scopes, CreatedAt: key.CreatedAt}
+	if response.Scopes == nil {
+		response.Scopes = []string{}
+	}
+	if !key.ExpiresAt.IsZero() {
+		response.ExpiresAt = &key.ExpiresAt
+	}
+	return response
+}
+
+func (h *Handlers) createKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if h.keys == nil {
+		writeError(w, r, reasonNotSupported, "API keys are disabled")
+		return
+	}
+
+	var req apiKeyRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if req.Name == "" {
+		writeError(w, r, reasonInvalidRequest, "missing name")
+		return
+	}
+	var ttl time.Duration
+	if req.ExpiresIn != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.ExpiresIn); err != nil || ttl <= 0 {
+			writeError(w, r, reasonInvalidRequest, "invalid expires_in, expected a positive duration like 720h")
+			return
+		}
+	}
+
+	key, token, err := h.keys.Create(req.Name, req.Scopes, ttl)
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	response := newAPIKeyResponse(key)
+	response.Token = token
+	w.Header().Set("Location", h.path("/api/v1/admin/keys/"+key.ID))
+	writeJSON(w, http.StatusCreated, response)
+}
+
+func (h *Handlers) listKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if h.keys == nil {
+		writeError(w, r, reasonNotSupported, "API keys are disabled")
+		return
+	}
+
+	keys, err := h.keys.List()
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	response := apiKeyListResponse{Keys: make([]apiKeyResponse, 0, len(keys))}
+	for _, key := range keys {
+		response.Keys = append(response.Keys, newAPIKeyResponse(key))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h *Handlers) revokeKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if h.keys == nil {
+		writeError(w, r, reasonNotSupported, "API keys are disabled")
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	if id == auth.BootstrapID {
+		writeError(w, r, reasonInvalidRequest, "the bootstrap key is configured, not stored")
+		return
+	}
+	err := h.keys.Revoke(id)
+	if errors.Is(err, storage.ErrNotFound) {
+		writeError(w, r, reasonNotFound, "API key not found")
+		return
+	}
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,728 @@
+package handler
+
+import (
+	"OZON_test/internal/auth"
+	"OZON_test/internal/qr"
+	"OZON_test/internal/storage"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// apiOperation describes one route for the OpenAPI document. Request and
+// response bodies are given as values of the handler types, so the schemas
+// are derived from the same structs the handlers encode and decode.
+type apiOperation struct {
+	method      string
+	path        string
+	tag         string
+	summary     string
+	description string
+	params      []apiParam
+	body        []apiContent
+	partialBody bool
+	responses   []apiResponse
+	// scope is required from the caller when authentication is enabled.
+	scope string
+}
+
+type apiParam struct {
+	name        string
+	in          string
+	schema      map[string]any
+	description string
+}
+
+type apiContent struct {
+	mediaType string
+	value     any
+	schema    map[string]any
+}
+
+type apiResponse struct {
+	status      int
+	description string
+	content     []apiContent
+	headers     []string
+}
+
+var (
+	keyParam    = apiParam{name: "key", in: "path", schema: stringSchema(), description: "Short link key"}
+	suffixParam = apiParam{name: "suffix", in: "path", schema: stringSchema(), description: "Extra path forwarded to the destination when path passthrough is enabled"}
+	jobIDParam  = apiParam{name: "id", in: "path", schema: stringSchema(), description: "Job id"}
+	keyIDParam  = apiParam{name: "id", in: "path", schema: stringSchema(), description: "API key id"}
+	userIDParam = apiParam{name: "id", in: "path", schema: stringSchema(), description: "User id"}
+	afterParam  = apiParam{name: "after", in: "query", schema: stringSchema(), description: "Return keys after this one"}
+	limitParam  = apiParam{name: "limit", in: "query", schema: map[string]any{"type": "integer", "minimum": 1}, description: "Page size, 100 by default"}
+)
+
+var (
+	jsonBody    = func(value any) []apiContent { return []apiContent{{mediaType: "application/json", value: value}} }
+	htmlBody    = []apiContent{{mediaType: "text/html", schema: stringSchema()}}
+	errorBody   = []apiContent{{mediaType: problemContentType, value: problem{}}}
+	redirectTo  = apiResponse{status: http.StatusFound, description: "Redirect to the destination; 301, 307 and 308 are used by links with such a redirect mode", headers: []string{"Location"}}
+	redirectAlt = apiResponse{status: http.StatusOK, description: "HTML page redirecting with meta refresh or JavaScript", content: htmlBody}
+	notFound    = apiResponse{status: http.StatusNotFound, description: "Link not found", content: errorBody}
+	invalid     = apiResponse{status: http.StatusBadRequest, description: "Invalid request", content: errorBody}
+	internal    = apiResponse{status: http.StatusInternalServerError, description: "Internal error", content: errorBody}
+	unsupported = apiResponse{status: http.StatusNotImplemented, description: "Not supported by the storage or disabled", content: errorBody}
+	blocked     = apiResponse{status: http.StatusForbidden, description: "Destination is blocked", content: htmlBody}
+	noKey       = apiResponse{status: http.StatusUnauthorized, description: "Missing, invalid or expired credentials", content: errorBody, headers: []string{"WWW-Authenticate"}}
+	noScope     = apiResponse{status: http.StatusForbidden, description: "The caller lacks the required scope or does not own the link", content: errorBody}
+	notUser     = apiResponse{status: http.StatusForbidden, description: "The caller is not a user account", content: errorBody}
+	limited     = apiResponse{status: http.StatusTooManyRequests, description: "Rate limit exceeded", content: errorBody, headers: []string{"Retry-After"}}
+)
+
+// bulkBody lists the accepted bulk input formats.
+func bulkBody() []apiContent {
+	return []apiContent{
+		{mediaType: "application/json", value: []linkRequest{}},
+		{mediaType: "text/csv", schema: map[string]any{
+			"type":        "string",
+			"description": "One url per line, optionally with a header naming the url, redirect, preview, query and path columns",
+		}},
+		{mediaType: "multipart/form-data", schema: map[string]any{
+			"type":     "object",
+			"required": []string{"file"},
+			"properties": map[string]any{
+				"file": map[string]any{"type": "string", "format": "binary", "description": "CSV or JSON file"},
+			},
+		}},
+	}
+}
+
+var apiOperations = []apiOperation{
+	{
+		method: http.MethodGet, path: "/page", tag: "pages",
+		summary:   "Web page for shortening links",
+		responses: []apiResponse{{status: http.StatusOK, description: "HTML page", content: htmlBody}},
+	},
+	{
+		method: http.MethodGet, path: "/login", tag: "pages",
+		summary:   "Sign-in page of the web page",
+		responses: []apiResponse{{status: http.StatusOK, description: "HTML page", content: htmlBody}, {status: http.StatusSeeOther, description: "Already signed in, redirect to /page", headers: []string{"Location"}}, unsupported},
+	},
+	{
+		method: http.MethodPost, path: "/login", tag: "pages",
+		summary: "Sign in with a username and password",
+		description: "Form fields username, password and csrf_token from the sign-in page, and code for accounts with two-factor authentication. " +
+			"Sets an HttpOnly session cookie.",
+		responses: []apiResponse{
+			{status: http.StatusSeeOther, description: "Signed in, redirect to /page", headers: []string{"Location", "Set-Cookie"}},
+			{status: http.StatusUnauthorized, description: "Wrong username, password or code, the sign-in page again", content: htmlBody},
+			{status: http.StatusForbidden, description: "Missing or stale CSRF token, the sign-in page again", content: htmlBody},
+			unsupported,
+		},
+	},
+	{
+		method: http.MethodPost, path: "/logout", tag: "pages",
+		summary:     "Sign out",
+		description: "Form field csrf_token or the X-CSRF-Token header must hold the CSRF token of the session.",
+		responses: []apiResponse{
+			{status: http.StatusSeeOther, description: "Signed out, redirect to /login", headers: []string{"Location", "Set-Cookie"}},
+			{status: http.StatusForbidden, description: "Missing or wrong CSRF token", content: errorBody},
+			unsupported,
+		},
+	},
+	{
+		method: http.MethodGet, path: "/docs", tag: "pages",
+		summary:   "Interactive API documentation",
+		responses: []apiResponse{{status: http.StatusOK, description: "HTML page", content: htmlBody}},
+	},
+	{
+		method: http.MethodGet, path: "/openapi.json", tag: "pages",
+		summary:   "This document",
+		responses: []apiResponse{{status: http.StatusOK, description: "OpenAPI 3 document", content: []apiContent{{mediaType: "application/json", schema: map[string]any{"type": "object"}}}}},
+	},
+	{
+		method: http.MethodPost, path: "/", tag: "legacy",
+		scope:       auth.ScopeLinksCreate,
+		summary:     "Shorten a link",
+		description: "Original endpoint, kept for existing clients. New clients should use POST /api/v1/links.",
+		body:        jsonBody(shortenRequest{}),
+		responses: []apiResponse{
+			{status: http.StatusOK, description: "Short link", content: jsonBody(shortenResponse{})},
+			invalid, internal,
+			limited,
+		},
+	},
+	{
+		method: http.MethodGet, path: "/", tag: "redirects",
+		summary:   "Missing key",
+		responses: []apiResponse{{status: http.StatusBadRequest, description: "Missing key", content: errorBody}, limited},
+	},
+	{
+		method: http.MethodGet, path: "/{key}", tag: "redirects",
+		summary:   "Follow a short link",
+		params:    []apiParam{keyParam},
+		responses: []apiResponse{redirectTo, redirectAlt, blocked, notFound, limited},
+	},
+	{
+		method: http.MethodGet, path: "/{key}/{suffix}", tag: "redirects",
+		summary:   "Follow a short link with an extra path",
+		params:    []apiParam{keyParam, suffixParam},
+		responses: []apiResponse{redirectTo, redirectAlt, blocked, notFound, limited},
+	},
+	{
+		method: http.MethodGet, path: "/{key}+", tag: "redirects",
+		summary:   "Preview a short link",
+		params:    []apiParam{keyParam},
+		responses: []apiResponse{{status: http.StatusOK, description: "Preview page", content: htmlBody}, blocked, notFound, limited},
+	},
+	{
+		method: http.MethodGet, path: "/preview/{key}", tag: "redirects",
+		summary:   "Preview a short link",
+		params:    []apiParam{keyParam},
+		responses: []apiResponse{{status: http.StatusOK, description: "Preview page", content: htmlBody}, blocked, notFound, limited},
+	},
+	{
+		method: http.MethodPost, path: "/preview/{key}", tag: "redirects",
+		summary: "Always or never show previews in this browser",
+		params:  []apiParam{keyParam},
+		body: []apiContent{{mediaType: "application/x-www-form-urlencoded", schema: map[string]any{
+			"type":       "object",
+			"properties": map[string]any{"always": map[string]any{"type": "string", "enum": []string{"0", "1"}}},
+		}}},
+		responses: []apiResponse{
+			{status: http.StatusSeeOther, description: "Back to the preview page", headers: []string{"Location", "Set-Cookie"}},
+			invalid,
+		},
+	},
+	{
+		method: http.MethodGet, path: "/preview/{key}/continue", tag: "redirects",
+		summary:   "Continue from the preview page to the destination",
+		params:    []apiParam{keyParam},
+		responses: []apiResponse{redirectTo, redirectAlt, blocked, notFound, limited},
+	},
+	{
+		method: http.MethodGet, path: "/preview/{key}/continue/{suffix}", tag: "redirects",
+		summary:   "Continue from the preview page to the destination with an extra path",
+		params:    []apiParam{keyParam, suffixParam},
+		responses: []apiResponse{redirectTo, redirectAlt, blocked, notFound, limited},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/links", tag: "links",
+		scope:   auth.ScopeLinksCreate,
+		summary: "Create a link",
+		body:    jsonBody(linkRequest{}),
+		responses: []apiResponse{
+			{status: http.StatusCreated, description: "Link created", content: jsonBody(linkResponse{}), headers: []string{"Location"}},
+			{status: http.StatusOK, description: "Link already existed", content: jsonBody(linkResponse{}), headers: []string{"Location"}},
+			invalid, unsupported, internal,
+			limited,
+		},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/links", tag: "links",
+		scope:     auth.ScopeLinksRead,
+		summary:   "List links ordered by key",
+		params:    []apiParam{afterParam, limitParam},
+		responses: []apiResponse{{status: http.StatusOK, description: "Page of links", content: jsonBody(linkListResponse{})}, invalid, unsupported, internal},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/links/bulk", tag: "links",
+		scope:   auth.ScopeLinksCreate,
+		summary: "Shorten many links at once",
+		description: "New links are written in one transaction. With a key pool every new link is committed " +
+			"separately instead, so links created before a failure are kept.",
+		body: bulkBody(),
+		responses: []apiResponse{
+			{status: http.StatusOK, description: "Result for every item in input order", content: jsonBody(bulkResponse{})},
+			invalid,
+			{status: http.StatusRequestEntityTooLarge, description: "Too many items", content: errorBody},
+			{status: http.StatusUnsupportedMediaType, description: "Unsupported content type", content: errorBody},
+			limited,
+		},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/links/{key}", tag: "links",
+		scope:     auth.ScopeLinksRead,
+		summary:   "Get a link",
+		params:    []apiParam{keyParam},
+		responses: []apiResponse{{status: http.StatusOK, description: "Link", content: jsonBody(linkResponse{})}, notFound, internal},
+	},
+	{
+		method: http.MethodPatch, path: "/api/v1/links/{key}", tag: "links",
+		scope:       auth.ScopeLinksCreate,
+		summary:     "Change the destination or options of a link",
+		description: "Only the owner of the link or an admin may change it when authentication is enabled.",
+		params:      []apiParam{keyParam},
+		body:        jsonBody(linkRequest{}),
+		partialBody: true,
+		responses:   []apiResponse{{status: http.StatusOK, description: "Updated link", content: jsonBody(linkResponse{})}, invalid, notFound, unsupported, internal},
+	},
+	{
+		method: http.MethodDelete, path: "/api/v1/links/{key}", tag: "links",
+		scope:       auth.ScopeLinksDelete,
+		summary:     "Delete a link",
+		description: "Only the owner of the link or an admin may delete it when authentication is enabled.",
+		params:      []apiParam{keyParam},
+		responses:   []apiResponse{{status: http.StatusNoContent, description: "Link deleted"}, notFound, unsupported, internal},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/links/{key}/health", tag: "health",
+		scope:     auth.ScopeLinksRead,
+		summary:   "Latest health check of a link destination",
+		params:    []apiParam{keyParam},
+		responses: []apiResponse{{status: http.StatusOK, description: "Health", content: jsonBody(healthResponse{})}, notFound},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/links/{key}/qr", tag: "links",
+		scope:   auth.ScopeLinksRead,
+		summary: "QR code of a short link",
+		params: []apiParam{
+			keyParam,
+			{name: "format", in: "query", schema: enumSchema(qr.FormatPNG, qr.FormatSVG)},
+			{name: "size", in: "query", schema: map[string]any{"type": "integer", "minimum": qr.MinSize, "maximum": qr.MaxSize}},
+			{name: "level", in: "query", schema: enumSchema("L", "M", "Q", "H")},
+			{name: "margin", in: "query", schema: map[string]any{"type": "integer", "minimum": 0, "maximum": qr.MaxMargin}},
+			{name: "fg", in: "query", schema: stringSchema(), description: "Foreground color, #rgb or #rrggbb"},
+			{name: "bg", in: "query", schema: stringSchema(), description: "Background color, #rgb or #rrggbb"},
+		},
+		responses: []apiResponse{
+			{status: http.StatusOK, description: "QR code image", content: []apiContent{
+				{mediaType: "image/png", schema: map[string]any{"type": "string", "format": "binary"}},
+				{mediaType: "image/svg+xml", schema: stringSchema()},
+			}},
+			invalid, notFound, internal,
+		},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/health", tag: "health",
+		scope:     auth.ScopeLinksRead,
+		summary:   "List links with failing destinations",
+		params:    []apiParam{afterParam, limitParam},
+		responses: []apiResponse{{status: http.StatusOK, description: "Page of unhealthy links", content: jsonBody(healthListResponse{})}, notFound},
+	},
+	{
+		method: http.MethodGet, path: "/readyz", tag: "health",
+		summary:     "Readiness probe",
+		description: "Answers 503 with NOT_READY once the service starts shutting down.",
+		responses: []apiResponse{
+			{status: http.StatusOK, description: "Ready to accept traffic", content: jsonBody(readinessResponse{})},
+			{status: http.StatusServiceUnavailable, description: "Not ready", content: errorBody},
+		},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/jobs", tag: "jobs",
+		scope:   auth.ScopeLinksCreate,
+		summary: "Shorten many links in the background",
+		body:    bulkBody(),
+		responses: []apiResponse{
+			{status: http.StatusAccepted, description: "Job queued", content: jsonBody(jobResponse{}), headers: []string{"Location"}},
+			invalid,
+			{status: http.StatusRequestEntityTooLarge, description: "Too many items", content: errorBody},
+			{status: http.StatusUnsupportedMediaType, description: "Unsupported content type", content: errorBody},
+			unsupported,
+			{status: http.StatusServiceUnavailable, description: "Queue is full", content: errorBody, headers: []string{"Retry-After"}},
+			limited,
+		},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/jobs/{id}", tag: "jobs",
+		scope:     auth.ScopeLinksRead,
+		summary:   "Job status and progress",
+		params:    []apiParam{jobIDParam},
+		responses: []apiResponse{{status: http.StatusOK, description: "Job", content: jsonBody(jobResponse{})}, {status: http.StatusNotFound, description: "Job not found", content: errorBody}, unsupported},
+	},
+	{
+		method: http.MethodDelete, path: "/api/v1/jobs/{id}", tag: "jobs",
+		scope:   auth.ScopeLinksCreate,
+		summary: "Cancel a queued or running job",
+		params:  []apiParam{jobIDParam},
+		responses: []apiResponse{
+			{status: http.StatusOK, description: "Cancelled job", content: jsonBody(jobResponse{})},
+			{status: http.StatusNotFound, description: "Job not found", content: errorBody},
+			{status: http.StatusConflict, description: "Job is already finished", content: errorBody},
+			unsupported,
+		},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/jobs/{id}/result", tag: "jobs",
+		scope:   auth.ScopeLinksRead,
+		summary: "Result of a finished job",
+		params:  []apiParam{jobIDParam},
+		responses: []apiResponse{
+			{status: http.StatusOK, description: "One CSV row per processed item", content: []apiContent{{mediaType: "text/csv", schema: map[string]any{
+				"type":    "string",
+				"example": strings.TrimSpace(jobResultHeader),
+			}}}},
+			{status: http.StatusNotFound, description: "Job not found", content: errorBody},
+			{status: http.StatusConflict, description: "Job is not finished", content: errorBody},
+			unsupported,
+		},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/admin/keys", tag: "admin",
+		scope:   auth.ScopeAdmin,
+		summary: "Issue an API key",
+		description: "The token is returned only once. Scopes are " + strings.Join(auth.Scopes, ", ") +
+			"; admin implies all of them.",
+		body: jsonBody(apiKeyRequest{}),
+		responses: []apiResponse{
+			{status: http.StatusCreated, description: "Key issued", content: jsonBody(apiKeyResponse{}), headers: []string{"Location"}},
+			invalid, unsupported, internal,
+		},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/admin/keys", tag: "admin",
+		scope:     auth.ScopeAdmin,
+		summary:   "List API keys without their tokens",
+		responses: []apiResponse{{status: http.StatusOK, description: "Keys", content: jsonBody(apiKeyListResponse{})}, unsupported, internal},
+	},
+	{
+		method: http.MethodDelete, path: "/api/v1/admin/keys/{id}", tag: "admin",
+		scope:     auth.ScopeAdmin,
+		summary:   "Revoke an API key",
+		params:    []apiParam{keyIDParam},
+		responses: []apiResponse{{status: http.StatusNoContent, description: "Key revoked"}, {status: http.StatusNotFound, description: "Key not found", content: errorBody}, invalid, unsupported, internal},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/admin/users", tag: "admin",
+		scope:   auth.ScopeAdmin,
+		summary: "Create a user account",
+		description: "Users log in with basic credentials and own the links they create. " +
+			"The role is user by default; admins may change and delete any link.",
+		body: jsonBody(userRequest{}),
+		responses: []apiResponse{
+			{status: http.StatusCreated, description: "Account created", content: jsonBody(userResponse{})},
+			invalid,
+			{status: http.StatusConflict, description: "Username is taken", content: errorBody},
+			unsupported, internal,
+		},
+	},
+	{
+		method: http.MethodDelete, path: "/api/v1/admin/users/{id}/totp", tag: "admin",
+		scope:     auth.ScopeAdmin,
+		summary:   "Reset the two-factor authentication of a user",
+		params:    []apiParam{userIDParam},
+		responses: []apiResponse{{status: http.StatusNoContent, description: "Second factor removed"}, {status: http.StatusNotFound, description: "User not found", content: errorBody}, unsupported, internal},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/me/totp", tag: "account",
+		summary:     "Two-factor authentication status of the caller",
+		description: totpDescription,
+		responses:   []apiResponse{{status: http.StatusOK, description: "Status", content: jsonBody(totpStatusResponse{})}, noKey, notUser, unsupported, internal},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/me/totp", tag: "account",
+		summary: "Start enrolling an authenticator app",
+		description: totpDescription + " Returns the secret, its otpauth provisioning URI with a QR code of it and recovery codes. " +
+			"Enrolling again before confirming replaces the secret.",
+		responses: []apiResponse{
+			{status: http.StatusCreated, description: "Pending enrolment, shown only once", content: jsonBody(totpEnrollmentResponse{})},
+			noKey, notUser,
+			{status: http.StatusConflict, description: "Two-factor authentication is already enabled", content: errorBody},
+			unsupported, internal,
+		},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/me/totp/confirm", tag: "account",
+		summary:     "Enable the pending enrolment with a code of the app",
+		description: totpDescription,
+		body:        jsonBody(totpCodeRequest{}),
+		responses:   []apiResponse{{status: http.StatusNoContent, description: "Enabled"}, {status: http.StatusBadRequest, description: "Wrong code or nothing to confirm", content: errorBody}, noKey, notUser, unsupported, internal},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/me/totp/disable", tag: "account",
+		summary:     "Disable two-factor authentication with a code of the app or a recovery code",
+		description: totpDescription,
+		body:        jsonBody(totpCodeRequest{}),
+		responses:   []apiResponse{{status: http.StatusNoContent, description: "Disabled"}, {status: http.StatusBadRequest, description: "Wrong or used code", content: errorBody}, noKey, notUser, unsupported, internal},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/me/links", tag: "links",
+		scope:     auth.ScopeLinksRead,
+		summary:   "List the links of the caller ordered by key",
+		params:    []apiParam{afterParam, limitParam},
+		responses: []apiResponse{{status: http.StatusOK, description: "Page of links", content: jsonBody(linkListResponse{})}, invalid, unsupported, internal},
+	},
+}
+
+const totpDescription = "Requires a user account, signed in with basic credentials or a session; " +
+	"accounts that have to set up two-factor authentication may only use these routes."
+
+// apiEnums restricts string fields of the handler types, keyed by Go type
+// name and JSON field name.
+var apiEnums = map[string][]string{
+	"linkRequest.redirect":    redirectModes(),
+	"linkResponse.redirect":   redirectModes(),
+	"shortenRequest.redirect": redirectModes(),
+	"Passthrough.query":       {storage.QueryPassthroughIncoming, storage.QueryPassthroughDestination},
+	"jobResponse.status":      {storage.JobQueued, storage.JobRunning, storage.JobDone, storage.JobFailed, storage.JobCancelled},
+	"userRequest.role":        {auth.RoleUser, auth.RoleAdmin},
+	"userResponse.role":       {auth.RoleUser, auth.RoleAdmin},
+}
+
+func redirectModes() []string {
+	return []string{
+		storage.RedirectMovedPermanently, storage.RedirectFound, storage.RedirectTemporary,
+		storage.RedirectPermanent, storage.RedirectMetaRefresh, storage.RedirectJavaScript,
+	}
+}
+
+var openAPIDocument = sync.OnceValue(func() []byte {
+	document, err := json.MarshalIndent(buildOpenAPI(apiOperations), "", "  ")
+	if err != nil {
+		log.Fatalf("failed to encode OpenAPI document: %v", err)
+	}
+	return document
+})
+
+func (h *Handlers) openAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(openAPIDocument())
+}
+
+func (h *Handlers) docsHandler(w http.ResponseWriter, _ *http.Request) {
+	page, _ := f.ReadFile("docs.html")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(page)
+}
+
+// Route is a method and mux path template served by the handlers.
+type Route struct {
+	Method string
+	Path   string
+}
+
+// Routes lists the registered routes, e.g. to check them against the
+// OpenAPI document.
+func (h *Handlers) Routes() []Route {
+	var routes []Route
+	_ = h.router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			routes = append(routes, Route{Method: method, Path: path})
+		}
+		return nil
+	})
+	return routes
+}
+
+func buildOpenAPI(operations []apiOperation) map[string]any {
+	schemas := schemaBuilder{components: make(map[string]any)}
+	paths := make(map[string]map[string]any)
+	for _, op := range operations {
+		if paths[op.path] == nil {
+			paths[op.path] = make(map[string]any)
+		}
+		responses := op.responses
+		if op.scope != "" {
+			responses = append(responses[:len(responses):len(responses)], noKey, noScope)
+		}
+		operation := map[string]any{
+			"tags":        []string{op.tag},
+			"summary":     op.summary,
+			"operationId": operationID(op),
+			"responses":   schemas.responses(responses),
+		}
+		description := op.description
+		if op.scope != "" {
+			operation["security"] = []map[string]any{{"bearerAuth": []string{}}, {"basicAuth": []string{}}}
+			description = strings.TrimSpace(description + " Requires the " + op.scope + " scope when authentication is enabled.")
+		}
+		if description != "" {
+			operation["description"] = description
+		}
+		if len(op.params) > 0 {
+			operation["parameters"] = parameters(op.params)
+		}
+		if len(op.body) > 0 {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  schemas.content(op.body, op.partialBody),
+			}
+		}
+		paths[op.path][strings.ToLower(op.method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "URL shortener",
+			"version":     "1.0.0",
+			"description": "Errors are RFC 7807 problem details with a stable reason code and the request ID, which is also returned in the X-Request-ID header.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas.components,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer", "description": "API key issued by an admin, or a JWT of the identity provider signed with RS256 or ES256"},
+				"basicAuth":  map[string]any{"type": "http", "scheme": "basic", "description": "Username and password of a user account"},
+			},
+		},
+	}
+}
+
+func operationID(op apiOperation) string {
+	var id strings.Builder
+	id.WriteString(strings.ToLower(op.method))
+	for _, part := range strings.FieldsFunc(op.path, func(r rune) bool { return !unicode.IsLetter(r) }) {
+		r, size := utf8.DecodeRuneInString(part)
+		id.WriteRune(unicode.ToUpper(r))
+		id.WriteString(part[size:])
+	}
+	if strings.HasSuffix(op.path, "+") {
+		id.WriteString("Preview")
+	}
+	if op.path == "/" {
+		id.WriteString("Root")
+	}
+	return id.String()
+}
+
+func parameters(params []apiParam) []map[string]any {
+	result := make([]map[string]any, 0, len(params))
+	for _, p := range params {
+		param := map[string]any{"name": p.name, "in": p.in, "schema": p.schema}
+		if p.in == "path" {
+			param["required"] = true
+		}
+		if p.description != "" {
+			param["description"] = p.description
+		}
+		result = append(result, param)
+	}
+	return result
+}
+
+type schemaBuilder struct {
+	components map[string]any
+}
+
+func (b schemaBuilder) responses(responses []apiResponse) map[string]any {
+	result := make(map[string]any, len(responses))
+	for _, r := range responses {
+		response := map[string]any{"description": r.description}
+		if len(r.content) > 0 {
+			response["content"] = b.content(r.content, false)
+		}
+		if len(r.headers) > 0 {
+			headers := make(map[string]any, len(r.headers))
+			for _, name := range r.headers {
+				headers[name] = map[string]any{"schema": stringSchema()}
+			}
+			response["headers"] = headers
+		}
+		result[strconv.Itoa(r.status)] = response
+	}
+	return result
+}
+
+func (b schemaBuilder) content(contents []apiContent, partial bool) map[string]any {
+	result := make(map[string]any, len(contents))
+	for _, c := range contents {
+		schema := c.schema
+		if c.value != nil {
+			if partial {
+				schema = b.inline(reflect.TypeOf(c.value))
+				delete(schema, "required")
+			} else {
+				schema = b.schema(reflect.TypeOf(c.value), "")
+			}
+		}
+		result[c.mediaType] = map[string]any{"schema": schema}
+	}
+	return result
+}
+
+// schema returns the schema of t. Named structs become components and are
+// referenced; field is the "Type.field" key used to look up enums.
+func (b schemaBuilder) schema(t reflect.Type, field string) map[string]any {
+	if t.Kind() == reflect.Pointer {
+		return b.schema(t.Elem(), field)
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		name := componentName(t)
+		if _, ok := b.components[name]; !ok {
+			b.components[name] = nil
+			b.components[name] = b.inline(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": b.schema(t.Elem(), "")}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem(), "")}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		if values, ok := apiEnums[field]; ok {
+			return enumSchema(values...)
+		}
+		return stringSchema()
+	default:
+		return map[string]any{}
+	}
+}
+
+// inline returns the object schema of struct t. Fields without omitempty
+// are required: handlers always encode them, and request types mark their
+// optional fields with omitempty.
+func (b schemaBuilder) inline(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = b.schema(f.Type, t.Name()+"."+name)
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func componentName(t reflect.Type) string {
+	r, size := utf8.DecodeRuneInString(t.Name())
+	return string(unicode.ToUpper(r)) + t.Name()[size:]
+}
+
+func stringSchema() map[string]any {
+	return map[string]any{"type": "string"}
+}
+
+func enumSchema(values ...string) map[string]any {
+	return map[string]any{"type": "string", "enum": values}
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"OZON_test/internal/storage"
+	"net/url"
+	"strings"
+)
+
+// applyPassthrough merges the incoming query and path suffix into destination
+// according to the link's passthrough policy.
+func applyPassthrough(destination string, incoming url.Values, suffix string, policy storage.Passthrough) (string, error) {
+	forwardQuery := policy.Query != storage.QueryPassthroughNone && len(incoming) > 0
+	forwardPath := policy.Path && suffix != ""
+	if !forwardQuery && !forwardPath {
+		return destination, nil
+	}
+
+	u, err := url.Parse(destination)
+	if err != nil {
+		return "", err
+	}
+
+	if forwardPath {
+		appendPath(u, suffix)
+	}
+
+	if forwardQuery {
+		query := u.Query()
+		for name, values := range incoming {
+			if _, exists := query[name]; exists && policy.Query == storage.QueryPassthroughDestination {
+				continue
+			}
+			query[name] = values
+		}
+		u.RawQuery = query.Encode()
+	}
+
+	return u.String(), nil
+}
+
+// appendPath adds the decoded suffix to the path of u as is. Unlike
+// url.JoinPath it keeps dot segments and repeated slashes of both parts and
+// does not unescape the suffix a second time.
+func appendPath(u *url.URL, suffix string) {
+	escaped := u.EscapedPath()
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+		escaped += "/"
+	}
+	segments := strings.Split(suffix, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	u.Path += suffix
+	u.RawPath = escaped + strings.Join(segments, "/")
+}
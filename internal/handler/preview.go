@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"OZON_test/internal/storage"
+	"bytes"
+	"fmt"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/idna"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const PathToPreviewHtml = "preview.html"
+
+// previewCookie makes every short link open the preview page for the
+// browser that carries it.
+const previewCookie = "always_preview"
+
+const previewCookieMaxAge = 365 * 24 * 60 * 60
+
+// previewCSRFCookie protects the preview settings form. The form changes a
+// cookie of an anonymous browser, so the token is bound to a cookie of its
+// own instead of a session.
+const previewCSRFCookie = "preview_csrf"
+
+func alwaysPreview(r *http.Request) bool {
+	cookie, err := r.Cookie(previewCookie)
+	return err == nil && cookie.Value == "1"
+}
+
+// continuePath is the preview page's "continue" target. It counts the click
+// and redirects without showing the preview again.
+func continuePath(key string, suffix string, rawQuery string) string {
+	path := "/preview/" + url.PathEscape(key) + "/continue"
+	if suffix != "" {
+		path += "/" + suffix
+	}
+	if rawQuery != "" {
+		path += "?" + rawQuery
+	}
+	return path
+}
+
+func (h *Handlers) previewHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	redirectURL, _, ok := h.resolve(w, r, key, "")
+	if !ok {
+		return
+	}
+	h.previewPage(w, r, key, redirectURL, h.path(continuePath(key, "", r.URL.RawQuery)))
+}
+
+func (h *Handlers) continueHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	redirectURL, options, ok := h.resolve(w, r, vars["key"], vars["suffix"])
+	if !ok {
+		return
+	}
+	h.follow(w, r, vars["key"], redirectURL, options)
+}
+
+// previewSettingsHandler turns the always-preview cookie on or off and goes
+// back to the preview page. Forms without the CSRF token of the preview
+// page are refused, so other sites cannot change the setting.
+func (h *Handlers) previewSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, reasonInvalidRequest, "invalid form")
+		return
+	}
+	csrf, err := r.Cookie(previewCSRFCookie)
+	if err != nil || !validCSRF(r.PostFormValue(csrfField), csrf.Value) {
+		writeError(w, r, reasonForbidden, "invalid CSRF token")
+		return
+	}
+
+	cookie := &http.Cookie{
+		Name:     previewCookie,
+		Value:    "1",
+		Path:     h.path("/"),
+		MaxAge:   previewCookieMaxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if r.PostFormValue("always") != "1" {
+		cookie.Value = ""
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, h.path("/preview/"+url.PathEscape(mux.Vars(r)["key"])), http.StatusSeeOther)
+}
+
+func (h *Handlers) previewPage(w http.ResponseWriter, r *http.Request, key string, redirectURL string, continueURL string) {
+	token, err := previewCSRF(r)
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	htmlPage, _ := fs.ReadFile(f, PathToPreviewHtml)
+
+	data := struct {
+		Key       string
+		URL       string
+		Domain    string
+		CreatedAt string
+		Clicks    uint64
+		HasStats  bool
+		Continue  string
+		Settings  string
+		CSRF      string
+		Always    bool
+	}{
+		Key:      key,
+		URL:      redirectURL,
+		Domain:   displayDomain(redirectURL),
+		Continue: continueURL,
+		Settings: h.path("/preview/" + url.PathEscape(key)),
+		CSRF:     token,
+		Always:   alwaysPreview(r),
+	}
+	if stats, ok := h.storage.(storage.StatsStorage); ok {
+		if linkStats, err := stats.LoadStats(key); err == nil {
+			data.CreatedAt = linkStats.CreatedAt.UTC().Format("02.01.2006 15:04 UTC")
+			data.Clicks = linkStats.Clicks
+			data.HasStats = true
+		} else {
+			log.Printf("failed to load stats of %s: %v", key, err)
+		}
+	}
+
+	var page bytes.Buffer
+	if err := template.Must(template.New("preview").Parse(string(htmlPage))).Execute(&page, data); err != nil {
+		writeProblem(w, r, fmt.Errorf("execution error: %w", err))
+		return
+	}
+
+	h.setCookie(w, previewCSRFCookie, token, time.Hour)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if _, err := page.WriteTo(w); err != nil {
+		log.Println("write error", err)
+	}
+}
+
+// previewCSRF keeps the token of an earlier preview page, so pages open in
+// other tabs stay valid.
+func previewCSRF(r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(previewCSRFCookie); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+	return newCSRFToken()
+}
+
+// displayDomain returns the host of rawUrl, spelling out internationalized
+// names next to their punycode form so look-alike domains stand out.
+func displayDomain(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	host := u.Hostname()
+	if !strings.Contains(host, "xn--") {
+		return host
+	}
+	unicode, err := idna.ToUnicode(host)
+	if err != nil || unicode == host {
+		return host
+	}
+	return fmt.Sprintf("%s (%s)", unicode, host)
+}
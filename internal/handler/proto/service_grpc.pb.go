@@ -21,6 +21,7 @@ const _ = grpc.SupportPackageIsVersion9
 const (
 	UrlService_GenerateKey_FullMethodName = "/proto.UrlService/GenerateKey"
 	UrlService_Redirect_FullMethodName    = "/proto.UrlService/Redirect"
+	UrlService_GenerateQr_FullMethodName  = "/proto.UrlService/GenerateQr"
 )
 
 // UrlServiceClient is the client API for UrlService service.
@@ -29,6 +30,7 @@ const (
 type UrlServiceClient interface {
 	GenerateKey(ctx context.Context, in *GenerateKeyRequest, opts ...grpc.CallOption) (*GenerateKeyResponse, error)
 	Redirect(ctx context.Context, in *RedirectRequest, opts ...grpc.CallOption) (*RedirectResponse, error)
+	GenerateQr(ctx context.Context, in *GenerateQrRequest, opts ...grpc.CallOption) (*GenerateQrResponse, error)
 }
 
 type urlServiceClient struct {
@@ -59,12 +61,23 @@ func (c *urlServiceClient) Redirect(ctx context.Context, in *RedirectRequest, op
 	return out, nil
 }
 
+func (c *urlServiceClient) GenerateQr(ctx context.Context, in *GenerateQrRequest, opts ...grpc.CallOption) (*GenerateQrResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GenerateQrResponse)
+	err := c.cc.Invoke(ctx, UrlService_GenerateQr_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // UrlServiceServer is the server API for UrlService service.
 // All implementations must embed UnimplementedUrlServiceServer
 // for forward compatibility.
 type UrlServiceServer interface {
 	GenerateKey(context.Context, *GenerateKeyRequest) (*GenerateKeyResponse, error)
 	Redirect(context.Context, *RedirectRequest) (*RedirectResponse, error)
+	GenerateQr(context.Context, *GenerateQrRequest) (*GenerateQrResponse, error)
 	mustEmbedUnimplementedUrlServiceServer()
 }
 
@@ -81,6 +94,9 @@ func (UnimplementedUrlServiceServer) GenerateKey(context.Context, *GenerateKeyRe
 func (UnimplementedUrlServiceServer) Redirect(context.Context, *RedirectRequest) (*RedirectResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Redirect not implemented")
 }
+func (UnimplementedUrlServiceServer) GenerateQr(context.Context, *GenerateQrRequest) (*GenerateQrResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GenerateQr not implemented")
+}
 func (UnimplementedUrlServiceServer) mustEmbedUnimplementedUrlServiceServer() {}
 func (UnimplementedUrlServiceServer) testEmbeddedByValue()                    {}
 
@@ -138,6 +154,24 @@ func _UrlService_Redirect_Handler(srv interface{}, ctx context.Context, dec func
 	return interceptor(ctx, in, info, handler)
 }
 
+func _UrlService_GenerateQr_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GenerateQrRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UrlServiceServer).GenerateQr(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UrlService_GenerateQr_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UrlServiceServer).GenerateQr(ctx, req.(*GenerateQrRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // UrlService_ServiceDesc is the grpc.ServiceDesc for UrlService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -153,6 +187,10 @@ var UrlService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Redirect",
 			Handler:    _UrlService_Redirect_Handler,
 		},
+		{
+			MethodName: "GenerateQr",
+			Handler:    _UrlService_GenerateQr_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "service.proto",
@@ -2,71 +2,119 @@ package handler
 
 import (
 	"context"
-	"fmt"
+	"log"
+	"strings"
 
 	pb "OZON_test/internal/handler/proto"
+	"OZON_test/internal/qr"
 	"OZON_test/internal/storage"
 )
 
 type UrlServer struct {
 	pb.UnimplementedUrlServiceServer
-	generator func(url string, seed int) (string, error)
-	storage   *storage.Storage
-	ip        string
+	shortener
+	storage *storage.Storage
+	baseUrl string
 }
 
 func NewUrlServer(generator func(url string, seed int) (string, error), storage *storage.Storage, ip string) *UrlServer {
-	return &UrlServer{generator: generator, storage: storage, ip: ip}
+	return &UrlServer{shortener: shortener{generator: generator}, storage: storage, baseUrl: "http://" + ip}
 }
 
-func (s *UrlServer) GenerateKey(_ context.Context, req *pb.GenerateKeyRequest) (*pb.GenerateKeyResponse, error) {
+// SetBaseUrl sets the address short links are served from. It is returned
+// in short_url and encoded into QR codes.
+func (s *UrlServer) SetBaseUrl(baseUrl string) {
+	s.baseUrl = strings.TrimSuffix(baseUrl, "/")
+}
+
+func (s *UrlServer) GenerateKey(ctx context.Context, req *pb.GenerateKeyRequest) (*pb.GenerateKeyResponse, error) {
 	url := req.GetUrl()
 	if url == "" {
-		return nil, fmt.Errorf("missing URL parameter")
+		return nil, grpcError(ctx, newError(reasonInvalidRequest, "missing url"))
 	}
 
-	var res string
-	for i := 0; ; i++ {
-		key, err := s.generator(url, i)
-		if err != nil {
-			return nil, fmt.Errorf("failed to generate key: %v", err)
-		}
-
-		v, err := (*s.storage).Load(key)
-		if err != nil {
-			res = key
-			err = (*s.storage).Store(key, url)
-			if err != nil {
-				return nil, fmt.Errorf("failed to store key: %v", err)
-			}
-			break
-		}
-		if v == url {
-			return &pb.GenerateKeyResponse{
-				Message:  "Data already received",
-				ShortUrl: key,
-			}, nil
-		}
+	options := storage.LinkOptions{
+		Passthrough: storage.Passthrough{
+			Query: req.GetPassthrough().GetQuery(),
+			Path:  req.GetPassthrough().GetPath(),
+		},
+		Redirect: req.GetRedirect(),
+		Preview:  req.GetPreview(),
+	}
+	link, existed, err := s.shorten(*s.storage, url, options, ownerOf(ctx, *s.storage))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	if existed {
+		return &pb.GenerateKeyResponse{
+			Message:  "Data already received",
+			ShortUrl: s.baseUrl + "/" + link.Key,
+		}, nil
 	}
 
 	return &pb.GenerateKeyResponse{
 		Message:  "Data received successfully",
-		ShortUrl: res,
+		ShortUrl: s.baseUrl + "/" + link.Key,
 	}, nil
 }
 
-func (s *UrlServer) Redirect(_ context.Context, req *pb.RedirectRequest) (*pb.RedirectResponse, error) {
+func (s *UrlServer) Redirect(ctx context.Context, req *pb.RedirectRequest) (*pb.RedirectResponse, error) {
 	key := req.GetKey()
 	if key == "" {
-		return nil, fmt.Errorf("missing key parameter")
+		return nil, grpcError(ctx, newError(reasonInvalidRequest, "missing key"))
 	}
 
 	redirectURL, err := (*s.storage).Load(key)
 	if err != nil {
-		return nil, fmt.Errorf("cannot find key %v", err)
+		return nil, grpcError(ctx, storage.ErrNotFound)
+	}
+
+	if rule, ok := s.blocked(redirectURL); ok {
+		log.Printf("blocked redirect %s -> %s by rule %q", key, redirectURL, rule)
+		return nil, grpcError(ctx, errDestinationBlocked)
 	}
 
 	return &pb.RedirectResponse{
-		Url: redirectURL,
+		Url:      redirectURL,
+		Redirect: loadOptions(*s.storage, key).Redirect,
+	}, nil
+}
+
+func (s *UrlServer) GenerateQr(ctx context.Context, req *pb.GenerateQrRequest) (*pb.GenerateQrResponse, error) {
+	key := req.GetKey()
+	if key == "" {
+		return nil, grpcError(ctx, newError(reasonInvalidRequest, "missing key"))
+	}
+	if _, err := (*s.storage).Load(key); err != nil {
+		return nil, grpcError(ctx, storage.ErrNotFound)
+	}
+
+	opts := qr.DefaultOptions()
+	if req.GetFormat() != "" {
+		opts.Format = req.GetFormat()
+	}
+	if req.GetSize() != 0 {
+		opts.Size = int(req.GetSize())
+	}
+	if req.GetLevel() != "" {
+		opts.Level = req.GetLevel()
+	}
+	if req.Margin != nil {
+		opts.Margin = int(req.GetMargin())
+	}
+	if req.GetForeground() != "" {
+		opts.Foreground = req.GetForeground()
+	}
+	if req.GetBackground() != "" {
+		opts.Background = req.GetBackground()
+	}
+
+	image, err := qr.Encode(s.baseUrl+"/"+key, opts)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return &pb.GenerateQrResponse{
+		Image:       image,
+		ContentType: qr.ContentType(opts.Format),
 	}, nil
 }
@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"OZON_test/internal/qr"
+	"encoding/base64"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+func (h *Handlers) qrHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	if _, err := h.loadLink(key); err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+
+	opts, err := parseQrOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, r, reasonInvalidRequest, err.Error())
+		return
+	}
+	image, err := qr.Encode(shortUrl(h.baseUrl(r), key), opts)
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", qr.ContentType(opts.Format))
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(image); err != nil {
+		log.Println("write error", err)
+	}
+}
+
+// parseQrOptions reads format, size, level, margin, fg and bg query
+// parameters on top of the default options.
+func parseQrOptions(query url.Values) (qr.Options, error) {
+	opts := qr.DefaultOptions()
+	if format := query.Get("format"); format != "" {
+		opts.Format = format
+	}
+	if level := query.Get("level"); level != "" {
+		opts.Level = level
+	}
+	if fg := query.Get("fg"); fg != "" {
+		opts.Foreground = fg
+	}
+	if bg := query.Get("bg"); bg != "" {
+		opts.Background = bg
+	}
+	for name, target := range map[string]*int{"size": &opts.Size, "margin": &opts.Margin} {
+		raw := query.Get(name)
+		if raw == "" {
+			continue
+		}
+		value, err := strconv.Atoi(raw)
+		if err != nil {
+			return qr.Options{}, fmt.Errorf("invalid %s parameter", name)
+		}
+		*target = value
+	}
+	return opts, nil
+}
+
+// qrDataUri renders the default QR code of key as an inline PNG.
+func qrDataUri(base string, key string) (string, error) {
+	image, err := qr.Encode(shortUrl(base, key), qr.DefaultOptions())
+	if err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(image), nil
+}
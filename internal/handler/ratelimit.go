@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	pb "OZON_test/internal/handler/proto"
+	"OZON_test/internal/ratelimit"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// RateLimiter decides whether a client may make another request of a class.
+type RateLimiter interface {
+	Allow(class string, identity string) ratelimit.Decision
+}
+
+// grpcClasses maps gRPC methods to the rate limit classes of their HTTP
+// counterparts.
+var grpcClasses = map[string]string{
+	pb.UrlService_GenerateKey_FullMethodName: ratelimit.ClassCreate,
+	pb.UrlService_Redirect_FullMethodName:    ratelimit.ClassRedirect,
+}
+
+// SetRateLimiter enables rate limiting of link creation, redirects and
+// sign-in attempts.
+func (h *Handlers) SetRateLimiter(limiter RateLimiter) {
+	h.limiter = limiter
+}
+
+// clientIdentity is the authenticated identity of the request or, for
+// anonymous clients, their address.
+func (h *Handlers) clientIdentity(r *http.Request) string {
+	if identity := ratelimit.Identity(r.Context()); identity != "" {
+		return identity
+	}
+	return "ip:" + h.publicUrl.ClientIP(r)
+}
+
+// limited rejects requests over the limit of class with 429 and
+// Retry-After.
+func (h *Handlers) limited(class string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.limiter != nil {
+			decision := h.limiter.Allow(class, h.clientIdentity(r))
+			if !decision.Allowed {
+				writeRateLimited(w, r, decision)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+func writeRateLimited(w http.ResponseWriter, r *http.Request, decision ratelimit.Decision) {
+	w.Header().Set("Retry-After", strconv.Itoa(decision.RetryAfterSeconds()))
+	writeError(w, r, reasonRateLimited, "rate limit exceeded, retry later")
+}
+
+// allowLogin takes a sign-in attempt of the client at address and, for
+// password attempts, of username. Limiting usernames too keeps attackers
+// with many addresses from guessing the password of one account quickly.
+func allowLogin(limiter RateLimiter, address string, username string) ratelimit.Decision {
+	if limiter == nil {
+		return ratelimit.Decision{Allowed: true}
+	}
+	decision := limiter.Allow(ratelimit.ClassLogin, address)
+	if username == "" {
+		return decision
+	}
+	byName := limiter.Allow(ratelimit.ClassLogin, "username:"+username)
+	if !byName.Allowed && (decision.Allowed || byName.RetryAfter > decision.RetryAfter) {
+		return byName
+	}
+	return decision
+}
+
+// allowLogin is the package allowLogin for the address of r. Sign-in is
+// limited by address even for signed-in browsers.
+func (h *Handlers) allowLogin(r *http.Request, username string) ratelimit.Decision {
+	return allowLogin(h.limiter, "ip:"+h.publicUrl.ClientIP(r), username)
+}
+
+// UnaryRateLimit applies limiter to GenerateKey and Redirect calls.
+// Rejected calls fail with ResourceExhausted carrying RetryInfo and a
+// retry-after header.
+func UnaryRateLimit(limiter RateLimiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		class, ok := grpcClasses[info.FullMethod]
+		if !ok {
+			return handler(ctx, req)
+		}
+		decision := limiter.Allow(class, grpcIdentity(ctx))
+		if decision.Allowed {
+			return handler(ctx, req)
+		}
+		return nil, grpcRateLimited(ctx, decision)
+	}
+}
+
+func grpcRateLimited(ctx context.Context, decision ratelimit.Decision) error {
+	retryAfter := time.Duration(decision.RetryAfterSeconds()) * time.Second
+	_ = grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(decision.RetryAfterSeconds())))
+	err := grpcError(ctx, newError(reasonRateLimited, "rate limit exceeded, retry later"))
+	if st, detailsErr := status.Convert(err).WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)}); detailsErr == nil {
+		err = st.Err()
+	}
+	return err
+}
+
+func grpcIdentity(ctx context.Context) string {
+	if identity := ratelimit.Identity(ctx); identity != "" {
+		return identity
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return "ip:" + host
+		}
+		return "ip:" + p.Addr.String()
+	}
+	return "ip:unknown"
+}
@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"OZON_test/internal/storage"
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+)
+
+const PathToRedirectHtml = "redirect.html"
+
+const (
+	permanentCacheControl = "public, max-age=86400"
+	temporaryCacheControl = "private, no-store"
+)
+
+// redirect sends the client to url the way the link's redirect mode asks
+// for. Permanent redirects may be cached by browsers and proxies; every
+// other mode is marked non-cacheable so each click reaches the server.
+func (h *Handlers) redirect(w http.ResponseWriter, r *http.Request, url string, mode string) {
+	switch mode {
+	case storage.RedirectMovedPermanently:
+		w.Header().Set("Cache-Control", permanentCacheControl)
+		http.Redirect(w, r, url, http.StatusMovedPermanently)
+	case storage.RedirectPermanent:
+		w.Header().Set("Cache-Control", permanentCacheControl)
+		http.Redirect(w, r, url, http.StatusPermanentRedirect)
+	case storage.RedirectTemporary:
+		w.Header().Set("Cache-Control", temporaryCacheControl)
+		http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+	case storage.RedirectMetaRefresh, storage.RedirectJavaScript:
+		h.redirectPageHandler(w, r, url, mode == storage.RedirectJavaScript)
+	default:
+		w.Header().Set("Cache-Control", temporaryCacheControl)
+		http.Redirect(w, r, url, http.StatusFound)
+	}
+}
+
+func (h *Handlers) redirectPageHandler(w http.ResponseWriter, r *http.Request, url string, script bool) {
+	htmlPage, _ := fs.ReadFile(f, PathToRedirectHtml)
+
+	data := struct {
+		URL    string
+		Script bool
+	}{URL: url, Script: script}
+
+	var page bytes.Buffer
+	if err := template.Must(template.New("redirect").Parse(string(htmlPage))).Execute(&page, data); err != nil {
+		writeProblem(w, r, fmt.Errorf("execution error: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", temporaryCacheControl)
+	w.WriteHeader(http.StatusOK)
+	if _, err := page.WriteTo(w); err != nil {
+		log.Println("write error", err)
+	}
+}
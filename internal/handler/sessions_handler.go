@@ -0,0 +1,266 @@
+package handler
+
+import (
+	"OZON_test/internal/auth"
+	"OZON_test/internal/storage"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const PathToLoginHtml = "login.html"
+
+const (
+	// sessionCookie holds the session token of a signed-in browser.
+	sessionCookie = "session"
+	// loginCSRFCookie protects the login form, which is sent before there
+	// is a session to bind the token to.
+	loginCSRFCookie = "login_csrf"
+	csrfField       = "csrf_token"
+	csrfHeader      = "X-CSRF-Token"
+)
+
+// recentLinks is the number of links the web page lists.
+const recentLinks = 10
+
+// SessionManager signs users in and out of the web page.
+type SessionManager interface {
+	Create(userID string) (string, storage.Session, error)
+	Resolve(token string) (auth.Principal, storage.Session, error)
+	End(token string) error
+	TTL() time.Duration
+}
+
+// SetSessions enables signing in on the web page. It needs user accounts,
+// see SetUsers. Cookies are marked Secure unless secureCookies is false,
+// which is only meant for plain HTTP during development.
+func (h *Handlers) SetSessions(sessions SessionManager, secureCookies bool) {
+	h.sessions = sessions
+	h.secureCookies = secureCookies
+}
+
+type sessionKey struct{}
+
+func sessionFromContext(ctx context.Context) (storage.Session, bool) {
+	session, ok := ctx.Value(sessionKey{}).(storage.Session)
+	return session, ok
+}
+
+// withSession signs the request in with its session cookie. Unsafe
+// requests are only signed in when they carry the CSRF token of the
+// session, so other sites cannot act on behalf of the browser.
+func (h *Handlers) withSession(r *http.Request) *http.Request {
+	if h.sessions == nil {
+		return r
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return r
+	}
+	principal, session, err := h.sessions.Resolve(cookie.Value)
+	if err != nil {
+		if !errors.Is(err, auth.ErrInvalidCredentials) {
+			log.Printf("failed to resolve session: %v", err)
+		}
+		return r
+	}
+	if !safeMethod(r.Method) && !validCSRF(requestCSRF(r), session.CSRF) {
+		return r
+	}
+	ctx := context.WithValue(withPrincipal(r.Context(), principal), sessionKey{}, session)
+	return r.WithContext(ctx)
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// requestCSRF reads the CSRF token from the header set by scripts or from
+// the field of a submitted form.
+func requestCSRF(r *http.Request) string {
+	if token := r.Header.Get(csrfHeader); token != "" {
+		return token
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" {
+		return r.PostFormValue(csrfField)
+	}
+	return ""
+}
+
+func validCSRF(got string, want string) bool {
+	return got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+func (h *Handlers) setCookie(w http.ResponseWriter, name string, value string, maxAge time.Duration) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     h.path("/"),
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   h.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if maxAge < 0 {
+		cookie.Value = ""
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+func (h *Handlers) loginPageHandler(w http.ResponseWriter, r *http.Request) {
+	if h.sessions == nil {
+		writeError(w, r, reasonNotSupported, "sign-in is disabled")
+		return
+	}
+	if _, ok := sessionFromContext(r.Context()); ok {
+		http.Redirect(w, r, h.path("/page"), http.StatusSeeOther)
+		return
+	}
+	h.loginPage(w, r, http.StatusOK, "", "")
+}
+
+func (h *Handlers) loginHandler(w http.ResponseWriter, r *http.Request) {
+	if h.sessions == nil || h.users == nil {
+		writeError(w, r, reasonNotSupported, "sign-in is disabled")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, reasonInvalidRequest, "invalid form")
+		return
+	}
+
+	username := r.PostFormValue("username")
+	cookie, err := r.Cookie(loginCSRFCookie)
+	if err != nil || !validCSRF(r.PostFormValue(csrfField), cookie.Value) {
+		h.loginPage(w, r, http.StatusForbidden, username, "Форма устарела, попробуйте ещё раз.")
+		return
+	}
+
+	if decision := h.allowLogin(r, username); !decision.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(decision.RetryAfterSeconds()))
+		h.loginPage(w, r, http.StatusTooManyRequests, username, "Слишком много попыток входа, попробуйте позже.")
+		return
+	}
+
+	principal, err := h.users.LoginWithCode(username, r.PostFormValue("password"), r.PostFormValue("code"))
+	switch {
+	case errors.Is(err, auth.ErrInvalidCredentials):
+		h.loginPage(w, r, http.StatusUnauthorized, username, "Неверное имя пользователя или пароль.")
+		return
+	case errors.Is(err, auth.ErrSecondFactorRequired):
+		h.loginPage(w, r, http.StatusUnauthorized, username, "Введите код из приложения-аутентификатора или код восстановления.")
+		return
+	case errors.Is(err, auth.ErrInvalidCode):
+		h.loginPage(w, r, http.StatusUnauthorized, username, "Неверный или уже использованный код подтверждения.")
+		return
+	}
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+
+	token, _, err := h.sessions.Create(principal.ID)
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	h.setCookie(w, loginCSRFCookie, "", -1)
+	h.setCookie(w, sessionCookie, token, h.sessions.TTL())
+	http.Redirect(w, r, h.path("/page"), http.StatusSeeOther)
+}
+
+// logoutHandler ends the session. A session cookie without the CSRF token
+// is refused, so other sites cannot sign the browser out.
+func (h *Handlers) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if h.sessions == nil {
+		writeError(w, r, reasonNotSupported, "sign-in is disabled")
+		return
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err == nil {
+		if _, ok := sessionFromContext(r.Context()); !ok {
+			if _, _, err := h.sessions.Resolve(cookie.Value); err == nil {
+				writeError(w, r, reasonForbidden, "invalid CSRF token")
+				return
+			}
+		}
+		if err := h.sessions.End(cookie.Value); err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+	}
+	h.setCookie(w, sessionCookie, "", -1)
+	http.Redirect(w, r, h.path("/login"), http.StatusSeeOther)
+}
+
+// loginPage renders the login form with a fresh CSRF token bound to a
+// short-lived cookie.
+func (h *Handlers) loginPage(w http.ResponseWriter, r *http.Request, status int, username string, message string) {
+	token, err := newCSRFToken()
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	htmlPage, _ := fs.ReadFile(f, PathToLoginHtml)
+
+	data := struct {
+		Action   string
+		CSRF     string
+		Username string
+		Error    string
+	}{Action: h.path("/login"), CSRF: token, Username: username, Error: message}
+
+	var page bytes.Buffer
+	if err := template.Must(template.New("login").Parse(string(htmlPage))).Execute(&page, data); err != nil {
+		writeProblem(w, r, fmt.Errorf("execution error: %w", err))
+		return
+	}
+
+	h.setCookie(w, loginCSRFCookie, token, time.Hour)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if _, err := page.WriteTo(w); err != nil {
+		log.Println("write error", err)
+	}
+}
+
+func newCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// recentLinksOf returns the latest links of principal for the web page.
+func (h *Handlers) recentLinksOf(principal auth.Principal, base string) []linkResponse {
+	ownerStorage, ok := h.storage.(storage.OwnerStorage)
+	if !ok {
+		return nil
+	}
+	links, err := ownerStorage.RecentOwned(principal.Identity(), recentLinks)
+	if err != nil {
+		log.Printf("failed to load links of %s: %v", principal.Identity(), err)
+		return nil
+	}
+	response := make([]linkResponse, 0, len(links))
+	for _, link := range links {
+		response = append(response, newLinkResponse(base, link))
+	}
+	return response
+}
@@ -0,0 +1,309 @@
+package handler
+
+import (
+	"OZON_test/internal/auth"
+	"OZON_test/internal/storage"
+	"OZON_test/internal/validator"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+)
+
+var (
+	errInvalidUrl    = errors.New("invalid url")
+	errKeyGeneration = errors.New("failed to generate key")
+)
+
+// Issuer stores url under a fresh key it already owns, skipping the
+// generate-and-probe loop.
+type Issuer interface {
+	Issue(url string) (string, error)
+}
+
+// Blocklist reports whether a destination must not be shortened or
+// redirected to, and which rule matched it.
+type Blocklist interface {
+	Blocked(url string) (string, bool)
+}
+
+// shortener holds the link creation pipeline shared by the HTTP and gRPC
+// handlers.
+type shortener struct {
+	generator func(url string, seed int) (string, error)
+	issuer    Issuer
+	normalize func(url string) (string, error)
+	validate  func(url string) error
+	blocklist Blocklist
+}
+
+func (s *shortener) SetIssuer(issuer Issuer) {
+	s.issuer = issuer
+}
+
+func (s *shortener) SetNormalizer(normalize func(url string) (string, error)) {
+	s.normalize = normalize
+}
+
+func (s *shortener) SetValidator(validate func(url string) error) {
+	s.validate = validate
+}
+
+func (s *shortener) SetBlocklist(blocklist Blocklist) {
+	s.blocklist = blocklist
+}
+
+func (s *shortener) blocked(urls ...string) (string, bool) {
+	if s.blocklist == nil {
+		return "", false
+	}
+	for _, url := range urls {
+		if rule, ok := s.blocklist.Blocked(url); ok {
+			return rule, true
+		}
+	}
+	return "", false
+}
+
+// prepare validates url, canonicalizes it and checks it against the
+// blocklist, returning the form that should be stored.
+func (s *shortener) prepare(url string) (string, error) {
+	if s.validate != nil {
+		if err := s.validate(url); err != nil {
+			return "", err
+		}
+	}
+
+	raw := url
+	if s.normalize != nil {
+		var err error
+		url, err = s.normalize(url)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", errInvalidUrl, err)
+		}
+	}
+
+	if rule, ok := s.blocked(raw, url); ok {
+		log.Printf("rejected %s: blocked by rule %q", raw, rule)
+		return "", &validator.Error{Reason: validator.ReasonBlocked, Message: "url is blocked"}
+	}
+	return url, nil
+}
+
+// shorten validates url, canonicalizes it and stores it together with
+// options and owner. The canonical form is used both as the generator input
+// and for deduplication; an existing link is reused only if its options and
+// owner match.
+func (s *shortener) shorten(st storage.Storage, url string, options storage.LinkOptions, owner string) (link storage.Link, existed bool, err error) {
+	if err := validateOptions(options); err != nil {
+		return storage.Link{}, false, err
+	}
+	if err := checkOptionsSupport(st, options); err != nil {
+		return storage.Link{}, false, err
+	}
+
+	url, err = s.prepare(url)
+	if err != nil {
+		return storage.Link{}, false, err
+	}
+	return s.store(st, url, options, owner)
+}
+
+// store saves an already prepared url, reusing an existing link with the
+// same destination, options and owner. Storages that find links by url are
+// asked first, since issued and sequential keys do not depend on the url.
+func (s *shortener) store(st storage.Storage, url string, options storage.LinkOptions, owner string) (link storage.Link, existed bool, err error) {
+	optionsStorage, _ := st.(storage.OptionsStorage)
+	link = storage.Link{Url: url, Options: options, Owner: owner}
+
+	if finder, ok := st.(storage.UrlFinder); ok {
+		links, err := finder.FindByUrl(url)
+		if err != nil {
+			return storage.Link{}, false, fmt.Errorf("failed to find links: %v", err)
+		}
+		for _, existing := range links {
+			if existing.Options == options && existing.Owner == owner {
+				return existing, true, nil
+			}
+		}
+	}
+
+	if s.issuer != nil {
+		link.Key, err = s.issuer.Issue(url)
+		if err != nil {
+			return storage.Link{}, false, fmt.Errorf("%w: failed to issue key: %v", errKeyGeneration, err)
+		}
+		err = storeOptions(optionsStorage, link.Key, options)
+		if err == nil {
+			err = storeOwner(st, link.Key, owner)
+		}
+		if err != nil {
+			discardLink(st, link.Key)
+			return storage.Link{}, false, err
+		}
+		return link, false, nil
+	}
+
+	for i := 0; ; i++ {
+		link.Key, err = s.generator(url, i)
+		if err != nil {
+			return storage.Link{}, false, fmt.Errorf("%w: %v", errKeyGeneration, err)
+		}
+
+		if _, err := st.Load(link.Key); err != nil {
+			err := storeLink(st, link)
+			if err == nil {
+				return link, false, nil
+			}
+			if !errors.Is(err, storage.ErrAlreadyExists) {
+				return storage.Link{}, false, err
+			}
+			// A concurrent request took the key since Load; its link may
+			// be the one we are about to create.
+		}
+		reusable, err := sameLink(st, link)
+		if err != nil {
+			return storage.Link{}, false, err
+		}
+		if reusable {
+			return link, true, nil
+		}
+	}
+}
+
+// storeLink stores a new link under a key that looked free. Batchers get
+// the link together with its options and owner, so that PostgreSQL writes
+// it in one statement and concurrent requests never see it without them.
+func storeLink(st storage.Storage, link storage.Link) error {
+	if batcher, ok := st.(storage.Batcher); ok {
+		if err := batcher.StoreBatch([]storage.Link{link}); err != nil {
+			if errors.Is(err, storage.ErrAlreadyExists) {
+				return err
+			}
+			return fmt.Errorf("failed to store key: %v", err)
+		}
+		return nil
+	}
+	if err := st.Store(link.Key, link.Url); err != nil {
+		if errors.Is(err, storage.ErrAlreadyExists) {
+			return err
+		}
+		return fmt.Errorf("failed to store key: %v", err)
+	}
+	optionsStorage, _ := st.(storage.OptionsStorage)
+	if err := storeOptions(optionsStorage, link.Key, link.Options); err != nil {
+		return err
+	}
+	return storeOwner(st, link.Key, link.Owner)
+}
+
+// discardLink removes an issued link whose options or owner could not be
+// stored, so that it is not left behind without them. The pool commits the
+// url on its own, hence the separate writes.
+func discardLink(st storage.Storage, key string) {
+	if pending, ok := st.(*batch); ok {
+		st = pending.Storage
+	}
+	manager, ok := st.(storage.Manager)
+	if !ok {
+		log.Printf("cannot roll back link %s: storage does not support deletes", key)
+		return
+	}
+	if err := manager.Delete(key); err != nil {
+		log.Printf("failed to roll back link %s: %v", key, err)
+	}
+}
+
+// sameLink reports whether the link stored under link.Key has the url,
+// options and owner of link.
+func sameLink(st storage.Storage, link storage.Link) (bool, error) {
+	v, err := st.Load(link.Key)
+	if err != nil || v != link.Url {
+		return false, nil
+	}
+	if optionsStorage, ok := st.(storage.OptionsStorage); ok {
+		existing, err := optionsStorage.LoadOptions(link.Key)
+		if err != nil {
+			return false, fmt.Errorf("failed to load options: %v", err)
+		}
+		if existing != link.Options {
+			return false, nil
+		}
+	}
+	if ownerStorage, ok := st.(storage.OwnerStorage); ok {
+		existing, err := ownerStorage.LoadOwner(link.Key)
+		if err != nil {
+			return false, fmt.Errorf("failed to load owner: %v", err)
+		}
+		if existing != link.Owner {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// ownerOf returns the identity of the principal of ctx as the owner of the
+// links it creates in st, or "" for anonymous requests and storages that do
+// not record owners.
+func ownerOf(ctx context.Context, st storage.Storage) string {
+	if _, ok := st.(storage.OwnerStorage); !ok {
+		return ""
+	}
+	if principal, ok := auth.FromContext(ctx); ok {
+		return principal.Identity()
+	}
+	return ""
+}
+
+func storeOwner(st storage.Storage, key string, owner string) error {
+	if owner == "" {
+		return nil
+	}
+	ownerStorage, ok := st.(storage.OwnerStorage)
+	if !ok {
+		return nil
+	}
+	if err := ownerStorage.StoreOwner(key, owner); err != nil {
+		return fmt.Errorf("failed to store owner: %v", err)
+	}
+	return nil
+}
+
+func checkOptionsSupport(st storage.Storage, options storage.LinkOptions) error {
+	if _, ok := st.(storage.OptionsStorage); !ok && options != (storage.LinkOptions{}) {
+		return errOptionsNotSupported
+	}
+	return nil
+}
+
+func storeOptions(optionsStorage storage.OptionsStorage, key string, options storage.LinkOptions) error {
+	if options == (storage.LinkOptions{}) {
+		return nil
+	}
+	if err := optionsStorage.StoreOptions(key, options); err != nil {
+		return fmt.Errorf("failed to store options: %v", err)
+	}
+	return nil
+}
+
+func validateOptions(options storage.LinkOptions) error {
+	switch options.Passthrough.Query {
+	case storage.QueryPassthroughNone, storage.QueryPassthroughIncoming, storage.QueryPassthroughDestination:
+	default:
+		return &validator.Error{
+			Reason:  validator.ReasonInvalidOptions,
+			Message: fmt.Sprintf("unknown query passthrough mode %q", options.Passthrough.Query),
+		}
+	}
+	switch options.Redirect {
+	case storage.RedirectDefault, storage.RedirectMovedPermanently, storage.RedirectFound,
+		storage.RedirectTemporary, storage.RedirectPermanent,
+		storage.RedirectMetaRefresh, storage.RedirectJavaScript:
+	default:
+		return &validator.Error{
+			Reason:  validator.ReasonInvalidOptions,
+			Message: fmt.Sprintf("unknown redirect mode %q", options.Redirect),
+		}
+	}
+	return nil
+}
@@ -1,17 +1,36 @@
 package tests
 
 import (
+	"OZON_test/internal/auth"
 	"OZON_test/internal/handler"
+	"OZON_test/internal/jobs"
+	"OZON_test/internal/keypool"
+	"OZON_test/internal/publicurl"
+	"OZON_test/internal/ratelimit"
+	"OZON_test/internal/storage"
+	"OZON_test/internal/validator"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"html/template"
 	"io"
 	"log"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -42,9 +61,13 @@ func TestHandlers(t *testing.T) {
 		t.Fatalf("failed to read file %q: %v", pathToHTML, err)
 	}
 	data := struct {
-		IP   string
-		PORT string
-	}{IP: ip, PORT: port}
+		BaseURL    string
+		User       string
+		CSRF       string
+		LoginPath  string
+		LogoutPath string
+		Links      []struct{ ShortUrl, Url string }
+	}{BaseURL: fmt.Sprintf("http://%s:%s", ip, port)}
 
 	var pageBuffer bytes.Buffer
 	err = template.Must(template.New("page").Parse(string(tmp))).Execute(&pageBuffer, data)
@@ -173,3 +196,1858 @@ func TestHandlers(t *testing.T) {
 		})
 	}
 }
+
+func TestHandlers_BlockedRedirect(t *testing.T) {
+	ip := "localhost"
+	port := strconv.Itoa(findFreePort(t))
+
+	mockStorage := newMockStorage()
+	assert.NoError(t, mockStorage.Store("blocked", "http://evil.com"))
+	handlers := handler.CreateHandlers(MockGenerator, mockStorage, ip, port)
+	handlers.SetBlocklist(stubBlocklist{"http://evil.com": true})
+
+	go handlers.Run()
+	time.Sleep(1 * time.Second)
+	t.Cleanup(func() {
+		handlers.Close()
+	})
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(fmt.Sprintf("http://%s:%s/blocked", ip, port))
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, resp.Body.Close())
+	}()
+
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Location"))
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), "http://evil.com")
+
+	post, err := client.Post(fmt.Sprintf("http://%s:%s/", ip, port), "application/json", bytes.NewBufferString(`{"url": "http://evil.com"}`))
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, post.Body.Close())
+	}()
+	assert.Equal(t, http.StatusBadRequest, post.StatusCode)
+}
+
+type stubHealth map[string]storage.LinkHealth
+
+func (s stubHealth) Health(key string) (storage.LinkHealth, error) {
+	if health, ok := s[key]; ok {
+		return health, nil
+	}
+	return storage.LinkHealth{}, storage.ErrNotFound
+}
+
+func (s stubHealth) Unhealthy(string, int) ([]storage.LinkHealth, error) {
+	var unhealthy []storage.LinkHealth
+	for _, health := range s {
+		if health.ConsecutiveFailures > 0 {
+			unhealthy = append(unhealthy, health)
+		}
+	}
+	return unhealthy, nil
+}
+
+func (s stubHealth) Dead(key string) bool {
+	return s[key].ConsecutiveFailures >= 3
+}
+
+func TestHandlers_Health(t *testing.T) {
+	ip := "localhost"
+	port := strconv.Itoa(findFreePort(t))
+
+	mockStorage := newMockStorage()
+	assert.NoError(t, mockStorage.Store("alive", "http://example.com/alive"))
+	assert.NoError(t, mockStorage.Store("dead", "http://example.com/dead"))
+	assert.NoError(t, mockStorage.Store("fresh", "http://example.com/fresh"))
+
+	handlers := handler.CreateHandlers(MockGenerator, mockStorage, ip, port)
+	handlers.SetHealth(stubHealth{
+		"alive": {Key: "alive", Status: http.StatusOK, CheckedAt: time.Now()},
+		"dead":  {Key: "dead", Status: http.StatusNotFound, CheckedAt: time.Now(), ConsecutiveFailures: 3},
+	}, "http://example.com/fallback")
+
+	go handlers.Run()
+	time.Sleep(1 * time.Second)
+	t.Cleanup(func() {
+		handlers.Close()
+	})
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(path string) *http.Response {
+		resp, err := client.Get(fmt.Sprintf("http://%s:%s/%s", ip, port, path))
+		assert.NoError(t, err)
+		t.Cleanup(func() {
+			assert.NoError(t, resp.Body.Close())
+		})
+		return resp
+	}
+
+	resp := get("alive")
+	assert.Equal(t, "http://example.com/alive", resp.Header.Get("Location"))
+	resp = get("dead")
+	assert.Equal(t, "http://example.com/fallback", resp.Header.Get("Location"))
+
+	resp = get("api/v1/links/dead/health")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var health struct {
+		Status              int  `json:"status"`
+		ConsecutiveFailures int  `json:"consecutive_failures"`
+		Dead                bool `json:"dead"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&health))
+	assert.Equal(t, http.StatusNotFound, health.Status)
+	assert.Equal(t, 3, health.ConsecutiveFailures)
+	assert.True(t, health.Dead)
+
+	assert.Equal(t, http.StatusNotFound, get("api/v1/links/fresh/health").StatusCode)
+	assert.Equal(t, http.StatusNotFound, get("api/v1/links/missing/health").StatusCode)
+
+	resp = get("api/v1/health")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var list struct {
+		Links []struct {
+			Key string `json:"key"`
+		} `json:"links"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	if assert.Len(t, list.Links, 1) {
+		assert.Equal(t, "dead", list.Links[0].Key)
+	}
+}
+
+func TestHandlers_Passthrough(t *testing.T) {
+	ip := "localhost"
+	port := strconv.Itoa(findFreePort(t))
+
+	store := storage.NewSafeMap()
+	links := map[string]storage.LinkOptions{
+		"plain":       {},
+		"incoming":    {Passthrough: storage.Passthrough{Query: storage.QueryPassthroughIncoming}},
+		"destination": {Passthrough: storage.Passthrough{Query: storage.QueryPassthroughDestination}},
+		"path":        {Passthrough: storage.Passthrough{Query: storage.QueryPassthroughIncoming, Path: true}},
+	}
+	for key, options := range links {
+		assert.NoError(t, store.Store(key, "http://example.com/base?a=1"))
+		assert.NoError(t, store.StoreOptions(key, options))
+	}
+	assert.NoError(t, store.Store("dots", "http://example.com/a/./b/../c/"))
+	assert.NoError(t, store.StoreOptions("dots", storage.LinkOptions{Passthrough: storage.Passthrough{Path: true}}))
+
+	handlers := handler.CreateHandlers(MockGenerator, store, ip, port)
+	go handlers.Run()
+	time.Sleep(1 * time.Second)
+	t.Cleanup(func() {
+		handlers.Close()
+	})
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	tests := []struct {
+		name               string
+		path               string
+		expectedURL        string
+		expectedStatusCode int
+	}{
+		{
+			name:               "QueryDropped",
+			path:               "plain?ref=email",
+			expectedURL:        "http://example.com/base?a=1",
+			expectedStatusCode: http.StatusFound,
+		},
+		{
+			name:               "IncomingWins",
+			path:               "incoming?ref=email&a=2",
+			expectedURL:        "http://example.com/base?a=2&ref=email",
+			expectedStatusCode: http.StatusFound,
+		},
+		{
+			name:               "DestinationWins",
+			path:               "destination?ref=email&a=2",
+			expectedURL:        "http://example.com/base?a=1&ref=email",
+			expectedStatusCode: http.StatusFound,
+		},
+		{
+			name:               "PathSuffix",
+			path:               "path/docs/page2?ref=email",
+			expectedURL:        "http://example.com/base/docs/page2?a=1&ref=email",
+			expectedStatusCode: http.StatusFound,
+		},
+		{
+			name:               "PathSuffixEscaped",
+			path:               "path/a%2520b/c%3Fd",
+			expectedURL:        "http://example.com/base/a%2520b/c%3Fd?a=1",
+			expectedStatusCode: http.StatusFound,
+		},
+		{
+			name:               "PathSuffixDotSegments",
+			path:               "dots/docs/page2",
+			expectedURL:        "http://example.com/a/./b/../c/docs/page2",
+			expectedStatusCode: http.StatusFound,
+		},
+		{
+			name:               "PathSuffixDisabled",
+			path:               "plain/docs/page2",
+			expectedURL:        "",
+			expectedStatusCode: http.StatusNotFound,
+		},
+		{
+			name:               "ReservedPath",
+			path:               "page",
+			expectedURL:        "",
+			expectedStatusCode: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := client.Get(fmt.Sprintf("http://%s:%s/%s", ip, port, tt.path))
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, resp.Body.Close())
+			}()
+
+			assert.Equal(t, tt.expectedStatusCode, resp.StatusCode)
+			assert.Equal(t, tt.expectedURL, resp.Header.Get("Location"))
+		})
+	}
+
+	post, err := client.Post(fmt.Sprintf("http://%s:%s/", ip, port), "application/json",
+		bytes.NewBufferString(`{"url": "http://example.com/new", "passthrough": {"query": "sideways"}}`))
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, post.Body.Close())
+	}()
+	assert.Equal(t, http.StatusBadRequest, post.StatusCode)
+}
+
+func TestHandlers_LinksAPI(t *testing.T) {
+	ip := "localhost"
+	port := strconv.Itoa(findFreePort(t))
+
+	handlers := handler.CreateHandlers(MockGenerator, storage.NewSafeMap(), ip, port)
+	handlers.SetValidator(validator.New(validator.DefaultConfig()).Validate)
+	go handlers.Run()
+	time.Sleep(1 * time.Second)
+	t.Cleanup(func() {
+		handlers.Close()
+	})
+
+	type link struct {
+		Key         string              `json:"key"`
+		Url         string              `json:"url"`
+		ShortUrl    string              `json:"short_url"`
+		Passthrough storage.Passthrough `json:"passthrough"`
+	}
+	base := fmt.Sprintf("http://%s:%s/api/v1/links", ip, port)
+
+	do := func(method, url, body string, out interface{}) *http.Response {
+		req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+		assert.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, resp.Body.Close())
+		}()
+		if out != nil {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+		}
+		return resp
+	}
+
+	var created link
+	resp := do(http.MethodPost, base, `{"url": "http://example.com/a", "passthrough": {"query": "incoming"}}`, &created)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "/api/v1/links/path0", resp.Header.Get("Location"))
+	assert.Equal(t, link{
+		Key:         "path0",
+		Url:         "http://example.com/a",
+		ShortUrl:    fmt.Sprintf("http://%s:%s/path0", ip, port),
+		Passthrough: storage.Passthrough{Query: storage.QueryPassthroughIncoming},
+	}, created)
+
+	resp = do(http.MethodPost, base, `{"url": "http://example.com/a", "passthrough": {"query": "incoming"}}`, &created)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "path0", created.Key)
+
+	resp = do(http.MethodPost, base, `{"url": "http://example.com/b"}`, nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var problem struct {
+		Message string `json:"message"`
+		Reason  string `json:"reason"`
+	}
+	resp = do(http.MethodPost, base, `{"link": "http://example.com/a"}`, &problem)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "INVALID_REQUEST", problem.Reason)
+
+	var fetched link
+	resp = do(http.MethodGet, base+"/path0", "", &fetched)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, created, fetched)
+
+	resp = do(http.MethodGet, base+"/missing", "", &problem)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "NOT_FOUND", problem.Reason)
+
+	var page struct {
+		Links []link `json:"links"`
+		Next  string `json:"next"`
+	}
+	resp = do(http.MethodGet, base+"?limit=1", "", &page)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, page.Links, 1)
+	assert.Equal(t, "path0", page.Next)
+
+	resp = do(http.MethodGet, base+"?limit=1&after="+page.Next, "", &page)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, page.Links, 1)
+	assert.Equal(t, "path1", page.Links[0].Key)
+
+	var updated link
+	resp = do(http.MethodPatch, base+"/path0", `{"url": "http://example.com/c"}`, &updated)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "http://example.com/c", updated.Url)
+	assert.Equal(t, storage.QueryPassthroughIncoming, updated.Passthrough.Query)
+
+	updated = link{}
+	resp = do(http.MethodPatch, base+"/path0", `{"passthrough": {"path": true}}`, &updated)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "http://example.com/c", updated.Url)
+	assert.Equal(t, storage.Passthrough{Path: true}, updated.Passthrough)
+
+	resp = do(http.MethodPatch, base+"/path0", `{"url": "ftp://example.com"}`, &problem)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = do(http.MethodPatch, base+"/missing", `{"url": "http://example.com/c"}`, &problem)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = do(http.MethodDelete, base+"/path0", "", nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = do(http.MethodDelete, base+"/path0", "", &problem)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = do(http.MethodGet, fmt.Sprintf("http://%s:%s/path0", ip, port), "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestHandlers_RedirectModes(t *testing.T) {
+	ip := "localhost"
+	port := strconv.Itoa(findFreePort(t))
+
+	store := storage.NewSafeMap()
+	modes := []string{
+		storage.RedirectDefault,
+		storage.RedirectMovedPermanently,
+		storage.RedirectFound,
+		storage.RedirectTemporary,
+		storage.RedirectPermanent,
+		storage.RedirectMetaRefresh,
+		storage.RedirectJavaScript,
+	}
+	for _, mode := range modes {
+		key := "mode" + mode
+		assert.NoError(t, store.Store(key, "http://example.com/a?b=1&c=2"))
+		assert.NoError(t, store.StoreOptions(key, storage.LinkOptions{Redirect: mode}))
+	}
+
+	handlers := handler.CreateHandlers(MockGenerator, store, ip, port)
+	go handlers.Run()
+	time.Sleep(1 * time.Second)
+	t.Cleanup(func() {
+		handlers.Close()
+	})
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	tests := []struct {
+		mode                 string
+		expectedStatusCode   int
+		expectedCacheControl string
+		expectedBody         string
+	}{
+		{storage.RedirectDefault, http.StatusFound, "private, no-store", ""},
+		{storage.RedirectMovedPermanently, http.StatusMovedPermanently, "public, max-age=86400", ""},
+		{storage.RedirectFound, http.StatusFound, "private, no-store", ""},
+		{storage.RedirectTemporary, http.StatusTemporaryRedirect, "private, no-store", ""},
+		{storage.RedirectPermanent, http.StatusPermanentRedirect, "public, max-age=86400", ""},
+		{storage.RedirectMetaRefresh, http.StatusOK, "private, no-store", `<meta http-equiv="refresh" content="0; url=http://example.com/a?b=1&amp;c=2">`},
+		{storage.RedirectJavaScript, http.StatusOK, "private, no-store", `window.location.replace("http://example.com/a?b=1\u0026c=2")`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run("Mode"+tt.mode, func(t *testing.T) {
+			resp, err := client.Get(fmt.Sprintf("http://%s:%s/mode%s", ip, port, tt.mode))
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, resp.Body.Close())
+			}()
+
+			assert.Equal(t, tt.expectedStatusCode, resp.StatusCode)
+			assert.Equal(t, tt.expectedCacheControl, resp.Header.Get("Cache-Control"))
+			if tt.expectedBody == "" {
+				assert.Equal(t, "http://example.com/a?b=1&c=2", resp.Header.Get("Location"))
+				return
+			}
+			body, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.Contains(t, string(body), tt.expectedBody)
+		})
+	}
+
+	post, err := client.Post(fmt.Sprintf("http://%s:%s/", ip, port), "application/json",
+		bytes.NewBufferString(`{"url": "http://example.com/new", "redirect": "303"}`))
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, post.Body.Close())
+	}()
+	assert.Equal(t, http.StatusBadRequest, post.StatusCode)
+}
+
+func TestHandlers_Preview(t *testing.T) {
+	ip := "localhost"
+	port := strconv.Itoa(findFreePort(t))
+
+	store := storage.NewSafeMap()
+	assert.NoError(t, store.Store("plain", "http://example.com/a"))
+	assert.NoError(t, store.Store("always", "http://xn--e1afmkfd.xn--p1ai/"))
+	assert.NoError(t, store.StoreOptions("always", storage.LinkOptions{Preview: true}))
+
+	handlers := handler.CreateHandlers(MockGenerator, store, ip, port)
+	go handlers.Run()
+	time.Sleep(1 * time.Second)
+	t.Cleanup(func() {
+		handlers.Close()
+	})
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(path string, cookies ...*http.Cookie) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s:%s%s", ip, port, path), nil)
+		assert.NoError(t, err)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, resp.Body.Close())
+		}()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp, string(body)
+	}
+
+	resp, body := get("/plain+")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+	assert.Contains(t, body, "http://example.com/a")
+	assert.Contains(t, body, "Домен: <b>example.com</b>")
+	assert.Contains(t, body, "Переходов: 0")
+	assert.Contains(t, body, `href="/preview/plain/continue"`)
+
+	resp, _ = get("/preview/plain")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _ = get("/preview/plain/continue")
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "http://example.com/a", resp.Header.Get("Location"))
+
+	resp, _ = get("/plain")
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+
+	_, body = get("/plain+")
+	assert.Contains(t, body, "Переходов: 2")
+
+	resp, body = get("/always")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "пример.рф (xn--e1afmkfd.xn--p1ai)")
+
+	resp, _ = get("/missing+")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	settings, err := client.PostForm(fmt.Sprintf("http://%s:%s/preview/plain", ip, port), map[string][]string{"always": {"1"}})
+	assert.NoError(t, err)
+	assert.NoError(t, settings.Body.Close())
+	assert.Equal(t, http.StatusForbidden, settings.StatusCode, "the form requires the CSRF token")
+
+	page, body := get("/preview/plain")
+	csrf := page.Cookies()
+	assert.Len(t, csrf, 1)
+	token := regexp.MustCompile(`name="csrf_token" value="([^"]+)"`).FindStringSubmatch(body)
+	assert.Len(t, token, 2)
+	assert.Equal(t, csrf[0].Value, token[1])
+
+	form := url.Values{"always": {"1"}, "csrf_token": {token[1]}}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s:%s/preview/plain", ip, port), strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	settings, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.NoError(t, settings.Body.Close())
+	assert.Equal(t, http.StatusForbidden, settings.StatusCode, "the token must match the cookie")
+
+	req, err = http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s:%s/preview/plain", ip, port), strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(csrf[0])
+	settings, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.NoError(t, settings.Body.Close())
+	assert.Equal(t, http.StatusSeeOther, settings.StatusCode)
+	assert.Equal(t, "/preview/plain", settings.Header.Get("Location"))
+	cookies := settings.Cookies()
+	assert.Len(t, cookies, 1)
+
+	resp, body = get("/plain", cookies...)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "Не показывать предпросмотр")
+
+	resp, _ = get("/preview/plain/continue", cookies...)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+}
+
+func TestHandlers_Qr(t *testing.T) {
+	ip := "localhost"
+	port := strconv.Itoa(findFreePort(t))
+
+	store := storage.NewSafeMap()
+	assert.NoError(t, store.Store("key", "http://example.com"))
+
+	handlers := handler.CreateHandlers(MockGenerator, store, ip, port)
+	go handlers.Run()
+	time.Sleep(1 * time.Second)
+	t.Cleanup(func() {
+		handlers.Close()
+	})
+
+	base := fmt.Sprintf("http://%s:%s", ip, port)
+	tests := []struct {
+		name                string
+		path                string
+		expectedStatusCode  int
+		expectedContentType string
+	}{
+		{"PNG", "/api/v1/links/key/qr", http.StatusOK, "image/png"},
+		{"SVG", "/api/v1/links/key/qr?format=svg&size=512&level=H&margin=0&fg=%23333&bg=%23eeeeee", http.StatusOK, "image/svg+xml"},
+		{"InvalidLevel", "/api/v1/links/key/qr?level=Z", http.StatusBadRequest, "application/problem+json"},
+		{"InvalidSize", "/api/v1/links/key/qr?size=big", http.StatusBadRequest, "application/problem+json"},
+		{"MissingKey", "/api/v1/links/missing/qr", http.StatusNotFound, "application/problem+json"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(base + tt.path)
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, resp.Body.Close())
+			}()
+
+			assert.Equal(t, tt.expectedStatusCode, resp.StatusCode)
+			assert.Equal(t, tt.expectedContentType, resp.Header.Get("Content-Type"))
+		})
+	}
+
+	var created struct {
+		Qr string `json:"qr"`
+	}
+	post, err := http.Post(base+"/api/v1/links", "application/json",
+		bytes.NewBufferString(`{"url": "http://example.com/qr", "qr": true}`))
+	assert.NoError(t, err)
+	assert.NoError(t, json.NewDecoder(post.Body).Decode(&created))
+	assert.NoError(t, post.Body.Close())
+	assert.True(t, strings.HasPrefix(created.Qr, "data:image/png;base64,"))
+
+	var legacy map[string]string
+	post, err = http.Post(base+"/", "application/json",
+		bytes.NewBufferString(`{"url": "http://example.com/qr", "qr": true}`))
+	assert.NoError(t, err)
+	assert.NoError(t, json.NewDecoder(post.Body).Decode(&legacy))
+	assert.NoError(t, post.Body.Close())
+	assert.True(t, strings.HasPrefix(legacy["qr"], "data:image/png;base64,"))
+}
+
+func TestHandlers_Bulk(t *testing.T) {
+	ip := "localhost"
+	port := strconv.Itoa(findFreePort(t))
+
+	store := storage.NewSafeMap()
+	assert.NoError(t, store.Store("path0", "http://example.com/existing"))
+
+	handlers := handler.CreateHandlers(MockGenerator, store, ip, port)
+	handlers.SetValidator(validator.New(validator.DefaultConfig()).Validate)
+	handlers.SetBulkConfig(handler.BulkConfig{MaxItems: 4, Concurrency: 2})
+	go handlers.Run()
+	time.Sleep(1 * time.Second)
+	t.Cleanup(func() {
+		handlers.Close()
+	})
+
+	type result struct {
+		Index    int    `json:"index"`
+		Url      string `json:"url"`
+		Key      string `json:"key"`
+		ShortUrl string `json:"short_url"`
+		Existed  bool   `json:"existed"`
+		Error    *struct {
+			Reason string `json:"reason"`
+		} `json:"error"`
+	}
+	type response struct {
+		Results []result `json:"results"`
+		Created int      `json:"created"`
+		Existed int      `json:"existed"`
+		Failed  int      `json:"failed"`
+	}
+	url := fmt.Sprintf("http://%s:%s/api/v1/links/bulk", ip, port)
+	post := func(contentType string, body io.Reader) (*http.Response, response) {
+		resp, err := http.Post(url, contentType, body)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, resp.Body.Close())
+		}()
+		var decoded response
+		if resp.StatusCode == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&decoded))
+		}
+		return resp, decoded
+	}
+
+	resp, decoded := post("application/json", bytes.NewBufferString(`[
+		{"url": "http://example.com/existing"},
+		{"url": "http://example.com/new", "redirect": "301"},
+		{"url": "ftp://example.com"},
+		{"url": "http://example.com/new", "redirect": "301"}
+	]`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, decoded.Created)
+	assert.Equal(t, 2, decoded.Existed)
+	assert.Equal(t, 1, decoded.Failed)
+	assert.Len(t, decoded.Results, 4)
+	assert.Equal(t, "path0", decoded.Results[0].Key)
+	assert.True(t, decoded.Results[0].Existed)
+	assert.Equal(t, "path1", decoded.Results[1].Key)
+	assert.Equal(t, fmt.Sprintf("http://%s:%s/path1", ip, port), decoded.Results[1].ShortUrl)
+	assert.False(t, decoded.Results[1].Existed)
+	assert.Equal(t, "SCHEME_NOT_ALLOWED", decoded.Results[2].Error.Reason)
+	assert.Equal(t, 2, decoded.Results[2].Index)
+	assert.Equal(t, "path1", decoded.Results[3].Key)
+	assert.True(t, decoded.Results[3].Existed, "duplicates within a request must be deduplicated")
+
+	options, err := store.LoadOptions("path1")
+	assert.NoError(t, err)
+	assert.Equal(t, storage.RedirectMovedPermanently, options.Redirect)
+
+	resp, decoded = post("text/csv", bytes.NewBufferString("url,preview\nhttp://example.com/csv,true\n,\n"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, decoded.Created)
+	assert.Equal(t, 1, decoded.Failed)
+	assert.Equal(t, "INVALID_REQUEST", decoded.Results[1].Error.Reason)
+	options, err = store.LoadOptions(decoded.Results[0].Key)
+	assert.NoError(t, err)
+	assert.True(t, options.Preview)
+
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	file, err := writer.CreateFormFile("file", "links.csv")
+	assert.NoError(t, err)
+	_, err = file.Write([]byte("http://example.com/upload\nhttp://example.com/existing\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	resp, decoded = post(writer.FormDataContentType(), &form)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, decoded.Created)
+	assert.Equal(t, 1, decoded.Existed)
+
+	resp, _ = post("text/csv", bytes.NewBufferString("http://a.com\nhttp://b.com\nhttp://c.com\nhttp://d.com\nhttp://e.com\n"))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	resp, _ = post("text/plain", bytes.NewBufferString("http://a.com"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+
+	resp, _ = post("text/csv", bytes.NewBufferString("url,preview\nhttp://a.com,maybe\n"))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestHandlers_BulkKeyPool(t *testing.T) {
+	store := storage.NewSafeMap()
+	var n int
+	pool := keypool.NewPool(func() (string, error) {
+		n++
+		return fmt.Sprintf("pooled%d", n), nil
+	}, store, keypool.Config{Size: 1})
+	handlers := handler.NewHandlers(handler.Options{Generator: MockGenerator, Storage: store})
+	handlers.SetIssuer(pool)
+	server := httptest.NewServer(handlers)
+	t.Cleanup(server.Close)
+
+	resp, err := http.Post(server.URL+"/api/v1/links/bulk", "text/csv",
+		strings.NewReader("url,preview\nhttp://example.com/a,true\nhttp://example.com/b,\nhttp://example.com/a,true\n"))
+	assert.NoError(t, err)
+	var bulk struct {
+		Results []struct {
+			Key     string `json:"key"`
+			Existed bool   `json:"existed"`
+		} `json:"results"`
+		Created int `json:"created"`
+		Existed int `json:"existed"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&bulk))
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, bulk.Created)
+	assert.Equal(t, 1, bulk.Existed, "items of one request are deduplicated with pooled keys too")
+	if assert.Len(t, bulk.Results, 3) {
+		assert.Equal(t, "pooled1", bulk.Results[0].Key)
+		assert.Equal(t, "pooled2", bulk.Results[1].Key)
+		assert.Equal(t, "pooled1", bulk.Results[2].Key)
+	}
+
+	options, err := store.LoadOptions("pooled1")
+	assert.NoError(t, err)
+	assert.True(t, options.Preview, "pooled links are stored with their options")
+	value, err := store.Load("pooled2")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://example.com/b", value)
+}
+
+func TestHandlers_Jobs(t *testing.T) {
+	ip := "localhost"
+	port := strconv.Itoa(findFreePort(t))
+
+	store := storage.NewSafeMap()
+	assert.NoError(t, store.Store("path0", "http://example.com/existing"))
+
+	handlers := handler.CreateHandlers(MockGenerator, store, ip, port)
+	handlers.SetValidator(validator.New(validator.DefaultConfig()).Validate)
+	manager := jobs.NewManager(store, handlers.ProcessJob, jobs.DefaultConfig())
+	assert.NoError(t, manager.Start())
+	handlers.SetJobs(manager, 3)
+	go handlers.Run()
+	time.Sleep(1 * time.Second)
+	t.Cleanup(func() {
+		handlers.Close()
+		manager.Close()
+	})
+
+	type job struct {
+		ID        string `json:"id"`
+		Status    string `json:"status"`
+		Total     int    `json:"total"`
+		Processed int    `json:"processed"`
+		Created   int    `json:"created"`
+		Existed   int    `json:"existed"`
+		Failed    int    `json:"failed"`
+		Errors    []struct {
+			Index  int    `json:"index"`
+			Reason string `json:"reason"`
+		} `json:"errors"`
+		ResultUrl string `json:"result_url"`
+	}
+	base := fmt.Sprintf("http://%s:%s", ip, port)
+	get := func(path string) (*http.Response, []byte) {
+		resp, err := http.Get(base + path)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, resp.Body.Close())
+		}()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp, body
+	}
+
+	resp, err := http.Post(base+"/api/v1/jobs", "text/csv",
+		strings.NewReader("url\nhttp://example.com/existing\nhttp://example.com/new\nftp://example.com\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	var created job
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, "/api/v1/jobs/"+created.ID, resp.Header.Get("Location"))
+	assert.Equal(t, 3, created.Total)
+
+	var finished job
+	assert.Eventually(t, func() bool {
+		_, body := get("/api/v1/jobs/" + created.ID)
+		finished = job{}
+		assert.NoError(t, json.Unmarshal(body, &finished))
+		return finished.Status == storage.JobDone
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 3, finished.Processed)
+	assert.Equal(t, 1, finished.Created)
+	assert.Equal(t, 1, finished.Existed)
+	assert.Equal(t, 1, finished.Failed)
+	if assert.Len(t, finished.Errors, 1) {
+		assert.Equal(t, 2, finished.Errors[0].Index)
+		assert.Equal(t, validator.ReasonSchemeNotAllowed, finished.Errors[0].Reason)
+	}
+
+	resp, body := get(finished.ResultUrl)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/csv; charset=utf-8", resp.Header.Get("Content-Type"))
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	assert.Equal(t, []string{
+		"index,url,key,short_url,existed,error_reason,error_message",
+		fmt.Sprintf("0,http://example.com/existing,path0,%s/path0,true,,", base),
+		fmt.Sprintf("1,http://example.com/new,path1,%s/path1,false,,", base),
+	}, lines[:3])
+	assert.True(t, strings.HasPrefix(lines[3], "2,ftp://example.com,,,false,SCHEME_NOT_ALLOWED,"))
+
+	req, err := http.NewRequest(http.MethodDelete, base+"/api/v1/jobs/"+created.ID, nil)
+	assert.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp, _ = get("/api/v1/jobs/missing")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = http.Post(base+"/api/v1/jobs", "text/csv", strings.NewReader("a\nb\nc\nd\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+func TestHandlers_JobsPathPrefix(t *testing.T) {
+	store := storage.NewSafeMap()
+	handlers := handler.NewHandlers(handler.Options{
+		Generator:  MockGenerator,
+		Storage:    store,
+		PathPrefix: "/s/",
+	})
+	manager := jobs.NewManager(store, handlers.ProcessJob, jobs.DefaultConfig())
+	assert.NoError(t, manager.Start())
+	t.Cleanup(manager.Close)
+	handlers.SetJobs(manager, 3)
+	outer := http.NewServeMux()
+	outer.Handle("/s/", handlers)
+	server := httptest.NewServer(outer)
+	t.Cleanup(server.Close)
+
+	resp, err := http.Post(server.URL+"/s/api/v1/jobs", "text/csv", strings.NewReader("url\nhttp://example.com\n"))
+	assert.NoError(t, err)
+	var created struct {
+		ID        string `json:"id"`
+		ResultUrl string `json:"result_url"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, "/s/api/v1/jobs/"+created.ID, resp.Header.Get("Location"))
+	assert.Equal(t, "/s/api/v1/jobs/"+created.ID+"/result", created.ResultUrl)
+
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get(server.URL + created.ResultUrl)
+		if !assert.NoError(t, err) {
+			return false
+		}
+		assert.NoError(t, resp.Body.Close())
+		return resp.StatusCode == http.StatusOK
+	}, 2*time.Second, 10*time.Millisecond, "result_url must point to a route under the prefix")
+}
+
+func TestHandlers_OpenAPI(t *testing.T) {
+	ip := "localhost"
+	port := strconv.Itoa(findFreePort(t))
+
+	handlers := handler.CreateHandlers(MockGenerator, storage.NewSafeMap(), ip, port)
+	go handlers.Run()
+	time.Sleep(1 * time.Second)
+	t.Cleanup(func() {
+		handlers.Close()
+	})
+
+	base := fmt.Sprintf("http://%s:%s", ip, port)
+	resp, err := http.Get(base + "/openapi.json")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var spec struct {
+		OpenAPI    string                               `json:"openapi"`
+		Paths      map[string]map[string]map[string]any `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]any `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&spec))
+	assert.NoError(t, resp.Body.Close())
+	assert.True(t, strings.HasPrefix(spec.OpenAPI, "3."))
+
+	routes := handlers.Routes()
+	assert.NotEmpty(t, routes)
+	patterns := regexp.MustCompile(`\{(\w+):[^}]*\}`)
+	served := make(map[string]bool)
+	for _, route := range routes {
+		path := patterns.ReplaceAllString(route.Path, "{$1}")
+		method := strings.ToLower(route.Method)
+		served[method+" "+path] = true
+		_, ok := spec.Paths[path][method]
+		assert.True(t, ok, "route %s %s is missing from the OpenAPI document", route.Method, path)
+	}
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			assert.True(t, served[method+" "+path], "documented operation %s %s is not served", method, path)
+		}
+	}
+
+	// Responses of the handlers must only use documented fields.
+	assertDocumented := func(schema string, body io.Reader) {
+		t.Helper()
+		var fields map[string]any
+		assert.NoError(t, json.NewDecoder(body).Decode(&fields))
+		properties := spec.Components.Schemas[schema].Properties
+		assert.NotEmpty(t, properties, "schema %s is missing", schema)
+		for name := range fields {
+			assert.Contains(t, properties, name, "field %s is missing from schema %s", name, schema)
+		}
+	}
+
+	resp, err = http.Post(base+"/api/v1/links", "application/json",
+		strings.NewReader(`{"url": "http://example.com", "redirect": "308", "preview": true, "qr": true}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assertDocumented("LinkResponse", resp.Body)
+	assert.NoError(t, resp.Body.Close())
+
+	resp, err = http.Post(base+"/", "application/json", strings.NewReader(`{"url": "http://example.com/legacy", "qr": true}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assertDocumented("ShortenResponse", resp.Body)
+	assert.NoError(t, resp.Body.Close())
+
+	resp, err = http.Get(base + "/docs")
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+}
+
+type failingStorage struct {
+	storage.Storage
+}
+
+func (failingStorage) Store(string, string) error {
+	return errors.New("connection refused by db-internal:5432")
+}
+
+func TestHandlers_Problems(t *testing.T) {
+	ip := "localhost"
+	port := strconv.Itoa(findFreePort(t))
+
+	handlers := handler.CreateHandlers(MockGenerator, failingStorage{storage.NewSafeMap()}, ip, port)
+	go handlers.Run()
+	time.Sleep(1 * time.Second)
+	t.Cleanup(func() {
+		handlers.Close()
+	})
+
+	type problem struct {
+		Type      string `json:"type"`
+		Title     string `json:"title"`
+		Status    int    `json:"status"`
+		Detail    string `json:"detail"`
+		Instance  string `json:"instance"`
+		Reason    string `json:"reason"`
+		RequestID string `json:"request_id"`
+	}
+	base := fmt.Sprintf("http://%s:%s", ip, port)
+	do := func(method, path, requestID, body string) (*http.Response, problem, string) {
+		req, err := http.NewRequest(method, base+path, strings.NewReader(body))
+		assert.NoError(t, err)
+		if requestID != "" {
+			req.Header.Set("X-Request-ID", requestID)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, resp.Body.Close())
+		}()
+		raw, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		var decoded problem
+		assert.NoError(t, json.Unmarshal(raw, &decoded))
+		return resp, decoded, string(raw)
+	}
+
+	resp, p, _ := do(http.MethodGet, "/missing", "trace-1", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "trace-1", resp.Header.Get("X-Request-ID"))
+	assert.Equal(t, problem{
+		Type:      "urn:shortener:error:NOT_FOUND",
+		Title:     "Not found",
+		Status:    http.StatusNotFound,
+		Detail:    "link not found",
+		Instance:  "/missing",
+		Reason:    "NOT_FOUND",
+		RequestID: "trace-1",
+	}, p)
+
+	resp, p, _ = do(http.MethodGet, "/api/v1/links/missing", "bad id with spaces", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NotEmpty(t, p.RequestID)
+	assert.NotEqual(t, "bad id with spaces", p.RequestID, "malformed request IDs must be replaced")
+	assert.Equal(t, p.RequestID, resp.Header.Get("X-Request-ID"))
+
+	resp, p, raw := do(http.MethodPost, "/api/v1/links", "", `{"url": "http://example.com"}`)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, "INTERNAL", p.Reason)
+	assert.Equal(t, "internal error", p.Detail)
+	assert.NotContains(t, raw, "db-internal", "internal errors must not leak")
+
+	resp, p, raw = do(http.MethodPost, "/", "", `{"url": "http://example.com"}`)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, "INTERNAL", p.Reason)
+	assert.NotContains(t, raw, "db-internal")
+
+	resp, p, _ = do(http.MethodPost, "/", "", `not json`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "INVALID_REQUEST", p.Reason)
+
+	resp, p, _ = do(http.MethodDelete, "/page", "", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, "METHOD_NOT_ALLOWED", p.Reason)
+	assert.NotEmpty(t, p.RequestID)
+}
+
+func TestHandlers_PublicUrl(t *testing.T) {
+	ip := "localhost"
+	port := strconv.Itoa(findFreePort(t))
+	base := fmt.Sprintf("http://%s:%s", ip, port)
+
+	handlers := handler.CreateHandlers(MockGenerator, storage.NewSafeMap(), ip, port)
+	resolver, err := publicurl.New(publicurl.Config{TrustedProxies: []string{"127.0.0.1", "::1"}, Fallback: base})
+	assert.NoError(t, err)
+	handlers.SetPublicUrl(resolver)
+	go handlers.Run()
+	time.Sleep(1 * time.Second)
+	t.Cleanup(func() {
+		handlers.Close()
+	})
+
+	do := func(method, path string, headers map[string]string, body string) string {
+		req, err := http.NewRequest(method, base+path, strings.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, resp.Body.Close())
+		}()
+		raw, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return string(raw)
+	}
+	forwarded := map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "sho.rt"}
+
+	var link struct {
+		ShortUrl string `json:"short_url"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(do(http.MethodPost, "/api/v1/links", forwarded, `{"url": "http://example.com"}`)), &link))
+	assert.Equal(t, "https://sho.rt/path0", link.ShortUrl)
+
+	var legacy struct {
+		URL string `json:"URL"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(do(http.MethodPost, "/", map[string]string{"Forwarded": "proto=https;host=go.sho.rt"}, `{"url": "http://example.com"}`)), &legacy))
+	assert.Equal(t, "https://go.sho.rt/path0", legacy.URL)
+
+	assert.NoError(t, json.Unmarshal([]byte(do(http.MethodGet, "/api/v1/links/path0", nil, "")), &link))
+	assert.Equal(t, base+"/path0", link.ShortUrl)
+
+	assert.Contains(t, do(http.MethodGet, "/page", forwarded, ""), `https:\/\/sho.rt`)
+
+	resolver, err = publicurl.New(publicurl.Config{BaseUrl: "https://public.rt/s", Fallback: base})
+	assert.NoError(t, err)
+	handlers.SetPublicUrl(resolver)
+	assert.NoError(t, json.Unmarshal([]byte(do(http.MethodGet, "/api/v1/links/path0", forwarded, "")), &link))
+	assert.Equal(t, "https://public.rt/s/path0", link.ShortUrl)
+}
+
+func TestHandlers_Instances(t *testing.T) {
+	create := func() (string, *handler.Handlers) {
+		port := strconv.Itoa(findFreePort(t))
+		handlers := handler.NewHandlers(handler.Options{
+			Generator: MockGenerator,
+			Storage:   storage.NewSafeMap(),
+			Addr:      "localhost:" + port,
+		})
+		go handlers.Run()
+		t.Cleanup(func() {
+			handlers.Close()
+		})
+		return "http://localhost:" + port, handlers
+	}
+	first, _ := create()
+	second, _ := create()
+	time.Sleep(1 * time.Second)
+
+	for _, base := range []string{first, second} {
+		resp, err := http.Post(base+"/api/v1/links", "application/json", strings.NewReader(`{"url": "http://example.com"}`))
+		assert.NoError(t, err)
+		var link struct {
+			ShortUrl string `json:"short_url"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&link))
+		assert.NoError(t, resp.Body.Close())
+		assert.Equal(t, base+"/path0", link.ShortUrl, "each instance must build links on its own address")
+	}
+}
+
+func TestHandlers_PathPrefix(t *testing.T) {
+	store := storage.NewSafeMap()
+	handlers := handler.NewHandlers(handler.Options{
+		Generator:  MockGenerator,
+		Storage:    store,
+		PathPrefix: "/s/",
+	})
+	outer := http.NewServeMux()
+	outer.Handle("/s/", handlers)
+	server := httptest.NewServer(outer)
+	t.Cleanup(server.Close)
+	handlers.SetPublicUrl(publicurl.Static(server.URL + "/s"))
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	resp, err := client.Post(server.URL+"/s/api/v1/links", "application/json", strings.NewReader(`{"url": "http://example.com", "preview": true}`))
+	assert.NoError(t, err)
+	var link struct {
+		ShortUrl string `json:"short_url"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&link))
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "/s/api/v1/links/path0", resp.Header.Get("Location"))
+	assert.Equal(t, server.URL+"/s/path0", link.ShortUrl)
+
+	resp, err = client.Get(link.ShortUrl)
+	assert.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), `href="/s/preview/path0/continue"`)
+	assert.Contains(t, string(body), `action="/s/preview/path0"`)
+
+	resp, err = client.Get(server.URL + "/s/preview/path0/continue")
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "http://example.com", resp.Header.Get("Location"))
+
+	resp, err = client.Get(server.URL + "/s/docs")
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Handlers is a plain http.Handler, so it can be wrapped as well.
+	wrapped := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Wrapped", "1")
+		handlers.ServeHTTP(w, r)
+	}))
+	t.Cleanup(wrapped.Close)
+	resp, err = client.Get(wrapped.URL + "/s/api/v1/links/path0")
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("X-Wrapped"))
+
+	resp, err = client.Get(wrapped.URL + "/api/v1/links/path0")
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "paths outside the prefix must not be served")
+}
+
+func TestHandlers_Readiness(t *testing.T) {
+	handlers := handler.NewHandlers(handler.Options{Generator: MockGenerator, Storage: storage.NewSafeMap()})
+	server := httptest.NewServer(handlers)
+	t.Cleanup(server.Close)
+
+	get := func() (int, string) {
+		resp, err := http.Get(server.URL + "/readyz")
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, resp.Body.Close())
+		}()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := get()
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"status": "ready"}`, body)
+
+	ready := true
+	handlers.SetReadiness(func() bool { return ready })
+	status, _ = get()
+	assert.Equal(t, http.StatusOK, status)
+
+	ready = false
+	status, body = get()
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Contains(t, body, `"reason":"NOT_READY"`)
+}
+
+func TestHandlers_RateLimit(t *testing.T) {
+	handlers := handler.NewHandlers(handler.Options{Generator: MockGenerator, Storage: storage.NewSafeMap()})
+	handlers.SetRateLimiter(ratelimit.New(ratelimit.NewMemory(), ratelimit.Config{
+		Policies: map[string]ratelimit.Policy{
+			ratelimit.ClassCreate:   {Rate: 0.01, Burst: 1},
+			ratelimit.ClassRedirect: {Rate: 0.01, Burst: 2},
+		},
+	}))
+	server := httptest.NewServer(handlers)
+	t.Cleanup(server.Close)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	create := func() *http.Response {
+		resp, err := client.Post(server.URL+"/api/v1/links", "application/json", strings.NewReader(`{"url": "https://example.com"}`))
+		assert.NoError(t, err)
+		return resp
+	}
+	resp := create()
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = create()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "100", resp.Header.Get("Retry-After"))
+	assert.Contains(t, string(body), `"reason":"RATE_LIMITED"`)
+
+	for i := 0; i < 2; i++ {
+		resp, err = client.Get(server.URL + "/path0")
+		assert.NoError(t, err)
+		assert.NoError(t, resp.Body.Close())
+		assert.Equal(t, http.StatusFound, resp.StatusCode, "redirects have their own policy")
+	}
+	resp, err = client.Get(server.URL + "/path0")
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	resp, err = client.Get(server.URL + "/api/v1/links/path0")
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "lookups are not limited")
+}
+
+func TestHandlers_LoginRateLimit(t *testing.T) {
+	st := storage.NewSafeMap()
+	users := auth.NewUsers(st)
+	_, err := users.Create("alice", "alice password", auth.RoleUser)
+	assert.NoError(t, err)
+	_, err = users.Create("bob", "bob password", auth.RoleUser)
+	assert.NoError(t, err)
+	handlers := handler.NewHandlers(handler.Options{Generator: MockGenerator, Storage: st})
+	handlers.SetUsers(users)
+	handlers.SetSessions(auth.NewSessions(st, st, auth.SessionConfig{TTL: time.Hour}), false)
+	handlers.SetRateLimiter(ratelimit.New(ratelimit.NewMemory(), ratelimit.Config{
+		Policies: map[string]ratelimit.Policy{ratelimit.ClassLogin: {Rate: 0.01, Burst: 2}},
+	}))
+	server := httptest.NewServer(handlers)
+	t.Cleanup(server.Close)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	resp, err := client.Get(server.URL + "/login")
+	assert.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	token := regexp.MustCompile(`name="csrf_token" value="([^"]+)"`).FindStringSubmatch(string(body))
+	if !assert.Len(t, token, 2) || !assert.Len(t, resp.Cookies(), 1) {
+		return
+	}
+	csrf := resp.Cookies()[0]
+	login := func(username string, password string) *http.Response {
+		form := url.Values{"username": {username}, "password": {password}, "csrf_token": {token[1]}}
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/login", strings.NewReader(form.Encode()))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(csrf)
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		assert.NoError(t, resp.Body.Close())
+		return resp
+	}
+	basic := func(username string, password string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/api/v1/links", nil)
+		assert.NoError(t, err)
+		req.SetBasicAuth(username, password)
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		assert.NoError(t, resp.Body.Close())
+		return resp
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, login("alice", "wrong").StatusCode)
+	assert.Equal(t, http.StatusSeeOther, login("alice", "alice password").StatusCode)
+	resp = login("alice", "alice password")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "every sign-in attempt counts")
+	assert.Equal(t, "100", resp.Header.Get("Retry-After"))
+
+	assert.Equal(t, http.StatusOK, basic("bob", "bob password").StatusCode, "successful authentications are not counted")
+	resp = basic("bob", "wrong")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "failed authentications count against the same limit")
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+}
+
+func TestHandlers_ApiKeys(t *testing.T) {
+	keys := auth.NewKeys(storage.NewSafeMap())
+	keys.SetBootstrap("bootstrap-secret")
+	handlers := handler.NewHandlers(handler.Options{Generator: MockGenerator, Storage: storage.NewSafeMap()})
+	handlers.SetKeys(keys)
+	server := httptest.NewServer(handlers)
+	t.Cleanup(server.Close)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	do := func(method string, path string, token string, body string) (*http.Response, string) {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		assert.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, resp.Body.Close())
+		}()
+		data, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp, string(data)
+	}
+
+	resp, body := do(http.MethodPost, "/api/v1/links", "", `{"url": "https://example.com"}`)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, "Bearer", resp.Header.Get("WWW-Authenticate"))
+	assert.Contains(t, body, `"reason":"UNAUTHENTICATED"`)
+
+	resp, _ = do(http.MethodPost, "/api/v1/admin/keys", "sk_wrong_secret", `{"name": "ci", "scopes": ["links:create"]}`)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, body = do(http.MethodPost, "/api/v1/admin/keys", "bootstrap-secret", `{"name": "ci", "scopes": ["links:create"], "expires_in": "24h"}`)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	var created struct {
+		ID        string    `json:"id"`
+		Token     string    `json:"token"`
+		Scopes    []string  `json:"scopes"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &created))
+	assert.NotEmpty(t, created.Token)
+	assert.Equal(t, []string{"links:create"}, created.Scopes)
+	assert.False(t, created.ExpiresAt.IsZero())
+
+	resp, body = do(http.MethodPost, "/api/v1/admin/keys", "bootstrap-secret", `{"name": "bad", "scopes": ["links:write"]}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, body, "links:write")
+
+	resp, _ = do(http.MethodPost, "/api/v1/links", created.Token, `{"url": "https://example.com"}`)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, body = do(http.MethodGet, "/api/v1/links/path0", created.Token, "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Contains(t, body, `"reason":"FORBIDDEN"`)
+
+	resp, _ = do(http.MethodGet, "/api/v1/admin/keys", created.Token, "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, _ = do(http.MethodGet, "/path0", "", "")
+	assert.Equal(t, http.StatusFound, resp.StatusCode, "redirects stay open")
+
+	resp, body = do(http.MethodGet, "/api/v1/admin/keys", "bootstrap-secret", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, created.ID)
+	assert.NotContains(t, body, created.Token)
+
+	resp, _ = do(http.MethodDelete, "/api/v1/admin/keys/"+created.ID, "bootstrap-secret", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = do(http.MethodDelete, "/api/v1/admin/keys/"+created.ID, "bootstrap-secret", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = do(http.MethodPost, "/api/v1/links", created.Token, `{"url": "https://example.org"}`)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "revoked keys must be rejected")
+}
+
+func TestHandlers_ApiKeysDisabled(t *testing.T) {
+	handlers := handler.NewHandlers(handler.Options{Generator: MockGenerator, Storage: storage.NewSafeMap()})
+	server := httptest.NewServer(handlers)
+	t.Cleanup(server.Close)
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/api/v1/links", strings.NewReader(`{"url": "https://example.com"}`))
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer anything")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusCreated, resp.StatusCode, "without keys the API stays open")
+
+	resp, err = http.Get(server.URL + "/api/v1/admin/keys")
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+}
+
+func TestHandlers_Users(t *testing.T) {
+	st := storage.NewSafeMap()
+	keys := auth.NewKeys(st)
+	keys.SetBootstrap("bootstrap-secret")
+	handlers := handler.NewHandlers(handler.Options{Generator: MockGenerator, Storage: st})
+	handlers.SetKeys(keys)
+	handlers.SetUsers(auth.NewUsers(st))
+	manager := jobs.NewManager(st, handlers.ProcessJob, jobs.DefaultConfig())
+	assert.NoError(t, manager.Start())
+	t.Cleanup(manager.Close)
+	handlers.SetJobs(manager, 10)
+	server := httptest.NewServer(handlers)
+	t.Cleanup(server.Close)
+
+	do := func(method string, path string, authorization string, body string) (*http.Response, string) {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		assert.NoError(t, err)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, resp.Body.Close())
+		}()
+		data, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp, string(data)
+	}
+	basic := func(username, password string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+	admin := "Bearer bootstrap-secret"
+	alice, bob := basic("alice", "alice password"), basic("bob", "bob password")
+
+	resp, body := do(http.MethodPost, "/api/v1/admin/users", admin, `{"username": "alice", "password": "alice password"}`)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	var created struct {
+		ID   string `json:"id"`
+		Role string `json:"role"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &created))
+	assert.Equal(t, auth.RoleUser, created.Role)
+	assert.NotContains(t, body, "alice password")
+
+	resp, _ = do(http.MethodPost, "/api/v1/admin/users", admin, `{"username": "bob", "password": "bob password"}`)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, body = do(http.MethodPost, "/api/v1/admin/users", admin, `{"username": "alice", "password": "another password"}`)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Contains(t, body, `"reason":"ALREADY_EXISTS"`)
+	resp, _ = do(http.MethodPost, "/api/v1/admin/users", admin, `{"username": "carol", "password": "short"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = do(http.MethodPost, "/api/v1/admin/users", alice, `{"username": "carol", "password": "carol password"}`)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "only admins create accounts")
+
+	resp, _ = do(http.MethodPost, "/api/v1/links", basic("alice", "wrong password"), `{"url": "https://example.com"}`)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, body = do(http.MethodPost, "/api/v1/links", alice, `{"url": "https://example.com"}`)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Contains(t, body, `"owner":"user:`+created.ID+`"`)
+	resp, _ = do(http.MethodPost, "/api/v1/links", alice, `{"url": "https://example.com"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "the owner's link is reused")
+	resp, body = do(http.MethodPost, "/api/v1/links", bob, `{"url": "https://example.com"}`)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode, "links of other users are not reused")
+	assert.Contains(t, body, `"key":"path1"`)
+	resp, _ = do(http.MethodPost, "/api/v1/links/bulk", bob, `[{"url": "https://example.org"}]`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body = do(http.MethodGet, "/api/v1/me/links", bob, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var mine struct {
+		Links []struct {
+			Key string `json:"key"`
+		} `json:"links"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &mine))
+	assert.Len(t, mine.Links, 2)
+	resp, body = do(http.MethodGet, "/api/v1/me/links", alice, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, `"key":"path0"`)
+	assert.NotContains(t, body, `"key":"path1"`)
+
+	resp, body = do(http.MethodPatch, "/api/v1/links/path0", bob, `{"url": "https://evil.example"}`)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Contains(t, body, `"reason":"FORBIDDEN"`)
+	resp, _ = do(http.MethodDelete, "/api/v1/links/path0", bob, "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _ = do(http.MethodPatch, "/api/v1/links/path0", alice, `{"url": "https://example.net"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = do(http.MethodDelete, "/api/v1/links/path1", admin, "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode, "admins may delete any link")
+	resp, _ = do(http.MethodDelete, "/api/v1/links/path0", alice, "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = do(http.MethodDelete, "/api/v1/links/path0", alice, "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, body = do(http.MethodPost, "/api/v1/jobs", alice, `[{"url": "https://example.com/job"}]`)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	var job struct {
+		ID string `json:"id"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &job))
+	for _, path := range []string{"/api/v1/jobs/" + job.ID, "/api/v1/jobs/" + job.ID + "/result"} {
+		resp, _ = do(http.MethodGet, path, bob, "")
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, "jobs of other users are hidden")
+		resp, _ = do(http.MethodGet, path, alice, "")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp, _ = do(http.MethodGet, path, admin, "")
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "admins may see any job")
+	}
+	resp, _ = do(http.MethodDelete, "/api/v1/jobs/"+job.ID, bob, "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestHandlers_Sessions(t *testing.T) {
+	now := time.Now()
+	st := storage.NewSafeMap()
+	users := auth.NewUsers(st)
+	_, err := users.Create("alice", "alice password", auth.RoleUser)
+	assert.NoError(t, err)
+	handlers := handler.NewHandlers(handler.Options{Generator: MockGenerator, Storage: st})
+	handlers.SetUsers(users)
+	handlers.SetSessions(auth.NewSessionsWithClock(st, st, auth.SessionConfig{TTL: time.Hour}, func() time.Time { return now }), true)
+	server := httptest.NewServer(handlers)
+	t.Cleanup(server.Close)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	do := func(method string, path string, cookies []*http.Cookie, header http.Header, body string) (*http.Response, string) {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		assert.NoError(t, err)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, resp.Body.Close())
+		}()
+		data, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp, string(data)
+	}
+	form := http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+	csrfToken := func(body string) string {
+		match := regexp.MustCompile(`name="csrf_token" value="([^"]+)"`).FindStringSubmatch(body)
+		if assert.Len(t, match, 2) {
+			return match[1]
+		}
+		return ""
+	}
+	cookie := func(resp *http.Response, name string) *http.Cookie {
+		for _, c := range resp.Cookies() {
+			if c.Name == name {
+				return c
+			}
+		}
+		return nil
+	}
+
+	resp, body := do(http.MethodGet, "/page", nil, nil, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, `href="/login"`)
+
+	resp, body = do(http.MethodGet, "/login", nil, nil, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	loginCSRF := cookie(resp, "login_csrf")
+	if !assert.NotNil(t, loginCSRF) {
+		return
+	}
+	token := csrfToken(body)
+	assert.Equal(t, loginCSRF.Value, token)
+
+	credentials := url.Values{"username": {"alice"}, "password": {"alice password"}}
+	resp, _ = do(http.MethodPost, "/login", nil, form, credentials.Encode()+"&csrf_token="+token)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "the login form needs its CSRF cookie")
+	resp, _ = do(http.MethodPost, "/login", []*http.Cookie{loginCSRF}, form, "username=alice&password=wrong+password&csrf_token="+token)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, _ = do(http.MethodPost, "/login", []*http.Cookie{loginCSRF}, form, credentials.Encode()+"&csrf_token="+token)
+	assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	assert.Equal(t, "/page", resp.Header.Get("Location"))
+	session := cookie(resp, "session")
+	if !assert.NotNil(t, session) {
+		return
+	}
+	assert.True(t, session.HttpOnly)
+	assert.True(t, session.Secure)
+	assert.Equal(t, 3600, session.MaxAge)
+	sessionCookies := []*http.Cookie{{Name: "session", Value: session.Value}}
+
+	resp, body = do(http.MethodGet, "/page", sessionCookies, nil, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "<b>alice</b>")
+	csrf := csrfToken(body)
+
+	resp, _ = do(http.MethodPost, "/api/v1/links", sessionCookies, nil, `{"url": "https://example.com"}`)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "cookies do not authenticate unsafe requests without the CSRF token")
+	resp, _ = do(http.MethodPost, "/api/v1/links", sessionCookies, http.Header{"X-Csrf-Token": {csrf}}, `{"url": "https://example.com"}`)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, body = do(http.MethodGet, "/page", sessionCookies, nil, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "https://example.com")
+	assert.Contains(t, body, "/path0")
+
+	resp, _ = do(http.MethodGet, "/login", sessionCookies, nil, "")
+	assert.Equal(t, http.StatusSeeOther, resp.StatusCode, "signed-in browsers skip the login page")
+
+	resp, _ = do(http.MethodPost, "/logout", sessionCookies, form, "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _ = do(http.MethodPost, "/logout", sessionCookies, form, "csrf_token="+csrf)
+	assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	assert.Equal(t, -1, cookie(resp, "session").MaxAge)
+	resp, body = do(http.MethodGet, "/page", sessionCookies, nil, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotContains(t, body, "alice", "ended sessions must be rejected")
+
+	resp, body = do(http.MethodGet, "/login", nil, nil, "")
+	loginCSRF, token = cookie(resp, "login_csrf"), csrfToken(body)
+	resp, _ = do(http.MethodPost, "/login", []*http.Cookie{loginCSRF}, form, credentials.Encode()+"&csrf_token="+token)
+	sessionCookies = []*http.Cookie{{Name: "session", Value: cookie(resp, "session").Value}}
+	now = now.Add(time.Hour)
+	resp, body = do(http.MethodGet, "/page", sessionCookies, nil, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotContains(t, body, "alice", "expired sessions must be rejected")
+}
+
+func TestHandlers_TOTP(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	st := storage.NewSafeMap()
+	keys := auth.NewKeys(st)
+	keys.SetBootstrap("bootstrap-secret")
+	users := auth.NewUsers(st)
+	totp := auth.NewTOTPWithClock(st, auth.TOTPConfig{RequiredRoles: []string{auth.RoleAdmin}}, clock)
+	users.SetTOTP(totp)
+	sessions := auth.NewSessionsWithClock(st, st, auth.SessionConfig{}, clock)
+	sessions.SetTOTP(totp)
+	root, err := users.Create("root", "root password", auth.RoleAdmin)
+	assert.NoError(t, err)
+	handlers := handler.NewHandlers(handler.Options{Generator: MockGenerator, Storage: st})
+	handlers.SetKeys(keys)
+	handlers.SetUsers(users)
+	handlers.SetSessions(sessions, false)
+	handlers.SetTOTP(totp)
+	server := httptest.NewServer(handlers)
+	t.Cleanup(server.Close)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	do := func(method string, path string, header http.Header, body string) (*http.Response, string) {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		assert.NoError(t, err)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		if body != "" && req.Header.Get("Content-Type") == "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, resp.Body.Close())
+		}()
+		data, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp, string(data)
+	}
+	basic := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("root:root password"))}}
+	bootstrap := http.Header{"Authorization": {"Bearer bootstrap-secret"}}
+	userRequest := `{"username": "alice", "password": "alice password"}`
+
+	resp, body := do(http.MethodPost, "/api/v1/admin/users", basic, userRequest)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "admins must enrol before using their scopes")
+	assert.Contains(t, body, "two-factor authentication must be set up first")
+
+	resp, body = do(http.MethodGet, "/api/v1/me/totp", basic, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"enabled": false, "required": true, "recovery_codes_left": 0}`, body)
+	resp, _ = do(http.MethodGet, "/api/v1/me/totp", bootstrap, "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "API keys have no second factor")
+
+	resp, body = do(http.MethodPost, "/api/v1/me/totp", basic, "")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	var enrollment struct {
+		Secret        string   `json:"secret"`
+		URI           string   `json:"uri"`
+		QRCode        string   `json:"qr_code"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &enrollment))
+	assert.Contains(t, enrollment.URI, "secret="+enrollment.Secret)
+	assert.True(t, strings.HasPrefix(enrollment.QRCode, "data:image/png;base64,"))
+	assert.Len(t, enrollment.RecoveryCodes, auth.RecoveryCodeCount)
+
+	resp, body = do(http.MethodPost, "/api/v1/me/totp/confirm", basic, `{"code": "000000"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, body, `"reason":"INVALID_REQUEST"`)
+	code, err := auth.TOTPCode(enrollment.Secret, now)
+	assert.NoError(t, err)
+	resp, _ = do(http.MethodPost, "/api/v1/me/totp/confirm", basic, `{"code": "`+code+`"}`)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, _ = do(http.MethodPost, "/api/v1/me/totp", basic, "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "enrolled users cannot use basic credentials alone")
+
+	resp, body = do(http.MethodGet, "/login", nil, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, `name="code"`)
+	loginCSRF := regexp.MustCompile(`name="csrf_token" value="([^"]+)"`).FindStringSubmatch(body)[1]
+	form := http.Header{
+		"Content-Type": {"application/x-www-form-urlencoded"},
+		"Cookie":       {"login_csrf=" + loginCSRF},
+	}
+	login := url.Values{"username": {"root"}, "password": {"root password"}, "csrf_token": {loginCSRF}}
+	resp, body = do(http.MethodPost, "/login", form, login.Encode())
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, body, "Введите код")
+	login.Set("code", code)
+	resp, _ = do(http.MethodPost, "/login", form, login.Encode())
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "the confirmation code must not be replayed")
+
+	login.Set("code", enrollment.RecoveryCodes[0])
+	resp, _ = do(http.MethodPost, "/login", form, login.Encode())
+	assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	var session string
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "session" {
+			session = cookie.Value
+		}
+	}
+	resp, body = do(http.MethodGet, "/page", http.Header{"Cookie": {"session=" + session}}, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	csrf := regexp.MustCompile(`name="csrf_token" value="([^"]+)"`).FindStringSubmatch(body)[1]
+	signedIn := http.Header{"Cookie": {"session=" + session}, "X-Csrf-Token": {csrf}}
+	resp, _ = do(http.MethodPost, "/api/v1/admin/users", signedIn, userRequest)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, body = do(http.MethodGet, "/api/v1/me/totp", signedIn, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"enabled": true, "required": true, "recovery_codes_left": 9}`, body)
+
+	resp, _ = do(http.MethodDelete, "/api/v1/admin/users/unknown/totp", bootstrap, "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = do(http.MethodDelete, "/api/v1/admin/users/"+root.ID+"/totp", bootstrap, "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = do(http.MethodPost, "/api/v1/admin/users", signedIn, `{"username": "bob", "password": "bob password"}`)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "after a reset the admin has to enrol again")
+}
+
+func TestHandlers_JWT(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	encode := base64.RawURLEncoding.EncodeToString
+	set := fmt.Sprintf(`{"keys": [{"kty": "EC", "kid": "k1", "crv": "P-256", "x": %q, "y": %q}]}`,
+		encode(key.X.FillBytes(make([]byte, 32))), encode(key.Y.FillBytes(make([]byte, 32))))
+	sign := func(claims string) string {
+		input := encode([]byte(`{"alg":"ES256","kid":"k1"}`)) + "." + encode([]byte(claims))
+		digest := sha256.Sum256([]byte(input))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		assert.NoError(t, err)
+		return input + "." + encode(append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...))
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+
+	st := storage.NewSafeMap()
+	keys := auth.NewKeys(st)
+	keys.SetBootstrap("bootstrap-secret")
+	tokens := auth.NewJWT(func() ([]byte, error) { return []byte(set), nil }, auth.JWTConfig{AdminGroups: []string{"admins"}, UserGroups: []string{"staff"}})
+	handlers := handler.NewHandlers(handler.Options{Generator: MockGenerator, Storage: st})
+	handlers.SetKeys(keys)
+	handlers.SetTokens(tokens)
+	server := httptest.NewServer(handlers)
+	t.Cleanup(server.Close)
+
+	do := func(method string, path string, token string, body string) (*http.Response, string) {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, resp.Body.Close())
+		}()
+		data, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp, string(data)
+	}
+	alice := sign(fmt.Sprintf(`{"sub": "alice-id", "groups": ["staff"], "exp": %d}`, exp))
+	bob := sign(fmt.Sprintf(`{"sub": "bob-id", "exp": %d}`, exp))
+	admin := sign(fmt.Sprintf(`{"sub": "root-id", "groups": ["admins"], "exp": %d}`, exp))
+
+	resp, body := do(http.MethodPost, "/api/v1/links", alice, `{"url": "https://example.com"}`)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Contains(t, body, `"owner":"jwt:alice-id"`)
+	resp, _ = do(http.MethodDelete, "/api/v1/links/path0", bob, "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "other subjects do not own the link")
+	resp, body = do(http.MethodGet, "/api/v1/me/links", alice, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, `"key":"path0"`)
+
+	resp, _ = do(http.MethodGet, "/api/v1/admin/keys", alice, "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _ = do(http.MethodGet, "/api/v1/admin/keys", admin, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "admin groups get the admin role")
+	resp, _ = do(http.MethodDelete, "/api/v1/links/path0", admin, "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, body = do(http.MethodGet, "/api/v1/me/links", sign(fmt.Sprintf(`{"sub": "alice-id", "exp": %d}`, time.Now().Add(-time.Hour).Unix())), "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, body, "token expired")
+	resp, _ = do(http.MethodGet, "/api/v1/admin/keys", "bootstrap-secret", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "API keys keep working next to JWTs")
+}
@@ -1,13 +1,27 @@
 package tests
 
 import (
+	"OZON_test/internal/auth"
 	"OZON_test/internal/handler"
 	pb "OZON_test/internal/handler/proto"
+	"OZON_test/internal/ratelimit"
 	"OZON_test/internal/storage"
+	"OZON_test/internal/urlnorm"
+	"OZON_test/internal/validator"
+	"bytes"
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"strings"
 	"testing"
 )
 
@@ -36,6 +50,11 @@ func newMockStorage() storage.Storage {
 	return &MockStorage{data: make(map[string]string)}
 }
 
+// keyOf extracts the key from a short URL.
+func keyOf(shortUrl string) string {
+	return shortUrl[strings.LastIndex(shortUrl, "/")+1:]
+}
+
 func TestUrlServer_GenerateKey(t *testing.T) {
 	mockStorage := newMockStorage()
 	server := handler.NewUrlServer(MockGenerator, &mockStorage, "localhost")
@@ -51,14 +70,14 @@ func TestUrlServer_GenerateKey(t *testing.T) {
 			name:        "New URL",
 			url:         "http://example.com",
 			wantMessage: "Data received successfully",
-			wantKey:     "path0",
+			wantKey:     "http://localhost/path0",
 			wantErr:     false,
 		},
 		{
 			name:        "Duplicate URL",
 			url:         "http://example.com",
 			wantMessage: "Data already received",
-			wantKey:     "path0",
+			wantKey:     "http://localhost/path0",
 			wantErr:     false,
 		},
 		{
@@ -148,3 +167,465 @@ func TestGenerateKey_GeneratorError(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "failed to generate key")
 }
+
+func TestGenerateKey_Sequence(t *testing.T) {
+	var st storage.Storage = storage.NewSafeMap()
+	next := 0
+	sequence := func(string, int) (string, error) {
+		next++
+		return fmt.Sprintf("seq%d", next), nil
+	}
+	server := handler.NewUrlServer(sequence, &st, "localhost")
+
+	first, err := server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{Url: "http://example.com"})
+	assert.NoError(t, err)
+	second, err := server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{Url: "http://example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost/seq1", first.ShortUrl)
+	assert.Equal(t, first.ShortUrl, second.ShortUrl, "keys that ignore the url must still be deduplicated")
+	assert.Equal(t, "Data already received", second.Message)
+	assert.Equal(t, 1, next)
+
+	preview, err := server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{Url: "http://example.com", Preview: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost/seq2", preview.ShortUrl, "links with other options are not reused")
+}
+
+// racingStorage stores a link of a concurrent request right after Load
+// found the key free.
+type racingStorage struct {
+	*storage.SafeStringMap
+	racer storage.Link
+}
+
+func (s *racingStorage) Load(key string) (string, error) {
+	value, err := s.SafeStringMap.Load(key)
+	if err != nil && key == s.racer.Key {
+		_ = s.SafeStringMap.StoreBatch([]storage.Link{s.racer})
+	}
+	return value, err
+}
+
+func TestGenerateKey_Race(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		racer   storage.Link
+		wantUrl string
+		message string
+	}{
+		{name: "SameLink", racer: storage.Link{Key: "path0", Url: "http://example.com"}, wantUrl: "http://localhost/path0", message: "Data already received"},
+		{name: "OtherUrl", racer: storage.Link{Key: "path0", Url: "http://example.org"}, wantUrl: "http://localhost/path1", message: "Data received successfully"},
+		{name: "OtherOwner", racer: storage.Link{Key: "path0", Url: "http://example.com", Owner: "user:1"}, wantUrl: "http://localhost/path1", message: "Data received successfully"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var st storage.Storage = &racingStorage{SafeStringMap: storage.NewSafeMap(), racer: tt.racer}
+			server := handler.NewUrlServer(MockGenerator, &st, "localhost")
+
+			resp, err := server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{Url: "http://example.com"})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantUrl, resp.ShortUrl)
+			assert.Equal(t, tt.message, resp.Message)
+			value, err := st.Load("path0")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.racer.Url, value, "the link of the concurrent request is kept")
+		})
+	}
+}
+
+type stubIssuer struct {
+	storage storage.Storage
+	issued  int
+}
+
+func (s *stubIssuer) Issue(url string) (string, error) {
+	s.issued++
+	key := fmt.Sprintf("pooled%d", s.issued)
+	return key, s.storage.Store(key, url)
+}
+
+func TestGenerateKey_Issuer(t *testing.T) {
+	mockStorage := newMockStorage()
+	server := handler.NewUrlServer(MockGenerator, &mockStorage, "localhost")
+	issuer := &stubIssuer{storage: mockStorage}
+	server.SetIssuer(issuer)
+
+	resp, err := server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{Url: "http://example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost/pooled1", resp.ShortUrl)
+	assert.Equal(t, 1, issuer.issued)
+
+	value, err := mockStorage.Load("pooled1")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://example.com", value)
+}
+
+func TestGenerateKey_IssuerRepeatedUrl(t *testing.T) {
+	var st storage.Storage = storage.NewSafeMap()
+	server := handler.NewUrlServer(MockGenerator, &st, "localhost")
+	issuer := &stubIssuer{storage: st}
+	server.SetIssuer(issuer)
+
+	for range 3 {
+		resp, err := server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{Url: "http://example.com"})
+		assert.NoError(t, err)
+		assert.Equal(t, "http://localhost/pooled1", resp.ShortUrl)
+	}
+	assert.Equal(t, 1, issuer.issued, "repeated urls must not use up pooled keys")
+
+	resp, err := server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{Url: "http://example.com/other"})
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost/pooled2", resp.ShortUrl)
+}
+
+// failingOptionsStorage cannot store link options.
+type failingOptionsStorage struct {
+	*storage.SafeStringMap
+}
+
+func (s failingOptionsStorage) StoreOptions(string, storage.LinkOptions) error {
+	return errors.New("options unavailable")
+}
+
+func TestGenerateKey_IssuerRollback(t *testing.T) {
+	var st storage.Storage = failingOptionsStorage{SafeStringMap: storage.NewSafeMap()}
+	server := handler.NewUrlServer(MockGenerator, &st, "localhost")
+	server.SetIssuer(&stubIssuer{storage: st})
+
+	_, err := server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{Url: "http://example.com", Preview: true})
+	assert.Error(t, err)
+	_, err = st.Load("pooled1")
+	assert.Error(t, err, "a link without its options must not be left behind")
+}
+
+func TestGenerateKey_Normalizer(t *testing.T) {
+	mockStorage := newMockStorage()
+	server := handler.NewUrlServer(MockGenerator, &mockStorage, "localhost")
+	server.SetNormalizer(func(url string) (string, error) {
+		return urlnorm.Normalize(url, urlnorm.DefaultOptions())
+	})
+
+	first, err := server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{Url: "https://Example.com:443/a/?b=2&a=1"})
+	assert.NoError(t, err)
+	second, err := server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{Url: "https://example.com/a?a=1&b=2"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, first.ShortUrl, second.ShortUrl)
+	assert.Equal(t, "Data already received", second.Message)
+
+	value, err := mockStorage.Load(keyOf(first.ShortUrl))
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/a?a=1&b=2", value)
+
+	_, err = server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{Url: "http://exa mple.com"})
+	assert.Error(t, err)
+}
+
+func TestGenerateKey_Validator(t *testing.T) {
+	mockStorage := newMockStorage()
+	server := handler.NewUrlServer(MockGenerator, &mockStorage, "localhost")
+	server.SetValidator(validator.New(validator.DefaultConfig()).Validate)
+
+	_, err := server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{Url: "javascript:alert(1)"})
+	st, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+	if assert.Len(t, st.Details(), 1) {
+		info, ok := st.Details()[0].(*errdetails.ErrorInfo)
+		assert.True(t, ok)
+		assert.Equal(t, validator.ReasonSchemeNotAllowed, info.Reason)
+	}
+
+	_, err = mockStorage.Load("path0")
+	assert.Error(t, err, "rejected url must not be stored")
+
+	_, err = server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{Url: "https://example.com"})
+	assert.NoError(t, err)
+}
+
+type stubBlocklist map[string]bool
+
+func (b stubBlocklist) Blocked(url string) (string, bool) {
+	return url, b[url]
+}
+
+func TestUrlServer_Blocklist(t *testing.T) {
+	mockStorage := newMockStorage()
+	assert.NoError(t, mockStorage.Store("legacy", "http://evil.com"))
+	server := handler.NewUrlServer(MockGenerator, &mockStorage, "localhost")
+	server.SetBlocklist(stubBlocklist{"http://evil.com": true})
+
+	_, err := server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{Url: "http://evil.com"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = server.Redirect(context.Background(), &pb.RedirectRequest{Key: "legacy"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{Url: "http://example.com"})
+	assert.NoError(t, err)
+}
+
+func TestGenerateKey_Passthrough(t *testing.T) {
+	var store storage.Storage = storage.NewSafeMap()
+	server := handler.NewUrlServer(MockGenerator, &store, "localhost")
+
+	plain, err := server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{Url: "http://example.com"})
+	assert.NoError(t, err)
+
+	withQuery, err := server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{
+		Url:         "http://example.com",
+		Passthrough: &pb.Passthrough{Query: storage.QueryPassthroughIncoming, Path: true},
+	})
+	assert.NoError(t, err)
+	assert.NotEqual(t, plain.ShortUrl, withQuery.ShortUrl, "links with different options must not be deduplicated")
+	assert.Equal(t, "Data received successfully", withQuery.Message)
+
+	again, err := server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{
+		Url:         "http://example.com",
+		Passthrough: &pb.Passthrough{Query: storage.QueryPassthroughIncoming, Path: true},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, withQuery.ShortUrl, again.ShortUrl)
+	assert.Equal(t, "Data already received", again.Message)
+
+	options, err := store.(storage.OptionsStorage).LoadOptions(keyOf(withQuery.ShortUrl))
+	assert.NoError(t, err)
+	assert.Equal(t, storage.Passthrough{Query: storage.QueryPassthroughIncoming, Path: true}, options.Passthrough)
+
+	_, err = server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{
+		Url:         "http://example.com",
+		Passthrough: &pb.Passthrough{Query: "sideways"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestUrlServer_RedirectMode(t *testing.T) {
+	var store storage.Storage = storage.NewSafeMap()
+	server := handler.NewUrlServer(MockGenerator, &store, "localhost")
+
+	created, err := server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{
+		Url:      "http://example.com",
+		Redirect: storage.RedirectPermanent,
+	})
+	assert.NoError(t, err)
+
+	resp, err := server.Redirect(context.Background(), &pb.RedirectRequest{Key: keyOf(created.ShortUrl)})
+	assert.NoError(t, err)
+	assert.Equal(t, "http://example.com", resp.Url)
+	assert.Equal(t, storage.RedirectPermanent, resp.Redirect)
+
+	_, err = server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{
+		Url:      "http://example.com",
+		Redirect: "303",
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestUrlServer_GenerateQr(t *testing.T) {
+	var store storage.Storage = storage.NewSafeMap()
+	assert.NoError(t, store.Store("key", "http://example.com"))
+	server := handler.NewUrlServer(MockGenerator, &store, "localhost")
+	server.SetBaseUrl("https://sho.rt/")
+
+	created, err := server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{Url: "http://example.org"})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://sho.rt/path0", created.ShortUrl)
+
+	resp, err := server.GenerateQr(context.Background(), &pb.GenerateQrRequest{Key: "key"})
+	assert.NoError(t, err)
+	assert.Equal(t, "image/png", resp.ContentType)
+	assert.True(t, bytes.HasPrefix(resp.Image, []byte("\x89PNG")))
+
+	margin := int32(0)
+	resp, err = server.GenerateQr(context.Background(), &pb.GenerateQrRequest{Key: "key", Format: "svg", Margin: &margin})
+	assert.NoError(t, err)
+	assert.Equal(t, "image/svg+xml", resp.ContentType)
+	assert.Contains(t, string(resp.Image), "M0 0h1v1h-1z")
+
+	_, err = server.GenerateQr(context.Background(), &pb.GenerateQrRequest{Key: "key", Level: "Z"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = server.GenerateQr(context.Background(), &pb.GenerateQrRequest{Key: "missing"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestUrlServer_ErrorDetails(t *testing.T) {
+	mockStorage := newMockStorage()
+	server := handler.NewUrlServer(MockGenerator, &mockStorage, "localhost")
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-request-id", "trace-1"))
+	_, err := handler.UnaryRequestID(ctx, &pb.RedirectRequest{Key: "missing"}, &grpc.UnaryServerInfo{},
+		func(ctx context.Context, req any) (any, error) {
+			return server.Redirect(ctx, req.(*pb.RedirectRequest))
+		})
+
+	st, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.NotFound, st.Code())
+	assert.Equal(t, "link not found", st.Message())
+	var (
+		info    *errdetails.ErrorInfo
+		request *errdetails.RequestInfo
+	)
+	for _, detail := range st.Details() {
+		switch d := detail.(type) {
+		case *errdetails.ErrorInfo:
+			info = d
+		case *errdetails.RequestInfo:
+			request = d
+		}
+	}
+	if assert.NotNil(t, info) {
+		assert.Equal(t, "NOT_FOUND", info.Reason)
+	}
+	if assert.NotNil(t, request) {
+		assert.Equal(t, "trace-1", request.RequestId)
+	}
+
+	_, err = server.GenerateKey(context.Background(), &pb.GenerateKeyRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestUnaryRateLimit(t *testing.T) {
+	mockStorage := newMockStorage()
+	server := handler.NewUrlServer(MockGenerator, &mockStorage, "localhost")
+	interceptor := handler.UnaryRateLimit(ratelimit.New(ratelimit.NewMemory(), ratelimit.Config{
+		Policies: map[string]ratelimit.Policy{ratelimit.ClassCreate: {Rate: 0.5, Burst: 1}},
+	}))
+	info := &grpc.UnaryServerInfo{FullMethod: pb.UrlService_GenerateKey_FullMethodName}
+	call := func(ctx context.Context) error {
+		_, err := interceptor(ctx, &pb.GenerateKeyRequest{Url: "https://example.com"}, info,
+			func(ctx context.Context, req any) (any, error) {
+				return server.GenerateKey(ctx, req.(*pb.GenerateKeyRequest))
+			})
+		return err
+	}
+	client := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000}})
+
+	assert.NoError(t, call(client))
+	err := call(client)
+	st, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.ResourceExhausted, st.Code())
+	var retry *errdetails.RetryInfo
+	for _, detail := range st.Details() {
+		if d, ok := detail.(*errdetails.RetryInfo); ok {
+			retry = d
+		}
+	}
+	if assert.NotNil(t, retry) {
+		assert.Equal(t, int64(2), retry.RetryDelay.GetSeconds())
+	}
+
+	other := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 5000}})
+	assert.NoError(t, call(other), "clients have separate buckets")
+	assert.NoError(t, call(ratelimit.WithIdentity(client, "key:1")), "authenticated clients are limited by identity")
+}
+
+func TestUnaryAuth(t *testing.T) {
+	mockStorage := newMockStorage()
+	server := handler.NewUrlServer(MockGenerator, &mockStorage, "localhost")
+	keys := auth.NewKeys(storage.NewSafeMap())
+	_, creator, err := keys.Create("creator", []string{auth.ScopeLinksCreate}, 0)
+	assert.NoError(t, err)
+	interceptor := handler.UnaryAuth(handler.Authenticators{Keys: keys})
+
+	call := func(token string, method string, req any) (any, error) {
+		ctx := context.Background()
+		if token != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+token))
+		}
+		return interceptor(ctx, req, &grpc.UnaryServerInfo{FullMethod: method},
+			func(ctx context.Context, req any) (any, error) {
+				if principal, ok := auth.FromContext(ctx); ok {
+					assert.Equal(t, "key:"+principal.ID, ratelimit.Identity(ctx), "limits must count per key")
+				}
+				switch req := req.(type) {
+				case *pb.GenerateKeyRequest:
+					return server.GenerateKey(ctx, req)
+				case *pb.RedirectRequest:
+					return server.Redirect(ctx, req)
+				}
+				return nil, nil
+			})
+	}
+
+	_, err = call("", pb.UrlService_GenerateKey_FullMethodName, &pb.GenerateKeyRequest{Url: "https://example.com"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = call("sk_bad_token", pb.UrlService_GenerateKey_FullMethodName, &pb.GenerateKeyRequest{Url: "https://example.com"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = call(creator, pb.UrlService_GenerateKey_FullMethodName, &pb.GenerateKeyRequest{Url: "https://example.com"})
+	assert.NoError(t, err)
+	_, err = call(creator, pb.UrlService_Redirect_FullMethodName, &pb.RedirectRequest{Key: "path0"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "Redirect requires links:read")
+
+	_, err = call("", "/grpc.health.v1.Health/Check", nil)
+	assert.NoError(t, err, "methods without a scope stay open")
+}
+
+func TestUnaryAuth_LimitFailures(t *testing.T) {
+	mockStorage := newMockStorage()
+	server := handler.NewUrlServer(MockGenerator, &mockStorage, "localhost")
+	keys := auth.NewKeys(storage.NewSafeMap())
+	_, creator, err := keys.Create("creator", []string{auth.ScopeLinksCreate}, 0)
+	assert.NoError(t, err)
+	interceptor := handler.UnaryAuth(handler.Authenticators{
+		Keys: keys,
+		Limiter: ratelimit.New(ratelimit.NewMemory(), ratelimit.Config{
+			Policies: map[string]ratelimit.Policy{ratelimit.ClassLogin: {Rate: 0.01, Burst: 2}},
+		}),
+	})
+	client := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000}})
+	call := func(token string) error {
+		ctx := metadata.NewIncomingContext(client, metadata.Pairs("authorization", "Bearer "+token))
+		_, err := interceptor(ctx, &pb.GenerateKeyRequest{Url: "https://example.com"},
+			&grpc.UnaryServerInfo{FullMethod: pb.UrlService_GenerateKey_FullMethodName},
+			func(ctx context.Context, req any) (any, error) {
+				return server.GenerateKey(ctx, req.(*pb.GenerateKeyRequest))
+			})
+		return err
+	}
+
+	assert.NoError(t, call(creator), "successful authentications are not counted")
+	assert.NoError(t, call(creator))
+	assert.NoError(t, call(creator))
+	assert.Equal(t, codes.Unauthenticated, status.Code(call("sk_bad_token")))
+	assert.Equal(t, codes.Unauthenticated, status.Code(call("sk_bad_token")))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(call("sk_bad_token")))
+}
+
+func TestUnaryAuth_Users(t *testing.T) {
+	var st storage.Storage = storage.NewSafeMap()
+	server := handler.NewUrlServer(MockGenerator, &st, "localhost")
+	users := auth.NewUsers(st.(storage.UserStorage))
+	alice, err := users.Create("alice", "correct horse", auth.RoleUser)
+	assert.NoError(t, err)
+	interceptor := handler.UnaryAuth(handler.Authenticators{Users: users})
+
+	call := func(credentials string) (*pb.GenerateKeyResponse, error) {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", credentials))
+		resp, err := interceptor(ctx, &pb.GenerateKeyRequest{Url: "https://example.com"},
+			&grpc.UnaryServerInfo{FullMethod: pb.UrlService_GenerateKey_FullMethodName},
+			func(ctx context.Context, req any) (any, error) {
+				return server.GenerateKey(ctx, req.(*pb.GenerateKeyRequest))
+			})
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*pb.GenerateKeyResponse), nil
+	}
+	basic := func(username, password string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+
+	_, err = call(basic("alice", "wrong password"))
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = call("Bearer sk_token")
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "bearer tokens are refused without keys")
+
+	resp, err := call(basic("alice", "correct horse"))
+	assert.NoError(t, err)
+	owner, err := st.(storage.OwnerStorage).LoadOwner(strings.TrimPrefix(resp.ShortUrl, "http://localhost/"))
+	assert.NoError(t, err)
+	assert.Equal(t, "user:"+alice.ID, owner)
+}
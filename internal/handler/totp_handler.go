@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"OZON_test/internal/auth"
+	"OZON_test/internal/qr"
+	"OZON_test/internal/storage"
+	"encoding/base64"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// SecondFactorManager enrols accounts in TOTP two-factor authentication.
+type SecondFactorManager interface {
+	Enroll(userID string, account string) (auth.Enrollment, error)
+	Confirm(userID string, code string) error
+	Disable(userID string, code string) error
+	Reset(userID string) error
+	Status(user storage.User) (auth.SecondFactorStatus, error)
+}
+
+type totpCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type totpEnrollmentResponse struct {
+	Secret        string   `json:"secret"`
+	URI           string   `json:"uri"`
+	QRCode        string   `json:"qr_code"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type totpStatusResponse struct {
+	Enabled           bool `json:"enabled"`
+	Required          bool `json:"required"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+// SetTOTP enables two-factor authentication. It needs user accounts, see
+// SetUsers.
+func (h *Handlers) SetTOTP(totp SecondFactorManager) {
+	h.totp = totp
+}
+
+// accountOf returns the account of the caller for the enrolment routes,
+// which are open to users who still have to set up their second factor.
+func (h *Handlers) accountOf(w http.ResponseWriter, r *http.Request) (storage.User, bool) {
+	if h.totp == nil || h.users == nil {
+		writeError(w, r, reasonNotSupported, "two-factor authentication is disabled")
+		return storage.User{}, false
+	}
+	principal, ok := auth.FromContext(r.Context())
+	if !ok {
+		writeError(w, r, reasonUnauthenticated, "authentication required")
+		return storage.User{}, false
+	}
+	if principal.Kind != auth.KindUser {
+		writeError(w, r, reasonForbidden, "two-factor authentication is only available to user accounts")
+		return storage.User{}, false
+	}
+	user, err := h.users.Lookup(principal.ID)
+	if err != nil {
+		writeProblem(w, r, err)
+		return storage.User{}, false
+	}
+	return user, true
+}
+
+func (h *Handlers) totpStatusHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.accountOf(w, r)
+	if !ok {
+		return
+	}
+	status, err := h.totp.Status(user)
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, totpStatusResponse{
+		Enabled:           status.Enabled,
+		Required:          status.Required,
+		RecoveryCodesLeft: status.RecoveryCodes,
+	})
+}
+
+// enrollTOTPHandler starts an enrolment. The secret is returned as the
+// provisioning URI and as a QR code of it, ready for an <img> tag.
+func (h *Handlers) enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.accountOf(w, r)
+	if !ok {
+		return
+	}
+	enrollment, err := h.totp.Enroll(user.ID, user.Username)
+	if errors.Is(err, auth.ErrAlreadyEnrolled) {
+		writeError(w, r, reasonAlreadyExists, "two-factor authentication is already enabled")
+		return
+	}
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	image, err := qr.Encode(enrollment.URI, qr.DefaultOptions())
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, totpEnrollmentResponse{
+		Secret:        enrollment.Secret,
+		URI:           enrollment.URI,
+		QRCode:        "data:" + qr.ContentType(qr.FormatPNG) + ";base64," + base64.StdEncoding.EncodeToString(image),
+		RecoveryCodes: enrollment.RecoveryCodes,
+	})
+}
+
+func (h *Handlers) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.accountOf(w, r)
+	if !ok {
+		return
+	}
+	var req totpCodeRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if err := h.totp.Confirm(user.ID, req.Code); err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handlers) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.accountOf(w, r)
+	if !ok {
+		return
+	}
+	var req totpCodeRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if err := h.totp.Disable(user.ID, req.Code); err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resetTOTPHandler removes the second factor of a user who lost it.
+func (h *Handlers) resetTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if h.totp == nil || h.users == nil {
+		writeError(w, r, reasonNotSupported, "two-factor authentication is disabled")
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if _, err := h.users.Lookup(id); errors.Is(err, storage.ErrNotFound) {
+		writeError(w, r, reasonNotFound, "user not found")
+		return
+	} else if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	if err := h.totp.Reset(id); err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"OZON_test/internal/auth"
+	"OZON_test/internal/storage"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// UserManager authenticates accounts by password, with a second factor on
+// the login page, and registers new ones for admins.
+type UserManager interface {
+	PasswordAuthenticator
+	LoginWithCode(username, password, code string) (auth.Principal, error)
+	Create(username, password, role string) (storage.User, error)
+	Lookup(id string) (storage.User, error)
+}
+
+type userRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role,omitempty"`
+}
+
+type userResponse struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SetUsers enables user accounts. They log in with basic credentials and
+// own the links they create.
+func (h *Handlers) SetUsers(users UserManager) {
+	h.users = users
+}
+
+func (h *Handlers) createUserHandler(w http.ResponseWriter, r *http.Request) {
+	if h.users == nil {
+		writeError(w, r, reasonNotSupported, "user accounts are disabled")
+		return
+	}
+
+	var req userRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if req.Role == "" {
+		req.Role = auth.RoleUser
+	}
+
+	user, err := h.users.Create(req.Username, req.Password, req.Role)
+	if errors.Is(err, storage.ErrAlreadyExists) {
+		writeError(w, r, reasonAlreadyExists, "username is taken")
+		return
+	}
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, userResponse{
+		ID:        user.ID,
+		Username:  user.Username,
+		Role:      user.Role,
+		CreatedAt: user.CreatedAt,
+	})
+}
+
+// myLinksHandler lists the links owned by the caller.
+func (h *Handlers) myLinksHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := auth.FromContext(r.Context())
+	if !ok {
+		writeError(w, r, reasonUnauthenticated, "authentication required")
+		return
+	}
+	ownerStorage, ok := h.storage.(storage.OwnerStorage)
+	if !ok {
+		writeError(w, r, reasonNotSupported, "link owners are not supported by the storage")
+		return
+	}
+	h.writeLinks(w, r, func(after string, limit int) ([]storage.Link, error) {
+		return ownerStorage.ListOwned(principal.Identity(), after, limit)
+	})
+}
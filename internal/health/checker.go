@@ -0,0 +1,315 @@
+package health
+
+import (
+	"OZON_test/internal/storage"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const maxRedirects = 5
+
+var errPrivateAddress = errors.New("destination resolves to a private address")
+
+type Config struct {
+	Interval     time.Duration
+	Timeout      time.Duration
+	Concurrency  int
+	HostDelay    time.Duration
+	DeadAfter    int
+	BatchSize    int
+	AllowPrivate bool
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Interval:    time.Hour,
+		Timeout:     10 * time.Second,
+		Concurrency: 8,
+		HostDelay:   time.Second,
+		DeadAfter:   3,
+		BatchSize:   500,
+	}
+}
+
+// Checker periodically probes stored destinations and records the outcome of
+// each probe in a storage.HealthStorage.
+type Checker struct {
+	links   storage.Lister
+	results storage.HealthStorage
+	cfg     Config
+	client  *http.Client
+
+	hostsMu sync.Mutex
+	hosts   map[string]time.Time
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewChecker(links storage.Lister, results storage.HealthStorage, cfg Config) *Checker {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultConfig().BatchSize
+	}
+	if cfg.DeadAfter <= 0 {
+		cfg.DeadAfter = DefaultConfig().DeadAfter
+	}
+
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	if !cfg.AllowPrivate {
+		dialer.Control = denyPrivate
+	}
+	client := &http.Client{
+		Timeout: cfg.Timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: cfg.Timeout,
+			MaxIdleConnsPerHost: 1,
+		},
+		CheckRedirect: func(_ *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return nil
+		},
+	}
+
+	return &Checker{
+		links:   links,
+		results: results,
+		cfg:     cfg,
+		client:  client,
+		hosts:   make(map[string]time.Time),
+		done:    make(chan struct{}),
+	}
+}
+
+func (c *Checker) Start() {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-c.done
+			cancel()
+		}()
+
+		ticker := time.NewTicker(c.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			if err := c.CheckAll(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("health check failed: %v", err)
+			}
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (c *Checker) Close() {
+	close(c.done)
+	c.wg.Wait()
+}
+
+// CheckAll probes every stored link once.
+func (c *Checker) CheckAll(ctx context.Context) error {
+	c.pruneHosts()
+
+	jobs := make(chan storage.Link)
+	var wg sync.WaitGroup
+	for i := 0; i < c.cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for link := range jobs {
+				if _, err := c.Check(ctx, link); err != nil && ctx.Err() == nil {
+					log.Printf("failed to record health of %s: %v", link.Key, err)
+				}
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(jobs)
+
+	after := ""
+	for {
+		links, err := c.links.List(after, c.cfg.BatchSize)
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			select {
+			case jobs <- link:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if len(links) < c.cfg.BatchSize {
+			return nil
+		}
+		after = links[len(links)-1].Key
+	}
+}
+
+// Check probes a single link and stores the result.
+func (c *Checker) Check(ctx context.Context, link storage.Link) (storage.LinkHealth, error) {
+	previous, err := c.results.LoadHealth(link.Key)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return storage.LinkHealth{}, err
+	}
+
+	result := storage.LinkHealth{Key: link.Key}
+	result.Status, err = c.probe(ctx, link.Url)
+	if ctx.Err() != nil {
+		return storage.LinkHealth{}, ctx.Err()
+	}
+	result.CheckedAt = time.Now()
+	if err != nil {
+		result.Error = err.Error()
+	}
+	if err != nil || result.Status >= http.StatusBadRequest {
+		result.ConsecutiveFailures = previous.ConsecutiveFailures + 1
+	}
+
+	return result, c.results.StoreHealth(result)
+}
+
+func (c *Checker) Health(key string) (storage.LinkHealth, error) {
+	return c.results.LoadHealth(key)
+}
+
+func (c *Checker) Unhealthy(after string, limit int) ([]storage.LinkHealth, error) {
+	return c.results.ListUnhealthy(after, limit)
+}
+
+// Dead reports whether the link failed at least DeadAfter checks in a row.
+func (c *Checker) Dead(key string) bool {
+	health, err := c.results.LoadHealth(key)
+	return err == nil && health.ConsecutiveFailures >= c.cfg.DeadAfter
+}
+
+func (c *Checker) probe(ctx context.Context, rawUrl string) (int, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Scheme == "" {
+		// Legacy links are stored without a scheme, see getHandler.
+		u, err = url.Parse("http://" + strings.TrimPrefix(rawUrl, "//"))
+	}
+	if err != nil {
+		return 0, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return 0, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	if err := c.waitForHost(ctx, u.Hostname()); err != nil {
+		return 0, err
+	}
+
+	status, err := c.do(ctx, http.MethodHead, u.String())
+	if err == nil && (status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented) {
+		status, err = c.do(ctx, http.MethodGet, u.String())
+	}
+	return status, err
+}
+
+func (c *Checker) do(ctx context.Context, method string, rawUrl string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawUrl, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", "OZON_test-link-checker")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		if err := resp.Body.Close(); err != nil {
+			log.Println("close body error", err)
+		}
+	}()
+	return resp.StatusCode, nil
+}
+
+// waitForHost keeps at least HostDelay between two requests to the same host.
+func (c *Checker) waitForHost(ctx context.Context, host string) error {
+	c.hostsMu.Lock()
+	now := time.Now()
+	slot := c.hosts[host]
+	if slot.Before(now) {
+		slot = now
+	}
+	c.hosts[host] = slot.Add(c.cfg.HostDelay)
+	c.hostsMu.Unlock()
+
+	timer := time.NewTimer(slot.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pruneHosts forgets hosts whose next slot has passed, so destinations that
+// are no longer stored do not pile up between sweeps.
+func (c *Checker) pruneHosts() {
+	c.hostsMu.Lock()
+	defer c.hostsMu.Unlock()
+	now := time.Now()
+	for host, slot := range c.hosts {
+		if slot.Before(now) {
+			delete(c.hosts, host)
+		}
+	}
+}
+
+// denyPrivate runs after DNS resolution, so it also stops redirects and DNS
+// records that point into internal networks.
+func denyPrivate(_ string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if isPrivate(addr.Unmap()) {
+		return fmt.Errorf("%w: %s", errPrivateAddress, addr)
+	}
+	return nil
+}
+
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+func isPrivate(addr netip.Addr) bool {
+	return addr.IsPrivate() ||
+		addr.IsLoopback() ||
+		addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() ||
+		addr.IsUnspecified() ||
+		sharedAddressSpace.Contains(addr)
+}
@@ -0,0 +1,167 @@
+package tests
+
+import (
+	"OZON_test/internal/health"
+	"OZON_test/internal/storage"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newDestination(t *testing.T, status int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, &hits
+}
+
+func testConfig() health.Config {
+	cfg := health.DefaultConfig()
+	cfg.Timeout = time.Second
+	cfg.HostDelay = 0
+	cfg.AllowPrivate = true
+	return cfg
+}
+
+func TestCheck(t *testing.T) {
+	alive, _ := newDestination(t, http.StatusOK)
+	gone, _ := newDestination(t, http.StatusNotFound)
+
+	store := storage.NewSafeMap()
+	checker := health.NewChecker(store, store, testConfig())
+
+	result, err := checker.Check(context.Background(), storage.Link{Key: "alive", Url: alive.URL})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, result.Status)
+	assert.Equal(t, 0, result.ConsecutiveFailures)
+	assert.False(t, result.CheckedAt.IsZero())
+
+	for i := 1; i <= 3; i++ {
+		result, err = checker.Check(context.Background(), storage.Link{Key: "gone", Url: gone.URL})
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, result.Status)
+		assert.Equal(t, i, result.ConsecutiveFailures)
+	}
+
+	assert.False(t, checker.Dead("alive"))
+	assert.True(t, checker.Dead("gone"))
+
+	stored, err := checker.Health("gone")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, stored.ConsecutiveFailures)
+}
+
+func TestCheck_RecoveryResetsFailures(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusInternalServerError)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	t.Cleanup(server.Close)
+
+	store := storage.NewSafeMap()
+	checker := health.NewChecker(store, store, testConfig())
+	link := storage.Link{Key: "flaky", Url: server.URL}
+
+	result, err := checker.Check(context.Background(), link)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.ConsecutiveFailures)
+
+	status.Store(http.StatusOK)
+	result, err = checker.Check(context.Background(), link)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.ConsecutiveFailures)
+}
+
+func TestCheck_HeadNotAllowed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	store := storage.NewSafeMap()
+	checker := health.NewChecker(store, store, testConfig())
+
+	result, err := checker.Check(context.Background(), storage.Link{Key: "get", Url: server.URL})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, result.Status)
+}
+
+func TestCheck_PrivateAddressDenied(t *testing.T) {
+	server, hits := newDestination(t, http.StatusOK)
+
+	cfg := testConfig()
+	cfg.AllowPrivate = false
+	store := storage.NewSafeMap()
+	checker := health.NewChecker(store, store, cfg)
+
+	result, err := checker.Check(context.Background(), storage.Link{Key: "internal", Url: server.URL})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.Status)
+	assert.Contains(t, result.Error, "private address")
+	assert.Equal(t, 1, result.ConsecutiveFailures)
+	assert.Equal(t, int32(0), hits.Load())
+}
+
+func TestCheck_UnsupportedScheme(t *testing.T) {
+	store := storage.NewSafeMap()
+	checker := health.NewChecker(store, store, testConfig())
+
+	result, err := checker.Check(context.Background(), storage.Link{Key: "mail", Url: "mailto:user@example.com"})
+	assert.NoError(t, err)
+	assert.Contains(t, result.Error, "unsupported scheme")
+}
+
+func TestCheckAll(t *testing.T) {
+	alive, aliveHits := newDestination(t, http.StatusOK)
+	gone, _ := newDestination(t, http.StatusGone)
+
+	store := storage.NewSafeMap()
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, store.Store(fmt.Sprintf("alive%d", i), alive.URL))
+	}
+	assert.NoError(t, store.Store("gone", gone.URL))
+
+	cfg := testConfig()
+	cfg.BatchSize = 2
+	checker := health.NewChecker(store, store, cfg)
+	assert.NoError(t, checker.CheckAll(context.Background()))
+
+	assert.Equal(t, int32(5), aliveHits.Load())
+	unhealthy, err := checker.Unhealthy("", 10)
+	assert.NoError(t, err)
+	if assert.Len(t, unhealthy, 1) {
+		assert.Equal(t, "gone", unhealthy[0].Key)
+	}
+}
+
+func TestCheckAll_HostDelay(t *testing.T) {
+	server, _ := newDestination(t, http.StatusOK)
+
+	store := storage.NewSafeMap()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, store.Store(fmt.Sprintf("key%d", i), server.URL))
+	}
+
+	cfg := testConfig()
+	cfg.Concurrency = 3
+	cfg.HostDelay = 50 * time.Millisecond
+	checker := health.NewChecker(store, store, cfg)
+
+	start := time.Now()
+	assert.NoError(t, checker.CheckAll(context.Background()))
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
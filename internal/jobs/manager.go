@@ -0,0 +1,316 @@
+package jobs
+
+import (
+	"OZON_test/internal/storage"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQueueFull   = errors.New("too many queued jobs")
+	ErrNotActive   = errors.New("job is not queued or running")
+	ErrNotFinished = errors.New("job is not finished")
+	ErrClosed      = errors.New("job manager is closed")
+	errStopped     = errors.New("job stopped")
+)
+
+type Config struct {
+	Workers   int
+	MaxQueued int
+}
+
+func DefaultConfig() Config {
+	return Config{Workers: 2, MaxQueued: 100}
+}
+
+// Progress is reported by a ProcessFunc after each processed chunk. The
+// counters are totals; Result holds only the rows of the new chunk.
+type Progress struct {
+	Processed int
+	Created   int
+	Existed   int
+	Failed    int
+	Errors    []storage.JobError
+	Result    []byte
+}
+
+// ProcessFunc runs job over its input, resuming after job.Processed items.
+// It must stop and return the error of report as soon as report fails.
+type ProcessFunc func(ctx context.Context, job storage.Job, input []byte, report func(Progress) error) error
+
+// Manager runs persisted jobs on a bounded pool of workers. Jobs left
+// queued or running by a previous process are resumed on Start.
+type Manager struct {
+	storage storage.JobStorage
+	process ProcessFunc
+	cfg     Config
+
+	mu      sync.Mutex
+	queue   []string
+	running map[string]context.CancelFunc
+	closed  bool
+
+	wake chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewManager(st storage.JobStorage, process ProcessFunc, cfg Config) *Manager {
+	if cfg.Workers <= 0 {
+		cfg.Workers = DefaultConfig().Workers
+	}
+	if cfg.MaxQueued <= 0 {
+		cfg.MaxQueued = DefaultConfig().MaxQueued
+	}
+	return &Manager{
+		storage: st,
+		process: process,
+		cfg:     cfg,
+		running: make(map[string]context.CancelFunc),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+func (m *Manager) Start() error {
+	pending, err := m.storage.ListJobs(storage.JobRunning, storage.JobQueued)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	for _, job := range pending {
+		m.queue = append(m.queue, job.ID)
+	}
+	m.mu.Unlock()
+	if len(pending) > 0 {
+		log.Printf("resuming %d jobs", len(pending))
+	}
+
+	for i := 0; i < m.cfg.Workers; i++ {
+		m.wg.Add(1)
+		go m.work()
+	}
+	m.signal()
+	return nil
+}
+
+// Close stops the workers. Interrupted jobs stay running in the storage and
+// are resumed by the next Start.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	for _, cancel := range m.running {
+		cancel()
+	}
+	m.mu.Unlock()
+
+	close(m.done)
+	m.wg.Wait()
+}
+
+// Submit persists a new job of owner and queues it. The links created by
+// the job belong to owner.
+func (m *Manager) Submit(format string, total int, input []byte, owner string) (storage.Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return storage.Job{}, ErrClosed
+	}
+	if len(m.queue) >= m.cfg.MaxQueued {
+		return storage.Job{}, ErrQueueFull
+	}
+
+	id, err := newID()
+	if err != nil {
+		return storage.Job{}, err
+	}
+	now := time.Now().UTC()
+	job := storage.Job{
+		ID:        id,
+		Owner:     owner,
+		Status:    storage.JobQueued,
+		Format:    format,
+		Total:     total,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := m.storage.CreateJob(job, input); err != nil {
+		return storage.Job{}, err
+	}
+	m.queue = append(m.queue, id)
+	m.signal()
+	return job, nil
+}
+
+func (m *Manager) Job(id string) (storage.Job, error) {
+	return m.storage.LoadJob(id)
+}
+
+// Result returns the result rows of a finished job.
+func (m *Manager) Result(id string) ([]byte, error) {
+	job, err := m.storage.LoadJob(id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status == storage.JobQueued || job.Status == storage.JobRunning {
+		return nil, ErrNotFinished
+	}
+	return m.storage.LoadJobResult(id)
+}
+
+// Cancel stops a queued or running job. Items processed so far stay
+// shortened and are listed in the result.
+func (m *Manager) Cancel(id string) (storage.Job, error) {
+	job, err := m.storage.LoadJob(id)
+	if err != nil {
+		return storage.Job{}, err
+	}
+	if job.Status != storage.JobQueued && job.Status != storage.JobRunning {
+		return job, ErrNotActive
+	}
+
+	job.Status = storage.JobCancelled
+	job.UpdatedAt = time.Now().UTC()
+	if err := m.storage.UpdateJob(job, nil); errors.Is(err, storage.ErrNotFound) {
+		job, err = m.storage.LoadJob(id)
+		if err != nil {
+			return storage.Job{}, err
+		}
+		return job, ErrNotActive
+	} else if err != nil {
+		return storage.Job{}, err
+	}
+
+	m.mu.Lock()
+	if cancel, ok := m.running[id]; ok {
+		cancel()
+	}
+	m.mu.Unlock()
+	return job, nil
+}
+
+func (m *Manager) signal() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Manager) next() (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed || len(m.queue) == 0 {
+		return "", false
+	}
+	id := m.queue[0]
+	m.queue = m.queue[1:]
+	if len(m.queue) > 0 {
+		m.signal()
+	}
+	return id, true
+}
+
+func (m *Manager) work() {
+	defer m.wg.Done()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-m.wake:
+		}
+		for {
+			id, ok := m.next()
+			if !ok {
+				break
+			}
+			m.run(id)
+		}
+	}
+}
+
+func (m *Manager) run(id string) {
+	job, err := m.storage.LoadJob(id)
+	if err != nil {
+		log.Printf("failed to load job %s: %v", id, err)
+		return
+	}
+	if job.Status != storage.JobQueued && job.Status != storage.JobRunning {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.running[id] = cancel
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.running, id)
+		m.mu.Unlock()
+	}()
+
+	job.Status = storage.JobRunning
+	job.UpdatedAt = time.Now().UTC()
+	if err := m.storage.UpdateJob(job, nil); err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("failed to start job %s: %v", id, err)
+		}
+		return
+	}
+
+	input, err := m.storage.LoadJobInput(id)
+	if err == nil {
+		err = m.process(ctx, job, input, func(p Progress) error {
+			if ctx.Err() != nil {
+				return errStopped
+			}
+			job.Processed = p.Processed
+			job.Created = p.Created
+			job.Existed = p.Existed
+			job.Failed = p.Failed
+			job.Errors = p.Errors
+			job.UpdatedAt = time.Now().UTC()
+			if err := m.storage.UpdateJob(job, p.Result); errors.Is(err, storage.ErrNotFound) {
+				return errStopped
+			} else if err != nil {
+				return err
+			}
+			return nil
+		})
+	}
+	if errors.Is(err, errStopped) || ctx.Err() != nil {
+		return
+	}
+
+	job.Status = storage.JobDone
+	if err != nil {
+		log.Printf("job %s failed: %v", id, err)
+		job.Status = storage.JobFailed
+		job.Error = err.Error()
+	}
+	job.UpdatedAt = time.Now().UTC()
+	if err := m.storage.UpdateJob(job, nil); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Printf("failed to finish job %s: %v", id, err)
+	}
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
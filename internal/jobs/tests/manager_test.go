@@ -0,0 +1,166 @@
+package tests
+
+import (
+	"OZON_test/internal/jobs"
+	"OZON_test/internal/storage"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countLines reports one result row per input line, one line per chunk.
+func countLines(block chan struct{}) jobs.ProcessFunc {
+	return func(ctx context.Context, job storage.Job, input []byte, report func(jobs.Progress) error) error {
+		lines := strings.Split(strings.TrimSpace(string(input)), "\n")
+		progress := jobs.Progress{Processed: job.Processed, Created: job.Created}
+		for i := job.Processed; i < len(lines); i++ {
+			if block != nil {
+				select {
+				case <-block:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			progress.Processed++
+			progress.Created++
+			progress.Result = []byte(fmt.Sprintf("%d,%s\n", i, lines[i]))
+			if err := report(progress); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func waitForStatus(t *testing.T, m *jobs.Manager, id, status string) storage.Job {
+	t.Helper()
+	var job storage.Job
+	assert.Eventually(t, func() bool {
+		job, _ = m.Job(id)
+		return job.Status == status
+	}, time.Second, 5*time.Millisecond)
+	return job
+}
+
+func TestManager_RunsJobs(t *testing.T) {
+	store := storage.NewSafeMap()
+	m := jobs.NewManager(store, countLines(nil), jobs.DefaultConfig())
+	assert.NoError(t, m.Start())
+	t.Cleanup(m.Close)
+
+	job, err := m.Submit("csv", 3, []byte("a\nb\nc\n"), "")
+	assert.NoError(t, err)
+	assert.Equal(t, storage.JobQueued, job.Status)
+
+	job = waitForStatus(t, m, job.ID, storage.JobDone)
+	assert.Equal(t, 3, job.Processed)
+	assert.Equal(t, 3, job.Created)
+
+	result, err := m.Result(job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "0,a\n1,b\n2,c\n", string(result))
+
+	_, err = m.Cancel(job.ID)
+	assert.ErrorIs(t, err, jobs.ErrNotActive)
+	_, err = m.Job("missing")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestManager_ReportsFailure(t *testing.T) {
+	store := storage.NewSafeMap()
+	failing := func(context.Context, storage.Job, []byte, func(jobs.Progress) error) error {
+		return fmt.Errorf("broken input")
+	}
+	m := jobs.NewManager(store, failing, jobs.DefaultConfig())
+	assert.NoError(t, m.Start())
+	t.Cleanup(m.Close)
+
+	job, err := m.Submit("csv", 1, []byte("a"), "")
+	assert.NoError(t, err)
+	job = waitForStatus(t, m, job.ID, storage.JobFailed)
+	assert.Equal(t, "broken input", job.Error)
+}
+
+func TestManager_Cancel(t *testing.T) {
+	store := storage.NewSafeMap()
+	block := make(chan struct{})
+	m := jobs.NewManager(store, countLines(block), jobs.Config{Workers: 1})
+	assert.NoError(t, m.Start())
+	t.Cleanup(m.Close)
+
+	running, err := m.Submit("csv", 3, []byte("a\nb\nc\n"), "")
+	assert.NoError(t, err)
+	queued, err := m.Submit("csv", 1, []byte("d\n"), "")
+	assert.NoError(t, err)
+
+	waitForStatus(t, m, running.ID, storage.JobRunning)
+	block <- struct{}{}
+	assert.Eventually(t, func() bool {
+		job, _ := m.Job(running.ID)
+		return job.Processed == 1
+	}, time.Second, 5*time.Millisecond)
+
+	_, err = m.Result(running.ID)
+	assert.ErrorIs(t, err, jobs.ErrNotFinished)
+
+	job, err := m.Cancel(queued.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.JobCancelled, job.Status)
+	job, err = m.Cancel(running.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.JobCancelled, job.Status)
+
+	job = waitForStatus(t, m, running.ID, storage.JobCancelled)
+	assert.Equal(t, 1, job.Processed)
+	result, err := m.Result(running.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "0,a\n", string(result))
+}
+
+func TestManager_QueueLimit(t *testing.T) {
+	store := storage.NewSafeMap()
+	m := jobs.NewManager(store, countLines(nil), jobs.Config{Workers: 1, MaxQueued: 1})
+
+	_, err := m.Submit("csv", 1, []byte("a"), "")
+	assert.NoError(t, err)
+	_, err = m.Submit("csv", 1, []byte("b"), "")
+	assert.ErrorIs(t, err, jobs.ErrQueueFull)
+
+	m.Close()
+	_, err = m.Submit("csv", 1, []byte("c"), "")
+	assert.ErrorIs(t, err, jobs.ErrClosed)
+}
+
+func TestManager_ResumesAfterRestart(t *testing.T) {
+	store := storage.NewSafeMap()
+	block := make(chan struct{})
+	m := jobs.NewManager(store, countLines(block), jobs.Config{Workers: 1})
+	assert.NoError(t, m.Start())
+
+	job, err := m.Submit("csv", 3, []byte("a\nb\nc\n"), "")
+	assert.NoError(t, err)
+	block <- struct{}{}
+	assert.Eventually(t, func() bool {
+		job, _ := m.Job(job.ID)
+		return job.Processed == 1
+	}, time.Second, 5*time.Millisecond)
+	m.Close()
+
+	interrupted, err := store.LoadJob(job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.JobRunning, interrupted.Status)
+
+	m = jobs.NewManager(store, countLines(nil), jobs.Config{Workers: 1})
+	assert.NoError(t, m.Start())
+	t.Cleanup(m.Close)
+
+	job = waitForStatus(t, m, job.ID, storage.JobDone)
+	assert.Equal(t, 3, job.Processed)
+	assert.Equal(t, 3, job.Created)
+	result, err := m.Result(job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "0,a\n1,b\n2,c\n", string(result))
+}
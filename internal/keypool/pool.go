@@ -0,0 +1,239 @@
+package keypool
+
+import (
+	"OZON_test/internal/storage"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	maxReserveAttempts = 10
+	maxCommitAttempts  = 3
+)
+
+type Config struct {
+	Size             int
+	RefillThreshold  int
+	ReservationTTL   time.Duration
+	RecoveryInterval time.Duration
+}
+
+type reservedKey struct {
+	key        string
+	reservedAt time.Time
+}
+
+// Pool keeps a buffer of keys that are already reserved in storage, so
+// issuing a link costs a single commit write.
+type Pool struct {
+	source  func() (string, error)
+	storage storage.Reserver
+	cfg     Config
+
+	keys   chan reservedKey
+	refill chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func NewPool(source func() (string, error), storage storage.Reserver, cfg Config) *Pool {
+	if cfg.Size <= 0 {
+		cfg.Size = 1
+	}
+	if cfg.RefillThreshold <= 0 || cfg.RefillThreshold > cfg.Size {
+		cfg.RefillThreshold = cfg.Size
+	}
+	return &Pool{
+		source:  source,
+		storage: storage,
+		cfg:     cfg,
+		keys:    make(chan reservedKey, cfg.Size),
+		refill:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+func (p *Pool) Start() {
+	p.wg.Add(1)
+	go p.run()
+}
+
+// Close stops the background worker and returns the buffered keys to storage.
+func (p *Pool) Close() {
+	close(p.done)
+	p.wg.Wait()
+
+	for {
+		select {
+		case rk := <-p.keys:
+			p.release(rk.key)
+		default:
+			return
+		}
+	}
+}
+
+func (p *Pool) Len() int {
+	return len(p.keys)
+}
+
+// Issue commits url under a pooled key and returns the key.
+func (p *Pool) Issue(url string) (string, error) {
+	for i := 0; i < maxCommitAttempts; i++ {
+		key, err := p.take()
+		if err != nil {
+			return "", err
+		}
+
+		err = p.storage.Commit(key, url)
+		if errors.Is(err, storage.ErrReservationLost) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to commit key: %w", err)
+		}
+		return key, nil
+	}
+	return "", fmt.Errorf("failed to commit key: %w", storage.ErrReservationLost)
+}
+
+func (p *Pool) take() (string, error) {
+	defer p.requestRefill()
+
+	for {
+		select {
+		case rk := <-p.keys:
+			if p.stale(rk) {
+				p.release(rk.key)
+				continue
+			}
+			return rk.key, nil
+		default:
+			return p.reserve()
+		}
+	}
+}
+
+func (p *Pool) requestRefill() {
+	if len(p.keys) >= p.cfg.RefillThreshold {
+		return
+	}
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// stale reports whether a reservation is close enough to its TTL that the
+// recovery job of another replica may reclaim it before we commit.
+func (p *Pool) stale(rk reservedKey) bool {
+	return p.cfg.ReservationTTL > 0 && time.Since(rk.reservedAt) > p.cfg.ReservationTTL/2
+}
+
+func (p *Pool) reserve() (string, error) {
+	for i := 0; i < maxReserveAttempts; i++ {
+		key, err := p.source()
+		if err != nil {
+			return "", fmt.Errorf("failed to generate key: %w", err)
+		}
+
+		ok, err := p.storage.Reserve(key)
+		if err != nil {
+			return "", fmt.Errorf("failed to reserve key: %w", err)
+		}
+		if ok {
+			return key, nil
+		}
+	}
+	return "", errors.New("failed to reserve key: too many collisions")
+}
+
+func (p *Pool) run() {
+	defer p.wg.Done()
+
+	p.fill()
+
+	var recovery <-chan time.Time
+	if p.cfg.RecoveryInterval > 0 {
+		ticker := time.NewTicker(p.cfg.RecoveryInterval)
+		defer ticker.Stop()
+		recovery = ticker.C
+	}
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-p.refill:
+			p.fill()
+		case <-recovery:
+			p.recover()
+			p.fill()
+		}
+	}
+}
+
+func (p *Pool) fill() {
+	for len(p.keys) < cap(p.keys) {
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+
+		key, err := p.reserve()
+		if err != nil {
+			log.Printf("key pool refill failed: %v", err)
+			return
+		}
+
+		select {
+		case p.keys <- reservedKey{key: key, reservedAt: time.Now()}:
+		default:
+			p.release(key)
+			return
+		}
+	}
+}
+
+func (p *Pool) recover() {
+	p.dropStale()
+
+	if p.cfg.ReservationTTL <= 0 {
+		return
+	}
+	released, err := p.storage.ReleaseExpired(p.cfg.ReservationTTL)
+	if err != nil {
+		log.Printf("failed to recover abandoned reservations: %v", err)
+		return
+	}
+	if released > 0 {
+		log.Printf("recovered %d abandoned key reservations", released)
+	}
+}
+
+func (p *Pool) dropStale() {
+	for n := len(p.keys); n > 0; n-- {
+		select {
+		case rk := <-p.keys:
+			if !p.stale(rk) {
+				p.keys <- rk
+				continue
+			}
+			p.release(rk.key)
+		default:
+			return
+		}
+	}
+}
+
+// release returns a reserved key to storage. Failures only delay the key
+// until the recovery job reclaims it.
+func (p *Pool) release(key string) {
+	if err := p.storage.Release(key); err != nil {
+		log.Printf("failed to release key %s: %v", key, err)
+	}
+}
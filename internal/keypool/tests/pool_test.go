@@ -0,0 +1,139 @@
+package tests
+
+import (
+	"OZON_test/internal/keypool"
+	"OZON_test/internal/storage"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func sequenceSource() func() (string, error) {
+	var n atomic.Int64
+	return func() (string, error) {
+		return fmt.Sprintf("key%d", n.Add(1)), nil
+	}
+}
+
+func waitForLen(t *testing.T, pool *keypool.Pool, want int) {
+	t.Helper()
+	assert.Eventually(t, func() bool { return pool.Len() == want }, time.Second, 5*time.Millisecond)
+}
+
+func TestPool_FillsAndIssues(t *testing.T) {
+	store := storage.NewSafeMap()
+	pool := keypool.NewPool(sequenceSource(), store, keypool.Config{Size: 5, RefillThreshold: 2})
+	pool.Start()
+	t.Cleanup(pool.Close)
+
+	waitForLen(t, pool, 5)
+
+	_, err := store.Load("key1")
+	assert.Error(t, err, "reserved key must not be visible")
+
+	key, err := pool.Issue("http://example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "key1", key)
+
+	value, err := store.Load(key)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://example.com", value)
+}
+
+func TestPool_Refill(t *testing.T) {
+	store := storage.NewSafeMap()
+	pool := keypool.NewPool(sequenceSource(), store, keypool.Config{Size: 4, RefillThreshold: 2})
+	pool.Start()
+	t.Cleanup(pool.Close)
+
+	waitForLen(t, pool, 4)
+	for i := 0; i < 3; i++ {
+		_, err := pool.Issue(fmt.Sprintf("http://example.com/%d", i))
+		assert.NoError(t, err)
+	}
+	waitForLen(t, pool, 4)
+}
+
+func TestPool_SkipsTakenKeys(t *testing.T) {
+	store := storage.NewSafeMap()
+	assert.NoError(t, store.Store("key1", "http://taken.com"))
+
+	pool := keypool.NewPool(sequenceSource(), store, keypool.Config{Size: 1})
+	key, err := pool.Issue("http://example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "key2", key)
+
+	value, err := store.Load("key1")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://taken.com", value)
+}
+
+func TestPool_RetriesLostReservation(t *testing.T) {
+	store := storage.NewSafeMap()
+	pool := keypool.NewPool(sequenceSource(), store, keypool.Config{Size: 2, RefillThreshold: 1})
+	pool.Start()
+	t.Cleanup(pool.Close)
+	waitForLen(t, pool, 2)
+
+	// Резервация key1 отозвана процессом восстановления другой реплики.
+	assert.NoError(t, store.Release("key1"))
+
+	key, err := pool.Issue("http://example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "key2", key)
+}
+
+func TestPool_CloseReleasesKeys(t *testing.T) {
+	store := storage.NewSafeMap()
+	pool := keypool.NewPool(sequenceSource(), store, keypool.Config{Size: 3})
+	pool.Start()
+	waitForLen(t, pool, 3)
+	pool.Close()
+
+	released, err := store.ReleaseExpired(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, released)
+
+	ok, err := store.Reserve("key1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestPool_RecoversAbandonedReservations(t *testing.T) {
+	store := storage.NewSafeMap()
+	ok, err := store.Reserve("abandoned")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	pool := keypool.NewPool(sequenceSource(), store, keypool.Config{
+		Size:             1,
+		ReservationTTL:   20 * time.Millisecond,
+		RecoveryInterval: 10 * time.Millisecond,
+	})
+	pool.Start()
+	t.Cleanup(pool.Close)
+
+	assert.Eventually(t, func() bool {
+		ok, err := store.Reserve("abandoned")
+		return err == nil && ok
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestPool_ReleasesStaleKeys(t *testing.T) {
+	store := storage.NewSafeMap()
+	pool := keypool.NewPool(sequenceSource(), store, keypool.Config{Size: 1, ReservationTTL: 20 * time.Millisecond})
+	pool.Start()
+	t.Cleanup(pool.Close)
+	waitForLen(t, pool, 1)
+	time.Sleep(20 * time.Millisecond)
+
+	key, err := pool.Issue("http://example.com")
+	assert.NoError(t, err)
+	assert.NotEqual(t, "key1", key, "stale keys are not issued")
+
+	ok, err := store.Reserve("key1")
+	assert.NoError(t, err)
+	assert.True(t, ok, "the stale key is released right away, not after its TTL")
+}
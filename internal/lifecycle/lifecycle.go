@@ -0,0 +1,153 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config controls the shutdown. After readiness flips, the manager waits
+// DrainDelay so load balancers stop routing new traffic, then runs the
+// shutdown hooks under a shared Timeout.
+type Config struct {
+	Timeout    time.Duration
+	DrainDelay time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{Timeout: 30 * time.Second}
+}
+
+type hook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// Manager runs servers, reports readiness and shuts the process down on a
+// signal or a server failure. Hooks run in reverse order of registration,
+// like deferred calls, so resources are registered as they are created:
+// storage first, servers last.
+type Manager struct {
+	cfg       Config
+	ready     atomic.Bool
+	mu        sync.Mutex
+	hooks     []hook
+	listeners []func(ready bool)
+	errs      chan error
+	once      sync.Once
+	result    error
+}
+
+func New(cfg Config) *Manager {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultConfig().Timeout
+	}
+	return &Manager{cfg: cfg, errs: make(chan error, 1)}
+}
+
+// Ready reports whether the process accepts traffic.
+func (m *Manager) Ready() bool {
+	return m.ready.Load()
+}
+
+// SetReady changes the readiness and notifies the listeners.
+func (m *Manager) SetReady(ready bool) {
+	if m.ready.Swap(ready) == ready {
+		return
+	}
+	m.mu.Lock()
+	listeners := append([]func(bool){}, m.listeners...)
+	m.mu.Unlock()
+	for _, listener := range listeners {
+		listener(ready)
+	}
+}
+
+// OnReadinessChange registers fn to be called whenever readiness changes.
+func (m *Manager) OnReadinessChange(fn func(ready bool)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listeners = append(m.listeners, fn)
+}
+
+// OnShutdown registers a hook. It should return once its work is stopped
+// or ctx is done.
+func (m *Manager) OnShutdown(name string, fn func(ctx context.Context) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hooks = append(m.hooks, hook{name: name, fn: fn})
+}
+
+// OnClose registers a hook for a component that stops synchronously.
+func (m *Manager) OnClose(name string, fn func()) {
+	m.OnShutdown(name, func(context.Context) error {
+		fn()
+		return nil
+	})
+}
+
+// Go runs serve in the background. An error from serve starts the shutdown.
+func (m *Manager) Go(name string, serve func() error) {
+	go func() {
+		if err := serve(); err != nil {
+			select {
+			case m.errs <- fmt.Errorf("%s: %w", name, err):
+			default:
+			}
+		}
+	}()
+}
+
+// Wait blocks until one of signals arrives, ctx is done or a server fails,
+// then shuts down. It returns the server failure or the shutdown error.
+func (m *Manager) Wait(ctx context.Context, signals ...os.Signal) error {
+	ctx, stop := signal.NotifyContext(ctx, signals...)
+	defer stop()
+
+	var cause error
+	select {
+	case <-ctx.Done():
+		log.Println("shutting down")
+	case cause = <-m.errs:
+		log.Printf("shutting down after failure: %v", cause)
+	}
+	if err := m.Shutdown(); err != nil && cause == nil {
+		cause = err
+	}
+	return cause
+}
+
+// Shutdown marks the process not ready, waits for the drain delay and runs
+// the hooks. Later calls return the result of the first one.
+func (m *Manager) Shutdown() error {
+	m.once.Do(func() {
+		m.SetReady(false)
+		time.Sleep(m.cfg.DrainDelay)
+
+		ctx, cancel := context.WithTimeout(context.Background(), m.cfg.Timeout)
+		defer cancel()
+
+		m.mu.Lock()
+		hooks := append([]hook{}, m.hooks...)
+		m.mu.Unlock()
+
+		var errs []error
+		for i := len(hooks) - 1; i >= 0; i-- {
+			start := time.Now()
+			if err := hooks[i].fn(ctx); err != nil {
+				log.Printf("shutdown of %s failed: %v", hooks[i].name, err)
+				errs = append(errs, fmt.Errorf("%s: %w", hooks[i].name, err))
+				continue
+			}
+			log.Printf("%s stopped in %s", hooks[i].name, time.Since(start).Round(time.Millisecond))
+		}
+		m.result = errors.Join(errs...)
+	})
+	return m.result
+}
@@ -0,0 +1,90 @@
+package tests
+
+import (
+	"OZON_test/internal/lifecycle"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestManager_ShutdownOrder(t *testing.T) {
+	m := lifecycle.New(lifecycle.DefaultConfig())
+	var order []string
+	var readyDuringShutdown []bool
+	for _, name := range []string{"storage", "key pool", "server"} {
+		name := name
+		m.OnShutdown(name, func(context.Context) error {
+			order = append(order, name)
+			readyDuringShutdown = append(readyDuringShutdown, m.Ready())
+			return nil
+		})
+	}
+	var changes []bool
+	m.OnReadinessChange(func(ready bool) {
+		changes = append(changes, ready)
+	})
+
+	m.SetReady(true)
+	assert.True(t, m.Ready())
+	assert.NoError(t, m.Shutdown())
+
+	assert.Equal(t, []string{"server", "key pool", "storage"}, order)
+	assert.Equal(t, []bool{false, false, false}, readyDuringShutdown, "readiness must flip before draining")
+	assert.Equal(t, []bool{true, false}, changes)
+
+	assert.NoError(t, m.Shutdown())
+	assert.Len(t, order, 3, "hooks must run once")
+}
+
+func TestManager_Deadline(t *testing.T) {
+	m := lifecycle.New(lifecycle.Config{Timeout: 50 * time.Millisecond})
+	closed := false
+	m.OnClose("storage", func() { closed = true })
+	m.OnShutdown("server", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	start := time.Now()
+	err := m.Shutdown()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.True(t, closed, "later hooks must still run after a failed one")
+}
+
+func TestManager_DrainDelay(t *testing.T) {
+	m := lifecycle.New(lifecycle.Config{DrainDelay: 50 * time.Millisecond})
+	m.SetReady(true)
+	var notReadyAt, drainedAt time.Time
+	m.OnReadinessChange(func(ready bool) { notReadyAt = time.Now() })
+	m.OnClose("server", func() { drainedAt = time.Now() })
+
+	assert.NoError(t, m.Shutdown())
+	assert.GreaterOrEqual(t, drainedAt.Sub(notReadyAt), 50*time.Millisecond)
+}
+
+func TestManager_Wait(t *testing.T) {
+	m := lifecycle.New(lifecycle.DefaultConfig())
+	stopped := make(chan struct{})
+	m.Go("server", func() error {
+		<-stopped
+		return nil
+	})
+	m.OnClose("server", func() { close(stopped) })
+	m.SetReady(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NoError(t, m.Wait(ctx))
+	assert.False(t, m.Ready())
+
+	failing := lifecycle.New(lifecycle.DefaultConfig())
+	closed := false
+	failing.OnClose("storage", func() { closed = true })
+	failing.Go("server", func() error { return errors.New("address in use") })
+	err := failing.Wait(context.Background())
+	assert.ErrorContains(t, err, "server: address in use")
+	assert.True(t, closed)
+}
@@ -0,0 +1,234 @@
+package publicurl
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Config describes where short links are served from. BaseUrl, when set,
+// always wins. Otherwise requests arriving from TrustedProxies (IPs or CIDR
+// ranges) may announce the original scheme and host with the Forwarded or
+// X-Forwarded-Proto/X-Forwarded-Host headers, and the client address with
+// Forwarded for= or X-Forwarded-For. Fallback is used in every other case,
+// including work done outside of a request.
+type Config struct {
+	BaseUrl        string
+	TrustedProxies []string
+	Fallback       string
+}
+
+type Resolver struct {
+	base     string
+	fallback string
+	trusted  []*net.IPNet
+}
+
+var validHost = regexp.MustCompile(`^([A-Za-z0-9.-]+|\[[0-9A-Fa-f:.]+\])(:[0-9]{1,5})?$`)
+
+func New(cfg Config) (*Resolver, error) {
+	r := &Resolver{fallback: strings.TrimSuffix(cfg.Fallback, "/")}
+	if cfg.BaseUrl != "" {
+		base, err := ParseBaseUrl(cfg.BaseUrl)
+		if err != nil {
+			return nil, err
+		}
+		r.base = base
+	}
+	for _, proxy := range cfg.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			r.trusted = append(r.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		r.trusted = append(r.trusted, network)
+	}
+	return r, nil
+}
+
+// Static returns a resolver that always answers with base.
+func Static(base string) *Resolver {
+	return &Resolver{fallback: strings.TrimSuffix(base, "/")}
+}
+
+// ParseBaseUrl checks that raw is an absolute http(s) URL without query
+// and fragment and returns it without the trailing slash.
+func ParseBaseUrl(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid base url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("base url must use http or https")
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("base url must have a host")
+	}
+	if u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", fmt.Errorf("base url must not have credentials, query or fragment")
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// Base returns the public base URL without the trailing slash. req may be
+// nil when there is no request to take forwarded headers from.
+func (r *Resolver) Base(req *http.Request) string {
+	if r.base != "" {
+		return r.base
+	}
+	if req != nil && r.fromTrustedProxy(req) {
+		if base, ok := forwardedBase(req); ok {
+			return base
+		}
+	}
+	return r.fallback
+}
+
+// Link returns the short URL of key.
+func (r *Resolver) Link(req *http.Request, key string) string {
+	return r.Base(req) + "/" + key
+}
+
+// Host returns the host of the configured base URL, or of the fallback.
+func (r *Resolver) Host() string {
+	base := r.base
+	if base == "" {
+		base = r.fallback
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// ClientIP returns the address of the client. Behind trusted proxies it
+// walks the Forwarded or X-Forwarded-For chain from the nearest hop and
+// takes the first address that is not a trusted proxy.
+func (r *Resolver) ClientIP(req *http.Request) string {
+	remote := hostOf(req.RemoteAddr)
+	if !r.trustedIP(remote) {
+		return remote
+	}
+
+	var chain []string
+	for _, header := range req.Header.Values("Forwarded") {
+		for _, element := range strings.Split(header, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(name, "for") {
+					chain = append(chain, hostOf(strings.Trim(value, `"`)))
+				}
+			}
+		}
+	}
+	if len(chain) == 0 {
+		for _, header := range req.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(header, ",") {
+				chain = append(chain, hostOf(strings.TrimSpace(hop)))
+			}
+		}
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		if net.ParseIP(chain[i]) == nil {
+			break
+		}
+		if !r.trustedIP(chain[i]) {
+			return chain[i]
+		}
+		remote = chain[i]
+	}
+	return remote
+}
+
+func (r *Resolver) fromTrustedProxy(req *http.Request) bool {
+	return r.trustedIP(hostOf(req.RemoteAddr))
+}
+
+func (r *Resolver) trustedIP(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range r.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostOf strips the port and IPv6 brackets from addr.
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+// forwardedBase reads the scheme and host the client used from the
+// Forwarded header, falling back to the X-Forwarded-* headers. Only the
+// first entry, added by the proxy facing the client, is taken into account.
+func forwardedBase(req *http.Request) (string, bool) {
+	proto, host := parseForwarded(req.Header.Get("Forwarded"))
+	if proto == "" && host == "" {
+		proto = firstValue(req.Header.Get("X-Forwarded-Proto"))
+		host = firstValue(req.Header.Get("X-Forwarded-Host"))
+	}
+	if proto == "" && host == "" {
+		return "", false
+	}
+
+	proto = strings.ToLower(proto)
+	if proto == "" {
+		proto = "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+	}
+	if host == "" {
+		host = req.Host
+	}
+	if (proto != "http" && proto != "https") || !validHost.MatchString(host) {
+		return "", false
+	}
+	return proto + "://" + host, true
+}
+
+func parseForwarded(header string) (string, string) {
+	var proto, host string
+	element := firstValue(header)
+	for _, pair := range strings.Split(element, ";") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		switch strings.ToLower(name) {
+		case "proto":
+			proto = value
+		case "host":
+			host = value
+		}
+	}
+	return proto, host
+}
+
+func firstValue(header string) string {
+	value, _, _ := strings.Cut(header, ",")
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,109 @@
+package tests
+
+import (
+	"OZON_test/internal/publicurl"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolver_Base(t *testing.T) {
+	resolver, err := publicurl.New(publicurl.Config{
+		TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1"},
+		Fallback:       "http://localhost:8080/",
+	})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{name: "NoHeaders", remote: "10.1.2.3:5000", want: "http://localhost:8080"},
+		{name: "Untrusted", remote: "203.0.113.7:5000", headers: map[string]string{"X-Forwarded-Host": "evil.com"}, want: "http://localhost:8080"},
+		{name: "XForwarded", remote: "10.1.2.3:5000", headers: map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "sho.rt, proxy.local"}, want: "https://sho.rt"},
+		{name: "SingleIp", remote: "192.0.2.1:5000", headers: map[string]string{"X-Forwarded-Host": "sho.rt:8443"}, want: "http://sho.rt:8443"},
+		{name: "Forwarded", remote: "10.1.2.3:5000", headers: map[string]string{"Forwarded": `for=192.0.2.60;proto=https;host="sho.rt", for=10.0.0.1`}, want: "https://sho.rt"},
+		{name: "ForwardedWins", remote: "10.1.2.3:5000", headers: map[string]string{"Forwarded": "proto=https;host=a.rt", "X-Forwarded-Host": "b.rt"}, want: "https://a.rt"},
+		{name: "ProtoOnly", remote: "10.1.2.3:5000", headers: map[string]string{"X-Forwarded-Proto": "https"}, want: "https://example.com"},
+		{name: "BadHost", remote: "10.1.2.3:5000", headers: map[string]string{"X-Forwarded-Host": "sho.rt/evil"}, want: "http://localhost:8080"},
+		{name: "BadProto", remote: "10.1.2.3:5000", headers: map[string]string{"X-Forwarded-Proto": "javascript"}, want: "http://localhost:8080"},
+	}
+
+	for _, tt := range tests {
+		tt := tt // захват переменной
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			req.RemoteAddr = tt.remote
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			assert.Equal(t, tt.want, resolver.Base(req))
+		})
+	}
+
+	assert.Equal(t, "http://localhost:8080", resolver.Base(nil))
+	assert.Equal(t, "http://localhost:8080/abc", resolver.Link(nil, "abc"))
+}
+
+func TestResolver_BaseUrl(t *testing.T) {
+	resolver, err := publicurl.New(publicurl.Config{
+		BaseUrl:        "https://sho.rt/s/",
+		TrustedProxies: []string{"10.0.0.0/8"},
+		Fallback:       "http://localhost:8080",
+	})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "10.1.2.3:5000"
+	req.Header.Set("X-Forwarded-Host", "other.rt")
+	assert.Equal(t, "https://sho.rt/s", resolver.Base(req))
+	assert.Equal(t, "https://sho.rt/s/abc", resolver.Link(nil, "abc"))
+	assert.Equal(t, "sho.rt", resolver.Host())
+}
+
+func TestNew_InvalidConfig(t *testing.T) {
+	for _, cfg := range []publicurl.Config{
+		{BaseUrl: "ftp://sho.rt"},
+		{BaseUrl: "sho.rt"},
+		{BaseUrl: "https://sho.rt/?a=1"},
+		{TrustedProxies: []string{"10.0.0.0/33"}},
+		{TrustedProxies: []string{"proxy.local"}},
+	} {
+		_, err := publicurl.New(cfg)
+		assert.Error(t, err, "config %+v", cfg)
+	}
+}
+
+func TestResolver_ClientIP(t *testing.T) {
+	resolver, err := publicurl.New(publicurl.Config{TrustedProxies: []string{"10.0.0.0/8"}})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{name: "Direct", remote: "203.0.113.7:5000", want: "203.0.113.7"},
+		{name: "UntrustedHeaders", remote: "203.0.113.7:5000", headers: map[string]string{"X-Forwarded-For": "198.51.100.1"}, want: "203.0.113.7"},
+		{name: "XForwardedFor", remote: "10.1.2.3:5000", headers: map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.9, 10.0.0.5"}, want: "203.0.113.9"},
+		{name: "Forwarded", remote: "10.1.2.3:5000", headers: map[string]string{"Forwarded": `for=198.51.100.1, for="[2001:db8::1]:4711"`}, want: "2001:db8::1"},
+		{name: "AllTrusted", remote: "10.1.2.3:5000", headers: map[string]string{"X-Forwarded-For": "10.0.0.9"}, want: "10.0.0.9"},
+		{name: "Obfuscated", remote: "10.1.2.3:5000", headers: map[string]string{"Forwarded": "for=_hidden"}, want: "10.1.2.3"},
+		{name: "IPv6Remote", remote: "[2001:db8::2]:5000", want: "2001:db8::2"},
+	}
+
+	for _, tt := range tests {
+		tt := tt // захват переменной
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			req.RemoteAddr = tt.remote
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			assert.Equal(t, tt.want, resolver.ClientIP(req))
+		})
+	}
+}
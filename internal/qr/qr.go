@@ -0,0 +1,179 @@
+package qr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strconv"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	FormatPNG = "png"
+	FormatSVG = "svg"
+)
+
+const (
+	MinSize   = 64
+	MaxSize   = 2048
+	MaxMargin = 16
+)
+
+// ErrInvalidOptions is wrapped by every error caused by bad Options.
+var ErrInvalidOptions = errors.New("invalid qr options")
+
+// Options control how a QR code is rendered. Size is the image width and
+// height in pixels, Margin is the quiet zone in modules, Level is one of
+// "L", "M", "Q" and "H", and colours are "#rgb" or "#rrggbb".
+type Options struct {
+	Format     string
+	Size       int
+	Level      string
+	Margin     int
+	Foreground string
+	Background string
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Format:     FormatPNG,
+		Size:       256,
+		Level:      "M",
+		Margin:     4,
+		Foreground: "#000000",
+		Background: "#ffffff",
+	}
+}
+
+func ContentType(format string) string {
+	if format == FormatSVG {
+		return "image/svg+xml"
+	}
+	return "image/png"
+}
+
+// Encode renders content as a QR code image.
+func Encode(content string, opts Options) ([]byte, error) {
+	level, err := parseLevel(opts.Level)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Size < MinSize || opts.Size > MaxSize {
+		return nil, fmt.Errorf("%w: size must be between %d and %d", ErrInvalidOptions, MinSize, MaxSize)
+	}
+	if opts.Margin < 0 || opts.Margin > MaxMargin {
+		return nil, fmt.Errorf("%w: margin must be between 0 and %d", ErrInvalidOptions, MaxMargin)
+	}
+	fg, err := ParseColor(opts.Foreground)
+	if err != nil {
+		return nil, err
+	}
+	bg, err := ParseColor(opts.Background)
+	if err != nil {
+		return nil, err
+	}
+
+	code, err := qrcode.New(content, level)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode qr code: %v", err)
+	}
+	code.DisableBorder = true
+	bitmap := code.Bitmap()
+
+	switch opts.Format {
+	case FormatPNG:
+		return renderPNG(bitmap, opts.Size, opts.Margin, fg, bg)
+	case FormatSVG:
+		return renderSVG(bitmap, opts.Size, opts.Margin, fg, bg), nil
+	default:
+		return nil, fmt.Errorf("%w: unknown format %q", ErrInvalidOptions, opts.Format)
+	}
+}
+
+func parseLevel(level string) (qrcode.RecoveryLevel, error) {
+	switch strings.ToUpper(level) {
+	case "L":
+		return qrcode.Low, nil
+	case "M":
+		return qrcode.Medium, nil
+	case "Q":
+		return qrcode.High, nil
+	case "H":
+		return qrcode.Highest, nil
+	default:
+		return 0, fmt.Errorf("%w: unknown error correction level %q", ErrInvalidOptions, level)
+	}
+}
+
+// ParseColor parses a "#rgb" or "#rrggbb" colour.
+func ParseColor(hex string) (color.RGBA, error) {
+	raw := strings.TrimPrefix(hex, "#")
+	if len(raw) == 3 {
+		raw = string([]byte{raw[0], raw[0], raw[1], raw[1], raw[2], raw[2]})
+	}
+	value, err := strconv.ParseUint(raw, 16, 32)
+	if len(raw) != 6 || err != nil {
+		return color.RGBA{}, fmt.Errorf("%w: invalid colour %q", ErrInvalidOptions, hex)
+	}
+	return color.RGBA{R: uint8(value >> 16), G: uint8(value >> 8), B: uint8(value), A: 0xff}, nil
+}
+
+// renderPNG scales every module to the same whole number of pixels and
+// centres the code, so the image is exactly size pixels wide unless the
+// code does not fit, in which case one pixel per module is used.
+func renderPNG(bitmap [][]bool, size int, margin int, fg color.RGBA, bg color.RGBA) ([]byte, error) {
+	modules := len(bitmap) + 2*margin
+	scale := max(size/modules, 1)
+	size = max(size, modules)
+	offset := (size - modules*scale) / 2
+
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{bg, fg})
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			left := offset + (x+margin)*scale
+			top := offset + (y+margin)*scale
+			for py := top; py < top+scale; py++ {
+				for px := left; px < left+scale; px++ {
+					img.SetColorIndex(px, py, 1)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func renderSVG(bitmap [][]bool, size int, margin int, fg color.RGBA, bg color.RGBA) []byte {
+	modules := len(bitmap) + 2*margin
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size, size, modules, modules)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="%s"/>`, modules, modules, svgColor(bg))
+	fmt.Fprintf(&buf, `<path fill="%s" d="`, svgColor(fg))
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x+margin, y+margin)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
+
+func svgColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
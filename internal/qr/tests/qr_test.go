@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"OZON_test/internal/qr"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestEncodePNG(t *testing.T) {
+	opts := qr.DefaultOptions()
+	opts.Size = 300
+	opts.Margin = 2
+	opts.Foreground = "#102030"
+	opts.Background = "#fff"
+
+	image, err := qr.Encode("http://localhost:8080/abcdefghij", opts)
+	assert.NoError(t, err)
+
+	decoded, err := png.Decode(bytes.NewReader(image))
+	assert.NoError(t, err)
+	assert.Equal(t, 300, decoded.Bounds().Dx())
+	assert.Equal(t, 300, decoded.Bounds().Dy())
+
+	rgba := func(x, y int) color.RGBA {
+		r, g, b, a := decoded.At(x, y).RGBA()
+		return color.RGBA{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(b >> 8), A: uint8(a >> 8)}
+	}
+	assert.Equal(t, color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}, rgba(0, 0), "quiet zone must use the background")
+
+	// The top left finder pattern starts right after the quiet zone.
+	found := false
+	for i := 0; i < 300 && !found; i++ {
+		found = rgba(i, i) == color.RGBA{R: 0x10, G: 0x20, B: 0x30, A: 0xff}
+	}
+	assert.True(t, found, "the code must use the foreground")
+}
+
+func TestEncodeSVG(t *testing.T) {
+	opts := qr.DefaultOptions()
+	opts.Format = qr.FormatSVG
+	opts.Margin = 0
+	opts.Foreground = "#ff0000"
+
+	image, err := qr.Encode("http://localhost:8080/abcdefghij", opts)
+	assert.NoError(t, err)
+
+	svg := string(image)
+	assert.True(t, strings.HasPrefix(svg, "<svg "))
+	assert.Contains(t, svg, `width="256" height="256"`)
+	assert.Contains(t, svg, `fill="#ff0000"`)
+	assert.Contains(t, svg, `fill="#ffffff"`)
+	assert.Contains(t, svg, "M0 0h1v1h-1z", "the finder pattern must touch the corner without a margin")
+	assert.Equal(t, "image/svg+xml", qr.ContentType(qr.FormatSVG))
+}
+
+func TestEncodeInvalidOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*qr.Options)
+	}{
+		{"Format", func(o *qr.Options) { o.Format = "gif" }},
+		{"Level", func(o *qr.Options) { o.Level = "X" }},
+		{"SizeTooSmall", func(o *qr.Options) { o.Size = qr.MinSize - 1 }},
+		{"SizeTooLarge", func(o *qr.Options) { o.Size = qr.MaxSize + 1 }},
+		{"NegativeMargin", func(o *qr.Options) { o.Margin = -1 }},
+		{"MarginTooLarge", func(o *qr.Options) { o.Margin = qr.MaxMargin + 1 }},
+		{"Foreground", func(o *qr.Options) { o.Foreground = "black" }},
+		{"Background", func(o *qr.Options) { o.Background = "#12345" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := qr.DefaultOptions()
+			tt.modify(&opts)
+			_, err := qr.Encode("http://localhost:8080/abcdefghij", opts)
+			assert.ErrorIs(t, err, qr.ErrInvalidOptions)
+		})
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	c, err := qr.ParseColor("#0a0B0c")
+	assert.NoError(t, err)
+	assert.Equal(t, color.RGBA{R: 0x0a, G: 0x0b, B: 0x0c, A: 0xff}, c)
+
+	c, err = qr.ParseColor("abc")
+	assert.NoError(t, err)
+	assert.Equal(t, color.RGBA{R: 0xaa, G: 0xbb, B: 0xcc, A: 0xff}, c)
+
+	_, err = qr.ParseColor("#ggg")
+	assert.Error(t, err)
+}
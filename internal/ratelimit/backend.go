@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"OZON_test/internal/storage"
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Memory keeps buckets in the process. Limits are per replica.
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+func NewMemory() *Memory {
+	return NewMemoryWithClock(time.Now)
+}
+
+// NewMemoryWithClock is NewMemory with a custom time source for tests.
+func NewMemoryWithClock(now func() time.Time) *Memory {
+	return &Memory{buckets: make(map[string]*bucket), now: now}
+}
+
+func (m *Memory) Take(key string, policy Policy) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(policy.Burst), updated: now}
+		m.buckets[key] = b
+	}
+	b.tokens = min(float64(policy.Burst), b.tokens+now.Sub(b.updated).Seconds()*policy.Rate)
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+	return false, time.Duration((1 - b.tokens) / policy.Rate * float64(time.Second)), nil
+}
+
+func (m *Memory) Prune(idle time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	for key, b := range m.buckets {
+		if now.Sub(b.updated) >= idle {
+			delete(m.buckets, key)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of tracked buckets.
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.buckets)
+}
+
+// Shared keeps buckets in the storage, so limits hold across replicas.
+type Shared struct {
+	storage storage.RateLimitStorage
+}
+
+func NewShared(st storage.RateLimitStorage) *Shared {
+	return &Shared{storage: st}
+}
+
+func (s *Shared) Take(key string, policy Policy) (bool, time.Duration, error) {
+	allowed, tokens, err := s.storage.TakeToken(key, policy.Rate, policy.Burst)
+	if err != nil || allowed {
+		return allowed, 0, err
+	}
+	return false, time.Duration((1 - tokens) / policy.Rate * float64(time.Second)), nil
+}
+
+func (s *Shared) Prune(idle time.Duration) error {
+	_, err := s.storage.PruneTokens(idle)
+	return err
+}
@@ -0,0 +1,177 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request classes with separate policies. ClassLogin counts sign-in
+// attempts and failed authentications.
+const (
+	ClassCreate   = "create"
+	ClassRedirect = "redirect"
+	ClassLogin    = "login"
+)
+
+// Policy is a token bucket: up to Burst requests at once, refilled at Rate
+// requests per second. A zero policy does not limit anything.
+type Policy struct {
+	Rate  float64
+	Burst int
+}
+
+func (p Policy) enabled() bool {
+	return p.Rate > 0 && p.Burst > 0
+}
+
+// fillTime is how long an empty bucket takes to become full again.
+func (p Policy) fillTime() time.Duration {
+	return time.Duration(float64(p.Burst) / p.Rate * float64(time.Second))
+}
+
+// ParseRate reads rates like "10/s", "30/m" or "1000/h" as requests per
+// second.
+func ParseRate(value string) (float64, error) {
+	count, unit, ok := strings.Cut(strings.TrimSpace(value), "/")
+	if !ok {
+		unit = "s"
+	}
+	n, err := strconv.ParseFloat(count, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q", value)
+	}
+	switch unit {
+	case "s":
+		return n, nil
+	case "m":
+		return n / 60, nil
+	case "h":
+		return n / 3600, nil
+	}
+	return 0, fmt.Errorf("invalid rate unit in %q", value)
+}
+
+// Backend stores the buckets.
+type Backend interface {
+	// Take removes a token from the bucket of key. When the bucket is empty
+	// it reports how long to wait for the next token.
+	Take(key string, policy Policy) (bool, time.Duration, error)
+	// Prune forgets buckets untouched for idle, which are full by then.
+	Prune(idle time.Duration) error
+}
+
+// Decision is the outcome of Allow.
+type Decision struct {
+	Allowed    bool
+	RetryAfter time.Duration
+}
+
+// RetryAfterSeconds rounds the wait up to whole seconds, as Retry-After
+// requires.
+func (d Decision) RetryAfterSeconds() int {
+	return max(int(math.Ceil(d.RetryAfter.Seconds())), 1)
+}
+
+type Config struct {
+	Policies      map[string]Policy
+	PruneInterval time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Policies: map[string]Policy{
+			ClassCreate:   {Rate: 1, Burst: 20},
+			ClassRedirect: {Rate: 20, Burst: 100},
+			ClassLogin:    {Rate: 0.1, Burst: 10},
+		},
+		PruneInterval: time.Minute,
+	}
+}
+
+// Limiter applies per class policies to client identities.
+type Limiter struct {
+	backend Backend
+	cfg     Config
+	idle    time.Duration
+	done    chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+func New(backend Backend, cfg Config) *Limiter {
+	if cfg.PruneInterval <= 0 {
+		cfg.PruneInterval = DefaultConfig().PruneInterval
+	}
+	l := &Limiter{backend: backend, cfg: cfg, done: make(chan struct{})}
+	for _, policy := range cfg.Policies {
+		if policy.enabled() {
+			l.idle = max(l.idle, policy.fillTime())
+		}
+	}
+	return l
+}
+
+// Allow takes a token for identity in class. Classes without a policy are
+// not limited. Backend failures let the request through, so an unavailable
+// shared backend does not take the service down.
+func (l *Limiter) Allow(class string, identity string) Decision {
+	policy := l.cfg.Policies[class]
+	if !policy.enabled() {
+		return Decision{Allowed: true}
+	}
+	allowed, retryAfter, err := l.backend.Take(class+":"+identity, policy)
+	if err != nil {
+		log.Printf("rate limit backend failed: %v", err)
+		return Decision{Allowed: true}
+	}
+	return Decision{Allowed: allowed, RetryAfter: retryAfter}
+}
+
+// Start prunes idle buckets in the background until Close.
+func (l *Limiter) Start() {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		ticker := time.NewTicker(l.cfg.PruneInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.done:
+				return
+			case <-ticker.C:
+				if err := l.backend.Prune(l.idle); err != nil {
+					log.Printf("failed to prune rate limit buckets: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func (l *Limiter) Close() {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	l.wg.Wait()
+}
+
+type identityKey struct{}
+
+// WithIdentity marks the request as made by an authenticated client, e.g.
+// "user:42" or "key:abc". Limits are then counted per identity instead of
+// per address. Only authentication code may set it: taking identities from
+// unverified input would let clients pick a fresh bucket for every request.
+func WithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// Identity returns the identity stored by WithIdentity.
+func Identity(ctx context.Context) string {
+	identity, _ := ctx.Value(identityKey{}).(string)
+	return identity
+}
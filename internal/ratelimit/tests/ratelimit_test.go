@@ -0,0 +1,132 @@
+package tests
+
+import (
+	"OZON_test/internal/ratelimit"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+type failingBackend struct{}
+
+func (failingBackend) Take(string, ratelimit.Policy) (bool, time.Duration, error) {
+	return false, 0, errors.New("connection refused")
+}
+
+func (failingBackend) Prune(time.Duration) error {
+	return nil
+}
+
+func TestMemory_TokenBucket(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	memory := ratelimit.NewMemoryWithClock(clock.Now)
+	policy := ratelimit.Policy{Rate: 2, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		allowed, _, err := memory.Take("a", policy)
+		assert.NoError(t, err)
+		assert.True(t, allowed, "request %d is within the burst", i)
+	}
+	allowed, retryAfter, err := memory.Take("a", policy)
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+
+	allowed, _, _ = memory.Take("b", policy)
+	assert.True(t, allowed, "buckets are per key")
+
+	clock.Advance(500 * time.Millisecond)
+	allowed, _, _ = memory.Take("a", policy)
+	assert.True(t, allowed)
+	allowed, _, _ = memory.Take("a", policy)
+	assert.False(t, allowed)
+
+	clock.Advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		allowed, _, _ = memory.Take("a", policy)
+		assert.True(t, allowed, "the bucket refills up to the burst only")
+	}
+	allowed, _, _ = memory.Take("a", policy)
+	assert.False(t, allowed)
+}
+
+func TestMemory_Prune(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	memory := ratelimit.NewMemoryWithClock(clock.Now)
+	policy := ratelimit.Policy{Rate: 1, Burst: 1}
+
+	_, _, _ = memory.Take("old", policy)
+	clock.Advance(time.Minute)
+	_, _, _ = memory.Take("new", policy)
+	assert.NoError(t, memory.Prune(30*time.Second))
+	assert.Equal(t, 1, memory.Len())
+}
+
+func TestLimiter_Allow(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	limiter := ratelimit.New(ratelimit.NewMemoryWithClock(clock.Now), ratelimit.Config{
+		Policies: map[string]ratelimit.Policy{
+			ratelimit.ClassCreate:   {Rate: 0.1, Burst: 1},
+			ratelimit.ClassRedirect: {Rate: 10, Burst: 2},
+		},
+	})
+
+	assert.True(t, limiter.Allow(ratelimit.ClassCreate, "ip:1").Allowed)
+	decision := limiter.Allow(ratelimit.ClassCreate, "ip:1")
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, 10, decision.RetryAfterSeconds())
+
+	assert.True(t, limiter.Allow(ratelimit.ClassRedirect, "ip:1").Allowed, "classes have separate buckets")
+	assert.True(t, limiter.Allow(ratelimit.ClassCreate, "ip:2").Allowed, "identities have separate buckets")
+	assert.True(t, limiter.Allow("other", "ip:1").Allowed, "classes without a policy are not limited")
+
+	failing := ratelimit.New(failingBackend{}, ratelimit.DefaultConfig())
+	assert.True(t, failing.Allow(ratelimit.ClassCreate, "ip:1").Allowed, "backend failures must fail open")
+}
+
+func TestDecision_RetryAfterSeconds(t *testing.T) {
+	assert.Equal(t, 1, ratelimit.Decision{RetryAfter: 10 * time.Millisecond}.RetryAfterSeconds())
+	assert.Equal(t, 2, ratelimit.Decision{RetryAfter: 1500 * time.Millisecond}.RetryAfterSeconds())
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+	}{
+		{"5", 5},
+		{"10/s", 10},
+		{"30/m", 0.5},
+		{"3600/h", 1},
+	}
+	for _, tt := range tests {
+		got, err := ratelimit.ParseRate(tt.value)
+		assert.NoError(t, err, tt.value)
+		assert.Equal(t, tt.want, got, tt.value)
+	}
+
+	for _, value := range []string{"", "fast", "-1/s", "10/d"} {
+		_, err := ratelimit.ParseRate(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	ctx := ratelimit.WithIdentity(context.Background(), "user:42")
+	assert.Equal(t, "user:42", ratelimit.Identity(ctx))
+	assert.Equal(t, "", ratelimit.Identity(context.Background()))
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Mux serves gRPC and plain HTTP on one port. Cleartext HTTP/2 (h2c) is
+// accepted both with prior knowledge, as gRPC clients use it, and through
+// the HTTP/1.1 upgrade. Requests are told apart by the application/grpc
+// content type, everything else goes to the HTTP handler.
+//
+// h2c connections are hijacked from the http.Server, so its Shutdown does
+// not wait for them. Mux tracks the requests itself, see Shutdown.
+type Mux struct {
+	grpcServer *grpc.Server
+	handler    http.Handler
+
+	mu      sync.Mutex
+	active  int
+	closing bool
+	idle    chan struct{}
+}
+
+func NewMux(grpcServer *grpc.Server, httpHandler http.Handler) *Mux {
+	m := &Mux{grpcServer: grpcServer, idle: make(chan struct{})}
+	m.handler = h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.enter() {
+			refuse(w, r)
+			return
+		}
+		defer m.leave()
+		if IsGrpc(r) {
+			grpcServer.ServeHTTP(w, r)
+			return
+		}
+		httpHandler.ServeHTTP(w, r)
+	}), &http2.Server{})
+	return m
+}
+
+func (m *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.handler.ServeHTTP(w, r)
+}
+
+// Shutdown refuses new requests, waits for pending ones and stops the gRPC
+// server, forcibly when ctx is done first. grpc.Server.GracefulStop cannot
+// be used here: it panics for servers serving through ServeHTTP.
+func (m *Mux) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	if !m.closing {
+		m.closing = true
+		if m.active == 0 {
+			close(m.idle)
+		}
+	}
+	m.mu.Unlock()
+
+	defer m.grpcServer.Stop()
+	select {
+	case <-m.idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Mux) enter() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closing {
+		return false
+	}
+	m.active++
+	return true
+}
+
+func (m *Mux) leave() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active--
+	if m.closing && m.active == 0 {
+		close(m.idle)
+	}
+}
+
+// refuse answers requests arriving during shutdown, gRPC calls with the
+// Unavailable status so that clients retry elsewhere.
+func refuse(w http.ResponseWriter, r *http.Request) {
+	if IsGrpc(r) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", strconv.Itoa(int(codes.Unavailable)))
+		w.Header().Set("Grpc-Message", "server is shutting down")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.Header().Set("Connection", "close")
+	http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+}
+
+// IsGrpc reports whether r is a gRPC call.
+func IsGrpc(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// GracefulStop waits for pending gRPC calls to finish and stops the server
+// forcibly when ctx is done first. It is meant for servers with their own
+// listener; use Mux.Shutdown for servers behind a Mux.
+func GracefulStop(ctx context.Context, grpcServer *grpc.Server) error {
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		grpcServer.Stop()
+		<-stopped
+		return ctx.Err()
+	}
+}
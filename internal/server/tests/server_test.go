@@ -0,0 +1,137 @@
+package tests
+
+import (
+	"OZON_test/internal/handler"
+	pb "OZON_test/internal/handler/proto"
+	"OZON_test/internal/server"
+	"OZON_test/internal/storage"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func MockGenerator(_ string, seed int) (string, error) {
+	return fmt.Sprintf("path%d", seed), nil
+}
+
+func TestMux_SinglePort(t *testing.T) {
+	var store storage.Storage = storage.NewSafeMap()
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(handler.UnaryRequestID))
+	pb.RegisterUrlServiceServer(grpcServer, handler.NewUrlServer(MockGenerator, &store, "localhost"))
+	handlers := handler.NewHandlers(handler.Options{Generator: MockGenerator, Storage: store})
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+	mixed := &http.Server{Handler: server.NewMux(grpcServer, handlers)}
+	go func() {
+		_ = mixed.Serve(lis)
+	}()
+	t.Cleanup(func() {
+		assert.NoError(t, mixed.Close())
+	})
+	addr := lis.Addr().String()
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, conn.Close())
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	created, err := pb.NewUrlServiceClient(conn).GenerateKey(ctx, &pb.GenerateKeyRequest{Url: "http://example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Data received successfully", created.Message)
+
+	// The link created over gRPC is served by the HTTP API on the same port.
+	resp, err := http.Get("http://" + addr + "/api/v1/links/path0")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, resp.Body.Close())
+	}()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, resp.ProtoMajor)
+	var link struct {
+		Url string `json:"url"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&link))
+	assert.Equal(t, "http://example.com", link.Url)
+
+	_, err = pb.NewUrlServiceClient(conn).Redirect(ctx, &pb.RedirectRequest{Key: "path0"})
+	assert.NoError(t, err)
+}
+
+func TestMux_Shutdown(t *testing.T) {
+	var store storage.Storage = storage.NewSafeMap()
+	started, release := make(chan struct{}), make(chan struct{})
+	blocking := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, next grpc.UnaryHandler) (any, error) {
+		started <- struct{}{}
+		<-release
+		return next(ctx, req)
+	}
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(blocking))
+	pb.RegisterUrlServiceServer(grpcServer, handler.NewUrlServer(MockGenerator, &store, "localhost"))
+	mux := server.NewMux(grpcServer, http.NotFoundHandler())
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+	mixed := &http.Server{Handler: mux}
+	go func() {
+		_ = mixed.Serve(lis)
+	}()
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, conn.Close())
+	})
+	client := pb.NewUrlServiceClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	called := make(chan error, 1)
+	go func() {
+		_, err := client.GenerateKey(ctx, &pb.GenerateKeyRequest{Url: "http://example.com"})
+		called <- err
+	}()
+	<-started
+
+	stopped := make(chan error, 1)
+	go func() {
+		err := mixed.Shutdown(ctx)
+		if stopErr := mux.Shutdown(ctx); err == nil {
+			err = stopErr
+		}
+		stopped <- err
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("shutdown must wait for the pending call")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	_, err = client.Redirect(ctx, &pb.RedirectRequest{Key: "path0"})
+	assert.Equal(t, codes.Unavailable, status.Code(err), "new calls are refused during shutdown")
+
+	close(release)
+	assert.NoError(t, <-called, "the pending call completes")
+	assert.NoError(t, <-stopped)
+}
+
+func TestIsGrpc(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPost, "http://localhost/pb.UrlService/GenerateKey", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	assert.False(t, server.IsGrpc(req), "gRPC requires HTTP/2")
+	req.ProtoMajor = 2
+	assert.True(t, server.IsGrpc(req))
+	req.Header.Set("Content-Type", "application/json")
+	assert.False(t, server.IsGrpc(req))
+}
@@ -2,19 +2,63 @@ package storage
 
 import (
 	"errors"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type SafeStringMap struct {
-	m sync.Map
+	m        sync.Map
+	health   sync.Map
+	options  sync.Map
+	stats    sync.Map
+	jobs     sync.Map
+	apiKeys  sync.Map
+	owners   sync.Map
+	users    sync.Map
+	names    sync.Map
+	sessions sync.Map
+	factors  sync.Map
+	// urls maps destinations to the sets of their keys for FindByUrl.
+	urls sync.Map
 }
 
 func NewSafeMap() *SafeStringMap {
-	return &SafeStringMap{m: sync.Map{}}
+	return &SafeStringMap{
+		m: sync.Map{}, health: sync.Map{}, options: sync.Map{}, stats: sync.Map{}, jobs: sync.Map{}, apiKeys: sync.Map{},
+		owners: sync.Map{}, users: sync.Map{}, names: sync.Map{}, sessions: sync.Map{}, factors: sync.Map{}, urls: sync.Map{},
+	}
 }
 
 func (sm *SafeStringMap) Store(key, value string) error {
-	sm.m.Store(key, value)
+	if _, loaded := sm.m.LoadOrStore(key, value); loaded {
+		return ErrAlreadyExists
+	}
+	sm.index(value, key)
+	sm.options.Delete(key)
+	sm.owners.Delete(key)
+	sm.stats.Store(key, newLinkCounters())
+	return nil
+}
+
+// StoreBatch stores links one by one and removes the stored ones again when
+// a key turns out to be taken.
+func (sm *SafeStringMap) StoreBatch(links []Link) error {
+	for i, link := range links {
+		if err := sm.Store(link.Key, link.Url); err != nil {
+			for _, stored := range links[:i] {
+				_ = sm.Delete(stored.Key)
+			}
+			return err
+		}
+		if link.Options != (LinkOptions{}) {
+			sm.options.Store(link.Key, link.Options)
+		}
+		if link.Owner != "" {
+			sm.owners.Store(link.Key, link.Owner)
+		}
+	}
 	return nil
 }
 
@@ -27,6 +71,525 @@ func (sm *SafeStringMap) Load(key string) (string, error) {
 	return "", errors.New("value not found")
 }
 
-func (sm *SafeStringMap) Delete(key string) {
-	sm.m.Delete(key)
+func (sm *SafeStringMap) Update(key, value string) error {
+	val, ok := sm.m.Load(key)
+	if _, isLink := val.(string); !ok || !isLink {
+		return ErrNotFound
+	}
+	if !sm.m.CompareAndSwap(key, val, value) {
+		return ErrNotFound
+	}
+	sm.unindex(val, key)
+	sm.index(value, key)
+	return nil
+}
+
+func (sm *SafeStringMap) Delete(key string) error {
+	val, ok := sm.m.Load(key)
+	if _, isLink := val.(string); !ok || !isLink {
+		return ErrNotFound
+	}
+	if !sm.m.CompareAndDelete(key, val) {
+		return ErrNotFound
+	}
+	sm.unindex(val, key)
+	sm.options.Delete(key)
+	sm.owners.Delete(key)
+	sm.health.Delete(key)
+	sm.stats.Delete(key)
+	return nil
+}
+
+func (sm *SafeStringMap) LoadOptions(key string) (LinkOptions, error) {
+	if _, err := sm.Load(key); err != nil {
+		return LinkOptions{}, err
+	}
+	if val, ok := sm.options.Load(key); ok {
+		return val.(LinkOptions), nil
+	}
+	return LinkOptions{}, nil
+}
+
+func (sm *SafeStringMap) StoreOptions(key string, options LinkOptions) error {
+	sm.options.Store(key, options)
+	return nil
+}
+
+func (sm *SafeStringMap) LoadOwner(key string) (string, error) {
+	val, ok := sm.m.Load(key)
+	if _, isLink := val.(string); !ok || !isLink {
+		return "", ErrNotFound
+	}
+	owner, _ := sm.owners.Load(key)
+	name, _ := owner.(string)
+	return name, nil
+}
+
+func (sm *SafeStringMap) StoreOwner(key string, owner string) error {
+	if owner == "" {
+		sm.owners.Delete(key)
+		return nil
+	}
+	sm.owners.Store(key, owner)
+	return nil
+}
+
+func (sm *SafeStringMap) ListOwned(owner string, after string, limit int) ([]Link, error) {
+	return sm.list(after, limit, func(key string) bool {
+		val, ok := sm.owners.Load(key)
+		return ok && val.(string) == owner
+	})
+}
+
+func (sm *SafeStringMap) RecentOwned(owner string, limit int) ([]Link, error) {
+	links, err := sm.ListOwned(owner, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	created := make(map[string]time.Time, len(links))
+	for _, link := range links {
+		if c, err := sm.counters(link.Key); err == nil {
+			created[link.Key] = c.createdAt
+		}
+	}
+	sort.SliceStable(links, func(i, j int) bool {
+		return created[links[i].Key].After(created[links[j].Key])
+	})
+	if limit > 0 && len(links) > limit {
+		links = links[:limit]
+	}
+	return links, nil
+}
+
+type linkCounters struct {
+	createdAt time.Time
+	clicks    atomic.Uint64
+}
+
+func newLinkCounters() *linkCounters {
+	return &linkCounters{createdAt: time.Now()}
+}
+
+func (sm *SafeStringMap) counters(key string) (*linkCounters, error) {
+	if _, err := sm.Load(key); err != nil {
+		return nil, err
+	}
+	val, _ := sm.stats.LoadOrStore(key, newLinkCounters())
+	return val.(*linkCounters), nil
+}
+
+func (sm *SafeStringMap) LoadStats(key string) (LinkStats, error) {
+	c, err := sm.counters(key)
+	if err != nil {
+		return LinkStats{}, err
+	}
+	return LinkStats{CreatedAt: c.createdAt, Clicks: c.clicks.Load()}, nil
+}
+
+func (sm *SafeStringMap) RecordClick(key string) error {
+	c, err := sm.counters(key)
+	if err != nil {
+		return err
+	}
+	c.clicks.Add(1)
+	return nil
+}
+
+// index adds key to the keys of url. Concurrent writers may leave stale
+// entries behind, so FindByUrl checks every key against the links.
+func (sm *SafeStringMap) index(url string, key string) {
+	keys, _ := sm.urls.LoadOrStore(url, &sync.Map{})
+	keys.(*sync.Map).Store(key, struct{}{})
+}
+
+func (sm *SafeStringMap) unindex(val any, key string) {
+	url, ok := val.(string)
+	if !ok {
+		return
+	}
+	if keys, ok := sm.urls.Load(url); ok {
+		keys.(*sync.Map).Delete(key)
+	}
+}
+
+func (sm *SafeStringMap) FindByUrl(url string) ([]Link, error) {
+	keys, ok := sm.urls.Load(url)
+	if !ok {
+		return nil, nil
+	}
+	var indexed []string
+	keys.(*sync.Map).Range(func(key, _ any) bool {
+		indexed = append(indexed, key.(string))
+		return true
+	})
+	sort.Strings(indexed)
+
+	var links []Link
+	for _, key := range indexed {
+		if val, ok := sm.m.Load(key); !ok || val != url {
+			continue
+		}
+		link := Link{Key: key, Url: url}
+		if val, ok := sm.options.Load(key); ok {
+			link.Options = val.(LinkOptions)
+		}
+		if val, ok := sm.owners.Load(key); ok {
+			link.Owner = val.(string)
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+func (sm *SafeStringMap) List(after string, limit int) ([]Link, error) {
+	return sm.list(after, limit, func(string) bool { return true })
+}
+
+func (sm *SafeStringMap) list(after string, limit int, match func(key string) bool) ([]Link, error) {
+	var links []Link
+	sm.m.Range(func(key, val any) bool {
+		k, _ := key.(string)
+		if url, ok := val.(string); ok && k > after && match(k) {
+			links = append(links, Link{Key: k, Url: url})
+		}
+		return true
+	})
+	sort.Slice(links, func(i, j int) bool { return links[i].Key < links[j].Key })
+	if limit > 0 && len(links) > limit {
+		links = links[:limit]
+	}
+	for i := range links {
+		if val, ok := sm.options.Load(links[i].Key); ok {
+			links[i].Options = val.(LinkOptions)
+		}
+		if val, ok := sm.owners.Load(links[i].Key); ok {
+			links[i].Owner = val.(string)
+		}
+	}
+	return links, nil
+}
+
+func (sm *SafeStringMap) LoadHealth(key string) (LinkHealth, error) {
+	if val, ok := sm.health.Load(key); ok {
+		return val.(LinkHealth), nil
+	}
+	return LinkHealth{}, ErrNotFound
+}
+
+func (sm *SafeStringMap) StoreHealth(health LinkHealth) error {
+	sm.health.Store(health.Key, health)
+	return nil
+}
+
+func (sm *SafeStringMap) ListUnhealthy(after string, limit int) ([]LinkHealth, error) {
+	var unhealthy []LinkHealth
+	sm.health.Range(func(_, val any) bool {
+		if h := val.(LinkHealth); h.ConsecutiveFailures > 0 && h.Key > after {
+			unhealthy = append(unhealthy, h)
+		}
+		return true
+	})
+	sort.Slice(unhealthy, func(i, j int) bool { return unhealthy[i].Key < unhealthy[j].Key })
+	if limit > 0 && len(unhealthy) > limit {
+		unhealthy = unhealthy[:limit]
+	}
+	return unhealthy, nil
+}
+
+type storedJob struct {
+	mu     sync.Mutex
+	job    Job
+	input  []byte
+	result []byte
+}
+
+func (sm *SafeStringMap) storedJob(id string) (*storedJob, error) {
+	if val, ok := sm.jobs.Load(id); ok {
+		return val.(*storedJob), nil
+	}
+	return nil, ErrNotFound
+}
+
+func (sm *SafeStringMap) CreateJob(job Job, input []byte) error {
+	if _, loaded := sm.jobs.LoadOrStore(job.ID, &storedJob{job: job, input: input}); loaded {
+		return errors.New("job already exists")
+	}
+	return nil
+}
+
+func (sm *SafeStringMap) LoadJob(id string) (Job, error) {
+	sj, err := sm.storedJob(id)
+	if err != nil {
+		return Job{}, err
+	}
+	sj.mu.Lock()
+	defer sj.mu.Unlock()
+	return sj.job, nil
+}
+
+func (sm *SafeStringMap) UpdateJob(job Job, result []byte) error {
+	sj, err := sm.storedJob(job.ID)
+	if err != nil {
+		return err
+	}
+	sj.mu.Lock()
+	defer sj.mu.Unlock()
+	if sj.job.Status != JobQueued && sj.job.Status != JobRunning {
+		return ErrNotFound
+	}
+	job.CreatedAt = sj.job.CreatedAt
+	job.Owner = sj.job.Owner
+	sj.job = job
+	sj.result = append(sj.result, result...)
+	return nil
+}
+
+func (sm *SafeStringMap) LoadJobInput(id string) ([]byte, error) {
+	sj, err := sm.storedJob(id)
+	if err != nil {
+		return nil, err
+	}
+	return sj.input, nil
+}
+
+func (sm *SafeStringMap) LoadJobResult(id string) ([]byte, error) {
+	sj, err := sm.storedJob(id)
+	if err != nil {
+		return nil, err
+	}
+	sj.mu.Lock()
+	defer sj.mu.Unlock()
+	return append([]byte(nil), sj.result...), nil
+}
+
+func (sm *SafeStringMap) ListJobs(statuses ...string) ([]Job, error) {
+	var jobs []Job
+	sm.jobs.Range(func(_, val any) bool {
+		sj := val.(*storedJob)
+		sj.mu.Lock()
+		job := sj.job
+		sj.mu.Unlock()
+		for _, status := range statuses {
+			if job.Status == status {
+				jobs = append(jobs, job)
+				break
+			}
+		}
+		return true
+	})
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	return jobs, nil
+}
+
+func (sm *SafeStringMap) CreateAPIKey(key APIKey) error {
+	if _, loaded := sm.apiKeys.LoadOrStore(key.ID, key); loaded {
+		return errors.New("API key already exists")
+	}
+	return nil
+}
+
+func (sm *SafeStringMap) LoadAPIKey(id string) (APIKey, error) {
+	if val, ok := sm.apiKeys.Load(id); ok {
+		return val.(APIKey), nil
+	}
+	return APIKey{}, ErrNotFound
+}
+
+func (sm *SafeStringMap) ListAPIKeys() ([]APIKey, error) {
+	var keys []APIKey
+	sm.apiKeys.Range(func(_, val any) bool {
+		keys = append(keys, val.(APIKey))
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].ID < keys[j].ID
+		}
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (sm *SafeStringMap) DeleteAPIKey(id string) error {
+	if _, loaded := sm.apiKeys.LoadAndDelete(id); !loaded {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (sm *SafeStringMap) CreateUser(user User) error {
+	if _, loaded := sm.names.LoadOrStore(user.Username, user.ID); loaded {
+		return ErrAlreadyExists
+	}
+	if _, loaded := sm.users.LoadOrStore(user.ID, user); loaded {
+		sm.names.Delete(user.Username)
+		return ErrAlreadyExists
+	}
+	return nil
+}
+
+func (sm *SafeStringMap) LoadUser(id string) (User, error) {
+	if val, ok := sm.users.Load(id); ok {
+		return val.(User), nil
+	}
+	return User{}, ErrNotFound
+}
+
+func (sm *SafeStringMap) LoadUserByName(username string) (User, error) {
+	if id, ok := sm.names.Load(username); ok {
+		return sm.LoadUser(id.(string))
+	}
+	return User{}, ErrNotFound
+}
+
+func (sm *SafeStringMap) CreateSession(session Session) error {
+	if _, loaded := sm.sessions.LoadOrStore(session.ID, session); loaded {
+		return ErrAlreadyExists
+	}
+	return nil
+}
+
+func (sm *SafeStringMap) LoadSession(id string) (Session, error) {
+	if val, ok := sm.sessions.Load(id); ok {
+		return val.(Session), nil
+	}
+	return Session{}, ErrNotFound
+}
+
+func (sm *SafeStringMap) DeleteSession(id string) error {
+	if _, loaded := sm.sessions.LoadAndDelete(id); !loaded {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (sm *SafeStringMap) DeleteExpiredSessions(now time.Time) (int, error) {
+	deleted := 0
+	sm.sessions.Range(func(key, val any) bool {
+		if !now.Before(val.(Session).ExpiresAt) {
+			sm.sessions.Delete(key)
+			deleted++
+		}
+		return true
+	})
+	return deleted, nil
+}
+
+// Enrolments are stored as pointers, which unlike the struct with its
+// slice can be compared and swapped.
+func (sm *SafeStringMap) StoreSecondFactor(factor SecondFactor) error {
+	factor.RecoveryCodes = append([]string(nil), factor.RecoveryCodes...)
+	sm.factors.Store(factor.UserID, &factor)
+	return nil
+}
+
+func (sm *SafeStringMap) LoadSecondFactor(userID string) (SecondFactor, error) {
+	if val, ok := sm.factors.Load(userID); ok {
+		factor := *val.(*SecondFactor)
+		factor.RecoveryCodes = append([]string(nil), factor.RecoveryCodes...)
+		return factor, nil
+	}
+	return SecondFactor{}, ErrNotFound
+}
+
+func (sm *SafeStringMap) DeleteSecondFactor(userID string) error {
+	if _, loaded := sm.factors.LoadAndDelete(userID); !loaded {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (sm *SafeStringMap) UseTOTPStep(userID string, step int64) (bool, error) {
+	return sm.updateSecondFactor(userID, func(factor *SecondFactor) bool {
+		if step <= factor.LastStep {
+			return false
+		}
+		factor.LastStep = step
+		return true
+	})
+}
+
+func (sm *SafeStringMap) UseRecoveryCode(userID string, hash string) (bool, error) {
+	return sm.updateSecondFactor(userID, func(factor *SecondFactor) bool {
+		for i, code := range factor.RecoveryCodes {
+			if code == hash {
+				factor.RecoveryCodes = append(factor.RecoveryCodes[:i:i], factor.RecoveryCodes[i+1:]...)
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// updateSecondFactor applies update to a copy of the enrolment of userID
+// and stores it if update reports a change, retrying on concurrent writes.
+func (sm *SafeStringMap) updateSecondFactor(userID string, update func(factor *SecondFactor) bool) (bool, error) {
+	for {
+		val, ok := sm.factors.Load(userID)
+		if !ok {
+			return false, ErrNotFound
+		}
+		factor := *val.(*SecondFactor)
+		if !update(&factor) {
+			return false, nil
+		}
+		if sm.factors.CompareAndSwap(userID, val, &factor) {
+			return true, nil
+		}
+	}
+}
+
+type reservation struct {
+	at time.Time
+}
+
+func (sm *SafeStringMap) Reserve(key string) (bool, error) {
+	_, loaded := sm.m.LoadOrStore(key, reservation{at: time.Now()})
+	return !loaded, nil
+}
+
+func (sm *SafeStringMap) Commit(key, value string) error {
+	val, ok := sm.m.Load(key)
+	if _, reserved := val.(reservation); !ok || !reserved {
+		return ErrReservationLost
+	}
+	if !sm.m.CompareAndSwap(key, val, value) {
+		return ErrReservationLost
+	}
+	sm.index(value, key)
+	sm.stats.Store(key, newLinkCounters())
+	return nil
+}
+
+func (sm *SafeStringMap) Release(key string) error {
+	if val, ok := sm.m.Load(key); ok {
+		if _, reserved := val.(reservation); reserved {
+			sm.m.CompareAndDelete(key, val)
+		}
+	}
+	return nil
+}
+
+func (sm *SafeStringMap) ReleaseExpired(ttl time.Duration) (int, error) {
+	cutoff := time.Now().Add(-ttl)
+	released := 0
+	sm.m.Range(func(key, val any) bool {
+		if r, ok := val.(reservation); ok && r.at.Before(cutoff) && sm.m.CompareAndDelete(key, val) {
+			released++
+		}
+		return true
+	})
+	return released, nil
+}
+
+type SafeCounter struct {
+	next atomic.Uint64
+}
+
+func NewSafeCounter() *SafeCounter {
+	return &SafeCounter{}
+}
+
+func (c *SafeCounter) LeaseRange(size uint64) (uint64, error) {
+	return c.next.Add(size) - size, nil
 }
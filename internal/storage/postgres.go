@@ -5,11 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"log"
 	"strconv"
+	"sync"
+	"time"
 )
 
 type PostgresStringMap struct {
+	mu        sync.Mutex
 	conn      *pgx.Conn
 	tableName string
 }
@@ -32,14 +36,21 @@ func NewPostgresStringMap(connString string, tableName string, keyLen int) (*Pos
 		}
 	}
 
+	if err := migrateTable(conn, tableName); err != nil {
+		return nil, err
+	}
+
 	return &PostgresStringMap{conn: conn, tableName: tableName}, nil
 }
 
 func (pg *PostgresStringMap) Load(key string) (value string, err error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
 	query := fmt.Sprintf(`
         SELECT url
         FROM "%s"
-        WHERE id = $1
+        WHERE id = $1 AND reserved_at IS NULL
     `, pg.tableName)
 
 	var url string
@@ -55,24 +66,998 @@ func (pg *PostgresStringMap) Load(key string) (value string, err error) {
 }
 
 func (pg *PostgresStringMap) Store(key string, value string) error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
 	query := fmt.Sprintf(`
         INSERT INTO "%s" (id, url)
         VALUES ($1, $2)
-        ON CONFLICT (id) DO UPDATE SET url = EXCLUDED.url
+        ON CONFLICT (id) DO NOTHING
     `, pg.tableName)
 
-	_, err := pg.conn.Exec(context.Background(), query, key, value)
+	tag, err := pg.conn.Exec(context.Background(), query, key, value)
 	if err != nil {
 		log.Printf("Error storing key: %v", err)
 		return err
 	}
+	if tag.RowsAffected() == 0 {
+		return ErrAlreadyExists
+	}
+	return nil
+}
+
+func (pg *PostgresStringMap) StoreBatch(links []Link) error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        INSERT INTO "%s" (id, url, options, owner)
+        VALUES ($1, $2, $3, NULLIF($4, ''))
+        ON CONFLICT (id) DO NOTHING
+    `, pg.tableName)
+
+	ctx := context.Background()
+	tx, err := pg.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// No-op once the transaction is committed.
+		_ = tx.Rollback(ctx)
+	}()
+
+	batch := &pgx.Batch{}
+	for _, link := range links {
+		batch.Queue(query, link.Key, link.Url, link.Options, link.Owner)
+	}
+	results := tx.SendBatch(ctx, batch)
+	conflict := false
+	for range links {
+		tag, err := results.Exec()
+		if err != nil {
+			_ = results.Close()
+			log.Printf("Error storing batch: %v", err)
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			conflict = true
+		}
+	}
+	if err := results.Close(); err != nil {
+		log.Printf("Error storing batch: %v", err)
+		return err
+	}
+	if conflict {
+		// The deferred rollback discards the links stored so far.
+		return ErrAlreadyExists
+	}
+	return tx.Commit(ctx)
+}
+
+func (pg *PostgresStringMap) Update(key string, value string) error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        UPDATE "%s"
+        SET url = $2
+        WHERE id = $1 AND reserved_at IS NULL
+    `, pg.tableName)
+
+	tag, err := pg.conn.Exec(context.Background(), query, key, value)
+	if err != nil {
+		log.Printf("Error updating key: %v", err)
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (pg *PostgresStringMap) Delete(key string) error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        WITH deleted AS (
+            DELETE FROM "%[1]s"
+            WHERE id = $1 AND reserved_at IS NULL
+            RETURNING id
+        ), health AS (
+            DELETE FROM "%[1]s_health"
+            WHERE id IN (SELECT id FROM deleted)
+        )
+        SELECT count(*) FROM deleted
+    `, pg.tableName)
+
+	var deleted int
+	if err := pg.conn.QueryRow(context.Background(), query, key).Scan(&deleted); err != nil {
+		log.Printf("Error deleting key: %v", err)
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
 	return nil
 }
 
+func (pg *PostgresStringMap) LoadOptions(key string) (LinkOptions, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        SELECT options
+        FROM "%s"
+        WHERE id = $1 AND reserved_at IS NULL
+    `, pg.tableName)
+
+	var options LinkOptions
+	err := pg.conn.QueryRow(context.Background(), query, key).Scan(&options)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("Error loading options: %v", err)
+		}
+		return LinkOptions{}, err
+	}
+	return options, nil
+}
+
+func (pg *PostgresStringMap) StoreOptions(key string, options LinkOptions) error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        UPDATE "%s"
+        SET options = $2
+        WHERE id = $1
+    `, pg.tableName)
+
+	_, err := pg.conn.Exec(context.Background(), query, key, options)
+	if err != nil {
+		log.Printf("Error storing options: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (pg *PostgresStringMap) LoadStats(key string) (LinkStats, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        SELECT created_at, clicks
+        FROM "%s"
+        WHERE id = $1 AND reserved_at IS NULL
+    `, pg.tableName)
+
+	var stats LinkStats
+	err := pg.conn.QueryRow(context.Background(), query, key).Scan(&stats.CreatedAt, &stats.Clicks)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return LinkStats{}, ErrNotFound
+	}
+	if err != nil {
+		log.Printf("Error loading stats: %v", err)
+		return LinkStats{}, err
+	}
+	return stats, nil
+}
+
+func (pg *PostgresStringMap) RecordClick(key string) error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        UPDATE "%s"
+        SET clicks = clicks + 1
+        WHERE id = $1 AND reserved_at IS NULL
+    `, pg.tableName)
+
+	tag, err := pg.conn.Exec(context.Background(), query, key)
+	if err != nil {
+		log.Printf("Error recording click: %v", err)
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (pg *PostgresStringMap) Reserve(key string) (bool, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        INSERT INTO "%s" (id, url, reserved_at)
+        VALUES ($1, '', now())
+        ON CONFLICT (id) DO NOTHING
+    `, pg.tableName)
+
+	tag, err := pg.conn.Exec(context.Background(), query, key)
+	if err != nil {
+		log.Printf("Error reserving key: %v", err)
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (pg *PostgresStringMap) Commit(key string, value string) error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        UPDATE "%s"
+        SET url = $2, reserved_at = NULL, created_at = now()
+        WHERE id = $1 AND reserved_at IS NOT NULL
+    `, pg.tableName)
+
+	tag, err := pg.conn.Exec(context.Background(), query, key, value)
+	if err != nil {
+		log.Printf("Error committing key: %v", err)
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrReservationLost
+	}
+	return nil
+}
+
+func (pg *PostgresStringMap) Release(key string) error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        DELETE FROM "%s"
+        WHERE id = $1 AND reserved_at IS NOT NULL
+    `, pg.tableName)
+
+	_, err := pg.conn.Exec(context.Background(), query, key)
+	return err
+}
+
+func (pg *PostgresStringMap) ReleaseExpired(ttl time.Duration) (int, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        DELETE FROM "%s"
+        WHERE reserved_at < now() - make_interval(secs => $1)
+    `, pg.tableName)
+
+	tag, err := pg.conn.Exec(context.Background(), query, ttl.Seconds())
+	if err != nil {
+		log.Printf("Error releasing expired reservations: %v", err)
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+func (pg *PostgresStringMap) List(after string, limit int) ([]Link, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        SELECT id, url, options, coalesce(owner, '')
+        FROM "%s"
+        WHERE reserved_at IS NULL AND id > $1
+        ORDER BY id
+        LIMIT $2
+    `, pg.tableName)
+
+	rows, err := pg.conn.Query(context.Background(), query, after, pgLimit(limit))
+	if err != nil {
+		log.Printf("Error listing keys: %v", err)
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scanLink)
+}
+
+func (pg *PostgresStringMap) ListOwned(owner string, after string, limit int) ([]Link, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        SELECT id, url, options, coalesce(owner, '')
+        FROM "%s"
+        WHERE reserved_at IS NULL AND owner = $1 AND id > $2
+        ORDER BY id
+        LIMIT $3
+    `, pg.tableName)
+
+	rows, err := pg.conn.Query(context.Background(), query, owner, after, pgLimit(limit))
+	if err != nil {
+		log.Printf("Error listing owned keys: %v", err)
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scanLink)
+}
+
+func (pg *PostgresStringMap) RecentOwned(owner string, limit int) ([]Link, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        SELECT id, url, options, coalesce(owner, '')
+        FROM "%s"
+        WHERE reserved_at IS NULL AND owner = $1
+        ORDER BY created_at DESC, id
+        LIMIT $2
+    `, pg.tableName)
+
+	rows, err := pg.conn.Query(context.Background(), query, owner, pgLimit(limit))
+	if err != nil {
+		log.Printf("Error listing recent keys: %v", err)
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scanLink)
+}
+
+func (pg *PostgresStringMap) FindByUrl(url string) ([]Link, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        SELECT id, url, options, coalesce(owner, '')
+        FROM "%s"
+        WHERE reserved_at IS NULL AND url = $1
+        ORDER BY id
+    `, pg.tableName)
+
+	rows, err := pg.conn.Query(context.Background(), query, url)
+	if err != nil {
+		log.Printf("Error finding keys by url: %v", err)
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scanLink)
+}
+
+func scanLink(row pgx.CollectableRow) (Link, error) {
+	var link Link
+	err := row.Scan(&link.Key, &link.Url, &link.Options, &link.Owner)
+	return link, err
+}
+
+func (pg *PostgresStringMap) LoadOwner(key string) (string, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        SELECT coalesce(owner, '')
+        FROM "%s"
+        WHERE id = $1 AND reserved_at IS NULL
+    `, pg.tableName)
+
+	var owner string
+	err := pg.conn.QueryRow(context.Background(), query, key).Scan(&owner)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		log.Printf("Error loading owner: %v", err)
+		return "", err
+	}
+	return owner, nil
+}
+
+func (pg *PostgresStringMap) StoreOwner(key string, owner string) error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        UPDATE "%s"
+        SET owner = NULLIF($2, '')
+        WHERE id = $1 AND reserved_at IS NULL
+    `, pg.tableName)
+
+	tag, err := pg.conn.Exec(context.Background(), query, key, owner)
+	if err != nil {
+		log.Printf("Error storing owner: %v", err)
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (pg *PostgresStringMap) LoadHealth(key string) (LinkHealth, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        SELECT id, status, error, checked_at, failures
+        FROM "%s_health"
+        WHERE id = $1
+    `, pg.tableName)
+
+	var health LinkHealth
+	err := pg.conn.QueryRow(context.Background(), query, key).Scan(
+		&health.Key, &health.Status, &health.Error, &health.CheckedAt, &health.ConsecutiveFailures,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return LinkHealth{}, ErrNotFound
+	}
+	if err != nil {
+		log.Printf("Error loading health: %v", err)
+		return LinkHealth{}, err
+	}
+	return health, nil
+}
+
+func (pg *PostgresStringMap) StoreHealth(health LinkHealth) error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        INSERT INTO "%s_health" (id, status, error, checked_at, failures)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (id) DO UPDATE SET
+            status = EXCLUDED.status,
+            error = EXCLUDED.error,
+            checked_at = EXCLUDED.checked_at,
+            failures = EXCLUDED.failures
+    `, pg.tableName)
+
+	_, err := pg.conn.Exec(context.Background(), query,
+		health.Key, health.Status, health.Error, health.CheckedAt, health.ConsecutiveFailures,
+	)
+	if err != nil {
+		log.Printf("Error storing health: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (pg *PostgresStringMap) ListUnhealthy(after string, limit int) ([]LinkHealth, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        SELECT id, status, error, checked_at, failures
+        FROM "%s_health"
+        WHERE failures > 0 AND id > $1
+        ORDER BY id
+        LIMIT $2
+    `, pg.tableName)
+
+	rows, err := pg.conn.Query(context.Background(), query, after, pgLimit(limit))
+	if err != nil {
+		log.Printf("Error listing health: %v", err)
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (LinkHealth, error) {
+		var health LinkHealth
+		err := row.Scan(&health.Key, &health.Status, &health.Error, &health.CheckedAt, &health.ConsecutiveFailures)
+		return health, err
+	})
+}
+
+const jobColumns = `id, status, format, total, processed, created, existed, failed, errors, error, created_at, updated_at, owner`
+
+func scanJob(row pgx.Row) (Job, error) {
+	var job Job
+	err := row.Scan(
+		&job.ID, &job.Status, &job.Format, &job.Total, &job.Processed, &job.Created, &job.Existed, &job.Failed,
+		&job.Errors, &job.Error, &job.CreatedAt, &job.UpdatedAt, &job.Owner,
+	)
+	return job, err
+}
+
+func (pg *PostgresStringMap) CreateJob(job Job, input []byte) error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        INSERT INTO "%s_jobs" (%s, input)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+    `, pg.tableName, jobColumns)
+
+	_, err := pg.conn.Exec(context.Background(), query,
+		job.ID, job.Status, job.Format, job.Total, job.Processed, job.Created, job.Existed, job.Failed,
+		jobErrors(job.Errors), job.Error, job.CreatedAt, job.UpdatedAt, job.Owner, input,
+	)
+	if err != nil {
+		log.Printf("Error creating job: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (pg *PostgresStringMap) LoadJob(id string) (Job, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`SELECT %s FROM "%s_jobs" WHERE id = $1`, jobColumns, pg.tableName)
+
+	job, err := scanJob(pg.conn.QueryRow(context.Background(), query, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Job{}, ErrNotFound
+	}
+	if err != nil {
+		log.Printf("Error loading job: %v", err)
+		return Job{}, err
+	}
+	return job, nil
+}
+
+func (pg *PostgresStringMap) UpdateJob(job Job, result []byte) error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        UPDATE "%s_jobs"
+        SET status = $2, total = $3, processed = $4, created = $5, existed = $6, failed = $7,
+            errors = $8, error = $9, updated_at = $10, result = result || coalesce($11, ''::bytea)
+        WHERE id = $1 AND status IN ('%s', '%s')
+    `, pg.tableName, JobQueued, JobRunning)
+
+	tag, err := pg.conn.Exec(context.Background(), query,
+		job.ID, job.Status, job.Total, job.Processed, job.Created, job.Existed, job.Failed,
+		jobErrors(job.Errors), job.Error, job.UpdatedAt, result,
+	)
+	if err != nil {
+		log.Printf("Error updating job: %v", err)
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (pg *PostgresStringMap) LoadJobInput(id string) ([]byte, error) {
+	return pg.loadJobData(id, "input")
+}
+
+func (pg *PostgresStringMap) LoadJobResult(id string) ([]byte, error) {
+	return pg.loadJobData(id, "result")
+}
+
+func (pg *PostgresStringMap) loadJobData(id string, column string) ([]byte, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`SELECT %s FROM "%s_jobs" WHERE id = $1`, column, pg.tableName)
+
+	var data []byte
+	err := pg.conn.QueryRow(context.Background(), query, id).Scan(&data)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		log.Printf("Error loading job %s: %v", column, err)
+		return nil, err
+	}
+	return data, nil
+}
+
+func (pg *PostgresStringMap) ListJobs(statuses ...string) ([]Job, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        SELECT %s
+        FROM "%s_jobs"
+        WHERE status = ANY($1)
+        ORDER BY created_at
+    `, jobColumns, pg.tableName)
+
+	rows, err := pg.conn.Query(context.Background(), query, statuses)
+	if err != nil {
+		log.Printf("Error listing jobs: %v", err)
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Job, error) {
+		return scanJob(row)
+	})
+}
+
+// jobErrors keeps an empty sample as a JSON array rather than null.
+func jobErrors(sample []JobError) []JobError {
+	if sample == nil {
+		return []JobError{}
+	}
+	return sample
+}
+
+func (pg *PostgresStringMap) TakeToken(key string, rate float64, burst int) (bool, float64, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	// SET expressions see the row as it was before the update.
+	refill := "LEAST($3::float8, b.tokens + EXTRACT(EPOCH FROM now() - b.updated_at)::float8 * $2::float8)"
+	query := fmt.Sprintf(`
+        INSERT INTO "%[1]s_ratelimit" AS b (key, tokens, allowed, updated_at)
+        VALUES ($1, $3::float8 - 1, true, now())
+        ON CONFLICT (key) DO UPDATE SET
+            allowed = %[2]s >= 1,
+            tokens = %[2]s - CASE WHEN %[2]s >= 1 THEN 1 ELSE 0 END,
+            updated_at = now()
+        RETURNING allowed, tokens
+    `, pg.tableName, refill)
+
+	var (
+		allowed bool
+		tokens  float64
+	)
+	if err := pg.conn.QueryRow(context.Background(), query, key, rate, burst).Scan(&allowed, &tokens); err != nil {
+		log.Printf("Error taking rate limit token: %v", err)
+		return false, 0, err
+	}
+	return allowed, tokens, nil
+}
+
+func (pg *PostgresStringMap) PruneTokens(idle time.Duration) (int, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        DELETE FROM "%s_ratelimit"
+        WHERE updated_at < now() - make_interval(secs => $1)
+    `, pg.tableName)
+
+	tag, err := pg.conn.Exec(context.Background(), query, idle.Seconds())
+	if err != nil {
+		log.Printf("Error pruning rate limit buckets: %v", err)
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+const apiKeyColumns = "id, name, hash, scopes, created_at, expires_at"
+
+func scanAPIKey(row pgx.Row) (APIKey, error) {
+	var (
+		key       APIKey
+		expiresAt *time.Time
+	)
+	err := row.Scan(&key.ID, &key.Name, &key.Hash, &key.Scopes, &key.CreatedAt, &expiresAt)
+	if expiresAt != nil {
+		key.ExpiresAt = *expiresAt
+	}
+	return key, err
+}
+
+func (pg *PostgresStringMap) CreateAPIKey(key APIKey) error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        INSERT INTO "%s_api_keys" (%s)
+        VALUES ($1, $2, $3, $4, $5, $6)
+    `, pg.tableName, apiKeyColumns)
+
+	scopes := key.Scopes
+	if scopes == nil {
+		scopes = []string{}
+	}
+	_, err := pg.conn.Exec(context.Background(), query,
+		key.ID, key.Name, key.Hash, scopes, key.CreatedAt, nullTime(key.ExpiresAt),
+	)
+	if err != nil {
+		log.Printf("Error creating API key: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (pg *PostgresStringMap) LoadAPIKey(id string) (APIKey, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`SELECT %s FROM "%s_api_keys" WHERE id = $1`, apiKeyColumns, pg.tableName)
+
+	key, err := scanAPIKey(pg.conn.QueryRow(context.Background(), query, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return APIKey{}, ErrNotFound
+	}
+	if err != nil {
+		log.Printf("Error loading API key: %v", err)
+		return APIKey{}, err
+	}
+	return key, nil
+}
+
+func (pg *PostgresStringMap) ListAPIKeys() ([]APIKey, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`SELECT %s FROM "%s_api_keys" ORDER BY created_at, id`, apiKeyColumns, pg.tableName)
+
+	rows, err := pg.conn.Query(context.Background(), query)
+	if err != nil {
+		log.Printf("Error listing API keys: %v", err)
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (APIKey, error) {
+		return scanAPIKey(row)
+	})
+}
+
+func (pg *PostgresStringMap) DeleteAPIKey(id string) error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`DELETE FROM "%s_api_keys" WHERE id = $1`, pg.tableName)
+
+	tag, err := pg.conn.Exec(context.Background(), query, id)
+	if err != nil {
+		log.Printf("Error deleting API key: %v", err)
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// uniqueViolation is the SQLSTATE of a duplicate key.
+const uniqueViolation = "23505"
+
+const userColumns = "id, username, password_hash, role, created_at"
+
+func scanUser(row pgx.Row) (User, error) {
+	var user User
+	err := row.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role, &user.CreatedAt)
+	return user, err
+}
+
+func (pg *PostgresStringMap) CreateUser(user User) error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        INSERT INTO "%s_users" (%s)
+        VALUES ($1, $2, $3, $4, $5)
+    `, pg.tableName, userColumns)
+
+	_, err := pg.conn.Exec(context.Background(), query,
+		user.ID, user.Username, user.PasswordHash, user.Role, user.CreatedAt,
+	)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return ErrAlreadyExists
+	}
+	if err != nil {
+		log.Printf("Error creating user: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (pg *PostgresStringMap) LoadUser(id string) (User, error) {
+	return pg.loadUser("id", id)
+}
+
+func (pg *PostgresStringMap) LoadUserByName(username string) (User, error) {
+	return pg.loadUser("username", username)
+}
+
+func (pg *PostgresStringMap) loadUser(column string, value string) (User, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`SELECT %s FROM "%s_users" WHERE %s = $1`, userColumns, pg.tableName, column)
+
+	user, err := scanUser(pg.conn.QueryRow(context.Background(), query, value))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return User{}, ErrNotFound
+	}
+	if err != nil {
+		log.Printf("Error loading user: %v", err)
+		return User{}, err
+	}
+	return user, nil
+}
+
+const sessionColumns = "id, user_id, csrf, created_at, expires_at"
+
+func (pg *PostgresStringMap) CreateSession(session Session) error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        INSERT INTO "%s_sessions" (%s)
+        VALUES ($1, $2, $3, $4, $5)
+    `, pg.tableName, sessionColumns)
+
+	_, err := pg.conn.Exec(context.Background(), query,
+		session.ID, session.UserID, session.CSRF, session.CreatedAt, session.ExpiresAt,
+	)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return ErrAlreadyExists
+	}
+	if err != nil {
+		log.Printf("Error creating session: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (pg *PostgresStringMap) LoadSession(id string) (Session, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`SELECT %s FROM "%s_sessions" WHERE id = $1`, sessionColumns, pg.tableName)
+
+	var session Session
+	err := pg.conn.QueryRow(context.Background(), query, id).Scan(
+		&session.ID, &session.UserID, &session.CSRF, &session.CreatedAt, &session.ExpiresAt,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Session{}, ErrNotFound
+	}
+	if err != nil {
+		log.Printf("Error loading session: %v", err)
+		return Session{}, err
+	}
+	return session, nil
+}
+
+func (pg *PostgresStringMap) DeleteSession(id string) error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`DELETE FROM "%s_sessions" WHERE id = $1`, pg.tableName)
+
+	tag, err := pg.conn.Exec(context.Background(), query, id)
+	if err != nil {
+		log.Printf("Error deleting session: %v", err)
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (pg *PostgresStringMap) DeleteExpiredSessions(now time.Time) (int, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`DELETE FROM "%s_sessions" WHERE expires_at <= $1`, pg.tableName)
+
+	tag, err := pg.conn.Exec(context.Background(), query, now)
+	if err != nil {
+		log.Printf("Error deleting expired sessions: %v", err)
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+const secondFactorColumns = "user_id, secret, confirmed, recovery_codes, last_step, created_at"
+
+func (pg *PostgresStringMap) StoreSecondFactor(factor SecondFactor) error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        INSERT INTO "%s_totp" (%s)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        ON CONFLICT (user_id) DO UPDATE SET
+            secret = EXCLUDED.secret,
+            confirmed = EXCLUDED.confirmed,
+            recovery_codes = EXCLUDED.recovery_codes,
+            last_step = EXCLUDED.last_step,
+            created_at = EXCLUDED.created_at
+    `, pg.tableName, secondFactorColumns)
+
+	codes := factor.RecoveryCodes
+	if codes == nil {
+		codes = []string{}
+	}
+	_, err := pg.conn.Exec(context.Background(), query,
+		factor.UserID, factor.Secret, factor.Confirmed, codes, factor.LastStep, factor.CreatedAt,
+	)
+	if err != nil {
+		log.Printf("Error storing second factor: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (pg *PostgresStringMap) LoadSecondFactor(userID string) (SecondFactor, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`SELECT %s FROM "%s_totp" WHERE user_id = $1`, secondFactorColumns, pg.tableName)
+
+	var factor SecondFactor
+	err := pg.conn.QueryRow(context.Background(), query, userID).Scan(
+		&factor.UserID, &factor.Secret, &factor.Confirmed, &factor.RecoveryCodes, &factor.LastStep, &factor.CreatedAt,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return SecondFactor{}, ErrNotFound
+	}
+	if err != nil {
+		log.Printf("Error loading second factor: %v", err)
+		return SecondFactor{}, err
+	}
+	return factor, nil
+}
+
+func (pg *PostgresStringMap) DeleteSecondFactor(userID string) error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	query := fmt.Sprintf(`DELETE FROM "%s_totp" WHERE user_id = $1`, pg.tableName)
+
+	tag, err := pg.conn.Exec(context.Background(), query, userID)
+	if err != nil {
+		log.Printf("Error deleting second factor: %v", err)
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (pg *PostgresStringMap) UseTOTPStep(userID string, step int64) (bool, error) {
+	query := fmt.Sprintf(`
+        UPDATE "%s_totp" SET last_step = $2
+        WHERE user_id = $1 AND last_step < $2
+    `, pg.tableName)
+	return pg.useSecondFactor(userID, query, step)
+}
+
+func (pg *PostgresStringMap) UseRecoveryCode(userID string, hash string) (bool, error) {
+	query := fmt.Sprintf(`
+        UPDATE "%s_totp" SET recovery_codes = array_remove(recovery_codes, $2)
+        WHERE user_id = $1 AND $2 = ANY(recovery_codes)
+    `, pg.tableName)
+	return pg.useSecondFactor(userID, query, hash)
+}
+
+// useSecondFactor runs the conditional update query and tells a refused
+// update apart from a missing enrolment.
+func (pg *PostgresStringMap) useSecondFactor(userID string, query string, arg any) (bool, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	tag, err := pg.conn.Exec(context.Background(), query, userID, arg)
+	if err != nil {
+		log.Printf("Error updating second factor: %v", err)
+		return false, err
+	}
+	if tag.RowsAffected() > 0 {
+		return true, nil
+	}
+
+	var exists bool
+	query = fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM "%s_totp" WHERE user_id = $1)`, pg.tableName)
+	if err := pg.conn.QueryRow(context.Background(), query, userID).Scan(&exists); err != nil {
+		log.Printf("Error loading second factor: %v", err)
+		return false, err
+	}
+	if !exists {
+		return false, ErrNotFound
+	}
+	return false, nil
+}
+
 func (pg *PostgresStringMap) Close() error {
 	return pg.conn.Close(context.Background())
 }
 
+// pgLimit maps a non-positive limit to NULL, which Postgres treats as no limit.
+func pgLimit(limit int) any {
+	if limit <= 0 {
+		return nil
+	}
+	return limit
+}
+
+// nullTime stores the zero time as NULL.
+func nullTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
 func checkTableExists(conn *pgx.Conn, tableName string) (bool, error) {
 	var exists bool
 	query := `
@@ -103,3 +1088,81 @@ func createTable(conn *pgx.Conn, tableName string, keyLen int) error {
 	}
 	return nil
 }
+
+func migrateTable(conn *pgx.Conn, tableName string) error {
+	query := fmt.Sprintf(`
+        ALTER TABLE "%[1]s" ADD COLUMN IF NOT EXISTS reserved_at TIMESTAMPTZ;
+        ALTER TABLE "%[1]s" ADD COLUMN IF NOT EXISTS options JSONB NOT NULL DEFAULT '{}';
+        ALTER TABLE "%[1]s" ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+        ALTER TABLE "%[1]s" ADD COLUMN IF NOT EXISTS clicks BIGINT NOT NULL DEFAULT 0;
+        ALTER TABLE "%[1]s" ADD COLUMN IF NOT EXISTS owner TEXT;
+        CREATE INDEX IF NOT EXISTS "%[1]s_owner_idx" ON "%[1]s" (owner, id);
+        CREATE INDEX IF NOT EXISTS "%[1]s_url_idx" ON "%[1]s" USING hash (url);
+        CREATE TABLE IF NOT EXISTS "%[1]s_health" (
+            id TEXT PRIMARY KEY,
+            status INTEGER NOT NULL,
+            error TEXT NOT NULL,
+            checked_at TIMESTAMPTZ NOT NULL,
+            failures INTEGER NOT NULL
+        );
+        CREATE TABLE IF NOT EXISTS "%[1]s_jobs" (
+            id TEXT PRIMARY KEY,
+            status TEXT NOT NULL,
+            format TEXT NOT NULL,
+            total INTEGER NOT NULL,
+            processed INTEGER NOT NULL DEFAULT 0,
+            created INTEGER NOT NULL DEFAULT 0,
+            existed INTEGER NOT NULL DEFAULT 0,
+            failed INTEGER NOT NULL DEFAULT 0,
+            errors JSONB NOT NULL DEFAULT '[]',
+            error TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMPTZ NOT NULL,
+            updated_at TIMESTAMPTZ NOT NULL,
+            input BYTEA NOT NULL,
+            result BYTEA NOT NULL DEFAULT ''
+        );
+        ALTER TABLE "%[1]s_jobs" ADD COLUMN IF NOT EXISTS owner TEXT NOT NULL DEFAULT '';
+        CREATE TABLE IF NOT EXISTS "%[1]s_ratelimit" (
+            key TEXT PRIMARY KEY,
+            tokens DOUBLE PRECISION NOT NULL,
+            allowed BOOLEAN NOT NULL,
+            updated_at TIMESTAMPTZ NOT NULL
+        );
+        CREATE TABLE IF NOT EXISTS "%[1]s_api_keys" (
+            id TEXT PRIMARY KEY,
+            name TEXT NOT NULL,
+            hash TEXT NOT NULL,
+            scopes TEXT[] NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL,
+            expires_at TIMESTAMPTZ
+        );
+        CREATE TABLE IF NOT EXISTS "%[1]s_users" (
+            id TEXT PRIMARY KEY,
+            username TEXT NOT NULL UNIQUE,
+            password_hash TEXT NOT NULL,
+            role TEXT NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL
+        );
+        CREATE TABLE IF NOT EXISTS "%[1]s_sessions" (
+            id TEXT PRIMARY KEY,
+            user_id TEXT NOT NULL,
+            csrf TEXT NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL,
+            expires_at TIMESTAMPTZ NOT NULL
+        );
+        CREATE TABLE IF NOT EXISTS "%[1]s_totp" (
+            user_id TEXT PRIMARY KEY,
+            secret TEXT NOT NULL,
+            confirmed BOOLEAN NOT NULL,
+            recovery_codes TEXT[] NOT NULL,
+            last_step BIGINT NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL
+        );
+    `, tableName)
+
+	_, err := conn.Exec(context.Background(), query)
+	if err != nil {
+		return fmt.Errorf("failed to migrate table: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"log"
+	"sync"
+)
+
+// PostgresSequence leases id ranges from a ticket table. Every lease moves the
+// stored counter forward in one atomic statement, so ranges handed to different
+// replicas, or to the same replica across restarts, never overlap.
+type PostgresSequence struct {
+	mu        sync.Mutex
+	conn      *pgx.Conn
+	tableName string
+	name      string
+}
+
+func NewPostgresSequence(connString string, tableName string, name string) (*PostgresSequence, error) {
+	conn, err := pgx.Connect(context.Background(), connString)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`
+        CREATE TABLE IF NOT EXISTS "%s" (
+            name TEXT PRIMARY KEY,
+            next BIGINT NOT NULL
+        );
+    `, tableName)
+	if _, err := conn.Exec(context.Background(), query); err != nil {
+		return nil, fmt.Errorf("failed to create ticket table: %w", err)
+	}
+
+	return &PostgresSequence{conn: conn, tableName: tableName, name: name}, nil
+}
+
+func (ps *PostgresSequence) LeaseRange(size uint64) (uint64, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	query := fmt.Sprintf(`
+        INSERT INTO "%[1]s" (name, next)
+        VALUES ($1, $2)
+        ON CONFLICT (name) DO UPDATE SET next = "%[1]s".next + EXCLUDED.next
+        RETURNING next - $2
+    `, ps.tableName)
+
+	var start int64
+	err := ps.conn.QueryRow(context.Background(), query, ps.name, int64(size)).Scan(&start)
+	if err != nil {
+		log.Printf("Error leasing id range: %v", err)
+		return 0, err
+	}
+	return uint64(start), nil
+}
+
+func (ps *PostgresSequence) Close() error {
+	return ps.conn.Close(context.Background())
+}
@@ -1,6 +1,271 @@
 package storage
 
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrReservationLost = errors.New("reservation lost")
+	ErrNotFound        = errors.New("not found")
+	ErrAlreadyExists   = errors.New("already exists")
+)
+
+// Storage holds links by key. Store never overwrites: it fails with
+// ErrAlreadyExists when the key is taken, including by a reservation.
 type Storage interface {
 	Load(key string) (string, error)
 	Store(key string, value string) error
 }
+
+// Reserver is implemented by storages that can hold a key in a "reserved"
+// state. Reserved keys are invisible to Load until they are committed.
+type Reserver interface {
+	Reserve(key string) (bool, error)
+	Commit(key string, value string) error
+	Release(key string) error
+	ReleaseExpired(ttl time.Duration) (int, error)
+}
+
+type Link struct {
+	Key     string
+	Url     string
+	Options LinkOptions
+	// Owner identifies who created the link, e.g. "user:42". Links created
+	// anonymously have no owner.
+	Owner string
+}
+
+// Manager is implemented by storages that support editing and removing
+// existing links. Both methods return ErrNotFound for unknown keys.
+type Manager interface {
+	Update(key string, value string) error
+	Delete(key string) error
+}
+
+// Batcher stores many links at once, within a single transaction where the
+// storage supports them. Like Store it never overwrites: when any key is
+// taken, nothing is stored and ErrAlreadyExists is returned.
+type Batcher interface {
+	StoreBatch(links []Link) error
+}
+
+// Lister pages through stored links ordered by key, starting after the given
+// key. An empty after starts from the beginning.
+type Lister interface {
+	List(after string, limit int) ([]Link, error)
+}
+
+// UrlFinder returns the links to url ordered by key, so that links can be
+// reused even when their keys are not derived from the destination.
+type UrlFinder interface {
+	FindByUrl(url string) ([]Link, error)
+}
+
+type LinkHealth struct {
+	Key                 string
+	Status              int
+	Error               string
+	CheckedAt           time.Time
+	ConsecutiveFailures int
+}
+
+type HealthStorage interface {
+	LoadHealth(key string) (LinkHealth, error)
+	StoreHealth(health LinkHealth) error
+	ListUnhealthy(after string, limit int) ([]LinkHealth, error)
+}
+
+const (
+	QueryPassthroughNone        = ""
+	QueryPassthroughIncoming    = "incoming"
+	QueryPassthroughDestination = "destination"
+)
+
+// Passthrough controls what parts of the incoming short link request are
+// forwarded to the destination. Query selects which side wins when a query
+// parameter is present in both; Path appends extra path segments.
+type Passthrough struct {
+	Query string `json:"query,omitempty"`
+	Path  bool   `json:"path,omitempty"`
+}
+
+// Redirect modes. The empty mode is a plain 302 redirect.
+const (
+	RedirectDefault          = ""
+	RedirectMovedPermanently = "301"
+	RedirectFound            = "302"
+	RedirectTemporary        = "307"
+	RedirectPermanent        = "308"
+	RedirectMetaRefresh      = "meta-refresh"
+	RedirectJavaScript       = "js"
+)
+
+type LinkOptions struct {
+	Passthrough Passthrough `json:"passthrough"`
+	Redirect    string      `json:"redirect,omitempty"`
+	Preview     bool        `json:"preview,omitempty"`
+}
+
+type OptionsStorage interface {
+	LoadOptions(key string) (LinkOptions, error)
+	StoreOptions(key string, options LinkOptions) error
+}
+
+// OwnerStorage records who created a link. ListOwned pages through the
+// links of owner like List, RecentOwned returns the last limit links of
+// owner, newest first.
+type OwnerStorage interface {
+	LoadOwner(key string) (string, error)
+	StoreOwner(key string, owner string) error
+	ListOwned(owner string, after string, limit int) ([]Link, error)
+	RecentOwned(owner string, limit int) ([]Link, error)
+}
+
+// LinkStats holds usage statistics of a link.
+type LinkStats struct {
+	CreatedAt time.Time
+	Clicks    uint64
+}
+
+type StatsStorage interface {
+	LoadStats(key string) (LinkStats, error)
+	RecordClick(key string) error
+}
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// Job is a persisted asynchronous bulk import. Errors holds a sample of the
+// failed items; all of them are listed in the job result.
+type Job struct {
+	ID        string
+	Owner     string
+	Status    string
+	Format    string
+	Total     int
+	Processed int
+	Created   int
+	Existed   int
+	Failed    int
+	Errors    []JobError
+	Error     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+type JobError struct {
+	Index   int    `json:"index"`
+	Url     string `json:"url"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// JobStorage persists jobs together with their input and result. UpdateJob
+// only changes queued and running jobs and returns ErrNotFound otherwise,
+// so a cancelled or finished job is never resurrected.
+type JobStorage interface {
+	CreateJob(job Job, input []byte) error
+	LoadJob(id string) (Job, error)
+	UpdateJob(job Job, result []byte) error
+	LoadJobInput(id string) ([]byte, error)
+	LoadJobResult(id string) ([]byte, error)
+	ListJobs(statuses ...string) ([]Job, error)
+}
+
+// RateLimitStorage keeps token buckets shared by all replicas. TakeToken
+// refills the bucket of key at rate tokens per second up to burst, takes a
+// token if one is available and returns the tokens left.
+type RateLimitStorage interface {
+	TakeToken(key string, rate float64, burst int) (bool, float64, error)
+	PruneTokens(idle time.Duration) (int, error)
+}
+
+// APIKey is a credential for programmatic access. Only the hash of the
+// secret is stored. A zero ExpiresAt means the key does not expire.
+type APIKey struct {
+	ID        string
+	Name      string
+	Hash      string
+	Scopes    []string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// APIKeyStorage persists API keys. LoadAPIKey and DeleteAPIKey return
+// ErrNotFound for unknown keys.
+type APIKeyStorage interface {
+	CreateAPIKey(key APIKey) error
+	LoadAPIKey(id string) (APIKey, error)
+	ListAPIKeys() ([]APIKey, error)
+	DeleteAPIKey(id string) error
+}
+
+// User is an account. Only the hash of the password is stored.
+type User struct {
+	ID           string
+	Username     string
+	PasswordHash string
+	Role         string
+	CreatedAt    time.Time
+}
+
+// UserStorage persists accounts. Usernames are unique: CreateUser returns
+// ErrAlreadyExists for a taken one. Lookups return ErrNotFound for unknown
+// users.
+type UserStorage interface {
+	CreateUser(user User) error
+	LoadUser(id string) (User, error)
+	LoadUserByName(username string) (User, error)
+}
+
+// Session is a signed-in browser. ID is the hash of the session cookie, so
+// a leaked storage does not let anyone sign in. CSRF is the token state
+// changing requests of the session must carry.
+type Session struct {
+	ID        string
+	UserID    string
+	CSRF      string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// SessionStorage persists browser sessions. LoadSession returns ErrNotFound
+// for unknown sessions, expired ones are removed by DeleteExpiredSessions.
+type SessionStorage interface {
+	CreateSession(session Session) error
+	LoadSession(id string) (Session, error)
+	DeleteSession(id string) error
+	DeleteExpiredSessions(now time.Time) (int, error)
+}
+
+// SecondFactor is the TOTP enrolment of an account. Secret is the base32
+// shared secret, RecoveryCodes hold the hashes of the unused recovery
+// codes and LastStep is the last accepted time step, so a code cannot be
+// replayed. Enrolments take effect once Confirmed.
+type SecondFactor struct {
+	UserID        string
+	Secret        string
+	Confirmed     bool
+	RecoveryCodes []string
+	LastStep      int64
+	CreatedAt     time.Time
+}
+
+// SecondFactorStorage persists TOTP enrolments. StoreSecondFactor replaces
+// the enrolment of the user. UseTOTPStep records step unless an equal or
+// later one was already used and UseRecoveryCode removes the code with
+// hash; both report whether they succeeded. Lookups return ErrNotFound for
+// users without an enrolment.
+type SecondFactorStorage interface {
+	StoreSecondFactor(factor SecondFactor) error
+	LoadSecondFactor(userID string) (SecondFactor, error)
+	DeleteSecondFactor(userID string) error
+	UseTOTPStep(userID string, step int64) (bool, error)
+	UseRecoveryCode(userID string, hash string) (bool, error)
+}
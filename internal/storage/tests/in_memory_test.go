@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 type MockStorage struct {
@@ -127,3 +128,450 @@ func TestRedirect(t *testing.T) {
 		})
 	}
 }
+
+func TestSafeCounter(t *testing.T) {
+	counter := storage.NewSafeCounter()
+
+	first, err := counter.LeaseRange(100)
+	assert.NoError(t, err)
+	second, err := counter.LeaseRange(10)
+	assert.NoError(t, err)
+	third, err := counter.LeaseRange(100)
+	assert.NoError(t, err)
+
+	assert.Equal(t, uint64(0), first)
+	assert.Equal(t, uint64(100), second)
+	assert.Equal(t, uint64(110), third)
+}
+
+func TestSafeStringMap_Reservations(t *testing.T) {
+	sm := storage.NewSafeMap()
+
+	ok, err := sm.Reserve("key")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = sm.Reserve("key")
+	assert.NoError(t, err)
+	assert.False(t, ok, "key must not be reserved twice")
+
+	_, err = sm.Load("key")
+	assert.Error(t, err, "reserved key must not be loadable")
+
+	assert.NoError(t, sm.Commit("key", "http://example.com"))
+	value, err := sm.Load("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://example.com", value)
+
+	assert.ErrorIs(t, sm.Commit("key", "http://other.com"), storage.ErrReservationLost)
+	assert.ErrorIs(t, sm.Commit("missing", "http://other.com"), storage.ErrReservationLost)
+
+	assert.NoError(t, sm.Release("key"))
+	_, err = sm.Load("key")
+	assert.NoError(t, err, "release must not delete committed links")
+}
+
+func TestSafeStringMap_ReleaseExpired(t *testing.T) {
+	sm := storage.NewSafeMap()
+	_, err := sm.Reserve("old")
+	assert.NoError(t, err)
+	assert.NoError(t, sm.Store("link", "http://example.com"))
+
+	released, err := sm.ReleaseExpired(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, released)
+
+	ok, err := sm.Reserve("old")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	released, err = sm.ReleaseExpired(time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, released)
+}
+
+func TestSafeStringMap_List(t *testing.T) {
+	sm := storage.NewSafeMap()
+	for _, key := range []string{"c", "a", "b", "d"} {
+		assert.NoError(t, sm.Store(key, "http://example.com/"+key))
+	}
+	_, err := sm.Reserve("bb")
+	assert.NoError(t, err)
+
+	page, err := sm.List("", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []storage.Link{{Key: "a", Url: "http://example.com/a"}, {Key: "b", Url: "http://example.com/b"}}, page)
+
+	page, err = sm.List("b", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []storage.Link{{Key: "c", Url: "http://example.com/c"}, {Key: "d", Url: "http://example.com/d"}}, page)
+
+	page, err = sm.List("d", 2)
+	assert.NoError(t, err)
+	assert.Empty(t, page)
+}
+
+func TestSafeStringMap_FindByUrl(t *testing.T) {
+	sm := storage.NewSafeMap()
+	links, err := sm.FindByUrl("http://example.com")
+	assert.NoError(t, err)
+	assert.Empty(t, links)
+
+	options := storage.LinkOptions{Preview: true}
+	assert.NoError(t, sm.Store("b", "http://example.com"))
+	assert.NoError(t, sm.Store("a", "http://example.com"))
+	assert.NoError(t, sm.Store("c", "http://example.com/other"))
+	assert.NoError(t, sm.StoreOptions("b", options))
+	assert.NoError(t, sm.StoreOwner("a", "user:1"))
+	reserved, err := sm.Reserve("d")
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+
+	links, err = sm.FindByUrl("http://example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []storage.Link{
+		{Key: "a", Url: "http://example.com", Owner: "user:1"},
+		{Key: "b", Url: "http://example.com", Options: options},
+	}, links)
+
+	assert.NoError(t, sm.Commit("d", "http://example.com"))
+	assert.NoError(t, sm.Update("c", "http://example.com"))
+	assert.NoError(t, sm.Delete("a"))
+	links, err = sm.FindByUrl("http://example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "c", "d"}, []string{links[0].Key, links[1].Key, links[2].Key})
+	links, err = sm.FindByUrl("http://example.com/other")
+	assert.NoError(t, err)
+	assert.Empty(t, links, "updated links are found by their new url only")
+}
+
+func TestSafeStringMap_Health(t *testing.T) {
+	sm := storage.NewSafeMap()
+
+	_, err := sm.LoadHealth("key")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	checked := time.Now()
+	assert.NoError(t, sm.StoreHealth(storage.LinkHealth{Key: "key", Status: 404, CheckedAt: checked, ConsecutiveFailures: 2}))
+	assert.NoError(t, sm.StoreHealth(storage.LinkHealth{Key: "ok", Status: 200, CheckedAt: checked}))
+
+	health, err := sm.LoadHealth("key")
+	assert.NoError(t, err)
+	assert.Equal(t, 404, health.Status)
+	assert.Equal(t, 2, health.ConsecutiveFailures)
+
+	unhealthy, err := sm.ListUnhealthy("", 10)
+	assert.NoError(t, err)
+	if assert.Len(t, unhealthy, 1) {
+		assert.Equal(t, "key", unhealthy[0].Key)
+	}
+}
+
+func TestSafeStringMap_Options(t *testing.T) {
+	sm := storage.NewSafeMap()
+
+	_, err := sm.LoadOptions("missing")
+	assert.Error(t, err)
+
+	assert.NoError(t, sm.Store("key", "http://example.com"))
+	options, err := sm.LoadOptions("key")
+	assert.NoError(t, err)
+	assert.Equal(t, storage.LinkOptions{}, options)
+
+	want := storage.LinkOptions{Passthrough: storage.Passthrough{Query: storage.QueryPassthroughIncoming, Path: true}}
+	assert.NoError(t, sm.StoreOptions("key", want))
+	options, err = sm.LoadOptions("key")
+	assert.NoError(t, err)
+	assert.Equal(t, want, options)
+
+	assert.ErrorIs(t, sm.Store("key", "http://example.com/other"), storage.ErrAlreadyExists)
+	options, err = sm.LoadOptions("key")
+	assert.NoError(t, err)
+	assert.Equal(t, want, options, "storing a taken key must not reset its options")
+}
+
+func TestSafeStringMap_UpdateDelete(t *testing.T) {
+	sm := storage.NewSafeMap()
+
+	assert.ErrorIs(t, sm.Update("missing", "http://example.com"), storage.ErrNotFound)
+	assert.ErrorIs(t, sm.Delete("missing"), storage.ErrNotFound)
+
+	options := storage.LinkOptions{Passthrough: storage.Passthrough{Path: true}}
+	assert.NoError(t, sm.Store("key", "http://example.com"))
+	assert.NoError(t, sm.StoreOptions("key", options))
+
+	assert.NoError(t, sm.Update("key", "http://example.com/new"))
+	value, err := sm.Load("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://example.com/new", value)
+	stored, err := sm.LoadOptions("key")
+	assert.NoError(t, err)
+	assert.Equal(t, options, stored, "updating a link must keep its options")
+
+	reserved, err := sm.Reserve("reserved")
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+	assert.ErrorIs(t, sm.Update("reserved", "http://example.com"), storage.ErrNotFound)
+	assert.ErrorIs(t, sm.Delete("reserved"), storage.ErrNotFound)
+
+	assert.NoError(t, sm.Delete("key"))
+	_, err = sm.Load("key")
+	assert.Error(t, err)
+	_, err = sm.LoadOptions("key")
+	assert.Error(t, err)
+}
+
+func TestSafeStringMap_Stats(t *testing.T) {
+	sm := storage.NewSafeMap()
+
+	_, err := sm.LoadStats("missing")
+	assert.Error(t, err)
+	assert.Error(t, sm.RecordClick("missing"))
+
+	before := time.Now()
+	assert.NoError(t, sm.Store("key", "http://example.com"))
+	assert.NoError(t, sm.RecordClick("key"))
+	assert.NoError(t, sm.RecordClick("key"))
+
+	stats, err := sm.LoadStats("key")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), stats.Clicks)
+	assert.False(t, stats.CreatedAt.Before(before))
+
+	assert.ErrorIs(t, sm.Store("key", "http://example.com/other"), storage.ErrAlreadyExists)
+	stats, err = sm.LoadStats("key")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), stats.Clicks, "storing a taken key must not reset its statistics")
+}
+
+func TestSafeStringMap_StoreBatch(t *testing.T) {
+	sm := storage.NewSafeMap()
+	assert.NoError(t, sm.Store("old", "http://example.com/old"))
+	assert.NoError(t, sm.StoreOptions("old", storage.LinkOptions{Preview: true}))
+
+	options := storage.LinkOptions{Redirect: storage.RedirectPermanent}
+	err := sm.StoreBatch([]storage.Link{
+		{Key: "a", Url: "http://example.com/a", Options: options},
+		{Key: "old", Url: "http://example.com/new"},
+	})
+	assert.ErrorIs(t, err, storage.ErrAlreadyExists)
+	_, err = sm.Load("a")
+	assert.Error(t, err, "a conflicting batch stores nothing")
+	value, err := sm.Load("old")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://example.com/old", value)
+	stored, err := sm.LoadOptions("old")
+	assert.NoError(t, err)
+	assert.Equal(t, storage.LinkOptions{Preview: true}, stored)
+
+	assert.NoError(t, sm.StoreBatch([]storage.Link{
+		{Key: "a", Url: "http://example.com/a", Options: options},
+		{Key: "b", Url: "http://example.com/b"},
+	}))
+	value, err = sm.Load("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://example.com/a", value)
+	stored, err = sm.LoadOptions("a")
+	assert.NoError(t, err)
+	assert.Equal(t, options, stored)
+}
+
+func TestSafeStringMap_Jobs(t *testing.T) {
+	sm := storage.NewSafeMap()
+	now := time.Now()
+	first := storage.Job{ID: "first", Status: storage.JobQueued, Format: "csv", Total: 2, CreatedAt: now}
+	second := storage.Job{ID: "second", Status: storage.JobQueued, CreatedAt: now.Add(time.Second)}
+	assert.NoError(t, sm.CreateJob(second, nil))
+	assert.NoError(t, sm.CreateJob(first, []byte("input")))
+	assert.Error(t, sm.CreateJob(first, nil))
+
+	_, err := sm.LoadJob("missing")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	input, err := sm.LoadJobInput("first")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("input"), input)
+
+	first.Status = storage.JobRunning
+	first.Processed = 1
+	first.Errors = []storage.JobError{{Index: 0, Url: "ftp://example.com", Reason: "SCHEME_NOT_ALLOWED"}}
+	assert.NoError(t, sm.UpdateJob(first, []byte("row1\n")))
+	first.Status = storage.JobDone
+	first.Processed = 2
+	assert.NoError(t, sm.UpdateJob(first, []byte("row2\n")))
+
+	loaded, err := sm.LoadJob("first")
+	assert.NoError(t, err)
+	assert.Equal(t, first.Status, loaded.Status)
+	assert.Equal(t, 2, loaded.Processed)
+	assert.Equal(t, first.Errors, loaded.Errors)
+
+	result, err := sm.LoadJobResult("first")
+	assert.NoError(t, err)
+	assert.Equal(t, "row1\nrow2\n", string(result))
+
+	first.Status = storage.JobRunning
+	assert.ErrorIs(t, sm.UpdateJob(first, nil), storage.ErrNotFound, "finished jobs must not change")
+
+	active, err := sm.ListJobs(storage.JobQueued, storage.JobRunning)
+	assert.NoError(t, err)
+	assert.Len(t, active, 1)
+	assert.Equal(t, "second", active[0].ID)
+}
+
+func TestSafeStringMap_APIKeys(t *testing.T) {
+	sm := storage.NewSafeMap()
+
+	now := time.Now()
+	second := storage.APIKey{ID: "b", Name: "second", Hash: "hash-b", Scopes: []string{"admin"}, CreatedAt: now.Add(time.Second)}
+	first := storage.APIKey{ID: "a", Name: "first", Hash: "hash-a", Scopes: []string{"links:read"}, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	assert.NoError(t, sm.CreateAPIKey(second))
+	assert.NoError(t, sm.CreateAPIKey(first))
+	assert.Error(t, sm.CreateAPIKey(first))
+
+	loaded, err := sm.LoadAPIKey("a")
+	assert.NoError(t, err)
+	assert.Equal(t, first, loaded)
+
+	keys, err := sm.ListAPIKeys()
+	assert.NoError(t, err)
+	assert.Equal(t, []storage.APIKey{first, second}, keys)
+
+	assert.NoError(t, sm.DeleteAPIKey("a"))
+	assert.ErrorIs(t, sm.DeleteAPIKey("a"), storage.ErrNotFound)
+	_, err = sm.LoadAPIKey("a")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestSafeStringMap_Owners(t *testing.T) {
+	sm := storage.NewSafeMap()
+	assert.NoError(t, sm.Store("a", "https://a.example"))
+	assert.NoError(t, sm.Store("b", "https://b.example"))
+	assert.NoError(t, sm.Store("c", "https://c.example"))
+	assert.NoError(t, sm.StoreOwner("a", "user:1"))
+	assert.NoError(t, sm.StoreOwner("c", "user:1"))
+	assert.NoError(t, sm.StoreOwner("b", "user:2"))
+
+	owner, err := sm.LoadOwner("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "user:1", owner)
+	_, err = sm.LoadOwner("missing")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	links, err := sm.ListOwned("user:1", "", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []storage.Link{
+		{Key: "a", Url: "https://a.example", Owner: "user:1"},
+		{Key: "c", Url: "https://c.example", Owner: "user:1"},
+	}, links)
+	links, err = sm.ListOwned("user:1", "a", 10)
+	assert.NoError(t, err)
+	assert.Len(t, links, 1)
+
+	assert.ErrorIs(t, sm.Store("a", "https://other.example"), storage.ErrAlreadyExists)
+	owner, err = sm.LoadOwner("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "user:1", owner, "storing a taken key must not hijack the link")
+
+	assert.NoError(t, sm.StoreBatch([]storage.Link{{Key: "d", Url: "https://d.example", Owner: "user:2"}}))
+	links, err = sm.ListOwned("user:2", "", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "d"}, []string{links[0].Key, links[1].Key})
+}
+
+func TestSafeStringMap_Users(t *testing.T) {
+	sm := storage.NewSafeMap()
+
+	user := storage.User{ID: "1", Username: "alice", PasswordHash: "hash", Role: "user", CreatedAt: time.Now()}
+	assert.NoError(t, sm.CreateUser(user))
+	assert.ErrorIs(t, sm.CreateUser(storage.User{ID: "2", Username: "alice"}), storage.ErrAlreadyExists)
+	assert.ErrorIs(t, sm.CreateUser(storage.User{ID: "1", Username: "bob"}), storage.ErrAlreadyExists)
+
+	loaded, err := sm.LoadUser("1")
+	assert.NoError(t, err)
+	assert.Equal(t, user, loaded)
+	loaded, err = sm.LoadUserByName("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, user, loaded)
+
+	_, err = sm.LoadUser("2")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	_, err = sm.LoadUserByName("bob")
+	assert.ErrorIs(t, err, storage.ErrNotFound, "failed creations must not reserve the username")
+}
+
+func TestSafeStringMap_RecentOwned(t *testing.T) {
+	sm := storage.NewSafeMap()
+	for _, key := range []string{"b", "a", "c"} {
+		assert.NoError(t, sm.StoreBatch([]storage.Link{{Key: key, Url: "https://" + key + ".example", Owner: "user:1"}}))
+		time.Sleep(time.Millisecond)
+	}
+	assert.NoError(t, sm.Store("d", "https://d.example"))
+
+	links, err := sm.RecentOwned("user:1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []storage.Link{
+		{Key: "c", Url: "https://c.example", Owner: "user:1"},
+		{Key: "a", Url: "https://a.example", Owner: "user:1"},
+	}, links)
+}
+
+func TestSafeStringMap_Sessions(t *testing.T) {
+	sm := storage.NewSafeMap()
+	now := time.Now()
+
+	active := storage.Session{ID: "a", UserID: "1", CSRF: "token", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	expired := storage.Session{ID: "b", UserID: "1", CSRF: "token", CreatedAt: now.Add(-time.Hour), ExpiresAt: now}
+	assert.NoError(t, sm.CreateSession(active))
+	assert.NoError(t, sm.CreateSession(expired))
+	assert.ErrorIs(t, sm.CreateSession(active), storage.ErrAlreadyExists)
+
+	loaded, err := sm.LoadSession("a")
+	assert.NoError(t, err)
+	assert.Equal(t, active, loaded)
+
+	deleted, err := sm.DeleteExpiredSessions(now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	_, err = sm.LoadSession("b")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	assert.NoError(t, sm.DeleteSession("a"))
+	assert.ErrorIs(t, sm.DeleteSession("a"), storage.ErrNotFound)
+}
+
+func TestSafeStringMap_SecondFactors(t *testing.T) {
+	sm := storage.NewSafeMap()
+
+	_, err := sm.LoadSecondFactor("1")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	_, err = sm.UseTOTPStep("1", 1)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	factor := storage.SecondFactor{UserID: "1", Secret: "SECRET", Confirmed: true, RecoveryCodes: []string{"a", "b"}, LastStep: 10, CreatedAt: time.Now()}
+	assert.NoError(t, sm.StoreSecondFactor(factor))
+	loaded, err := sm.LoadSecondFactor("1")
+	assert.NoError(t, err)
+	assert.Equal(t, factor, loaded)
+
+	used, err := sm.UseTOTPStep("1", 10)
+	assert.NoError(t, err)
+	assert.False(t, used, "steps must not be used twice")
+	used, err = sm.UseTOTPStep("1", 11)
+	assert.NoError(t, err)
+	assert.True(t, used)
+
+	used, err = sm.UseRecoveryCode("1", "a")
+	assert.NoError(t, err)
+	assert.True(t, used)
+	used, err = sm.UseRecoveryCode("1", "a")
+	assert.NoError(t, err)
+	assert.False(t, used, "recovery codes must not be used twice")
+	loaded, _ = sm.LoadSecondFactor("1")
+	assert.Equal(t, []string{"b"}, loaded.RecoveryCodes)
+	assert.Equal(t, int64(11), loaded.LastStep)
+	assert.Equal(t, []string{"a", "b"}, factor.RecoveryCodes, "stored codes must not alias the caller's")
+
+	assert.NoError(t, sm.DeleteSecondFactor("1"))
+	assert.ErrorIs(t, sm.DeleteSecondFactor("1"), storage.ErrNotFound)
+}
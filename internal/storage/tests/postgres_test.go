@@ -8,6 +8,7 @@ import (
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
 	"testing"
+	"time"
 )
 
 func setupPostgresContainer(t *testing.T) (string, func()) {
@@ -75,3 +76,485 @@ func TestPostgresStringMap(t *testing.T) {
 	err = pg.Close()
 	assert.NoError(t, err, "failed to close connection")
 }
+
+func TestPostgresSequence(t *testing.T) {
+	connString, teardown := setupPostgresContainer(t)
+	defer teardown()
+
+	seq, err := storage.NewPostgresSequence(connString, "links_ticket", "links")
+	assert.NoError(t, err, "failed to create PostgresSequence")
+
+	first, err := seq.LeaseRange(100)
+	assert.NoError(t, err)
+	second, err := seq.LeaseRange(100)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), first)
+	assert.Equal(t, uint64(100), second)
+	assert.NoError(t, seq.Close())
+
+	// Повторное подключение эмулирует перезапуск реплики.
+	restarted, err := storage.NewPostgresSequence(connString, "links_ticket", "links")
+	assert.NoError(t, err, "failed to reopen PostgresSequence")
+	third, err := restarted.LeaseRange(50)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(200), third)
+	assert.NoError(t, restarted.Close())
+}
+
+func TestPostgresStringMap_Reservations(t *testing.T) {
+	connString, teardown := setupPostgresContainer(t)
+	defer teardown()
+
+	pg, err := storage.NewPostgresStringMap(connString, "reserved_table", 10)
+	assert.NoError(t, err, "failed to create PostgresStringMap")
+
+	ok, err := pg.Reserve("reserved")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = pg.Reserve("reserved")
+	assert.NoError(t, err)
+	assert.False(t, ok, "key must not be reserved twice")
+
+	_, err = pg.Load("reserved")
+	assert.Error(t, err, "reserved key must not be loadable")
+
+	assert.NoError(t, pg.Commit("reserved", "http://example.com"))
+	value, err := pg.Load("reserved")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://example.com", value)
+	assert.ErrorIs(t, pg.Commit("reserved", "http://other.com"), storage.ErrReservationLost)
+
+	_, err = pg.Reserve("abandoned")
+	assert.NoError(t, err)
+	released, err := pg.ReleaseExpired(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, released)
+
+	assert.NoError(t, pg.Close())
+}
+
+func TestPostgresStringMap_ListAndHealth(t *testing.T) {
+	connString, teardown := setupPostgresContainer(t)
+	defer teardown()
+
+	pg, err := storage.NewPostgresStringMap(connString, "list_table", 1)
+	assert.NoError(t, err, "failed to create PostgresStringMap")
+
+	for _, key := range []string{"c", "a", "b"} {
+		assert.NoError(t, pg.Store(key, "http://example.com/"+key))
+	}
+	page, err := pg.List("a", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []storage.Link{{Key: "b", Url: "http://example.com/b"}, {Key: "c", Url: "http://example.com/c"}}, page)
+
+	_, err = pg.LoadHealth("a")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	checked := time.Now().UTC().Truncate(time.Microsecond)
+	assert.NoError(t, pg.StoreHealth(storage.LinkHealth{Key: "a", Status: 500, Error: "boom", CheckedAt: checked, ConsecutiveFailures: 1}))
+	health, err := pg.LoadHealth("a")
+	assert.NoError(t, err)
+	assert.Equal(t, 500, health.Status)
+	assert.Equal(t, "boom", health.Error)
+	assert.True(t, checked.Equal(health.CheckedAt))
+
+	unhealthy, err := pg.ListUnhealthy("", 10)
+	assert.NoError(t, err)
+	assert.Len(t, unhealthy, 1)
+
+	assert.NoError(t, pg.Close())
+}
+
+func TestPostgresStringMap_FindByUrl(t *testing.T) {
+	connString, teardown := setupPostgresContainer(t)
+	defer teardown()
+
+	pg, err := storage.NewPostgresStringMap(connString, "find_table", 1)
+	assert.NoError(t, err, "failed to create PostgresStringMap")
+
+	options := storage.LinkOptions{Preview: true}
+	assert.NoError(t, pg.Store("b", "http://example.com"))
+	assert.NoError(t, pg.Store("a", "http://example.com"))
+	assert.NoError(t, pg.Store("c", "http://example.com/other"))
+	assert.NoError(t, pg.StoreOptions("b", options))
+	assert.NoError(t, pg.StoreOwner("a", "user:1"))
+	reserved, err := pg.Reserve("d")
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+
+	links, err := pg.FindByUrl("http://example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []storage.Link{
+		{Key: "a", Url: "http://example.com", Owner: "user:1"},
+		{Key: "b", Url: "http://example.com", Options: options},
+	}, links)
+	links, err = pg.FindByUrl("http://example.com/missing")
+	assert.NoError(t, err)
+	assert.Empty(t, links)
+
+	assert.NoError(t, pg.Close())
+}
+
+func TestPostgresStringMap_Options(t *testing.T) {
+	connString, teardown := setupPostgresContainer(t)
+	defer teardown()
+
+	pg, err := storage.NewPostgresStringMap(connString, "options_table", 10)
+	assert.NoError(t, err, "failed to create PostgresStringMap")
+
+	assert.NoError(t, pg.Store("key", "http://example.com"))
+	options, err := pg.LoadOptions("key")
+	assert.NoError(t, err)
+	assert.Equal(t, storage.LinkOptions{}, options)
+
+	want := storage.LinkOptions{Passthrough: storage.Passthrough{Query: storage.QueryPassthroughDestination, Path: true}}
+	assert.NoError(t, pg.StoreOptions("key", want))
+	options, err = pg.LoadOptions("key")
+	assert.NoError(t, err)
+	assert.Equal(t, want, options)
+
+	assert.NoError(t, pg.Close())
+}
+
+func TestPostgresStringMap_UpdateDelete(t *testing.T) {
+	connString, teardown := setupPostgresContainer(t)
+	defer teardown()
+
+	pg, err := storage.NewPostgresStringMap(connString, "manage_table", 10)
+	assert.NoError(t, err, "failed to create PostgresStringMap")
+
+	assert.ErrorIs(t, pg.Update("missing", "http://example.com"), storage.ErrNotFound)
+	assert.ErrorIs(t, pg.Delete("missing"), storage.ErrNotFound)
+
+	options := storage.LinkOptions{Passthrough: storage.Passthrough{Path: true}}
+	assert.NoError(t, pg.Store("key", "http://example.com"))
+	assert.NoError(t, pg.StoreOptions("key", options))
+
+	assert.NoError(t, pg.Update("key", "http://example.com/new"))
+	value, err := pg.Load("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://example.com/new", value)
+	stored, err := pg.LoadOptions("key")
+	assert.NoError(t, err)
+	assert.Equal(t, options, stored)
+
+	assert.NoError(t, pg.Delete("key"))
+	_, err = pg.Load("key")
+	assert.Error(t, err)
+	assert.ErrorIs(t, pg.Delete("key"), storage.ErrNotFound)
+
+	assert.NoError(t, pg.Close())
+}
+
+func TestPostgresStringMap_Stats(t *testing.T) {
+	connString, teardown := setupPostgresContainer(t)
+	defer teardown()
+
+	pg, err := storage.NewPostgresStringMap(connString, "stats_table", 10)
+	assert.NoError(t, err, "failed to create PostgresStringMap")
+
+	_, err = pg.LoadStats("missing")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	assert.ErrorIs(t, pg.RecordClick("missing"), storage.ErrNotFound)
+
+	assert.NoError(t, pg.Store("key", "http://example.com"))
+	assert.NoError(t, pg.RecordClick("key"))
+	assert.NoError(t, pg.RecordClick("key"))
+
+	stats, err := pg.LoadStats("key")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), stats.Clicks)
+	assert.False(t, stats.CreatedAt.IsZero())
+
+	assert.ErrorIs(t, pg.Store("key", "http://example.com/other"), storage.ErrAlreadyExists)
+	stats, err = pg.LoadStats("key")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), stats.Clicks, "storing a taken key must not reset its statistics")
+
+	assert.NoError(t, pg.Close())
+}
+
+func TestPostgresStringMap_StoreBatch(t *testing.T) {
+	connString, teardown := setupPostgresContainer(t)
+	defer teardown()
+
+	pg, err := storage.NewPostgresStringMap(connString, "batch_table", 10)
+	assert.NoError(t, err, "failed to create PostgresStringMap")
+
+	options := storage.LinkOptions{Redirect: storage.RedirectPermanent}
+	assert.NoError(t, pg.StoreBatch([]storage.Link{
+		{Key: "a", Url: "http://example.com/a", Options: options},
+		{Key: "b", Url: "http://example.com/b"},
+	}))
+
+	value, err := pg.Load("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://example.com/a", value)
+	stored, err := pg.LoadOptions("a")
+	assert.NoError(t, err)
+	assert.Equal(t, options, stored)
+
+	value, err = pg.Load("b")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://example.com/b", value)
+
+	err = pg.StoreBatch([]storage.Link{
+		{Key: "c", Url: "http://example.com/c"},
+		{Key: "a", Url: "http://example.com/new"},
+	})
+	assert.ErrorIs(t, err, storage.ErrAlreadyExists)
+	_, err = pg.Load("c")
+	assert.Error(t, err, "a conflicting batch is rolled back")
+	stored, err = pg.LoadOptions("a")
+	assert.NoError(t, err)
+	assert.Equal(t, options, stored)
+
+	assert.NoError(t, pg.Close())
+}
+
+func TestPostgresStringMap_Jobs(t *testing.T) {
+	connString, teardown := setupPostgresContainer(t)
+	defer teardown()
+
+	pg, err := storage.NewPostgresStringMap(connString, "jobs_table", 10)
+	assert.NoError(t, err, "failed to create PostgresStringMap")
+
+	now := time.Now().UTC()
+	job := storage.Job{ID: "job", Status: storage.JobQueued, Format: "csv", Total: 2, CreatedAt: now, UpdatedAt: now}
+	assert.NoError(t, pg.CreateJob(job, []byte("input")))
+
+	_, err = pg.LoadJob("missing")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	input, err := pg.LoadJobInput("job")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("input"), input)
+
+	job.Status = storage.JobRunning
+	assert.NoError(t, pg.UpdateJob(job, nil), "starting a job does not append to its result")
+	result, err := pg.LoadJobResult("job")
+	assert.NoError(t, err)
+	assert.Empty(t, result)
+
+	job.Processed = 1
+	job.Failed = 1
+	job.Errors = []storage.JobError{{Index: 0, Url: "ftp://example.com", Reason: "SCHEME_NOT_ALLOWED"}}
+	assert.NoError(t, pg.UpdateJob(job, []byte("row1\n")))
+
+	active, err := pg.ListJobs(storage.JobRunning)
+	assert.NoError(t, err)
+	assert.Len(t, active, 1)
+
+	job.Status = storage.JobCancelled
+	assert.NoError(t, pg.UpdateJob(job, []byte("row2\n")))
+	job.Status = storage.JobRunning
+	assert.ErrorIs(t, pg.UpdateJob(job, nil), storage.ErrNotFound)
+
+	loaded, err := pg.LoadJob("job")
+	assert.NoError(t, err)
+	assert.Equal(t, storage.JobCancelled, loaded.Status)
+	assert.Equal(t, 1, loaded.Failed)
+	assert.Equal(t, job.Errors, loaded.Errors)
+
+	result, err = pg.LoadJobResult("job")
+	assert.NoError(t, err)
+	assert.Equal(t, "row1\nrow2\n", string(result))
+
+	assert.NoError(t, pg.Close())
+}
+
+func TestPostgresStringMap_RateLimit(t *testing.T) {
+	connString, teardown := setupPostgresContainer(t)
+	defer teardown()
+
+	pg, err := storage.NewPostgresStringMap(connString, "ratelimit_table", 10)
+	assert.NoError(t, err, "failed to create PostgresStringMap")
+
+	for i := 0; i < 2; i++ {
+		allowed, _, err := pg.TakeToken("create:ip:1", 0.001, 2)
+		assert.NoError(t, err)
+		assert.True(t, allowed)
+	}
+	allowed, tokens, err := pg.TakeToken("create:ip:1", 0.001, 2)
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Less(t, tokens, 1.0)
+
+	allowed, _, err = pg.TakeToken("create:ip:2", 0.001, 2)
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	pruned, err := pg.PruneTokens(time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, pruned)
+	pruned, err = pg.PruneTokens(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, pruned)
+
+	assert.NoError(t, pg.Close())
+}
+
+func TestPostgresStringMap_APIKeys(t *testing.T) {
+	connString, teardown := setupPostgresContainer(t)
+	defer teardown()
+
+	pg, err := storage.NewPostgresStringMap(connString, "keys_table", 10)
+	assert.NoError(t, err, "failed to create PostgresStringMap")
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	first := storage.APIKey{ID: "a", Name: "first", Hash: "hash-a", Scopes: []string{"links:read"}, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	second := storage.APIKey{ID: "b", Name: "second", Hash: "hash-b", Scopes: []string{"admin"}, CreatedAt: now.Add(time.Second)}
+	assert.NoError(t, pg.CreateAPIKey(first))
+	assert.NoError(t, pg.CreateAPIKey(second))
+	assert.Error(t, pg.CreateAPIKey(first))
+
+	loaded, err := pg.LoadAPIKey("a")
+	assert.NoError(t, err)
+	assert.Equal(t, first.Scopes, loaded.Scopes)
+	assert.True(t, first.ExpiresAt.Equal(loaded.ExpiresAt))
+
+	keys, err := pg.ListAPIKeys()
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+	assert.True(t, keys[1].ExpiresAt.IsZero())
+
+	assert.NoError(t, pg.DeleteAPIKey("a"))
+	assert.ErrorIs(t, pg.DeleteAPIKey("a"), storage.ErrNotFound)
+	_, err = pg.LoadAPIKey("a")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	assert.NoError(t, pg.Close())
+}
+
+func TestPostgresStringMap_Owners(t *testing.T) {
+	connString, teardown := setupPostgresContainer(t)
+	defer teardown()
+
+	pg, err := storage.NewPostgresStringMap(connString, "owners_table", 10)
+	assert.NoError(t, err, "failed to create PostgresStringMap")
+
+	assert.NoError(t, pg.Store("a", "https://a.example"))
+	assert.NoError(t, pg.Store("b", "https://b.example"))
+	assert.NoError(t, pg.StoreOwner("a", "user:1"))
+	assert.NoError(t, pg.StoreBatch([]storage.Link{{Key: "c", Url: "https://c.example", Owner: "user:1"}}))
+	assert.ErrorIs(t, pg.StoreOwner("missing", "user:1"), storage.ErrNotFound)
+
+	owner, err := pg.LoadOwner("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "user:1", owner)
+	owner, err = pg.LoadOwner("b")
+	assert.NoError(t, err)
+	assert.Empty(t, owner)
+
+	links, err := pg.ListOwned("user:1", "", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []storage.Link{
+		{Key: "a", Url: "https://a.example", Owner: "user:1"},
+		{Key: "c", Url: "https://c.example", Owner: "user:1"},
+	}, links)
+
+	assert.ErrorIs(t, pg.Store("a", "https://other.example"), storage.ErrAlreadyExists)
+	owner, err = pg.LoadOwner("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "user:1", owner, "storing a taken key must not hijack the link")
+
+	assert.NoError(t, pg.Close())
+}
+
+func TestPostgresStringMap_Users(t *testing.T) {
+	connString, teardown := setupPostgresContainer(t)
+	defer teardown()
+
+	pg, err := storage.NewPostgresStringMap(connString, "users_table", 10)
+	assert.NoError(t, err, "failed to create PostgresStringMap")
+
+	user := storage.User{ID: "1", Username: "alice", PasswordHash: "hash", Role: "user", CreatedAt: time.Now().UTC().Truncate(time.Microsecond)}
+	assert.NoError(t, pg.CreateUser(user))
+	assert.ErrorIs(t, pg.CreateUser(storage.User{ID: "2", Username: "alice", CreatedAt: time.Now()}), storage.ErrAlreadyExists)
+
+	loaded, err := pg.LoadUserByName("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, loaded.ID)
+	assert.True(t, user.CreatedAt.Equal(loaded.CreatedAt))
+	_, err = pg.LoadUser("2")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	assert.NoError(t, pg.Close())
+}
+
+func TestPostgresStringMap_Sessions(t *testing.T) {
+	connString, teardown := setupPostgresContainer(t)
+	defer teardown()
+
+	pg, err := storage.NewPostgresStringMap(connString, "sessions_table", 10)
+	assert.NoError(t, err, "failed to create PostgresStringMap")
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	active := storage.Session{ID: "a", UserID: "1", CSRF: "token", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	expired := storage.Session{ID: "b", UserID: "1", CSRF: "token", CreatedAt: now.Add(-time.Hour), ExpiresAt: now}
+	assert.NoError(t, pg.CreateSession(active))
+	assert.NoError(t, pg.CreateSession(expired))
+	assert.ErrorIs(t, pg.CreateSession(active), storage.ErrAlreadyExists)
+
+	loaded, err := pg.LoadSession("a")
+	assert.NoError(t, err)
+	assert.Equal(t, active.CSRF, loaded.CSRF)
+	assert.True(t, active.ExpiresAt.Equal(loaded.ExpiresAt))
+
+	deleted, err := pg.DeleteExpiredSessions(now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+
+	assert.NoError(t, pg.DeleteSession("a"))
+	assert.ErrorIs(t, pg.DeleteSession("a"), storage.ErrNotFound)
+
+	assert.NoError(t, pg.Store("x", "https://x.example"))
+	assert.NoError(t, pg.StoreOwner("x", "user:1"))
+	links, err := pg.RecentOwned("user:1", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []storage.Link{{Key: "x", Url: "https://x.example", Owner: "user:1"}}, links)
+
+	assert.NoError(t, pg.Close())
+}
+
+func TestPostgresStringMap_SecondFactors(t *testing.T) {
+	connString, teardown := setupPostgresContainer(t)
+	defer teardown()
+
+	pg, err := storage.NewPostgresStringMap(connString, "totp_table", 10)
+	assert.NoError(t, err, "failed to create PostgresStringMap")
+
+	_, err = pg.LoadSecondFactor("1")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	_, err = pg.UseRecoveryCode("1", "a")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	factor := storage.SecondFactor{UserID: "1", Secret: "SECRET", RecoveryCodes: []string{"a", "b"}, CreatedAt: now}
+	assert.NoError(t, pg.StoreSecondFactor(factor))
+	factor.Confirmed, factor.LastStep = true, 10
+	assert.NoError(t, pg.StoreSecondFactor(factor))
+	loaded, err := pg.LoadSecondFactor("1")
+	assert.NoError(t, err)
+	assert.True(t, factor.CreatedAt.Equal(loaded.CreatedAt))
+	loaded.CreatedAt = factor.CreatedAt
+	assert.Equal(t, factor, loaded)
+
+	used, err := pg.UseTOTPStep("1", 10)
+	assert.NoError(t, err)
+	assert.False(t, used)
+	used, err = pg.UseTOTPStep("1", 11)
+	assert.NoError(t, err)
+	assert.True(t, used)
+	used, err = pg.UseRecoveryCode("1", "a")
+	assert.NoError(t, err)
+	assert.True(t, used)
+	used, err = pg.UseRecoveryCode("1", "a")
+	assert.NoError(t, err)
+	assert.False(t, used)
+
+	assert.NoError(t, pg.DeleteSecondFactor("1"))
+	assert.ErrorIs(t, pg.DeleteSecondFactor("1"), storage.ErrNotFound)
+	assert.NoError(t, pg.Close())
+}
@@ -0,0 +1,138 @@
+package urlnorm
+
+import (
+	"golang.org/x/net/idna"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ws":    "80",
+	"wss":   "443",
+}
+
+// Options toggles individual normalization rules. Entries of TrackingParams
+// ending with "*" match any query parameter with that prefix.
+type Options struct {
+	LowercaseScheme    bool
+	LowercaseHost      bool
+	StripDefaultPort   bool
+	StripTrailingSlash bool
+	SortQuery          bool
+	RemoveTracking     bool
+	TrackingParams     []string
+	Punycode           bool
+}
+
+func DefaultOptions() Options {
+	return Options{
+		LowercaseScheme:    true,
+		LowercaseHost:      true,
+		StripDefaultPort:   true,
+		StripTrailingSlash: true,
+		SortQuery:          true,
+		TrackingParams:     []string{"utm_*", "fbclid", "gclid"},
+	}
+}
+
+// Normalize returns the canonical form of raw. Values without a host, such as
+// "example.com/path", are returned unchanged.
+func Normalize(raw string, opts Options) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return raw, nil
+	}
+
+	if !opts.LowercaseScheme {
+		u.Scheme = raw[:len(u.Scheme)]
+	}
+
+	host, port := u.Hostname(), u.Port()
+	// Punycode is case sensitive, so the host is lowercased before encoding
+	// for "BÜCHER.de" and "bücher.de" to share a canonical form.
+	if opts.LowercaseHost {
+		host = strings.ToLower(host)
+	}
+	if opts.Punycode {
+		if ascii, err := idna.Punycode.ToASCII(host); err == nil {
+			host = ascii
+		}
+	}
+	if opts.StripDefaultPort && defaultPorts[strings.ToLower(u.Scheme)] == port {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+
+	if opts.StripTrailingSlash && strings.HasSuffix(u.Path, "/") {
+		u.Path = strings.TrimRight(u.Path, "/")
+		u.RawPath = strings.TrimRight(u.RawPath, "/")
+	}
+
+	u.RawQuery = normalizeQuery(u.RawQuery, opts)
+	u.ForceQuery = false
+
+	return u.String(), nil
+}
+
+func normalizeQuery(rawQuery string, opts Options) string {
+	if rawQuery == "" {
+		return ""
+	}
+
+	type param struct {
+		key string
+		raw string
+	}
+	var params []param
+	for _, part := range strings.Split(rawQuery, "&") {
+		if part == "" {
+			continue
+		}
+		rawKey, _, _ := strings.Cut(part, "=")
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			key = rawKey
+		}
+		if opts.RemoveTracking && isTrackingParam(key, opts.TrackingParams) {
+			continue
+		}
+		params = append(params, param{key: key, raw: part})
+	}
+
+	if opts.SortQuery {
+		sort.SliceStable(params, func(i, j int) bool { return params[i].key < params[j].key })
+	}
+
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = p.raw
+	}
+	return strings.Join(parts, "&")
+}
+
+func isTrackingParam(key string, patterns []string) bool {
+	key = strings.ToLower(key)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if key == pattern {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"OZON_test/internal/urlnorm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	withTracking := urlnorm.DefaultOptions()
+	withTracking.RemoveTracking = true
+
+	withPunycode := urlnorm.DefaultOptions()
+	withPunycode.Punycode = true
+
+	tests := []struct {
+		name string
+		url  string
+		opts urlnorm.Options
+		want string
+	}{
+		{
+			name: "Equivalent",
+			url:  "https://Example.com:443/a/?b=2&a=1",
+			opts: urlnorm.DefaultOptions(),
+			want: "https://example.com/a?a=1&b=2",
+		},
+		{
+			name: "Canonical",
+			url:  "https://example.com/a?a=1&b=2",
+			opts: urlnorm.DefaultOptions(),
+			want: "https://example.com/a?a=1&b=2",
+		},
+		{
+			name: "SchemeCase",
+			url:  "HTTP://example.com",
+			opts: urlnorm.DefaultOptions(),
+			want: "http://example.com",
+		},
+		{
+			name: "NonDefaultPort",
+			url:  "http://example.com:8080/",
+			opts: urlnorm.DefaultOptions(),
+			want: "http://example.com:8080",
+		},
+		{
+			name: "DuplicateParamsKeepOrder",
+			url:  "http://example.com/?b=1&a=2&a=1",
+			opts: urlnorm.DefaultOptions(),
+			want: "http://example.com?a=2&a=1&b=1",
+		},
+		{
+			name: "TrackingKeptByDefault",
+			url:  "http://example.com/?utm_source=mail&id=1",
+			opts: urlnorm.DefaultOptions(),
+			want: "http://example.com?id=1&utm_source=mail",
+		},
+		{
+			name: "TrackingRemoved",
+			url:  "http://example.com/?utm_source=mail&fbclid=abc&id=1",
+			opts: withTracking,
+			want: "http://example.com?id=1",
+		},
+		{
+			name: "Punycode",
+			url:  "http://пример.рф/путь",
+			opts: withPunycode,
+			want: "http://xn--e1afmkfd.xn--p1ai/%D0%BF%D1%83%D1%82%D1%8C",
+		},
+		{
+			name: "PunycodeMixedCase",
+			url:  "http://BÜCHER.de",
+			opts: withPunycode,
+			want: "http://xn--bcher-kva.de",
+		},
+		{
+			name: "IPv6",
+			url:  "http://[::1]:80/",
+			opts: urlnorm.DefaultOptions(),
+			want: "http://[::1]",
+		},
+		{
+			name: "NoHost",
+			url:  "example.com/A/",
+			opts: urlnorm.DefaultOptions(),
+			want: "example.com/A/",
+		},
+		{
+			name: "AllDisabled",
+			url:  "HTTPS://Example.com:443/a/?b=2&a=1",
+			opts: urlnorm.Options{},
+			want: "HTTPS://Example.com:443/a/?b=2&a=1",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // захват переменной
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := urlnorm.Normalize(tt.url, tt.opts)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestNormalize_InvalidUrl(t *testing.T) {
+	_, err := urlnorm.Normalize("http://exa mple.com/%zz", urlnorm.DefaultOptions())
+	assert.Error(t, err)
+}
+
+func TestNormalize_PunycodeCase(t *testing.T) {
+	opts := urlnorm.DefaultOptions()
+	opts.Punycode = true
+	upper, err := urlnorm.Normalize("http://BÜCHER.de", opts)
+	assert.NoError(t, err)
+	lower, err := urlnorm.Normalize("http://bücher.de", opts)
+	assert.NoError(t, err)
+	assert.Equal(t, lower, upper)
+}
@@ -0,0 +1,71 @@
+package tests
+
+import (
+	"OZON_test/internal/validator"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	cfg := validator.DefaultConfig()
+	cfg.SelfHosts = []string{"short.ly", "localhost:8080", "public.example:443", "[::1]:8080"}
+	v := validator.New(cfg)
+
+	tests := []struct {
+		name       string
+		url        string
+		wantReason string
+	}{
+		{name: "Http", url: "http://example.com/path?q=1"},
+		{name: "Https", url: "https://example.com"},
+		{name: "UpperScheme", url: "HTTPS://example.com"},
+		{name: "JavaScript", url: "javascript:alert(1)", wantReason: validator.ReasonSchemeNotAllowed},
+		{name: "Data", url: "data:text/html;base64,PHNjcmlwdD4=", wantReason: validator.ReasonSchemeNotAllowed},
+		{name: "NoScheme", url: "example.com/path", wantReason: validator.ReasonSchemeNotAllowed},
+		{name: "Garbage", url: "http://%zz", wantReason: validator.ReasonInvalidUrl},
+		{name: "Whitespace", url: "http://example.com/a b", wantReason: validator.ReasonInvalidUrl},
+		{name: "NoHost", url: "http:///path", wantReason: validator.ReasonMissingHost},
+		{name: "Opaque", url: "https:evil.com", wantReason: validator.ReasonMissingHost},
+		{name: "OpaqueUpperScheme", url: "HTTP:evil.com/path", wantReason: validator.ReasonMissingHost},
+		{name: "SelfHost", url: "https://SHORT.LY/abc", wantReason: validator.ReasonSelfReference},
+		{name: "SelfHostWithPort", url: "http://localhost:8080/abc", wantReason: validator.ReasonSelfReference},
+		{name: "SelfHostOtherPort", url: "https://short.ly:8443/abc", wantReason: validator.ReasonSelfReference},
+		{name: "SameHostOtherPort", url: "http://localhost:3000/abc"},
+		{name: "SameHostDefaultPort", url: "http://localhost/abc"},
+		{name: "SelfHostDefaultPort", url: "https://Public.Example/abc", wantReason: validator.ReasonSelfReference},
+		{name: "SelfHostIPv6", url: "http://[::1]:8080/abc", wantReason: validator.ReasonSelfReference},
+		{name: "TooLong", url: "http://example.com/" + strings.Repeat("a", 2048), wantReason: validator.ReasonUrlTooLong},
+	}
+
+	for _, tt := range tests {
+		tt := tt // захват переменной
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.Validate(tt.url)
+			if tt.wantReason == "" {
+				assert.NoError(t, err)
+				return
+			}
+			var validationErr *validator.Error
+			assert.True(t, errors.As(err, &validationErr), "expected *validator.Error, got %v", err)
+			assert.Equal(t, tt.wantReason, validationErr.Reason)
+		})
+	}
+}
+
+func TestValidate_CustomSchemes(t *testing.T) {
+	v := validator.New(validator.Config{AllowedSchemes: []string{"https", "ftp", "mailto"}})
+
+	assert.NoError(t, v.Validate("ftp://files.example.com/pub"))
+	assert.NoError(t, v.Validate("https://example.com"))
+	assert.Error(t, v.Validate("http://example.com"))
+
+	var validationErr *validator.Error
+	for _, raw := range []string{"mailto:x@y", "mailto:user@example.com"} {
+		err := v.Validate(raw)
+		if assert.True(t, errors.As(err, &validationErr), raw) {
+			assert.Equal(t, validator.ReasonMissingHost, validationErr.Reason, "urls without a host are refused even for allowed schemes")
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package validator
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+const (
+	ReasonInvalidUrl       = "INVALID_URL"
+	ReasonUrlTooLong       = "URL_TOO_LONG"
+	ReasonSchemeNotAllowed = "SCHEME_NOT_ALLOWED"
+	ReasonMissingHost      = "MISSING_HOST"
+	ReasonSelfReference    = "SELF_REFERENCE"
+	ReasonBlocked          = "URL_BLOCKED"
+	ReasonInvalidOptions   = "INVALID_OPTIONS"
+)
+
+type Error struct {
+	Reason  string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Config controls validation. SelfHosts are the addresses of the service
+// itself: entries with a port, like "localhost:8080", only match urls on
+// that port, entries without one match every port of the host.
+type Config struct {
+	AllowedSchemes []string
+	MaxLength      int
+	SelfHosts      []string
+}
+
+func DefaultConfig() Config {
+	return Config{
+		AllowedSchemes: []string{"http", "https"},
+		MaxLength:      2048,
+	}
+}
+
+type Validator struct {
+	schemes   map[string]bool
+	maxLength int
+	selfHosts map[string]bool
+}
+
+func New(cfg Config) *Validator {
+	v := &Validator{
+		schemes:   make(map[string]bool),
+		maxLength: cfg.MaxLength,
+		selfHosts: make(map[string]bool),
+	}
+	for _, scheme := range cfg.AllowedSchemes {
+		v.schemes[strings.ToLower(scheme)] = true
+	}
+	for _, host := range cfg.SelfHosts {
+		v.selfHosts[normalizeAddress(host)] = true
+	}
+	return v
+}
+
+// Validate returns an *Error describing why raw cannot be shortened.
+func (v *Validator) Validate(raw string) error {
+	if v.maxLength > 0 && len(raw) > v.maxLength {
+		return &Error{Reason: ReasonUrlTooLong, Message: fmt.Sprintf("url is longer than %d characters", v.maxLength)}
+	}
+	if strings.IndexFunc(raw, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+		return &Error{Reason: ReasonInvalidUrl, Message: "url must not contain whitespace or control characters"}
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return &Error{Reason: ReasonInvalidUrl, Message: "url cannot be parsed"}
+	}
+	if u.Scheme == "" {
+		return &Error{Reason: ReasonSchemeNotAllowed, Message: "url must have a scheme"}
+	}
+	if !v.schemes[strings.ToLower(u.Scheme)] {
+		return &Error{Reason: ReasonSchemeNotAllowed, Message: fmt.Sprintf("scheme %q is not allowed", u.Scheme)}
+	}
+	// Opaque urls like "https:evil.com" have no host either, and nothing
+	// downstream could check or normalize where they lead.
+	if u.Opaque != "" || u.Hostname() == "" {
+		return &Error{Reason: ReasonMissingHost, Message: "url must have a host"}
+	}
+	if v.selfReference(u) {
+		return &Error{Reason: ReasonSelfReference, Message: "url must not point to the shortener itself"}
+	}
+	return nil
+}
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+func (v *Validator) selfReference(u *url.URL) bool {
+	host := normalizeHost(u.Hostname())
+	if v.selfHosts[host] {
+		return true
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultPorts[strings.ToLower(u.Scheme)]
+	}
+	return port != "" && v.selfHosts[net.JoinHostPort(host, port)]
+}
+
+// normalizeAddress returns the lowercased host of address, followed by its
+// port if it has one.
+func normalizeAddress(address string) string {
+	if host, port, err := net.SplitHostPort(address); err == nil {
+		return net.JoinHostPort(normalizeHost(host), port)
+	}
+	return normalizeHost(address)
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+}
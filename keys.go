@@ -0,0 +1,91 @@
+package main
+
+import (
+	"OZON_test/internal/auth"
+	"OZON_test/internal/storage"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const keysUsage = `usage:
+  OZON_test keys create -name <name> -scopes <scope,...> [-expires <duration>]
+  OZON_test keys list
+  OZON_test keys revoke <id>`
+
+// openCommandStorage opens the storage configured by the environment for
+// the keys and users commands. Anything kept in memory would be lost when
+// the command exits.
+func openCommandStorage() (*storage.PostgresStringMap, error) {
+	if getEnv("USE_IN_MEMORY", true, strconv.ParseBool) {
+		return nil, errors.New("managing credentials from the command line needs PostgreSQL, set USE_IN_MEMORY=false and POSTGRES_PATH")
+	}
+	return storage.NewPostgresStringMap(
+		getEnv("POSTGRES_PATH", "", idString),
+		getEnv("TABLE_NAME", "", idString),
+		getEnv("KEY_LEN", 10, strconv.Atoi),
+	)
+}
+
+// runKeys executes a keys subcommand and prints its result to out.
+func runKeys(args []string, keys *auth.Keys, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(keysUsage)
+	}
+
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("keys create", flag.ContinueOnError)
+		flags.SetOutput(io.Discard)
+		name := flags.String("name", "", "key name")
+		scopes := flags.String("scopes", "", "comma separated scopes: "+strings.Join(auth.Scopes, ", "))
+		expires := flags.Duration("expires", 0, "key lifetime, unlimited if zero")
+		if err := flags.Parse(args[1:]); err != nil {
+			return fmt.Errorf("%w\n%s", err, keysUsage)
+		}
+		if *name == "" {
+			return errors.New("missing -name\n" + keysUsage)
+		}
+		list, _ := parseList(*scopes)
+		key, token, err := keys.Create(*name, list, *expires)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "id:    %s\ntoken: %s\n", key.ID, token)
+		return err
+	case "list":
+		list, err := keys.List()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "ID\tNAME\tSCOPES\tCREATED\tEXPIRES")
+		for _, key := range list {
+			expiresAt := "never"
+			if !key.ExpiresAt.IsZero() {
+				expiresAt = key.ExpiresAt.Format(time.RFC3339)
+			}
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+				key.ID, key.Name, strings.Join(key.Scopes, ","), key.CreatedAt.Format(time.RFC3339), expiresAt)
+		}
+		return w.Flush()
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New(keysUsage)
+		}
+		if err := keys.Revoke(args[1]); err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				return fmt.Errorf("API key %s not found", args[1])
+			}
+			return err
+		}
+		_, err := fmt.Fprintf(out, "revoked %s\n", args[1])
+		return err
+	}
+	return fmt.Errorf("unknown command %q\n%s", args[0], keysUsage)
+}
@@ -1,16 +1,36 @@
 package main
 
 import (
+	"OZON_test/internal/auth"
+	"OZON_test/internal/blocklist"
 	"OZON_test/internal/encoder"
 	"OZON_test/internal/handler"
 	pb "OZON_test/internal/handler/proto"
+	"OZON_test/internal/health"
+	"OZON_test/internal/jobs"
+	"OZON_test/internal/keypool"
+	"OZON_test/internal/lifecycle"
+	"OZON_test/internal/publicurl"
+	"OZON_test/internal/ratelimit"
+	"OZON_test/internal/server"
 	"OZON_test/internal/storage"
+	"OZON_test/internal/urlnorm"
+	"OZON_test/internal/validator"
+	"context"
+	"errors"
 	"fmt"
 	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func getEnv[T any](key string, defaultValue T, parser func(string) (T, error)) T {
@@ -27,21 +47,183 @@ func idString(key string) (string, error) {
 	return key, nil
 }
 
+func parseUint(value string) (uint64, error) {
+	return strconv.ParseUint(value, 10, 64)
+}
+
+func parseList(value string) ([]string, error) {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list, nil
+}
+
 func main() {
+	if len(os.Args) > 1 && (os.Args[1] == "keys" || os.Args[1] == "users") {
+		store, err := openCommandStorage()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if os.Args[1] == "keys" {
+			err = runKeys(os.Args[2:], auth.NewKeys(store), os.Stdout)
+		} else {
+			err = runUsers(os.Args[2:], auth.NewUsers(store), os.Stdin, os.Stdout)
+		}
+		if closeErr := store.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	ip := getEnv("SERVER_IP", "localhost", idString)
 	port := getEnv("SERVER_PORT", "8080", idString)
+	pathPrefix := getEnv("PATH_PREFIX", "", idString)
+	publicUrlConfig := publicurl.Config{
+		BaseUrl:        getEnv("PUBLIC_BASE_URL", "", idString),
+		TrustedProxies: getEnv("TRUSTED_PROXIES", []string(nil), parseList),
+		Fallback:       fmt.Sprintf("http://%s:%s%s", ip, port, strings.TrimSuffix(pathPrefix, "/")),
+	}
+	publicUrl, err := publicurl.New(publicUrlConfig)
+	if err != nil {
+		log.Fatalf("invalid public url settings: %v", err)
+		return
+	}
+	selfHosts := []string{net.JoinHostPort(ip, port)}
+	if publicUrlConfig.BaseUrl != "" {
+		selfHosts = append(selfHosts, publicUrl.Host())
+	}
 	inMemory := getEnv("USE_IN_MEMORY", true, strconv.ParseBool)
 	postgresPath := getEnv("POSTGRES_PATH", "", idString)
 	tableName := getEnv("TABLE_NAME", "", idString)
-	grpcInterface := getEnv("GRPC", true, strconv.ParseBool)
+	singlePort := getEnv("SINGLE_PORT", false, strconv.ParseBool)
+	grpcInterface := getEnv("GRPC", true, strconv.ParseBool) || singlePort
+	httpInterface := getEnv("HTTP", !grpcInterface, strconv.ParseBool) || singlePort
+	defaultGrpcPort := port
+	if httpInterface && !singlePort {
+		defaultGrpcPort = "9090"
+	}
+	grpcPort := getEnv("GRPC_PORT", defaultGrpcPort, idString)
 	keyLen := getEnv("KEY_LEN", 10, strconv.Atoi)
+	idMode := getEnv("ID_MODE", "hash", idString)
+	leaseSize := getEnv("LEASE_SIZE", uint64(1000), parseUint)
+	normalizeOptions := urlnorm.Options{
+		LowercaseScheme:    getEnv("NORMALIZE_SCHEME", true, strconv.ParseBool),
+		LowercaseHost:      getEnv("NORMALIZE_HOST", true, strconv.ParseBool),
+		StripDefaultPort:   getEnv("NORMALIZE_DEFAULT_PORT", true, strconv.ParseBool),
+		StripTrailingSlash: getEnv("NORMALIZE_TRAILING_SLASH", true, strconv.ParseBool),
+		SortQuery:          getEnv("NORMALIZE_SORT_QUERY", true, strconv.ParseBool),
+		RemoveTracking:     getEnv("NORMALIZE_REMOVE_TRACKING", false, strconv.ParseBool),
+		TrackingParams:     getEnv("NORMALIZE_TRACKING_PARAMS", urlnorm.DefaultOptions().TrackingParams, parseList),
+		Punycode:           getEnv("NORMALIZE_PUNYCODE", false, strconv.ParseBool),
+	}
+	validatorConfig := validator.Config{
+		AllowedSchemes: getEnv("ALLOWED_SCHEMES", validator.DefaultConfig().AllowedSchemes, parseList),
+		MaxLength:      getEnv("MAX_URL_LENGTH", validator.DefaultConfig().MaxLength, strconv.Atoi),
+		SelfHosts:      getEnv("SELF_HOSTS", selfHosts, parseList),
+	}
+	blocklistFiles := getEnv("BLOCKLIST_FILES", []string(nil), parseList)
+	blocklistReload := getEnv("BLOCKLIST_RELOAD_INTERVAL", 10*time.Second, time.ParseDuration)
+	healthCheck := getEnv("HEALTH_CHECK", false, strconv.ParseBool)
+	healthConfig := health.Config{
+		Interval:    getEnv("HEALTH_CHECK_INTERVAL", health.DefaultConfig().Interval, time.ParseDuration),
+		Timeout:     getEnv("HEALTH_CHECK_TIMEOUT", health.DefaultConfig().Timeout, time.ParseDuration),
+		Concurrency: getEnv("HEALTH_CHECK_CONCURRENCY", health.DefaultConfig().Concurrency, strconv.Atoi),
+		HostDelay:   getEnv("HEALTH_CHECK_HOST_DELAY", health.DefaultConfig().HostDelay, time.ParseDuration),
+		DeadAfter:   getEnv("HEALTH_CHECK_DEAD_AFTER", health.DefaultConfig().DeadAfter, strconv.Atoi),
+		BatchSize:   health.DefaultConfig().BatchSize,
+	}
+	deadLinkFallback := getEnv("DEAD_LINK_FALLBACK_URL", "", idString)
+	bulkConfig := handler.BulkConfig{
+		MaxItems:    getEnv("BULK_MAX_ITEMS", handler.DefaultBulkConfig().MaxItems, strconv.Atoi),
+		Concurrency: getEnv("BULK_CONCURRENCY", handler.DefaultBulkConfig().Concurrency, strconv.Atoi),
+	}
+	jobsEnabled := getEnv("JOBS", true, strconv.ParseBool)
+	jobsConfig := jobs.Config{
+		Workers:   getEnv("JOBS_WORKERS", jobs.DefaultConfig().Workers, strconv.Atoi),
+		MaxQueued: getEnv("JOBS_MAX_QUEUED", jobs.DefaultConfig().MaxQueued, strconv.Atoi),
+	}
+	jobsMaxItems := getEnv("JOBS_MAX_ITEMS", 1000000, strconv.Atoi)
+	usePool := getEnv("KEY_POOL", false, strconv.ParseBool)
+	poolConfig := keypool.Config{
+		Size:             getEnv("KEY_POOL_SIZE", 1000, strconv.Atoi),
+		RefillThreshold:  getEnv("KEY_POOL_REFILL_THRESHOLD", 250, strconv.Atoi),
+		ReservationTTL:   getEnv("KEY_POOL_RESERVATION_TTL", time.Hour, time.ParseDuration),
+		RecoveryInterval: getEnv("KEY_POOL_RECOVERY_INTERVAL", 5*time.Minute, time.ParseDuration),
+	}
 
 	idGen := func(url string, seed int) (string, error) { return encoder.GenerateSecureShortId(url, seed, keyLen) }
+	normalize := func(url string) (string, error) { return urlnorm.Normalize(url, normalizeOptions) }
+	validate := validator.New(validatorConfig).Validate
 
-	var (
-		storageMap storage.Storage
-		err        error
-	)
+	authEnabled := getEnv("AUTH", false, strconv.ParseBool)
+	bootstrapKey := getEnv("AUTH_BOOTSTRAP_KEY", "", idString)
+	sessionConfig := auth.SessionConfig{
+		TTL:           getEnv("SESSION_TTL", auth.DefaultSessionConfig().TTL, time.ParseDuration),
+		PruneInterval: getEnv("SESSION_PRUNE_INTERVAL", auth.DefaultSessionConfig().PruneInterval, time.ParseDuration),
+	}
+	secureCookies := getEnv("SESSION_COOKIE_SECURE", true, strconv.ParseBool)
+	totpConfig := auth.TOTPConfig{
+		Issuer:        getEnv("TOTP_ISSUER", auth.DefaultTOTPConfig().Issuer, idString),
+		RequiredRoles: getEnv("TOTP_REQUIRED_ROLES", []string(nil), parseList),
+		Skew:          getEnv("TOTP_SKEW", auth.DefaultTOTPConfig().Skew, strconv.Atoi),
+	}
+	jwks := getEnv("JWT_JWKS", "", idString)
+	jwtConfig := auth.JWTConfig{
+		Issuer:          getEnv("JWT_ISSUER", "", idString),
+		Audience:        getEnv("JWT_AUDIENCE", "", idString),
+		GroupsClaim:     getEnv("JWT_GROUPS_CLAIM", auth.DefaultJWTConfig().GroupsClaim, idString),
+		AdminGroups:     getEnv("JWT_ADMIN_GROUPS", []string(nil), parseList),
+		UserGroups:      getEnv("JWT_USER_GROUPS", []string(nil), parseList),
+		Leeway:          getEnv("JWT_LEEWAY", auth.DefaultJWTConfig().Leeway, time.ParseDuration),
+		RefreshInterval: getEnv("JWT_JWKS_REFRESH_INTERVAL", auth.DefaultJWTConfig().RefreshInterval, time.ParseDuration),
+	}
+	if err := auth.ValidateRoles(totpConfig.RequiredRoles); err != nil {
+		log.Fatalln("invalid TOTP_REQUIRED_ROLES:", err)
+		return
+	}
+	if jwks != "" {
+		if err := jwtConfig.Validate(); err != nil {
+			log.Fatalln("JWT_JWKS requires JWT_ISSUER and JWT_AUDIENCE:", err)
+			return
+		}
+		if !jwtConfig.GrantsScopes() {
+			log.Println("WARNING: JWT_ADMIN_GROUPS and JWT_USER_GROUPS are empty, JWTs will authenticate but grant no scopes")
+		}
+	}
+	rateLimit := getEnv("RATE_LIMIT", false, strconv.ParseBool)
+	rateLimitBackend := getEnv("RATE_LIMIT_BACKEND", "memory", idString)
+	defaultPolicies := ratelimit.DefaultConfig().Policies
+	rateLimitConfig := ratelimit.Config{
+		Policies: map[string]ratelimit.Policy{
+			ratelimit.ClassCreate: {
+				Rate:  getEnv("RATE_LIMIT_CREATE", defaultPolicies[ratelimit.ClassCreate].Rate, ratelimit.ParseRate),
+				Burst: getEnv("RATE_LIMIT_CREATE_BURST", defaultPolicies[ratelimit.ClassCreate].Burst, strconv.Atoi),
+			},
+			ratelimit.ClassRedirect: {
+				Rate:  getEnv("RATE_LIMIT_REDIRECT", defaultPolicies[ratelimit.ClassRedirect].Rate, ratelimit.ParseRate),
+				Burst: getEnv("RATE_LIMIT_REDIRECT_BURST", defaultPolicies[ratelimit.ClassRedirect].Burst, strconv.Atoi),
+			},
+			ratelimit.ClassLogin: {
+				Rate:  getEnv("RATE_LIMIT_LOGIN", defaultPolicies[ratelimit.ClassLogin].Rate, ratelimit.ParseRate),
+				Burst: getEnv("RATE_LIMIT_LOGIN_BURST", defaultPolicies[ratelimit.ClassLogin].Burst, strconv.Atoi),
+			},
+		},
+		PruneInterval: getEnv("RATE_LIMIT_PRUNE_INTERVAL", ratelimit.DefaultConfig().PruneInterval, time.ParseDuration),
+	}
+
+	lifecycleConfig := lifecycle.Config{
+		Timeout:    getEnv("SHUTDOWN_TIMEOUT", lifecycle.DefaultConfig().Timeout, time.ParseDuration),
+		DrainDelay: getEnv("SHUTDOWN_DRAIN_DELAY", lifecycle.DefaultConfig().DrainDelay, time.ParseDuration),
+	}
+	lc := lifecycle.New(lifecycleConfig)
+
+	var storageMap storage.Storage
 
 	if inMemory {
 		storageMap = storage.NewSafeMap()
@@ -54,24 +236,268 @@ func main() {
 		return
 	}
 
-	if err != nil {
-		log.Fatalf(err.Error())
+	if closer, ok := storageMap.(io.Closer); ok {
+		lc.OnShutdown("storage", func(context.Context) error { return closer.Close() })
+	}
+
+	if idMode == "sequence" {
+		var leaser encoder.RangeLeaser
+		if inMemory {
+			leaser = storage.NewSafeCounter()
+		} else {
+			leaser, err = storage.NewPostgresSequence(postgresPath, tableName+"_ticket", tableName)
+		}
+		if err != nil {
+			log.Fatalf("failed to create id sequence: %v", err)
+			return
+		}
+		if closer, ok := leaser.(io.Closer); ok {
+			lc.OnShutdown("id sequence", func(context.Context) error { return closer.Close() })
+		}
+		idGen = encoder.NewSequentialGenerator(leaser, leaseSize, keyLen).Generate
+	}
+
+	var issuer handler.Issuer
+	if usePool {
+		reserver, ok := storageMap.(storage.Reserver)
+		if !ok {
+			log.Fatalln("key pool is not supported by the configured storage")
+			return
+		}
+		source := func() (string, error) { return encoder.GenerateRandomShortId(keyLen) }
+		if idMode == "sequence" {
+			source = func() (string, error) { return idGen("", 0) }
+		}
+		pool := keypool.NewPool(source, reserver, poolConfig)
+		pool.Start()
+		lc.OnClose("key pool", pool.Close)
+		issuer = pool
+	}
+
+	var links handler.Blocklist
+	if len(blocklistFiles) > 0 {
+		bl, err := blocklist.Load(blocklistFiles...)
+		if err != nil {
+			log.Fatalf("failed to load blocklist: %v", err)
+			return
+		}
+		bl.Watch(blocklistReload)
+		lc.OnClose("blocklist watcher", bl.Close)
+		links = bl
+	}
+
+	var checker *health.Checker
+	if healthCheck {
+		lister, listOk := storageMap.(storage.Lister)
+		results, resultsOk := storageMap.(storage.HealthStorage)
+		if !listOk || !resultsOk {
+			log.Fatalln("health checks are not supported by the configured storage")
+			return
+		}
+		checker = health.NewChecker(lister, results, healthConfig)
+		checker.Start()
+		lc.OnClose("health checker", checker.Close)
+	}
+
+	var limiter *ratelimit.Limiter
+	if rateLimit {
+		var backend ratelimit.Backend
+		switch rateLimitBackend {
+		case "memory":
+			backend = ratelimit.NewMemory()
+		case "storage":
+			tokens, ok := storageMap.(storage.RateLimitStorage)
+			if !ok {
+				log.Fatalln("shared rate limits are not supported by the configured storage")
+				return
+			}
+			backend = ratelimit.NewShared(tokens)
+		default:
+			log.Fatalf("unknown rate limit backend %q", rateLimitBackend)
+			return
+		}
+		limiter = ratelimit.New(backend, rateLimitConfig)
+		limiter.Start()
+		lc.OnClose("rate limiter", limiter.Close)
+	}
+
+	var keys *auth.Keys
+	var users *auth.Users
+	var sessions *auth.Sessions
+	var totp *auth.TOTP
+	var tokens *auth.JWT
+	var interceptors []grpc.UnaryServerInterceptor
+	if authEnabled {
+		keyStorage, ok := storageMap.(storage.APIKeyStorage)
+		if !ok {
+			log.Fatalln("API keys are not supported by the configured storage")
+			return
+		}
+		userStorage, ok := storageMap.(storage.UserStorage)
+		if !ok {
+			log.Fatalln("user accounts are not supported by the configured storage")
+			return
+		}
+		keys = auth.NewKeys(keyStorage)
+		keys.SetBootstrap(bootstrapKey)
+		users = auth.NewUsers(userStorage)
+		if factorStorage, ok := storageMap.(storage.SecondFactorStorage); ok {
+			totp = auth.NewTOTP(factorStorage, totpConfig)
+			users.SetTOTP(totp)
+		} else if len(totpConfig.RequiredRoles) > 0 {
+			log.Fatalln("two-factor authentication is not supported by the configured storage")
+			return
+		}
+		if sessionStorage, ok := storageMap.(storage.SessionStorage); ok {
+			sessions = auth.NewSessions(sessionStorage, userStorage, sessionConfig)
+			if totp != nil {
+				sessions.SetTOTP(totp)
+			}
+			sessions.Start()
+			lc.OnClose("session pruning", sessions.Close)
+		}
+		authenticators := handler.Authenticators{Keys: keys, Users: users}
+		if limiter != nil {
+			authenticators.Limiter = limiter
+		}
+		if jwks != "" {
+			tokens = auth.NewJWT(auth.JWKSLocation(jwks), jwtConfig)
+			if err := tokens.Refresh(); err != nil {
+				log.Fatalln("failed to load JWT_JWKS:", err)
+				return
+			}
+			tokens.Start()
+			lc.OnClose("key set refresh", tokens.Close)
+			authenticators.Tokens = tokens
+		}
+		interceptors = append(interceptors, handler.UnaryAuth(authenticators))
+	}
+
+	if limiter != nil {
+		interceptors = append(interceptors, handler.UnaryRateLimit(limiter))
+	}
+
+	configure := func(s shortenerSettings) {
+		s.SetIssuer(issuer)
+		s.SetNormalizer(normalize)
+		s.SetValidator(validate)
+		s.SetBlocklist(links)
+	}
+
+	if !httpInterface && !grpcInterface {
+		log.Fatalln("both HTTP and gRPC interfaces are disabled")
+		return
+	}
+	if httpInterface && grpcInterface && !singlePort && grpcPort == port {
+		log.Fatalln("HTTP and gRPC need different ports, set GRPC_PORT or SINGLE_PORT=true")
 		return
 	}
-	if grpcInterface {
-		if err := runServer(ip, port, storageMap, idGen); err != nil {
-			log.Fatalf("failed to start server: %v", err)
+
+	// Both interfaces share the storage, the key generator and the
+	// shortener settings, so links created over one are visible to the other.
+	urlServer := handler.NewUrlServer(idGen, &storageMap, ip)
+	configure(urlServer)
+	urlServer.SetBaseUrl(publicUrl.Base(nil))
+	grpcServer := newGrpcServer(urlServer, interceptors...)
+	readiness := grpchealth.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, readiness)
+	lc.OnReadinessChange(func(ready bool) {
+		if ready {
+			readiness.Resume()
+		} else {
+			readiness.Shutdown()
 		}
-	} else {
-		h := handler.CreateHandlers(idGen, storageMap, ip, port)
-		h.Run()
+	})
+
+	h := handler.NewHandlers(handler.Options{
+		Generator:  idGen,
+		Storage:    storageMap,
+		Addr:       ":" + port,
+		PathPrefix: pathPrefix,
+		PublicUrl:  publicUrl,
+		Bulk:       bulkConfig,
+	})
+	configure(h)
+	h.SetReadiness(lc.Ready)
+	if limiter != nil {
+		h.SetRateLimiter(limiter)
+	}
+	if keys != nil {
+		h.SetKeys(keys)
+		h.SetUsers(users)
+		if sessions != nil {
+			h.SetSessions(sessions, secureCookies)
+		}
+		if totp != nil {
+			h.SetTOTP(totp)
+		}
+		if tokens != nil {
+			h.SetTokens(tokens)
+		}
+	}
+	if checker != nil {
+		h.SetHealth(checker, deadLinkFallback)
+	}
+	if jobStorage, ok := storageMap.(storage.JobStorage); ok && jobsEnabled && httpInterface {
+		manager := jobs.NewManager(jobStorage, h.ProcessJob, jobsConfig)
+		if err := manager.Start(); err != nil {
+			log.Fatalf("failed to start jobs: %v", err)
+			return
+		}
+		lc.OnClose("jobs", manager.Close)
+		h.SetJobs(manager, jobsMaxItems)
+	}
+
+	switch {
+	case singlePort:
+		mux := server.NewMux(grpcServer, h)
+		mixed := &http.Server{Addr: ":" + port, Handler: mux}
+		log.Printf("HTTP and gRPC server started on port %s", port)
+		lc.Go("server", func() error {
+			if err := mixed.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		})
+		lc.OnShutdown("server", func(ctx context.Context) error {
+			err := mixed.Shutdown(ctx)
+			if stopErr := mux.Shutdown(ctx); err == nil {
+				err = stopErr
+			}
+			return err
+		})
+	default:
+		if httpInterface {
+			lc.Go("HTTP server", h.Run)
+			lc.OnShutdown("HTTP server", h.Shutdown)
+		}
+		if grpcInterface {
+			lc.Go("gRPC server", func() error { return serveGrpc(grpcServer, grpcPort) })
+			lc.OnShutdown("gRPC server", func(ctx context.Context) error { return server.GracefulStop(ctx, grpcServer) })
+		}
+	}
+	lc.SetReady(true)
+
+	if err := lc.Wait(context.Background(), os.Interrupt, syscall.SIGTERM); err != nil {
+		log.Fatalf("server stopped with error: %v", err)
 	}
 }
 
-func runServer(ip string, port string, storage storage.Storage, idGen func(url string, seed int) (string, error)) error {
-	server := grpc.NewServer()
-	pb.RegisterUrlServiceServer(server, handler.NewUrlServer(idGen, &storage, ip))
+type shortenerSettings interface {
+	SetIssuer(issuer handler.Issuer)
+	SetNormalizer(normalize func(url string) (string, error))
+	SetValidator(validate func(url string) error)
+	SetBlocklist(blocklist handler.Blocklist)
+}
+
+func newGrpcServer(urlServer pb.UrlServiceServer, interceptors ...grpc.UnaryServerInterceptor) *grpc.Server {
+	chain := append([]grpc.UnaryServerInterceptor{handler.UnaryRequestID}, interceptors...)
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(chain...))
+	pb.RegisterUrlServiceServer(server, urlServer)
+	return server
+}
 
+func serveGrpc(server *grpc.Server, port string) error {
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
 	if err != nil {
 		return err
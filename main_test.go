@@ -1,18 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc"
 
+	"OZON_test/internal/auth"
+	"OZON_test/internal/handler"
 	pb "OZON_test/internal/handler/proto"
 	"OZON_test/internal/storage"
 )
@@ -64,7 +68,7 @@ func TestRunServer(t *testing.T) {
 	idGen := MockGenerator
 
 	go func() {
-		if err := runServer(ip, strconv.Itoa(port), mockStorage, idGen); err != nil {
+		if err := serveGrpc(newGrpcServer(handler.NewUrlServer(idGen, &mockStorage, ip)), strconv.Itoa(port)); err != nil {
 			t.Errorf("failed to start server: %v", err)
 		}
 	}()
@@ -84,3 +88,50 @@ func TestRunServer(t *testing.T) {
 	_, err = client.GenerateKey(ctx, &pb.GenerateKeyRequest{Url: "http://example.com"})
 	assert.NoError(t, err, "failed to call GenerateKey")
 }
+
+func TestRunKeys(t *testing.T) {
+	keys := auth.NewKeys(storage.NewSafeMap())
+
+	var out bytes.Buffer
+	err := runKeys([]string{"create", "-name", "ci", "-scopes", "links:create, links:read", "-expires", "24h"}, keys, &out)
+	assert.NoError(t, err)
+	token := strings.TrimSpace(strings.TrimPrefix(strings.Split(out.String(), "\n")[1], "token:"))
+	principal, err := keys.Authenticate(token)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{auth.ScopeLinksCreate, auth.ScopeLinksRead}, principal.Scopes)
+
+	out.Reset()
+	assert.NoError(t, runKeys([]string{"list"}, keys, &out))
+	assert.Contains(t, out.String(), principal.ID)
+	assert.Contains(t, out.String(), "links:create,links:read")
+	assert.NotContains(t, out.String(), token)
+
+	assert.NoError(t, runKeys([]string{"revoke", principal.ID}, keys, &out))
+	_, err = keys.Authenticate(token)
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+	assert.ErrorContains(t, runKeys([]string{"revoke", principal.ID}, keys, &out), "not found")
+
+	assert.Error(t, runKeys(nil, keys, &out))
+	assert.Error(t, runKeys([]string{"create", "-scopes", "admin"}, keys, &out), "name is required")
+	assert.Error(t, runKeys([]string{"create", "-name", "x", "-scopes", "root"}, keys, &out))
+	assert.Error(t, runKeys([]string{"rotate"}, keys, &out))
+}
+
+func TestRunUsers(t *testing.T) {
+	users := auth.NewUsers(storage.NewSafeMap())
+
+	var out bytes.Buffer
+	err := runUsers([]string{"create", "-username", "root", "-role", "admin"}, users, strings.NewReader("admin password\n"), &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "role: admin")
+	principal, err := users.Login("root", "admin password")
+	assert.NoError(t, err)
+	assert.True(t, principal.Has(auth.ScopeAdmin))
+
+	err = runUsers([]string{"create", "-username", "root"}, users, strings.NewReader("other password"), &out)
+	assert.ErrorContains(t, err, "already exists")
+	assert.Error(t, runUsers([]string{"create", "-username", "alice"}, users, strings.NewReader("short\n"), &out))
+	assert.Error(t, runUsers([]string{"create"}, users, strings.NewReader("alice password\n"), &out))
+	assert.Error(t, runUsers(nil, users, nil, &out))
+	assert.Error(t, runUsers([]string{"delete"}, users, nil, &out))
+}
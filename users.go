@@ -0,0 +1,52 @@
+package main
+
+import (
+	"OZON_test/internal/auth"
+	"OZON_test/internal/storage"
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const usersUsage = `usage:
+  OZON_test users create -username <name> [-role user|admin] < password`
+
+// runUsers executes a users subcommand and prints its result to out. The
+// password is read from the first line of in, so it does not end up in the
+// shell history.
+func runUsers(args []string, users *auth.Users, in io.Reader, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(usersUsage)
+	}
+
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("users create", flag.ContinueOnError)
+		flags.SetOutput(io.Discard)
+		username := flags.String("username", "", "account name")
+		role := flags.String("role", auth.RoleUser, "account role: user or admin")
+		if err := flags.Parse(args[1:]); err != nil {
+			return fmt.Errorf("%w\n%s", err, usersUsage)
+		}
+		if *username == "" {
+			return errors.New("missing -username\n" + usersUsage)
+		}
+		password, err := bufio.NewReader(in).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read password: %w", err)
+		}
+		user, err := users.Create(*username, strings.TrimRight(password, "\r\n"), *role)
+		if errors.Is(err, storage.ErrAlreadyExists) {
+			return fmt.Errorf("user %s already exists", *username)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "id:   %s\nrole: %s\n", user.ID, user.Role)
+		return err
+	}
+	return fmt.Errorf("unknown command %q\n%s", args[0], usersUsage)
+}